@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -18,81 +19,97 @@ import (
 
 
 func main() {
+	if err := resp.LoadConfig(os.Args[1:]); err != nil {
+		fmt.Println("FATAL CONFIG FILE ERROR:", err)
+		os.Exit(1)
+	}
+	if err := resp.InitCluster(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := resp.LoadDataFromDisk(); err != nil {
+		fmt.Println("Fatal error loading the DB:", err)
+		os.Exit(1)
+	}
 
 	go resp.StartCleanupRoutine()
+	go resp.StartSaveRoutine()
+	go resp.StartAOFRoutine()
+	go resp.StartReplicationRoutine()
 
 	// PORT := 6379
 	// TODO use netcat to send commands and develop the Redis protocol parser
 
-	l, err := net.Listen("tcp", "0.0.0.0:6379")
-	if err != nil {
-		fmt.Println("Failed to bind to port 6379")
-		os.Exit(1)
-	}
-
-	defer l.Close()
-
-	// Channel to listen for interrupt signals
+	// SIGINT and SIGTERM go through the same shutdown as the SHUTDOWN command, which exits the process
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// Flag to indicate whether the server is running
-	running := true
-
 	go func() {
-		<-sigChan
-		fmt.Println("Shutting down server...")
-		l.Close()
-		running = false
-	}()
-
-	for running {
-
-		conn, err := l.Accept()
-
-		if err != nil {
-			// Check if the error is due to the listener being closed
-			if opErr, ok := err.(*net.OpError); ok && !opErr.Temporary() {
-				fmt.Println("Listener closed, stopping server...")
-				break
-			}
-
-			fmt.Println("Error accepting connection: ", err.Error())
-			break
+		for sig := range sigChan {
+			resp.HandleShutdownSignal(sig)
 		}
+	}()
 
-		go handleConnection(conn)
+	// port 0 disables the plain listeners, a tls-port adds TLS ones on the same bind addresses and
+	// unixsocket a Unix socket
+	if err := resp.Serve(handleConnection); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
 
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	for {
-		buff := make([]byte, 1024)
+	// protected mode sends other hosts the reason it refuses them
+	if resp.ProtectedModeRefuses(conn) {
+		return
+	}
 
-		n, err := conn.Read(buff)
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			print(err.Error())
-			break
-		}
+	client := resp.NewConnClient(conn)
+	defer client.Close()
 
-		data := buff[:n] // buff byte slice
+	// commands are read one by one, several of them may arrive in a single packet. The next one is read
+	// while a command runs, so a client that goes away during a blocking command wakes it.
+	frames := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(frames)
+		defer client.Disconnect()
+		reader := bufio.NewReader(conn)
+		for {
+			data, err := resp.ReadCommand(reader)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					print(err.Error())
+				}
+				return
+			}
+			select {
+			case frames <- data:
+			case <-done:
+				return
+			}
+		}
+	}()
 
+	for data := range frames {
 		fmt.Println("Received data: ", data)
-		answer, err := resp.ExecuteRespData(data)
+		answer, err := client.Execute(data)
 		if err != nil {
 			fmt.Println("Error executing command: ", err.Error())
 			break
 		}
 
-		_, err = conn.Write(answer)
+		_, err = client.Write(answer)
 		if err != nil {
 			fmt.Println("Error writing to connection:", err.Error())
 			break
 		}
+
+		// QUIT closes the connection once its reply is written
+		if client.CloseAfterReply() {
+			break
+		}
 	}
 }
@@ -0,0 +1,692 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// aclCategory is a set of ACL command categories
+type aclCategory uint32
+
+const (
+	aclKeyspace aclCategory = 1 << iota
+	aclRead
+	aclWrite
+	aclSet
+	aclSortedSet
+	aclList
+	aclHash
+	aclString
+	aclBitmap
+	aclHyperLogLog
+	aclGeo
+	aclStream
+	aclPubSub
+	aclAdmin
+	aclFast
+	aclSlow
+	aclBlocking
+	aclDangerous
+	aclConnection
+	aclTransaction
+	aclScripting
+)
+
+// aclCategoryNames lists the categories in the order ACL CAT gives them
+var aclCategoryNames = []struct {
+	category aclCategory
+	name     string
+}{
+	{aclKeyspace, "keyspace"}, {aclRead, "read"}, {aclWrite, "write"}, {aclSet, "set"},
+	{aclSortedSet, "sortedset"}, {aclList, "list"}, {aclHash, "hash"}, {aclString, "string"},
+	{aclBitmap, "bitmap"}, {aclHyperLogLog, "hyperloglog"}, {aclGeo, "geo"}, {aclStream, "stream"},
+	{aclPubSub, "pubsub"}, {aclAdmin, "admin"}, {aclFast, "fast"}, {aclSlow, "slow"},
+	{aclBlocking, "blocking"}, {aclDangerous, "dangerous"}, {aclConnection, "connection"},
+	{aclTransaction, "transaction"}, {aclScripting, "scripting"},
+}
+
+func aclCategoryByName(name string) (aclCategory, bool) {
+	for _, c := range aclCategoryNames {
+		if strings.EqualFold(c.name, name) {
+			return c.category, true
+		}
+	}
+	return 0, false
+}
+
+// aclCategories are the categories of the command, including the ones its flags imply
+func (cmd command) aclCategories() aclCategory {
+	categories := cmd.categories
+	if cmd.flags&cmdWrite != 0 {
+		categories |= aclWrite
+	}
+	if cmd.flags&cmdReadOnly != 0 {
+		categories |= aclRead
+	}
+	if cmd.flags&cmdAdmin != 0 {
+		categories |= aclAdmin | aclDangerous
+	}
+	if cmd.flags&cmdPubSub != 0 {
+		categories |= aclPubSub
+	}
+	if cmd.flags&cmdBlocking != 0 {
+		categories |= aclBlocking
+	}
+	if cmd.flags&cmdFast != 0 {
+		categories |= aclFast
+	} else {
+		categories |= aclSlow
+	}
+	return categories
+}
+
+// aclUser is a set of credentials and what a client authenticated with them may do
+type aclUser struct {
+	name    string
+	enabled bool
+	nopass  bool
+	// passwords are the hashes of the passwords, see passwordHash
+	passwords []string
+	// selectors[0] holds the permissions given outside parentheses, a command being allowed when any
+	// selector allows it
+	selectors []*aclSelector
+}
+
+// aclSelector is a set of permissions: the commands, keys and channels a command may use
+type aclSelector struct {
+	// allCommands is the permission of the commands missing from commands, set by +@all and cleared by -@all
+	allCommands bool
+	commands    map[string]bool
+	// firstArgs overrides the permission of commands called with a given first argument
+	firstArgs map[string]map[string]bool
+	// rules are the command rules applied since the last +@all or -@all, which describe the selector
+	rules []string
+
+	allKeys     bool
+	keys        []keyPattern
+	allChannels bool
+	channels    []string
+}
+
+// keyPattern gives the keys matching pattern the flags of the access allowed to them
+type keyPattern struct {
+	pattern string
+	flags   keyFlags
+}
+
+// aclUsers holds the users by name, guarded by mu. defaultUser is the one new connections start as, which
+// ACL LOAD updates in place.
+var (
+	defaultUser *aclUser
+	aclUsers    map[string]*aclUser
+)
+
+// commandTable is the command table the rules look commands up in. It is set in init since reading
+// commands directly would make the table depend on itself through ACL.
+var commandTable map[string]command
+
+func init() {
+	commandTable = commands
+	// the users are set up in init, since the rules reach back into the command table
+	defaultUser = newDefaultUser()
+	aclUsers = map[string]*aclUser{"default": defaultUser}
+}
+
+func newDefaultUser() *aclUser {
+	u := newACLUser("default")
+	u.setRules([]string{"on", "nopass", "~*", "&*", "+@all"})
+	return u
+}
+
+// newACLUser returns a disabled user without passwords, allowed to run nothing
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, selectors: []*aclSelector{newACLSelector()}}
+}
+
+func newACLSelector() *aclSelector {
+	return &aclSelector{
+		commands:    make(map[string]bool),
+		firstArgs:   make(map[string]map[string]bool),
+		allChannels: config.aclPubsubDefault,
+	}
+}
+
+func (u *aclUser) clone() *aclUser {
+	clone := *u
+	clone.passwords = append([]string(nil), u.passwords...)
+	clone.selectors = make([]*aclSelector, len(u.selectors))
+	for i, s := range u.selectors {
+		clone.selectors[i] = s.clone()
+	}
+	return &clone
+}
+
+func (s *aclSelector) clone() *aclSelector {
+	clone := *s
+	clone.commands = make(map[string]bool, len(s.commands))
+	for name, allowed := range s.commands {
+		clone.commands[name] = allowed
+	}
+	clone.firstArgs = make(map[string]map[string]bool, len(s.firstArgs))
+	for name, args := range s.firstArgs {
+		clone.firstArgs[name] = make(map[string]bool, len(args))
+		for arg, allowed := range args {
+			clone.firstArgs[name][arg] = allowed
+		}
+	}
+	clone.rules = append([]string(nil), s.rules...)
+	clone.keys = append([]keyPattern(nil), s.keys...)
+	clone.channels = append([]string(nil), s.channels...)
+	return &clone
+}
+
+// authRequired reports whether clients starting as the user must authenticate first
+func (u *aclUser) authRequired() bool {
+	return !u.nopass || !u.enabled
+}
+
+var (
+	errACLUnknownCommand   = errors.New("Unknown command or category name in ACL")
+	errACLSyntax           = errors.New("Syntax error")
+	errACLKeysAfterAll     = errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+	errACLChannelsAfterAll = errors.New("Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels")
+	errACLNoSuchPassword   = errors.New("The password you are trying to remove from the user does not exist")
+	errACLBadHash          = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+)
+
+// setRules applies the rules in order, returning the one that failed with its error. The user is left
+// half changed then, callers apply the rules to a clone.
+func (u *aclUser) setRules(rules []string) (string, error) {
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return rule, err
+		}
+	}
+	return "", nil
+}
+
+// applyRule applies a rule of ACL SETUSER. The ones that are not about the user itself go to its root selector.
+func (u *aclUser) applyRule(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass, u.passwords = true, nil
+	case lower == "resetpass":
+		u.nopass, u.passwords = false, nil
+	case lower == "clearselectors":
+		u.selectors = u.selectors[:1]
+	case lower == "reset":
+		u.enabled, u.nopass, u.passwords = false, false, nil
+		u.selectors = []*aclSelector{newACLSelector()}
+	case strings.HasPrefix(rule, ">"):
+		u.addPassword(passwordHash(rule[1:]))
+	case strings.HasPrefix(rule, "<"):
+		return u.removePassword(passwordHash(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		if !validPasswordHash(rule[1:]) {
+			return errACLBadHash
+		}
+		u.addPassword(rule[1:])
+	case strings.HasPrefix(rule, "!"):
+		if !validPasswordHash(rule[1:]) {
+			return errACLBadHash
+		}
+		return u.removePassword(rule[1:])
+	case strings.HasPrefix(rule, "(") && strings.HasSuffix(rule, ")"):
+		s := newACLSelector()
+		for _, selectorRule := range strings.Fields(rule[1 : len(rule)-1]) {
+			if err := s.applyRule(selectorRule); err != nil {
+				return err
+			}
+		}
+		u.selectors = append(u.selectors, s)
+	default:
+		return u.selectors[0].applyRule(rule)
+	}
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.nopass = false
+	for _, existing := range u.passwords {
+		if existing == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) error {
+	for i, existing := range u.passwords {
+		if existing == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errACLNoSuchPassword
+}
+
+func validPasswordHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if !('0' <= hash[i] && hash[i] <= '9' || 'a' <= hash[i] && hash[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRule applies a rule about the commands, keys or channels of the selector
+func (s *aclSelector) applyRule(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "allkeys":
+		s.allKeys, s.keys = true, nil
+	case lower == "resetkeys":
+		s.allKeys, s.keys = false, nil
+	case lower == "allchannels":
+		s.allChannels, s.channels = true, nil
+	case lower == "resetchannels":
+		s.allChannels, s.channels = false, nil
+	case lower == "allcommands" || lower == "+@all":
+		s.setAllCommands(true)
+	case lower == "nocommands" || lower == "-@all":
+		s.setAllCommands(false)
+	case strings.HasPrefix(rule, "~") || strings.HasPrefix(rule, "%"):
+		return s.addKeyPattern(rule)
+	case strings.HasPrefix(rule, "&"):
+		return s.addChannelPattern(rule[1:])
+	case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+		return s.applyCommandRule(lower)
+	default:
+		return errACLSyntax
+	}
+	return nil
+}
+
+func (s *aclSelector) setAllCommands(allowed bool) {
+	s.allCommands = allowed
+	clear(s.commands)
+	clear(s.firstArgs)
+	s.rules = nil
+}
+
+// addKeyPattern applies ~<pattern>, which allows reading and writing the keys matching pattern, or
+// %R~<pattern>, %W~<pattern> and %RW~<pattern> which allow either or both
+func (s *aclSelector) addKeyPattern(rule string) error {
+	flags := keyRead | keyWrite
+	pattern := rule[1:]
+	if rule[0] == '%' {
+		end := strings.IndexByte(rule, '~')
+		if end < 0 {
+			return errACLSyntax
+		}
+		flags = 0
+		for _, ch := range strings.ToUpper(rule[1:end]) {
+			switch ch {
+			case 'R':
+				flags |= keyRead
+			case 'W':
+				flags |= keyWrite
+			default:
+				return errACLSyntax
+			}
+		}
+		if flags == 0 {
+			return errACLSyntax
+		}
+		pattern = rule[end+1:]
+	}
+	if flags == keyRead|keyWrite && pattern == "*" {
+		s.allKeys, s.keys = true, nil
+		return nil
+	}
+	if s.allKeys {
+		return errACLKeysAfterAll
+	}
+	for i := range s.keys {
+		if s.keys[i].pattern == pattern {
+			s.keys[i].flags |= flags
+			return nil
+		}
+	}
+	s.keys = append(s.keys, keyPattern{pattern, flags})
+	return nil
+}
+
+func (s *aclSelector) addChannelPattern(pattern string) error {
+	if pattern == "*" {
+		s.allChannels, s.channels = true, nil
+		return nil
+	}
+	if s.allChannels {
+		return errACLChannelsAfterAll
+	}
+	for _, existing := range s.channels {
+		if existing == pattern {
+			return nil
+		}
+	}
+	s.channels = append(s.channels, pattern)
+	return nil
+}
+
+// applyCommandRule applies +<command>, +<command>|<first arg> or +@<category>, or their - counterparts,
+// given in lower case
+func (s *aclSelector) applyCommandRule(rule string) error {
+	allowed := rule[0] == '+'
+	target := rule[1:]
+	if strings.HasPrefix(target, "@") {
+		category, ok := aclCategoryByName(target[1:])
+		if !ok {
+			return errACLUnknownCommand
+		}
+		for name, cmd := range commandTable {
+			// the subcommands outside the category keep the permission they had
+			subs := make(map[string]bool)
+			for sub, subCmd := range cmd.subcommands {
+				if subCmd.aclCategories()&category != 0 {
+					subs[sub] = allowed
+				} else if cmd.aclCategories()&category != 0 {
+					subs[sub] = s.subcommandAllowed(name, sub)
+				}
+			}
+			if cmd.aclCategories()&category != 0 {
+				s.commands[name] = allowed
+				delete(s.firstArgs, name)
+			}
+			for sub, subAllowed := range subs {
+				s.setFirstArg(name, sub, subAllowed)
+			}
+		}
+		s.rules = append(s.rules, rule)
+		return nil
+	}
+
+	name, arg, hasArg := strings.Cut(target, "|")
+	upper := strings.ToUpper(name)
+	if _, ok := commandTable[upper]; !ok {
+		return errACLUnknownCommand
+	}
+	if hasArg {
+		if arg == "" || strings.Contains(arg, "|") {
+			return errACLSyntax
+		}
+		s.setFirstArg(upper, arg, allowed)
+	} else {
+		s.commands[upper] = allowed
+		delete(s.firstArgs, upper)
+	}
+
+	// a later rule about the same command replaces the earlier ones
+	rules := s.rules[:0]
+	for _, existing := range s.rules {
+		previous := existing[1:]
+		if previous == target || (!hasArg && strings.HasPrefix(previous, name+"|")) {
+			continue
+		}
+		rules = append(rules, existing)
+	}
+	s.rules = append(rules, rule)
+	return nil
+}
+
+const (
+	aclDeniedCommand = iota + 1
+	aclDeniedKey
+	aclDeniedAuth
+	aclDeniedChannel
+)
+
+var aclDenialReasons = map[int]string{
+	aclDeniedCommand: "command",
+	aclDeniedKey:     "key",
+	aclDeniedAuth:    "auth",
+	aclDeniedChannel: "channel",
+}
+
+// aclDenial is why a user may not run a command, object being the command, key or channel denied
+type aclDenial struct {
+	reason   int
+	object   string
+	username string
+}
+
+// message describes the denial, naming the key or channel when verbose
+func (d *aclDenial) message(verbose bool) string {
+	switch {
+	case d.reason == aclDeniedCommand:
+		return fmt.Sprintf("User %s has no permissions to run the '%s' command", d.username, d.object)
+	case verbose:
+		return fmt.Sprintf("User %s has no permissions to access the '%s' %s", d.username, d.object, aclDenialReasons[d.reason])
+	}
+	return fmt.Sprintf("No permissions to access a %s", aclDenialReasons[d.reason])
+}
+
+// checkPermissions returns why the user of the client may not run the command, nil when it may. The
+// caller must hold mu.
+func (c *Client) checkPermissions(name string, cmd command, args []BulkString) *aclDenial {
+	if c.user == nil {
+		return nil
+	}
+	return c.user.check(name, cmd, args)
+}
+
+// check returns why the user may not run the command, nil when one of its selectors allows it. When none
+// does the denial reported is the most specific one.
+func (u *aclUser) check(name string, cmd command, args []BulkString) *aclDenial {
+	var denial *aclDenial
+	for _, s := range u.selectors {
+		d := s.check(name, cmd, args)
+		if d == nil {
+			return nil
+		}
+		if denial == nil || d.reason > denial.reason {
+			denial = d
+		}
+	}
+	denial.username = u.name
+	return denial
+}
+
+func (s *aclSelector) check(name string, cmd command, args []BulkString) *aclDenial {
+	// a client can always authenticate
+	if !noAuthCommands[name] && !s.commandAllowed(name, args) {
+		return &aclDenial{reason: aclDeniedCommand, object: strings.ToLower(name)}
+	}
+	if !s.allKeys {
+		for _, k := range cmd.commandKeys(args) {
+			if k.flags&keyNotKey == 0 && !s.keyAllowed(k.key, k.flags) {
+				return &aclDenial{reason: aclDeniedKey, object: k.key}
+			}
+		}
+	}
+	if !s.allChannels {
+		channels, patterns := commandChannels(name, args)
+		for _, channel := range channels {
+			if !s.channelAllowed(channel, patterns) {
+				return &aclDenial{reason: aclDeniedChannel, object: channel}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *aclSelector) commandAllowed(name string, args []BulkString) bool {
+	if len(args) > 1 {
+		return s.subcommandAllowed(name, strings.ToLower(*args[1].Value))
+	}
+	if allowed, ok := s.commands[name]; ok {
+		return allowed
+	}
+	return s.allCommands
+}
+
+// subcommandAllowed reports whether the command may run with the lower case first argument
+func (s *aclSelector) subcommandAllowed(name, arg string) bool {
+	if allowed, ok := s.firstArgs[name][arg]; ok {
+		return allowed
+	}
+	if allowed, ok := s.commands[name]; ok {
+		return allowed
+	}
+	return s.allCommands
+}
+
+func (s *aclSelector) setFirstArg(name, arg string, allowed bool) {
+	if s.firstArgs[name] == nil {
+		s.firstArgs[name] = make(map[string]bool)
+	}
+	s.firstArgs[name][arg] = allowed
+}
+
+// keyAllowed reports whether a pattern gives every access in flags to key
+func (s *aclSelector) keyAllowed(key string, flags keyFlags) bool {
+	if s.allKeys {
+		return true
+	}
+	for _, p := range s.keys {
+		if p.flags&flags == flags && stringMatch(p.pattern, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelAllowed reports whether a pattern allows channel. A pattern subscribed to must be one of the
+// patterns itself, since it may match channels the patterns do not.
+func (s *aclSelector) channelAllowed(channel string, pattern bool) bool {
+	if s.allChannels {
+		return true
+	}
+	for _, allowed := range s.channels {
+		if (pattern && allowed == channel) || (!pattern && stringMatch(allowed, channel, false)) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelAllowed reports whether any selector of the user allows channel
+func (u *aclUser) channelAllowed(channel string, pattern bool) bool {
+	for _, s := range u.selectors {
+		if s.channelAllowed(channel, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandChannels returns the channels a command publishes or subscribes to, and whether they are patterns
+func commandChannels(name string, args []BulkString) ([]string, bool) {
+	switch name {
+	case "PUBLISH", "SPUBLISH":
+		return []string{*args[1].Value}, false
+	case "SUBSCRIBE", "SSUBSCRIBE":
+		return commandArgs(args[1:]), false
+	case "PSUBSCRIBE":
+		return commandArgs(args[1:]), true
+	}
+	return nil, false
+}
+
+// describe gives the rules that rebuild the user, as ACL LIST and ACL SAVE write them
+func (u *aclUser) describe() string {
+	parts := []string{"off"}
+	if u.enabled {
+		parts[0] = "on"
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, hash := range u.passwords {
+		parts = append(parts, "#"+hash)
+	}
+	parts = append(parts, u.selectors[0].describe())
+	for _, s := range u.selectors[1:] {
+		parts = append(parts, "("+s.describe()+")")
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *aclSelector) describe() string {
+	var parts []string
+	if keys := s.describeKeys(); keys != "" {
+		parts = append(parts, keys)
+	}
+	if s.allChannels {
+		parts = append(parts, "&*")
+	} else {
+		parts = append(parts, "resetchannels")
+		if channels := s.describeChannels(); channels != "" {
+			parts = append(parts, channels)
+		}
+	}
+	parts = append(parts, s.describeCommands())
+	return strings.Join(parts, " ")
+}
+
+func (s *aclSelector) describeKeys() string {
+	if s.allKeys {
+		return "~*"
+	}
+	parts := make([]string, len(s.keys))
+	for i, p := range s.keys {
+		switch p.flags {
+		case keyRead:
+			parts[i] = "%R~" + p.pattern
+		case keyWrite:
+			parts[i] = "%W~" + p.pattern
+		default:
+			parts[i] = "~" + p.pattern
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *aclSelector) describeChannels() string {
+	if s.allChannels {
+		return "&*"
+	}
+	parts := make([]string, len(s.channels))
+	for i, channel := range s.channels {
+		parts[i] = "&" + channel
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *aclSelector) describeCommands() string {
+	base := "-@all"
+	if s.allCommands {
+		base = "+@all"
+	}
+	return strings.Join(append([]string{base}, s.rules...), " ")
+}
+
+// mergeSelectorArgs joins the arguments of a selector split over several of them, like "(+get" "~key)"
+func mergeSelectorArgs(args []string) ([]string, error) {
+	var merged, selector []string
+	for _, arg := range args {
+		switch {
+		case selector != nil:
+			selector = append(selector, arg)
+			if strings.HasSuffix(arg, ")") {
+				merged = append(merged, strings.Join(selector, " "))
+				selector = nil
+			}
+		case strings.HasPrefix(arg, "(") && !strings.HasSuffix(arg, ")"):
+			selector = []string{arg}
+		default:
+			merged = append(merged, arg)
+		}
+	}
+	if selector != nil {
+		return nil, fmt.Errorf("Unmatched parenthesis in acl selector starting at '%s'.", selector[0])
+	}
+	return merged, nil
+}
@@ -0,0 +1,546 @@
+package resp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aclLogEntry is a denied command or authentication in ACL LOG. Similar denials close in time add up in
+// a single entry.
+type aclLogEntry struct {
+	count      int
+	reason     string
+	context    string
+	object     string
+	username   string
+	clientInfo string
+	id         int64
+	created    time.Time
+	updated    time.Time
+}
+
+// aclLogGroupingWindow is how long after the last one a similar denial still adds up in an entry
+const aclLogGroupingWindow = time.Minute
+
+// aclLog holds the entries of ACL LOG, newest first, guarded by mu
+var (
+	aclLog       []*aclLogEntry
+	aclLogNextID int64
+)
+
+// addACLLogEntry logs a denial for the client, in the context it ran the command in: toplevel, or multi
+// inside a transaction. The caller must hold mu.
+func addACLLogEntry(c *Client, d *aclDenial, context string) {
+	now := time.Now()
+	reason := aclDenialReasons[d.reason]
+	// only the latest entries are looked at for similar ones
+	for i, e := range aclLog[:min(len(aclLog), 10)] {
+		if e.reason == reason && e.context == context && e.object == d.object && e.username == d.username &&
+			now.Sub(e.updated) < aclLogGroupingWindow {
+			e.count++
+			e.updated = now
+			e.clientInfo = c.info()
+			copy(aclLog[1:i+1], aclLog[:i])
+			aclLog[0] = e
+			return
+		}
+	}
+
+	entry := &aclLogEntry{
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     d.object,
+		username:   d.username,
+		clientInfo: c.info(),
+		id:         aclLogNextID,
+		created:    now,
+		updated:    now,
+	}
+	aclLogNextID++
+	aclLog = append([]*aclLogEntry{entry}, aclLog...)
+	trimACLLog()
+}
+
+func trimACLLog() {
+	if len(aclLog) > config.aclLogMaxLen {
+		clear(aclLog[config.aclLogMaxLen:])
+		aclLog = aclLog[:config.aclLogMaxLen]
+	}
+}
+
+func setACLLogMaxLen(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return errors.New("argument must be a positive integer")
+	}
+	config.aclLogMaxLen = n
+	trimACLLog()
+	return nil
+}
+
+func formatACLPubsubDefault() string {
+	if config.aclPubsubDefault {
+		return "allchannels"
+	}
+	return "resetchannels"
+}
+
+func setACLPubsubDefault(value string) error {
+	switch strings.ToLower(value) {
+	case "allchannels":
+		config.aclPubsubDefault = true
+	case "resetchannels":
+		config.aclPubsubDefault = false
+	default:
+		return errors.New("argument(s) must be one of the following: allchannels, resetchannels")
+	}
+	return nil
+}
+
+// aclSubcommands are the ACL subcommands any user may be allowed, the other ones being admin
+var aclSubcommands = map[string]command{
+	"whoami":  {arity: 2},
+	"cat":     {arity: -2},
+	"genpass": {arity: -2},
+	"help":    {arity: 2},
+}
+
+// handleACL implements the ACL subcommands
+func handleACL(c *Client, args ...BulkString) ([]byte, error) {
+	sub := strings.ToUpper(*args[1].Value)
+	switch {
+	case sub == "SETUSER" && len(args) >= 3:
+		return aclSetUser(args[2:])
+	case sub == "GETUSER" && len(args) == 3:
+		return aclGetUser(c, *args[2].Value)
+	case sub == "DELUSER" && len(args) >= 3:
+		return aclDelUser(args[2:])
+	case sub == "USERS" && len(args) == 2:
+		return SerializeArray(bulkStrings(sortedNames(aclUsers)))
+	case sub == "LIST" && len(args) == 2:
+		names := sortedNames(aclUsers)
+		for i, name := range names {
+			names[i] = "user " + name + " " + aclUsers[name].describe()
+		}
+		return SerializeArray(bulkStrings(names))
+	case sub == "WHOAMI" && len(args) == 2:
+		if c.user == nil {
+			return bulkString("default").serialize()
+		}
+		return bulkString(c.user.name).serialize()
+	case sub == "CAT" && len(args) <= 3:
+		return aclCat(args[2:])
+	case sub == "LOG" && len(args) <= 3:
+		return aclLogReply(c, args[2:])
+	case sub == "LOAD" && len(args) == 2:
+		if config.aclFile == "" {
+			return errorReply(errNoACLFile)
+		}
+		if err := loadACLFile(config.aclFile); err != nil {
+			return errorReply("ERR " + err.Error())
+		}
+		return []byte("+OK\r\n"), nil
+	case sub == "SAVE" && len(args) == 2:
+		if config.aclFile == "" {
+			return errorReply(errNoACLFile)
+		}
+		if err := saveACLFile(config.aclFile); err != nil {
+			fmt.Println("Error saving ACLs:", err)
+			return errorReply("ERR There was an error trying to save the ACLs. Please check the server logs for more information")
+		}
+		return []byte("+OK\r\n"), nil
+	case sub == "DRYRUN" && len(args) >= 4:
+		return aclDryRun(args[2:])
+	case sub == "GENPASS" && len(args) <= 3:
+		return aclGenPass(args[2:])
+	case sub == "HELP" && len(args) == 2:
+		return helpReply(
+			"ACL <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CAT [<category>]",
+			"    List all commands that belong to <category>, or all command categories",
+			"    when no category is specified.",
+			"DELUSER <username> [<username> ...]",
+			"    Delete a list of users.",
+			"DRYRUN <username> <command> [<arg> ...]",
+			"    Returns whether the user can execute the given command without executing the command.",
+			"GETUSER <username>",
+			"    Get the user's details.",
+			"GENPASS [<bits>]",
+			"    Generate a secure 256-bit user password. The optional `bits` argument can",
+			"    be used to specify a different size.",
+			"LIST",
+			"    Show users details in config file format.",
+			"LOAD",
+			"    Reload users from the ACL file.",
+			"LOG [<count> | RESET]",
+			"    Show the ACL log entries.",
+			"SAVE",
+			"    Save the current config to the ACL file.",
+			"SETUSER <username> <attribute> [<attribute> ...]",
+			"    Create or modify a user with the specified attributes.",
+			"USERS",
+			"    List all the registered usernames.",
+			"WHOAMI",
+			"    Return the current connection username.",
+			"HELP",
+			"    Print this help.",
+		)
+	}
+	return subcommandSyntaxReply("acl", *args[1].Value)
+}
+
+const errNoACLFile = "ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration."
+
+func bulkStrings(values []string) Array {
+	elements := make([]RESPData, len(values))
+	for i, value := range values {
+		elements[i] = bulkString(value)
+	}
+	return Array{Elements: &elements}
+}
+
+// aclSetUser implements ACL SETUSER username [rule ...]. The rules apply all or not at all, to a new
+// user when none has the name.
+func aclSetUser(args []BulkString) ([]byte, error) {
+	name := *args[0].Value
+	if strings.ContainsAny(name, " \x00") {
+		return errorReply("ERR Usernames can't contain spaces or null characters")
+	}
+	rules, err := mergeSelectorArgs(commandArgs(args[1:]))
+	if err != nil {
+		return errorReply("ERR " + err.Error())
+	}
+	existing := aclUsers[name]
+	u := newACLUser(name)
+	if existing != nil {
+		u = existing.clone()
+	}
+	if rule, err := u.setRules(rules); err != nil {
+		return errorReply(fmt.Sprintf("ERR Error in ACL SETUSER modifier '%s': %v", rule, err))
+	}
+	installACLUser(u)
+	return []byte("+OK\r\n"), nil
+}
+
+// installACLUser adds u, or copies it over the user of the same name so the clients authenticated as
+// that user get its new permissions. Clients whose subscriptions are no longer allowed are disconnected.
+// The caller must hold mu.
+func installACLUser(u *aclUser) {
+	existing := aclUsers[u.name]
+	if existing == nil {
+		aclUsers[u.name] = u
+		return
+	}
+	*existing = *u
+	for _, c := range clientsByID {
+		if c.user == existing && !c.subscriptionsAllowed() {
+			c.closeForACL()
+		}
+	}
+}
+
+// subscriptionsAllowed reports whether the user of the client allows all its subscriptions
+func (c *Client) subscriptionsAllowed() bool {
+	for _, subscriptions := range []map[string]struct{}{c.channels, c.shardChannels} {
+		for channel := range subscriptions {
+			if !c.user.channelAllowed(channel, false) {
+				return false
+			}
+		}
+	}
+	for pattern := range c.patterns {
+		if !c.user.channelAllowed(pattern, true) {
+			return false
+		}
+	}
+	return true
+}
+
+// closeForACL disconnects a client whose user changed, the running client once it got its reply.
+// The caller must hold mu.
+func (c *Client) closeForACL() {
+	if c == currentClient {
+		c.closeAfterReply = true
+		return
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// aclGetUser implements ACL GETUSER, describing the user by field
+func aclGetUser(c *Client, name string) ([]byte, error) {
+	u := aclUsers[name]
+	if u == nil {
+		return []byte("$-1\r\n"), nil
+	}
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	selectors := []RESPData{}
+	for _, s := range u.selectors[1:] {
+		selectors = append(selectors, c.mapOf([]RESPData{
+			bulkString("commands"), bulkString(s.describeCommands()),
+			bulkString("keys"), bulkString(s.describeKeys()),
+			bulkString("channels"), bulkString(s.describeChannels()),
+		}))
+	}
+	root := u.selectors[0]
+	return c.mapReply([]RESPData{
+		bulkString("flags"), bulkStrings(flags),
+		bulkString("passwords"), bulkStrings(u.passwords),
+		bulkString("commands"), bulkString(root.describeCommands()),
+		bulkString("keys"), bulkString(root.describeKeys()),
+		bulkString("channels"), bulkString(root.describeChannels()),
+		bulkString("selectors"), Array{Elements: &selectors},
+	})
+}
+
+// aclDelUser implements ACL DELUSER, disconnecting the clients of the users deleted
+func aclDelUser(names []BulkString) ([]byte, error) {
+	for _, name := range names {
+		if *name.Value == "default" {
+			return errorReply("ERR The 'default' user cannot be removed")
+		}
+	}
+	deleted := 0
+	for _, name := range names {
+		if u := aclUsers[*name.Value]; u != nil {
+			deleteACLUser(u)
+			deleted++
+		}
+	}
+	return SerializeInteger(Integer{Value: deleted})
+}
+
+// deleteACLUser removes u and disconnects its clients. The caller must hold mu.
+func deleteACLUser(u *aclUser) {
+	delete(aclUsers, u.name)
+	for _, c := range clientsByID {
+		if c.user == u {
+			c.closeForACL()
+		}
+	}
+}
+
+// aclCat implements ACL CAT [category]: the categories, or the commands of one
+func aclCat(args []BulkString) ([]byte, error) {
+	if len(args) == 0 {
+		names := make([]string, len(aclCategoryNames))
+		for i, c := range aclCategoryNames {
+			names[i] = c.name
+		}
+		return SerializeArray(bulkStrings(names))
+	}
+	category, ok := aclCategoryByName(*args[0].Value)
+	if !ok {
+		return errorReply(fmt.Sprintf("ERR Unknown category '%s'", *args[0].Value))
+	}
+	var names []string
+	for _, name := range sortedNames(commandTable) {
+		cmd := commandTable[name]
+		if cmd.aclCategories()&category != 0 {
+			names = append(names, strings.ToLower(name))
+		}
+		for _, sub := range sortedNames(cmd.subcommands) {
+			if cmd.subcommands[sub].aclCategories()&category != 0 {
+				names = append(names, strings.ToLower(name)+"|"+sub)
+			}
+		}
+	}
+	return SerializeArray(bulkStrings(names))
+}
+
+// aclLogReply implements ACL LOG [count | RESET], the latest count entries, 10 by default
+func aclLogReply(c *Client, args []BulkString) ([]byte, error) {
+	count := 10
+	if len(args) == 1 {
+		if strings.EqualFold(*args[0].Value, "RESET") {
+			aclLog = nil
+			return []byte("+OK\r\n"), nil
+		}
+		n, err := strconv.Atoi(*args[0].Value)
+		if err != nil {
+			return errorReply(errNotInteger.Error())
+		}
+		if n < 0 {
+			return errorReply("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	now := time.Now()
+	entries := []RESPData{}
+	for _, e := range aclLog[:min(count, len(aclLog))] {
+		entries = append(entries, c.mapOf([]RESPData{
+			bulkString("count"), Integer{Value: e.count},
+			bulkString("reason"), bulkString(e.reason),
+			bulkString("context"), bulkString(e.context),
+			bulkString("object"), bulkString(e.object),
+			bulkString("username"), bulkString(e.username),
+			bulkString("age-seconds"), bulkString(strconv.FormatFloat(now.Sub(e.created).Seconds(), 'f', 3, 64)),
+			bulkString("client-info"), bulkString(e.clientInfo),
+			bulkString("entry-id"), Integer{Value: int(e.id)},
+			bulkString("timestamp-created"), Integer{Value: int(e.created.UnixMilli())},
+			bulkString("timestamp-last-updated"), Integer{Value: int(e.updated.UnixMilli())},
+		}))
+	}
+	return SerializeArray(Array{Elements: &entries})
+}
+
+// aclDryRun implements ACL DRYRUN username command [arg ...], telling whether the user may run the command
+func aclDryRun(args []BulkString) ([]byte, error) {
+	u := aclUsers[*args[0].Value]
+	if u == nil {
+		return errorReply(fmt.Sprintf("ERR User '%s' not found", *args[0].Value))
+	}
+	name := strings.ToUpper(*args[1].Value)
+	cmd, ok := commandTable[name]
+	if !ok {
+		return errorReply(fmt.Sprintf("ERR Command '%s' not found", *args[1].Value))
+	}
+	if !cmd.arityOK(len(args) - 1) {
+		return wrongArgsReply(name)
+	}
+	if denial := u.check(name, cmd, args[1:]); denial != nil {
+		return bulkString(denial.message(true)).serialize()
+	}
+	return []byte("+OK\r\n"), nil
+}
+
+// aclGenPass implements ACL GENPASS [bits], a random password of bits rounded up to hex digits
+func aclGenPass(args []BulkString) ([]byte, error) {
+	bits := 256
+	if len(args) == 1 {
+		n, err := strconv.Atoi(*args[0].Value)
+		if err != nil || n <= 0 || n > 4096 {
+			return errorReply("ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096")
+		}
+		bits = n
+	}
+	digits := (bits + 3) / 4
+	b := make([]byte, (digits+1)/2)
+	rand.Read(b)
+	return bulkString(hex.EncodeToString(b)[:digits]).serialize()
+}
+
+// loadACLFile replaces the users with the ones of an ACL file, made of lines like ACL LIST gives. Nothing
+// changes if any line is wrong. Existing users are updated in place, the ones missing from the file are
+// deleted, and the default user gets its initial rules unless the file has it. The caller must hold mu.
+func loadACLFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error loading ACLs, opening file '%s': %v", path, err)
+	}
+
+	users := make(map[string]*aclUser)
+	var errs []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields, err := splitConfigLine(line)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: %v.", path, i+1, err))
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			errs = append(errs, fmt.Sprintf("%s:%d should start with user keyword followed by the username.", path, i+1))
+			continue
+		}
+		name := fields[1]
+		if users[name] != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: Duplicate user '%s' found.", path, i+1, name))
+			continue
+		}
+		rules, err := mergeSelectorArgs(fields[2:])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: %v", path, i+1, err))
+			continue
+		}
+		u := newACLUser(name)
+		if rule, err := u.setRules(rules); err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: Error in applying operation '%s': %v.", path, i+1, rule, err))
+			continue
+		}
+		users[name] = u
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, " "))
+	}
+
+	if users["default"] == nil {
+		users["default"] = newDefaultUser()
+	}
+	for name, u := range aclUsers {
+		if users[name] == nil {
+			deleteACLUser(u)
+		}
+	}
+	for _, u := range users {
+		installACLUser(u)
+	}
+	return nil
+}
+
+// saveACLFile writes the users to path, replacing the file once they are all written
+func saveACLFile(path string) error {
+	var b strings.Builder
+	for _, name := range sortedNames(aclUsers) {
+		fmt.Fprintf(&b, "user %s %s\n", name, aclUsers[name].describe())
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// loadConfigUsers sets up the users declared with user directives in the config, or the ones of the
+// ACL file. Both can't be used together.
+func loadConfigUsers(directives [][]string) error {
+	if config.aclFile != "" {
+		if len(directives) > 0 {
+			return errors.New("configuring Redis with users defined in redis.conf and at the same setting an ACL file path is invalid. This setup is very likely to lead to configuration errors and security holes, please define either an ACL file or declare users directly in your redis.conf, but not both")
+		}
+		return loadACLFile(config.aclFile)
+	}
+
+	declared := make(map[string]bool)
+	for _, directive := range directives {
+		if len(directive) == 0 {
+			return errors.New("user directive without a username")
+		}
+		name := directive[0]
+		if declared[name] {
+			return fmt.Errorf("Duplicate user '%s' found. A user can only be defined once in config files", name)
+		}
+		declared[name] = true
+		rules, err := mergeSelectorArgs(directive[1:])
+		if err != nil {
+			return err
+		}
+		u := newACLUser(name)
+		if rule, err := u.setRules(rules); err != nil {
+			return fmt.Errorf("Error in user declaration '%s': %v", rule, err)
+		}
+		installACLUser(u)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package resp
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resetACL drops the users and the log the test leaves behind
+func resetACL(t *testing.T) {
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for name := range aclUsers {
+			if name != "default" {
+				delete(aclUsers, name)
+			}
+		}
+		*defaultUser = *newDefaultUser()
+		aclLog = nil
+	})
+}
+
+// aclClient connects a client authenticated as username
+func aclClient(t *testing.T, username, password string) (*Client, *bufio.Reader) {
+	t.Helper()
+	c, r := subscriber(t)
+	runClientCommandCases(t, c, []commandCase{{"auth", []string{"AUTH", username, password}, "+OK\r\n"}})
+	return c, r
+}
+
+func TestACLSetUser(t *testing.T) {
+	resetACL(t)
+	hash := passwordHash("pw")
+	runCommandCases(t, []commandCase{
+		{"setuser", []string{"ACL", "SETUSER", "alice", "on", ">pw", "~cached:*", "%R~ro:*", "+get", "+@stream", "-xadd", "&news"}, "+OK\r\n"},
+		{"selector", []string{"ACL", "SETUSER", "alice", "(+set", "~rw:*)"}, "+OK\r\n"},
+		{"users", []string{"ACL", "USERS"}, string(respCommand("alice", "default"))},
+		{"list", []string{"ACL", "LIST"}, string(respCommand(
+			"user alice on #"+hash+" ~cached:* %R~ro:* resetchannels &news -@all +get +@stream -xadd (~rw:* resetchannels -@all +set)",
+			"user default on nopass ~* &* +@all",
+		))},
+		{"getuser", []string{"ACL", "GETUSER", "alice"}, "*12\r\n$5\r\nflags\r\n*1\r\n$2\r\non\r\n$9\r\npasswords\r\n*1\r\n$64\r\n" + hash + "\r\n" +
+			"$8\r\ncommands\r\n$25\r\n-@all +get +@stream -xadd\r\n$4\r\nkeys\r\n$17\r\n~cached:* %R~ro:*\r\n$8\r\nchannels\r\n$5\r\n&news\r\n" +
+			"$9\r\nselectors\r\n*1\r\n*6\r\n$8\r\ncommands\r\n$10\r\n-@all +set\r\n$4\r\nkeys\r\n$5\r\n~rw:*\r\n$8\r\nchannels\r\n$0\r\n\r\n"},
+		{"no such user", []string{"ACL", "GETUSER", "bob"}, "$-1\r\n"},
+
+		// a later rule about a command replaces the earlier ones
+		{"replace rule", []string{"ACL", "SETUSER", "alice", "-get", "clearselectors", "nopass"}, "+OK\r\n"},
+		{"list replaced", []string{"ACL", "LIST"}, string(respCommand(
+			"user alice on nopass ~cached:* %R~ro:* resetchannels &news -@all +@stream -xadd -get",
+			"user default on nopass ~* &* +@all",
+		))},
+
+		{"unknown command", []string{"ACL", "SETUSER", "alice", "+nosuchcommand"}, "-ERR Error in ACL SETUSER modifier '+nosuchcommand': Unknown command or category name in ACL\r\n"},
+		{"unknown category", []string{"ACL", "SETUSER", "alice", "+@nosuchcategory"}, "-ERR Error in ACL SETUSER modifier '+@nosuchcategory': Unknown command or category name in ACL\r\n"},
+		{"syntax", []string{"ACL", "SETUSER", "alice", "bogus"}, "-ERR Error in ACL SETUSER modifier 'bogus': Syntax error\r\n"},
+		{"key flags", []string{"ACL", "SETUSER", "alice", "%X~key"}, "-ERR Error in ACL SETUSER modifier '%X~key': Syntax error\r\n"},
+		{"keys after all", []string{"ACL", "SETUSER", "alice", "allkeys", "~key"}, "-ERR Error in ACL SETUSER modifier '~key': Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns\r\n"},
+		{"missing password", []string{"ACL", "SETUSER", "alice", "<nope"}, "-ERR Error in ACL SETUSER modifier '<nope': The password you are trying to remove from the user does not exist\r\n"},
+		{"bad hash", []string{"ACL", "SETUSER", "alice", "#abc"}, "-ERR Error in ACL SETUSER modifier '#abc': The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters\r\n"},
+		{"unmatched parenthesis", []string{"ACL", "SETUSER", "alice", "(+get", "~key"}, "-ERR Unmatched parenthesis in acl selector starting at '(+get'.\r\n"},
+		{"space in name", []string{"ACL", "SETUSER", "al ice"}, "-ERR Usernames can't contain spaces or null characters\r\n"},
+		// a failed SETUSER changes nothing
+		{"all or nothing", []string{"ACL", "SETUSER", "alice", "off", "bogus"}, "-ERR Error in ACL SETUSER modifier 'bogus': Syntax error\r\n"},
+		{"unchanged", []string{"ACL", "LIST"}, string(respCommand(
+			"user alice on nopass ~cached:* %R~ro:* resetchannels &news -@all +@stream -xadd -get",
+			"user default on nopass ~* &* +@all",
+		))},
+
+		{"delete default", []string{"ACL", "DELUSER", "default"}, "-ERR The 'default' user cannot be removed\r\n"},
+		{"delete", []string{"ACL", "DELUSER", "alice", "bob"}, ":1\r\n"},
+		{"whoami", []string{"ACL", "WHOAMI"}, "$7\r\ndefault\r\n"},
+	})
+}
+
+func TestACLPermissions(t *testing.T) {
+	resetACL(t)
+	runCommandCases(t, []commandCase{
+		{"setuser", []string{"ACL", "SETUSER", "alice", "on", ">pw", "~cached:*", "%R~ro:*", "&news:*",
+			"+get", "+set", "+publish", "+psubscribe", "+config|get", "(+del ~tmp:*)"}, "+OK\r\n"},
+	})
+	c, _ := aclClient(t, "alice", "pw")
+	runClientCommandCases(t, c, []commandCase{
+		{"whoami", []string{"ACL", "WHOAMI"}, "-NOPERM User alice has no permissions to run the 'acl' command\r\n"},
+		{"get", []string{"GET", "cached:1"}, "$-1\r\n"},
+		{"key", []string{"GET", "other"}, "-NOPERM No permissions to access a key\r\n"},
+		{"command", []string{"DBSIZE"}, "-NOPERM User alice has no permissions to run the 'dbsize' command\r\n"},
+		{"read only key", []string{"GET", "ro:1"}, "$-1\r\n"},
+		{"read only key written", []string{"SET", "ro:1", "v"}, "-NOPERM No permissions to access a key\r\n"},
+		{"selector", []string{"DEL", "tmp:1"}, ":0\r\n"},
+		{"selector keys", []string{"DEL", "cached:1"}, "-NOPERM No permissions to access a key\r\n"},
+		{"first arg", []string{"CONFIG", "GET", "acllog-max-len"}, "*2\r\n$14\r\nacllog-max-len\r\n$3\r\n128\r\n"},
+		{"other first arg", []string{"CONFIG", "SET", "acllog-max-len", "1"}, "-NOPERM User alice has no permissions to run the 'config' command\r\n"},
+		{"channel", []string{"PUBLISH", "news:1", "hi"}, ":0\r\n"},
+		{"other channel", []string{"PUBLISH", "sports", "hi"}, "-NOPERM No permissions to access a channel\r\n"},
+		// a pattern must be one of the allowed ones, not just match them
+		{"wider pattern", []string{"PSUBSCRIBE", "news*"}, "-NOPERM No permissions to access a channel\r\n"},
+		// a client can always authenticate
+		{"auth", []string{"AUTH", "alice", "pw"}, "+OK\r\n"},
+	})
+
+	reply, _ := ExecuteRespData(respCommand("ACL", "LOG"))
+	entries := strings.Split(string(reply), "$5\r\ncount\r\n")
+	if len(entries) != 9 {
+		t.Fatalf("expected 8 entries, got %q", reply)
+	}
+	for i, expected := range []string{
+		"$7\r\nchannel\r\n$7\r\ncontext\r\n$8\r\ntoplevel\r\n$6\r\nobject\r\n$5\r\nnews*\r\n$8\r\nusername\r\n$5\r\nalice\r\n",
+		"$7\r\nchannel\r\n$7\r\ncontext\r\n$8\r\ntoplevel\r\n$6\r\nobject\r\n$6\r\nsports\r\n",
+		"$7\r\ncommand\r\n$7\r\ncontext\r\n$8\r\ntoplevel\r\n$6\r\nobject\r\n$6\r\nconfig\r\n",
+	} {
+		if !strings.Contains(entries[i+1], expected) {
+			t.Errorf("entry %d: expected %q in %q", i, expected, entries[i+1])
+		}
+	}
+
+	// similar denials add up
+	runClientCommandCases(t, c, []commandCase{{"again", []string{"PUBLISH", "sports", "hi"}, "-NOPERM No permissions to access a channel\r\n"}})
+	reply, _ = ExecuteRespData(respCommand("ACL", "LOG", "1"))
+	if !strings.Contains(string(reply), ":2\r\n$6\r\nreason\r\n$7\r\nchannel\r\n") || !strings.Contains(string(reply), "sports") {
+		t.Errorf("expected the denial to be counted twice, got %q", reply)
+	}
+	runCommandCases(t, []commandCase{
+		{"reset", []string{"ACL", "LOG", "RESET"}, "+OK\r\n"},
+		{"empty", []string{"ACL", "LOG"}, "*0\r\n"},
+	})
+
+	// failed authentications are logged too
+	fastAuthFailures(t, 0)
+	runClientCommandCases(t, c, []commandCase{
+		{"wrong password", []string{"AUTH", "alice", "nope"}, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+	})
+	reply, _ = ExecuteRespData(respCommand("ACL", "LOG"))
+	if !strings.Contains(string(reply), "$4\r\nauth\r\n$7\r\ncontext\r\n$8\r\ntoplevel\r\n$6\r\nobject\r\n$4\r\nAUTH\r\n$8\r\nusername\r\n$5\r\nalice\r\n") {
+		t.Errorf("expected an auth entry, got %q", reply)
+	}
+}
+
+func TestACLTransaction(t *testing.T) {
+	resetACL(t)
+	runCommandCases(t, []commandCase{
+		{"setuser", []string{"ACL", "SETUSER", "alice", "on", "nopass", "~*", "+@all", "-dbsize"}, "+OK\r\n"},
+	})
+	c, _ := aclClient(t, "alice", "any")
+	runClientCommandCases(t, c, []commandCase{
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"denied", []string{"DBSIZE"}, "-NOPERM User alice has no permissions to run the 'dbsize' command\r\n"},
+		{"exec", []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{"multi again", []string{"MULTI"}, "+OK\r\n"},
+		{"queued", []string{"GET", "acl:key"}, "+QUEUED\r\n"},
+	})
+	runCommandCases(t, []commandCase{
+		{"revoke", []string{"ACL", "SETUSER", "alice", "-get"}, "+OK\r\n"},
+	})
+	runClientCommandCases(t, c, []commandCase{
+		{"exec", []string{"EXEC"}, "*1\r\n-NOPERM ACLs rules changed between the moment the transaction was accumulated and the EXEC call. This command is no longer allowed for the following reason: User alice has no permissions to run the 'get' command\r\n"},
+	})
+	reply, _ := ExecuteRespData(respCommand("ACL", "LOG", "1"))
+	if !strings.Contains(string(reply), "$7\r\ncontext\r\n$5\r\nmulti\r\n") {
+		t.Errorf("expected a multi entry, got %q", reply)
+	}
+}
+
+func TestACLDryRunAndCat(t *testing.T) {
+	resetACL(t)
+	runCommandCases(t, []commandCase{
+		{"setuser", []string{"ACL", "SETUSER", "alice", "on", "~app:*", "&orders", "+@read", "+publish"}, "+OK\r\n"},
+		{"allowed", []string{"ACL", "DRYRUN", "alice", "GET", "app:1"}, "+OK\r\n"},
+		{"command", []string{"ACL", "DRYRUN", "alice", "SET", "app:1", "v"}, "$54\r\nUser alice has no permissions to run the 'set' command\r\n"},
+		{"key", []string{"ACL", "DRYRUN", "alice", "GET", "other"}, "$55\r\nUser alice has no permissions to access the 'other' key\r\n"},
+		{"channel", []string{"ACL", "DRYRUN", "alice", "PUBLISH", "news", "hi"}, "$58\r\nUser alice has no permissions to access the 'news' channel\r\n"},
+		{"no user", []string{"ACL", "DRYRUN", "bob", "GET", "k"}, "-ERR User 'bob' not found\r\n"},
+		{"no command", []string{"ACL", "DRYRUN", "alice", "NOPE"}, "-ERR Command 'NOPE' not found\r\n"},
+		{"arity", []string{"ACL", "DRYRUN", "alice", "GET"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+
+		{"category", []string{"ACL", "CAT", "hyperloglog"}, string(respCommand("pfadd", "pfcount", "pfdebug", "pfmerge", "pfselftest"))},
+		{"unknown category", []string{"ACL", "CAT", "nope"}, "-ERR Unknown category 'nope'\r\n"},
+		{"genpass bits", []string{"ACL", "GENPASS", "0"}, "-ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096\r\n"},
+	})
+
+	reply, _ := ExecuteRespData(respCommand("ACL", "CAT"))
+	if !strings.HasPrefix(string(reply), "*21\r\n$8\r\nkeyspace\r\n$4\r\nread\r\n") {
+		t.Errorf("unexpected categories %q", reply)
+	}
+	reply, _ = ExecuteRespData(respCommand("ACL", "GENPASS", "10"))
+	if len(reply) != len("$3\r\n...\r\n") {
+		t.Errorf("expected a password of 3 hex digits, got %q", reply)
+	}
+}
+
+// WHOAMI, CAT, GENPASS and HELP are not admin subcommands, -@admin leaves them to the user
+func TestACLSubcommands(t *testing.T) {
+	resetACL(t)
+	runCommandCases(t, []commandCase{
+		{"setuser", []string{"ACL", "SETUSER", "bob", "on", ">pw", "+@all", "-@admin"}, "+OK\r\n"},
+		{"dryrun whoami", []string{"ACL", "DRYRUN", "bob", "ACL", "WHOAMI"}, "+OK\r\n"},
+		{"dryrun list", []string{"ACL", "DRYRUN", "bob", "ACL", "LIST"}, "$52\r\nUser bob has no permissions to run the 'acl' command\r\n"},
+		// readmitting admin commands keeps the subcommands allowed
+		{"setuser admin", []string{"ACL", "SETUSER", "carol", "on", ">pw", "-@all", "+@admin"}, "+OK\r\n"},
+		{"dryrun admin whoami", []string{"ACL", "DRYRUN", "carol", "ACL", "WHOAMI"}, "$54\r\nUser carol has no permissions to run the 'acl' command\r\n"},
+		{"dryrun admin list", []string{"ACL", "DRYRUN", "carol", "ACL", "LIST"}, "+OK\r\n"},
+	})
+	c, _ := aclClient(t, "bob", "pw")
+	runClientCommandCases(t, c, []commandCase{
+		{"whoami", []string{"ACL", "WHOAMI"}, "$3\r\nbob\r\n"},
+		{"cat", []string{"ACL", "CAT", "hyperloglog"}, string(respCommand("pfadd", "pfcount", "pfdebug", "pfmerge", "pfselftest"))},
+		{"genpass bits", []string{"ACL", "GENPASS", "0"}, "-ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096\r\n"},
+		{"list", []string{"ACL", "LIST"}, "-NOPERM User bob has no permissions to run the 'acl' command\r\n"},
+		{"setuser", []string{"ACL", "SETUSER", "bob", "+@admin"}, "-NOPERM User bob has no permissions to run the 'acl' command\r\n"},
+	})
+
+	reply, _ := ExecuteRespData(respCommand("ACL", "CAT", "admin"))
+	if !strings.Contains(string(reply), "$3\r\nacl\r\n") || strings.Contains(string(reply), "acl|") {
+		t.Errorf("expected acl but none of its subcommands among the admin commands, got %q", reply)
+	}
+	reply, _ = ExecuteRespData(respCommand("ACL", "CAT", "slow"))
+	if !strings.Contains(string(reply), "$10\r\nacl|whoami\r\n") {
+		t.Errorf("expected acl|whoami among the slow commands, got %q", reply)
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	resetACL(t)
+	useTempDir(t)
+	path := filepath.Join(t.TempDir(), "users.acl")
+	runCommandCases(t, []commandCase{
+		{"no file", []string{"ACL", "SAVE"}, "-" + errNoACLFile + "\r\n"},
+	})
+	config.aclFile = path
+	t.Cleanup(func() { config.aclFile = "" })
+
+	runCommandCases(t, []commandCase{
+		{"setuser", []string{"ACL", "SETUSER", "alice", "on", ">pw", "~app:*", "+get", "(+set ~tmp:*)"}, "+OK\r\n"},
+		{"save", []string{"ACL", "SAVE"}, "+OK\r\n"},
+	})
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "user alice on #" + passwordHash("pw") + " ~app:* resetchannels -@all +get (~tmp:* resetchannels -@all +set)\n" +
+		"user default on nopass ~* &* +@all\n"
+	if string(saved) != expected {
+		t.Fatalf("expected %q, got %q", expected, saved)
+	}
+
+	c, r := aclClient(t, "alice", "pw")
+	bob, bobReader := subscriber(t)
+	runCommandCases(t, []commandCase{
+		{"setuser bob", []string{"ACL", "SETUSER", "bob", "on", "nopass", "+@all"}, "+OK\r\n"},
+		{"change alice", []string{"ACL", "SETUSER", "alice", "+dbsize"}, "+OK\r\n"},
+	})
+	runClientCommandCases(t, bob, []commandCase{{"auth bob", []string{"AUTH", "bob", "x"}, "+OK\r\n"}})
+	runCommandCases(t, []commandCase{
+		{"load", []string{"ACL", "LOAD"}, "+OK\r\n"},
+		{"users", []string{"ACL", "USERS"}, string(respCommand("alice", "default"))},
+	})
+	// alice is updated in place, bob is gone along with his connection
+	runClientCommandCases(t, c, []commandCase{{"reverted", []string{"DBSIZE"}, "-NOPERM User alice has no permissions to run the 'dbsize' command\r\n"}})
+	if _, err := bobReader.ReadByte(); err == nil {
+		t.Error("expected the connection of a deleted user to be closed")
+	}
+
+	// a broken file changes nothing
+	os.WriteFile(path, []byte("user carol on +nosuchcommand\nnot a user line\n"), 0o644)
+	runCommandCases(t, []commandCase{
+		{"broken", []string{"ACL", "LOAD"}, "-ERR " + path + ":1: Error in applying operation '+nosuchcommand': Unknown command or category name in ACL. " +
+			path + ":2 should start with user keyword followed by the username.\r\n"},
+		{"unchanged", []string{"ACL", "USERS"}, string(respCommand("alice", "default"))},
+	})
+
+	// deleting the user of a connection closes it
+	runCommandCases(t, []commandCase{{"deluser", []string{"ACL", "DELUSER", "alice"}, ":1\r\n"}})
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("expected the connection of a deleted user to be closed")
+	}
+}
+
+func TestACLConfigUsers(t *testing.T) {
+	resetACL(t)
+	if err := loadConfigUsers([][]string{{"default", "on", ">secret", "~*", "+@all"}, {"worker", "on", "nopass", "(+get", "~jobs:*)"}}); err != nil {
+		t.Fatal(err)
+	}
+	runCommandCases(t, []commandCase{
+		{"list", []string{"ACL", "LIST"}, string(respCommand(
+			"user default on #"+passwordHash("secret")+" ~* resetchannels +@all",
+			"user worker on nopass resetchannels -@all (~jobs:* resetchannels -@all +get)",
+		))},
+	})
+	if err := loadConfigUsers([][]string{{"worker"}, {"worker"}}); err == nil || !strings.Contains(err.Error(), "Duplicate user 'worker'") {
+		t.Errorf("expected a duplicate user error, got %v", err)
+	}
+}
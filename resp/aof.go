@@ -0,0 +1,698 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The append only file is split in several files kept in appenddirname, like Redis 7 does:
+// a base file holding a snapshot of the dataset in the RDB format, incremental files logging the
+// write commands executed since as RESP, and a manifest listing them. BGREWRITEAOF writes a new
+// base and starts a new incremental file, the files it replaces are listed as history until deleted.
+
+const (
+	aofTypeBase    = "b"
+	aofTypeHistory = "h"
+	aofTypeIncr    = "i"
+)
+
+const (
+	aofOff = iota
+	aofOn
+	// aofWaitRewrite is the state after appendonly was turned on at runtime, until the first rewrite
+	// wrote a base file the log can be replayed on
+	aofWaitRewrite
+)
+
+type aofInfo struct {
+	name string
+	seq  int
+	typ  string
+}
+
+type aofManifest struct {
+	base    *aofInfo
+	incrs   []aofInfo
+	history []aofInfo
+	// the sequence numbers of the latest files, the next ones being one higher
+	baseSeq int
+	incrSeq int
+}
+
+// aofState is the append only file being written, guarded by mu
+var aofState = struct {
+	status   int
+	manifest *aofManifest
+	file     *os.File
+	// buf holds what was logged since the last write to file
+	buf []byte
+	// selectedDB is the database the commands written last apply to, -1 forcing a SELECT
+	selectedDB   int
+	lastWriteErr error
+	// fsyncedOffset is the replication offset the file is synced up to for WAITAOF, -1 while the AOF is not on
+	fsyncedOffset int64
+
+	rewriteInProgress bool
+	rewriteScheduled  bool
+	// ready is set once the dataset was loaded, turning appendonly on from then on starts a rewrite
+	ready bool
+}{selectedDB: -1, fsyncedOffset: -1}
+
+var errAOFRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+func aofDirPath() string {
+	return filepath.Join(config.dir, config.appendDirname)
+}
+
+func aofManifestName() string {
+	return config.appendFilename + ".manifest"
+}
+
+func aofBaseName(seq int) string {
+	return fmt.Sprintf("%s.%d.base.rdb", config.appendFilename, seq)
+}
+
+func aofIncrName(seq int) string {
+	return fmt.Sprintf("%s.%d.incr.aof", config.appendFilename, seq)
+}
+
+// String renders the manifest in the format of Redis, one file per line
+func (m *aofManifest) String() string {
+	var b strings.Builder
+	line := func(info aofInfo) {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", info.name, info.seq, info.typ)
+	}
+	if m.base != nil {
+		line(*m.base)
+	}
+	for _, info := range m.history {
+		line(info)
+	}
+	for _, info := range m.incrs {
+		line(info)
+	}
+	return b.String()
+}
+
+// loadAOFManifest reads the manifest of the AOF directory, returning nil when there is none
+func loadAOFManifest() (*aofManifest, error) {
+	f, err := os.Open(filepath.Join(aofDirPath(), aofManifestName()))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &aofManifest{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields, err := splitConfigLine(line)
+		if err != nil || len(fields)%2 != 0 {
+			return nil, errors.New("invalid AOF manifest file format")
+		}
+		var info aofInfo
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				if info.seq, err = strconv.Atoi(fields[i+1]); err != nil {
+					return nil, errors.New("invalid AOF manifest file format")
+				}
+			case "type":
+				info.typ = fields[i+1]
+			}
+		}
+		if info.name == "" || info.seq < 1 || info.name != filepath.Base(info.name) {
+			return nil, errors.New("invalid AOF manifest file format")
+		}
+
+		switch info.typ {
+		case aofTypeBase:
+			if m.base != nil {
+				return nil, errors.New("found duplicate base file information")
+			}
+			m.base = &info
+			m.baseSeq = info.seq
+		case aofTypeHistory:
+			m.history = append(m.history, info)
+		case aofTypeIncr:
+			if info.seq <= m.incrSeq {
+				return nil, errors.New("found a non-monotonic sequence number")
+			}
+			m.incrs = append(m.incrs, info)
+			m.incrSeq = info.seq
+		default:
+			return nil, fmt.Errorf("unknown AOF file type '%s'", info.typ)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if m.base == nil && len(m.incrs) == 0 {
+		return nil, errors.New("found an empty AOF manifest")
+	}
+	return m, nil
+}
+
+// persistAOFManifest atomically replaces the manifest on disk
+func persistAOFManifest(m *aofManifest) error {
+	dir := aofDirPath()
+	tmp := filepath.Join(dir, "temp-"+aofManifestName())
+	if err := os.WriteFile(tmp, []byte(m.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, aofManifestName())); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renames and new files in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// deleteAOFHistory removes the files replaced by a rewrite, then drops them from the manifest.
+// They are listed until they are gone so that a crash in between does not leave files behind.
+func deleteAOFHistory(m *aofManifest) {
+	if len(m.history) == 0 {
+		return
+	}
+	for _, info := range m.history {
+		if err := os.Remove(filepath.Join(aofDirPath(), info.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Failed to delete history AOF file %s: %v\n", info.name, err)
+			continue
+		}
+		fmt.Printf("Removing the history file %s\n", info.name)
+	}
+	m.history = nil
+	if err := persistAOFManifest(m); err != nil {
+		fmt.Printf("Can't persist the AOF manifest: %v\n", err)
+	}
+}
+
+// openAOFIncr starts a new incremental file and makes it the one commands are written to.
+// The caller must hold mu.
+func openAOFIncr(m *aofManifest) error {
+	if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+		return err
+	}
+	info := aofInfo{name: aofIncrName(m.incrSeq + 1), seq: m.incrSeq + 1, typ: aofTypeIncr}
+	f, err := os.OpenFile(filepath.Join(aofDirPath(), info.name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("can't open the append-only file %s: %v", info.name, err)
+	}
+	closeAOFFile()
+	m.incrs = append(m.incrs, info)
+	m.incrSeq = info.seq
+	aofState.file = f
+	aofState.selectedDB = -1
+	return nil
+}
+
+// closeAOFFile writes out and syncs the current incremental file before closing it. The caller must hold mu.
+func closeAOFFile() {
+	if aofState.file == nil {
+		return
+	}
+	flushAppendOnlyFile()
+	aofState.file.Sync()
+	aofState.file.Close()
+	aofState.file = nil
+	aofState.buf = nil
+}
+
+// feedAppendOnlyFile logs a command executed against db, selecting db first when the previous
+// command was for another one. A nil db is for commands such as EXEC that apply to none.
+// The caller must hold mu.
+func feedAppendOnlyFile(db *database, args []string) {
+	if aofState.status == aofOff || aofState.file == nil {
+		return
+	}
+	if db != nil && db.id != aofState.selectedDB {
+		aofState.buf = appendCommand(aofState.buf, []string{"SELECT", strconv.Itoa(db.id)})
+		aofState.selectedDB = db.id
+	}
+	aofState.buf = appendCommand(aofState.buf, args)
+}
+
+// flushAppendOnlyFile writes what was logged to the incremental file, syncing it right away
+// with appendfsync always. It runs before replies are sent. The caller must hold mu.
+func flushAppendOnlyFile() {
+	if len(aofState.buf) == 0 || aofState.file == nil {
+		return
+	}
+	_, err := aofState.file.Write(aofState.buf)
+	if err == nil && config.appendFsync == "always" {
+		if err = aofState.file.Sync(); err == nil {
+			defer updateFsyncedOffset(replicationState.offset)
+		}
+	}
+	if err != nil {
+		if config.appendFsync == "always" {
+			fmt.Printf("Can't recover from AOF write error when the AOF fsync policy is 'always'. Exiting... (%v)\n", err)
+			os.Exit(1)
+		}
+		// keep the data and try again later
+		if aofState.lastWriteErr == nil {
+			fmt.Printf("Error writing to the AOF file: %v\n", err)
+		}
+		aofState.lastWriteErr = err
+		return
+	}
+	if aofState.lastWriteErr != nil {
+		fmt.Println("AOF write error looks solved, Redis can write again.")
+		aofState.lastWriteErr = nil
+	}
+	aofState.buf = aofState.buf[:0]
+}
+
+// updateFsyncedOffset records that the AOF is synced up to the replication offset, waking the clients of
+// WAITAOF. The caller must hold mu.
+func updateFsyncedOffset(offset int64) {
+	if aofState.status != aofOn {
+		return
+	}
+	aofState.fsyncedOffset = max(aofState.fsyncedOffset, offset)
+	signalReplicationWaiters()
+}
+
+// StartAOFRoutine syncs the AOF every second with appendfsync everysec, retries failed writes
+// and starts the rewrites that were scheduled
+func StartAOFRoutine() {
+	ticker := time.NewTicker(1 * time.Second)
+	for range ticker.C {
+		mu.Lock()
+		flushAppendOnlyFile()
+		if aofState.rewriteScheduled && !aofState.rewriteInProgress {
+			aofState.rewriteScheduled = false
+			if err := rewriteAppendOnlyFileBackground(); err != nil {
+				fmt.Println(err)
+			}
+		}
+		f := aofState.file
+		everysec := config.appendFsync == "everysec"
+		// what was written so far is covered by the sync
+		written := replicationState.offset
+		if len(aofState.buf) > 0 {
+			written = aofState.fsyncedOffset
+		}
+		mu.Unlock()
+
+		// the sync runs without the lock, a file closed meanwhile was synced when it was closed
+		if f != nil && everysec {
+			err := f.Sync()
+			if err != nil && !errors.Is(err, os.ErrClosed) {
+				fmt.Printf("Error syncing the AOF file: %v\n", err)
+			}
+			mu.Lock()
+			if err == nil && aofState.file == f {
+				updateFsyncedOffset(written)
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// setAppendOnly applies CONFIG SET appendonly. Turning it on writes the dataset as a new base file
+// in the background, commands being logged once it is written.
+func setAppendOnly(value string) error {
+	on, err := parseYesNo(value)
+	if err != nil {
+		return err
+	}
+	if aofState.ready && on != config.appendOnly {
+		if on {
+			if err := startAppendOnly(); err != nil {
+				return err
+			}
+		} else {
+			stopAppendOnly()
+		}
+	}
+	config.appendOnly = on
+	return nil
+}
+
+// startAppendOnly turns the AOF on at runtime. The caller must hold mu.
+func startAppendOnly() error {
+	aofState.status = aofWaitRewrite
+	if aofState.rewriteInProgress {
+		aofState.rewriteScheduled = true
+		return nil
+	}
+	if err := rewriteAppendOnlyFileBackground(); err != nil {
+		aofState.status = aofOff
+		return err
+	}
+	return nil
+}
+
+// stopAppendOnly turns the AOF off, writing out what was logged first. The caller must hold mu.
+func stopAppendOnly() {
+	closeAOFFile()
+	aofState.status = aofOff
+	aofState.fsyncedOffset = -1
+	aofState.rewriteScheduled = false
+	aofState.selectedDB = -1
+}
+
+// rewriteAppendOnlyFileBackground snapshots the dataset and writes it as a new base file from another
+// goroutine. Commands keep being logged to a new incremental file, which is all that remains next to
+// the new base once it is written. The caller must hold mu.
+func rewriteAppendOnlyFileBackground() error {
+	if aofState.rewriteInProgress {
+		return errAOFRewriteInProgress
+	}
+	if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+		return fmt.Errorf("ERR Can't create the AOF directory: %v", err)
+	}
+
+	m := aofState.manifest
+	if m == nil {
+		// the files of an AOF that was turned off before the server started keep their numbers
+		loaded, err := loadAOFManifest()
+		if err != nil {
+			return fmt.Errorf("ERR Can't load the AOF manifest: %v", err)
+		}
+		m = loaded
+	}
+	if m == nil {
+		m = &aofManifest{}
+	}
+	// the incremental files up to this one are covered by the snapshot
+	keepFromSeq := m.incrSeq + 1
+	if aofState.status != aofOff {
+		if err := openAOFIncr(m); err != nil {
+			return fmt.Errorf("ERR %v", err)
+		}
+		// without a base yet the manifest is only written once the rewrite is done
+		if aofState.status == aofOn {
+			if err := persistAOFManifest(m); err != nil {
+				return fmt.Errorf("ERR Can't persist the AOF manifest: %v", err)
+			}
+		}
+	}
+	aofState.manifest = m
+
+	dbs := snapshotKeyspace()
+	dir, compress, checksum := aofDirPath(), config.rdbCompression, config.rdbChecksum
+	aofState.rewriteInProgress = true
+	fmt.Println("Background append only file rewriting started")
+
+	go func() {
+		tmp := filepath.Join(dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+		err := writeAOFBase(tmp, dbs, compress, checksum)
+
+		mu.Lock()
+		defer mu.Unlock()
+		aofState.rewriteInProgress = false
+		if err == nil {
+			err = installAOFBase(m, tmp, keepFromSeq)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			fmt.Printf("Background AOF rewrite terminated with error: %v\n", err)
+			if aofState.status == aofWaitRewrite {
+				aofState.rewriteScheduled = true
+			}
+			return
+		}
+		if aofState.status == aofWaitRewrite {
+			aofState.status = aofOn
+			// the base holds the dataset and the incremental file what came after it
+			flushAppendOnlyFile()
+			if aofState.file != nil && aofState.file.Sync() == nil {
+				updateFsyncedOffset(replicationState.offset)
+			}
+		}
+		fmt.Println("Background AOF rewrite finished successfully")
+	}()
+	return nil
+}
+
+// writeAOFBase writes the snapshot of a rewrite to a temporary file
+func writeAOFBase(path string, dbs []map[string]StoreEntry, compress, checksum bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("opening the temp file for AOF rewrite: %v", err)
+	}
+	buffered := bufio.NewWriterSize(f, 64<<10)
+	err = writeRDB(buffered, dbs, compress, checksum, true)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// installAOFBase renames the base written by a rewrite into place and records it in the manifest,
+// the previous base and the incremental files it covers becoming history. The caller must hold mu.
+func installAOFBase(m *aofManifest, tmp string, keepFromSeq int) error {
+	info := aofInfo{name: aofBaseName(m.baseSeq + 1), seq: m.baseSeq + 1, typ: aofTypeBase}
+	if err := os.Rename(tmp, filepath.Join(aofDirPath(), info.name)); err != nil {
+		return err
+	}
+
+	next := &aofManifest{base: &info, baseSeq: info.seq, incrSeq: m.incrSeq, history: m.history}
+	if m.base != nil {
+		old := *m.base
+		old.typ = aofTypeHistory
+		next.history = append(next.history, old)
+	}
+	for _, incr := range m.incrs {
+		if incr.seq >= keepFromSeq && aofState.status != aofOff {
+			next.incrs = append(next.incrs, incr)
+		} else {
+			incr.typ = aofTypeHistory
+			next.history = append(next.history, incr)
+		}
+	}
+	if err := persistAOFManifest(next); err != nil {
+		return fmt.Errorf("can't persist the AOF manifest: %v", err)
+	}
+	deleteAOFHistory(next)
+	*m = *next
+	return nil
+}
+
+// handleBgrewriteAOF compacts the AOF into a new base file written in the background
+func handleBgrewriteAOF(args ...BulkString) ([]byte, error) {
+	if aofState.rewriteInProgress {
+		return errorReply(errAOFRewriteInProgress.Error())
+	}
+	if err := rewriteAppendOnlyFileBackground(); err != nil {
+		return errorReply(err.Error())
+	}
+	return []byte("+Background append only file rewriting started\r\n"), nil
+}
+
+// LoadDataFromDisk loads the dataset at startup, from the AOF when appendonly is on and from the RDB
+// file otherwise, and opens the AOF to log the commands that follow
+func LoadDataFromDisk() error {
+	if !config.appendOnly {
+		if err := LoadRDB(); err != nil {
+			return err
+		}
+	} else if err := loadAppendOnlyFiles(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	aofState.ready = true
+	if !config.appendOnly {
+		return nil
+	}
+	return openAppendOnlyOnStart()
+}
+
+// openAppendOnlyOnStart appends to the last incremental file, creating the files of a new AOF
+// from the loaded dataset when there is none yet. The caller must hold mu.
+func openAppendOnlyOnStart() error {
+	m := aofState.manifest
+	if m == nil {
+		m = &aofManifest{}
+	}
+	aofState.status = aofOn
+
+	if m.base == nil && len(m.incrs) == 0 {
+		info := aofInfo{name: aofBaseName(1), seq: 1, typ: aofTypeBase}
+		if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+			return err
+		}
+		path := filepath.Join(aofDirPath(), info.name)
+		if err := writeAOFBase(path, snapshotKeyspace(), config.rdbCompression, config.rdbChecksum); err != nil {
+			return err
+		}
+		fmt.Printf("Creating AOF base file %s on server start\n", info.name)
+		m.base, m.baseSeq = &info, 1
+	}
+
+	if len(m.incrs) == 0 {
+		if err := openAOFIncr(m); err != nil {
+			return err
+		}
+		fmt.Printf("Creating AOF incr file %s on server start\n", m.incrs[len(m.incrs)-1].name)
+	} else {
+		last := m.incrs[len(m.incrs)-1]
+		f, err := os.OpenFile(filepath.Join(aofDirPath(), last.name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("can't open the append-only file %s: %v", last.name, err)
+		}
+		aofState.file = f
+		aofState.selectedDB = -1
+	}
+	aofState.manifest = m
+	aofState.fsyncedOffset = replicationState.offset
+	return persistAOFManifest(m)
+}
+
+// loadAppendOnlyFiles replays the base and incremental files listed in the manifest
+func loadAppendOnlyFiles() error {
+	m, err := loadAOFManifest()
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return nil
+	}
+
+	start := time.Now()
+	files := m.incrs
+	if m.base != nil {
+		files = append([]aofInfo{*m.base}, files...)
+	}
+	for i, info := range files {
+		// only the last file can have been cut short by a crash
+		last := i == len(files)-1
+		if err := loadAppendOnlyFile(filepath.Join(aofDirPath(), info.name), last && config.aofLoadTruncated); err != nil {
+			return err
+		}
+		fmt.Printf("DB loaded from %s file %s\n", map[string]string{aofTypeBase: "base", aofTypeIncr: "incr"}[info.typ], info.name)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	aofState.manifest = m
+	deleteAOFHistory(m)
+	fmt.Printf("DB loaded from append only file: %.3f seconds\n", time.Since(start).Seconds())
+	return nil
+}
+
+var errAOFFormat = errors.New("bad file format reading the append only file")
+
+// countingReader counts the bytes read through it, to know where an RDB preamble ends
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// loadAppendOnlyFile replays one file of the AOF through the dispatcher, as a client would send it.
+// An RDB preamble is loaded as the dataset first. With allowTruncated a file ending in the middle of
+// a command is cut back to the last complete one, and an unterminated transaction is dropped.
+func loadAppendOnlyFile(path string, allowTruncated bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64<<10)
+	var offset int64
+	if head, _ := r.Peek(5); string(head) == "REDIS" {
+		counter := &countingReader{r: r}
+		dbs, err := readRDB(counter, config.rdbChecksum)
+		if err != nil {
+			return fmt.Errorf("error reading the RDB preamble of the AOF file %s: %v", filepath.Base(path), err)
+		}
+		mu.Lock()
+		loadDatabases(dbs)
+		mu.Unlock()
+		offset = counter.n
+	}
+
+	loader := NewClient()
+	loader.aofLoader = true
+	defer loader.Close()
+	// where the file is cut when it ends inside a transaction
+	var validBeforeMulti int64
+	for {
+		frame, name, err := readCommand(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			if !allowTruncated {
+				return fmt.Errorf("unexpected end of file reading the append only file %s. You can: "+
+					"1) Make a backup of your AOF file, then use ./redis-check-aof --fix <filename.manifest>. "+
+					"2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server.",
+					filepath.Base(path))
+			}
+			fmt.Printf("!!! Warning: short read while loading the AOF file %s!!!\n", filepath.Base(path))
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%v %s", errAOFFormat, filepath.Base(path))
+		}
+		if _, ok := commands[strings.ToUpper(name)]; !ok {
+			return fmt.Errorf("unknown command '%s' reading the append only file %s", name, filepath.Base(path))
+		}
+
+		if loader.multi == nil && strings.EqualFold(name, "MULTI") {
+			validBeforeMulti = offset
+		}
+		if _, err := loader.Execute(frame); err != nil {
+			return fmt.Errorf("%v %s", errAOFFormat, filepath.Base(path))
+		}
+		offset += int64(len(frame))
+	}
+
+	if loader.multi != nil {
+		if !allowTruncated {
+			return fmt.Errorf("unexpected end of file reading the append only file %s, an incomplete MULTI/EXEC transaction was found", filepath.Base(path))
+		}
+		fmt.Println("Revert incomplete MULTI/EXEC transaction in AOF file")
+		loader.multi = nil
+		offset = validBeforeMulti
+	}
+
+	if info, err := f.Stat(); err == nil && info.Size() > offset {
+		if err := os.Truncate(path, offset); err != nil {
+			return fmt.Errorf("error truncating the AOF file %s: %v", filepath.Base(path), err)
+		}
+		fmt.Printf("AOF %s loaded anyway because aof-load-truncated is enabled\n", filepath.Base(path))
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package resp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withAOF runs the test with appendonly on in a temporary directory, as if the server started with it
+func withAOF(t *testing.T) {
+	t.Helper()
+	mu.Lock()
+	oldDir := config.dir
+	config.dir = t.TempDir()
+	config.appendOnly = true
+	aofState.ready = true
+	err := openAppendOnlyOnStart()
+	mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		waitAOFRewrite(t)
+		mu.Lock()
+		defer mu.Unlock()
+		stopAppendOnly()
+		aofState.manifest = nil
+		aofState.ready = false
+		config.appendOnly = false
+		config.dir = oldDir
+	})
+}
+
+func waitAOFRewrite(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.RLock()
+		done := !aofState.rewriteInProgress
+		mu.RUnlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("BGREWRITEAOF did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func lastIncrPath() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	m := aofState.manifest
+	return filepath.Join(aofDirPath(), m.incrs[len(m.incrs)-1].name)
+}
+
+// reloadAOF stops logging, empties the dataset and loads it back from the AOF files
+func reloadAOF(t *testing.T) {
+	t.Helper()
+	mu.Lock()
+	stopAppendOnly()
+	for _, db := range databases {
+		db.flush()
+	}
+	aofState.manifest = nil
+	mu.Unlock()
+
+	if err := loadAppendOnlyFiles(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if err := openAppendOnlyOnStart(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAll(client *Client, reads [][]string) []string {
+	results := make([]string, len(reads))
+	for i, args := range reads {
+		result, _ := client.Execute(respCommand(args...))
+		results[i] = string(result)
+	}
+	return results
+}
+
+func TestAOFReplay(t *testing.T) {
+	runCommandCases(t, []commandCase{{"flush", []string{"FLUSHALL"}, "+OK\r\n"}})
+	withAOF(t)
+
+	runCommandCases(t, []commandCase{
+		{"set", []string{"SET", "aof:string", "hello"}, "+OK\r\n"},
+		{"set px", []string{"SET", "aof:px", "v", "PX", "100000"}, "+OK\r\n"},
+		{"read only", []string{"GET", "aof:string"}, "$5\r\nhello\r\n"},
+		{"no change", []string{"DEL", "aof:missing"}, ":0\r\n"},
+		{"bitmap", []string{"SETBIT", "aof:bits", "7", "1"}, ":0\r\n"},
+		{"hll", []string{"PFADD", "aof:hll", "a", "b", "c"}, ":1\r\n"},
+		{"geo", []string{"GEOADD", "aof:geo", "13.361389", "38.115556", "Palermo"}, ":1\r\n"},
+		{"stream", []string{"XADD", "aof:stream", "1-1", "f", "v"}, "$3\r\n1-1\r\n"},
+		{"stream seq", []string{"XADD", "aof:stream", "1-*", "f", "w"}, "$3\r\n1-2\r\n"},
+		{"stream trim", []string{"XADD", "aof:stream", "MAXLEN", "~", "10", "2-0", "f", "x"}, "$3\r\n2-0\r\n"},
+		{"group", []string{"XGROUP", "CREATE", "aof:stream", "g", "0"}, "+OK\r\n"},
+		{"deliver", []string{"XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "aof:stream", ">"},
+			"*1\r\n*2\r\n$10\r\naof:stream\r\n*2\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nf\r\n$1\r\nw\r\n"},
+		{"ack", []string{"XACK", "aof:stream", "g", "1-1"}, ":1\r\n"},
+		{"claim", []string{"XCLAIM", "aof:stream", "g", "bob", "0", "1-2", "JUSTID"}, "*1\r\n$3\r\n1-2\r\n"},
+		{"select", []string{"SELECT", "3"}, "+OK\r\n"},
+		{"other db", []string{"SET", "aof:db3", "three"}, "+OK\r\n"},
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"queued set", []string{"SET", "aof:tx", "1"}, "+QUEUED\r\n"},
+		{"queued del", []string{"DEL", "aof:db3"}, "+QUEUED\r\n"},
+		{"exec", []string{"EXEC"}, "*2\r\n+OK\r\n:1\r\n"},
+		{"read only multi", []string{"MULTI"}, "+OK\r\n"},
+		{"queued get", []string{"GET", "aof:tx"}, "+QUEUED\r\n"},
+		{"read only exec", []string{"EXEC"}, "*1\r\n$1\r\n1\r\n"},
+		{"back", []string{"SELECT", "0"}, "+OK\r\n"},
+	})
+
+	data, err := os.ReadFile(lastIncrPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	for _, want := range []string{
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*5\r\n$3\r\nSET\r\n$10\r\naof:string\r\n$5\r\nhello\r\n$4\r\nPXAT\r\n",
+		"$4\r\nXADD\r\n$10\r\naof:stream\r\n$3\r\n1-2\r\n",
+		"$6\r\nMAXLEN\r\n$1\r\n=\r\n$1\r\n3\r\n$3\r\n2-0\r\n",
+		"$6\r\nXCLAIM\r\n$10\r\naof:stream\r\n$1\r\ng\r\n$5\r\nalice\r\n$1\r\n0\r\n$3\r\n1-1\r\n",
+		"$6\r\nSELECT\r\n$1\r\n3\r\n",
+		"*1\r\n$5\r\nMULTI\r\n*5\r\n$3\r\nSET\r\n$6\r\naof:tx\r\n$1\r\n1\r\n$4\r\nPXAT\r\n",
+		"*1\r\n$4\r\nEXEC\r\n",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("expected the AOF to contain %q:\n%q", want, log)
+		}
+	}
+	for _, unwanted := range []string{"$3\r\nGET\r\n", "aof:missing", "XREADGROUP", "$1\r\n~\r\n"} {
+		if strings.Contains(log, unwanted) {
+			t.Errorf("expected the AOF not to contain %q:\n%q", unwanted, log)
+		}
+	}
+	if strings.Count(log, "MULTI") != 1 {
+		t.Errorf("expected only the transaction with writes to be logged:\n%q", log)
+	}
+
+	reads := [][]string{
+		{"GET", "aof:string"},
+		{"GET", "aof:px"},
+		{"GETBIT", "aof:bits", "7"},
+		{"PFCOUNT", "aof:hll"},
+		{"GEOPOS", "aof:geo", "Palermo"},
+		{"XRANGE", "aof:stream", "-", "+"},
+		{"XINFO", "GROUPS", "aof:stream"},
+		{"XPENDING", "aof:stream", "g"},
+		{"DBSIZE"},
+		{"SELECT", "3"},
+		{"GET", "aof:tx"},
+		{"GET", "aof:db3"},
+		{"SELECT", "0"},
+	}
+	client := NewClient()
+	before := readAll(client, reads)
+
+	reloadAOF(t)
+	if after := readAll(client, reads); strings.Join(after, "") != strings.Join(before, "") {
+		t.Errorf("expected the same dataset after replaying the AOF:\n%q\n%q", before, after)
+	}
+
+	// a rewrite compacts everything into a new base, later writes going to a new incremental file
+	runCommandCases(t, []commandCase{
+		{"bgrewriteaof", []string{"BGREWRITEAOF"}, "+Background append only file rewriting started\r\n"},
+		{"served during rewrite", []string{"SET", "aof:after", "1"}, "+OK\r\n"},
+	})
+	waitAOFRewrite(t)
+	runCommandCases(t, []commandCase{{"after rewrite", []string{"SET", "aof:string", "changed"}, "+OK\r\n"}})
+
+	manifest, err := os.ReadFile(filepath.Join(aofDirPath(), aofManifestName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "file appendonly.aof.2.base.rdb seq 2 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n"
+	if string(manifest) != expected {
+		t.Errorf("expected manifest %q, but got %q", expected, string(manifest))
+	}
+	for _, name := range []string{"appendonly.aof.1.base.rdb", "appendonly.aof.1.incr.aof"} {
+		if _, err := os.Stat(filepath.Join(aofDirPath(), name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted after the rewrite", name)
+		}
+	}
+
+	reads = append(reads, []string{"GET", "aof:after"})
+	before = readAll(client, reads)
+	reloadAOF(t)
+	if after := readAll(client, reads); strings.Join(after, "") != strings.Join(before, "") {
+		t.Errorf("expected the same dataset after replaying the rewritten AOF:\n%q\n%q", before, after)
+	}
+}
+
+func TestAOFEmptyFlush(t *testing.T) {
+	withAOF(t)
+	// the second flushes find the databases empty, they are logged all the same
+	runCommandCases(t, []commandCase{
+		{"flushall", []string{"FLUSHALL"}, "+OK\r\n"},
+		{"flushall empty", []string{"FLUSHALL"}, "+OK\r\n"},
+		{"flushdb empty", []string{"FLUSHDB"}, "+OK\r\n"},
+	})
+	data, err := os.ReadFile(lastIncrPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, db := strings.Count(string(data), "FLUSHALL"), strings.Count(string(data), "FLUSHDB"); all != 2 || db != 1 {
+		t.Errorf("expected every flush in the AOF, got %q", data)
+	}
+}
+
+func TestAOFTruncated(t *testing.T) {
+	runCommandCases(t, []commandCase{{"flush", []string{"FLUSHALL"}, "+OK\r\n"}})
+	withAOF(t)
+	runCommandCases(t, []commandCase{
+		{"set", []string{"SET", "trunc:a", "1"}, "+OK\r\n"},
+		{"set", []string{"SET", "trunc:b", "2"}, "+OK\r\n"},
+	})
+
+	path := lastIncrPath()
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		tail string
+	}{
+		{"cut inside a command", "*3\r\n$3\r\nSET\r\n$7\r\ntrunc:c\r\n$1\r"},
+		{"unterminated transaction", "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$7\r\ntrunc:c\r\n$1\r\n3\r\n"},
+	}
+	for _, test := range tests {
+		reload := func() error {
+			mu.Lock()
+			stopAppendOnly()
+			for _, db := range databases {
+				db.flush()
+			}
+			mu.Unlock()
+			if err := os.WriteFile(path, append(append([]byte(nil), valid...), test.tail...), 0644); err != nil {
+				t.Fatal(err)
+			}
+			return loadAppendOnlyFiles()
+		}
+
+		config.aofLoadTruncated = false
+		if err := reload(); err == nil || !strings.Contains(err.Error(), "unexpected end of file") {
+			t.Errorf("%s: expected an unexpected end of file error, but got %v", test.name, err)
+		}
+
+		config.aofLoadTruncated = true
+		if err := reload(); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != string(valid) {
+			t.Errorf("%s: expected the file to be cut back to its valid part, but got %q", test.name, string(data))
+		}
+		runCommandCases(t, []commandCase{
+			{test.name, []string{"GET", "trunc:b"}, "$1\r\n2\r\n"},
+			{test.name, []string{"GET", "trunc:c"}, "$-1\r\n"},
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err := openAppendOnlyOnStart(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAOFConfig(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"fsync", []string{"CONFIG", "SET", "appendfsync", "always"}, "+OK\r\n"},
+		{"get fsync", []string{"CONFIG", "GET", "appendfsync"}, "*2\r\n$11\r\nappendfsync\r\n$6\r\nalways\r\n"},
+		{"bad fsync", []string{"CONFIG", "SET", "appendfsync", "sometimes"},
+			"-ERR CONFIG SET failed (possibly related to argument 'appendfsync') - argument(s) must be one of the following: always, everysec, no\r\n"},
+		{"restore fsync", []string{"CONFIG", "SET", "appendfsync", "everysec"}, "+OK\r\n"},
+		{"immutable", []string{"CONFIG", "SET", "appendfilename", "other.aof"},
+			"-ERR CONFIG SET failed (possibly related to argument 'appendfilename') - can't set immutable config\r\n"},
+	})
+}
+
+func TestAOFEnabledAtRuntime(t *testing.T) {
+	mu.Lock()
+	oldDir := config.dir
+	config.dir = t.TempDir()
+	aofState.ready = true
+	mu.Unlock()
+	defer func() {
+		waitAOFRewrite(t)
+		mu.Lock()
+		defer mu.Unlock()
+		stopAppendOnly()
+		aofState.manifest = nil
+		aofState.ready = false
+		config.appendOnly = false
+		config.dir = oldDir
+	}()
+
+	// the dataset from before is in the base the rewrite writes, what follows in the incremental file
+	runCommandCases(t, []commandCase{
+		{"flush", []string{"FLUSHALL"}, "+OK\r\n"},
+		{"before", []string{"SET", "runtime:before", "1"}, "+OK\r\n"},
+		{"enable", []string{"CONFIG", "SET", "appendonly", "yes"}, "+OK\r\n"},
+		{"during", []string{"SET", "runtime:during", "2"}, "+OK\r\n"},
+	})
+	waitAOFRewrite(t)
+	runCommandCases(t, []commandCase{{"after", []string{"SET", "runtime:after", "3"}, "+OK\r\n"}})
+
+	manifest, err := os.ReadFile(filepath.Join(aofDirPath(), aofManifestName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "file appendonly.aof.1.base.rdb seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n"
+	if string(manifest) != expected {
+		t.Errorf("expected manifest %q, but got %q", expected, string(manifest))
+	}
+
+	reloadAOF(t)
+	runCommandCases(t, []commandCase{
+		{"before loaded", []string{"GET", "runtime:before"}, "$1\r\n1\r\n"},
+		{"during loaded", []string{"GET", "runtime:during"}, "$1\r\n2\r\n"},
+		{"after loaded", []string{"GET", "runtime:after"}, "$1\r\n3\r\n"},
+		{"disable", []string{"CONFIG", "SET", "appendonly", "no"}, "+OK\r\n"},
+		{"get", []string{"CONFIG", "GET", "appendonly"}, "*2\r\n$10\r\nappendonly\r\n$2\r\nno\r\n"},
+	})
+}
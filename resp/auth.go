@@ -0,0 +1,181 @@
+package resp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+)
+
+// noAuthCommands can be sent before the connection authenticates
+var noAuthCommands = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+	"QUIT":  true,
+	"RESET": true,
+}
+
+const (
+	wrongPassError = "WRONGPASS invalid username-password pair or user is disabled."
+	noAuthError    = "NOAUTH Authentication required."
+)
+
+// AUTH failures are answered after a delay doubling with each failure of the same host, from
+// authFailureDelay up to maxAuthFailureDelay. A host is forgiven authFailureWindow after its last failure.
+var (
+	authFailureDelay    = 100 * time.Millisecond
+	maxAuthFailureDelay = 5 * time.Second
+	authFailureWindow   = time.Minute
+)
+
+// authThrottle is the recent AUTH failures of a host. The failures of a host are answered one after the
+// other, next being when the last one queued is, so opening more connections doesn't speed up guessing.
+type authThrottle struct {
+	failures int
+	last     time.Time
+	next     time.Time
+}
+
+// delay is how long the host waits after its last failure
+func (t *authThrottle) delay() time.Duration {
+	return min(authFailureDelay<<min(t.failures-1, 16), maxAuthFailureDelay)
+}
+
+// authFailures counts the failed authentications since startup and authThrottles holds the recent
+// ones by host, both guarded by mu
+var (
+	authFailures  int64
+	authThrottles = make(map[string]*authThrottle)
+)
+
+// authRequired reports whether the client must authenticate before running commands, which it does
+// unless the default user it starts as has no password. The caller must hold mu.
+func (c *Client) authRequired() bool {
+	return !c.authenticated && defaultUser.authRequired()
+}
+
+// setRequirepass sets the password of the default user, which needs none when it is empty
+func setRequirepass(value string) error {
+	config.requirepass = value
+	defaultUser.passwords = nil
+	defaultUser.nopass = value == ""
+	if value != "" {
+		defaultUser.passwords = []string{passwordHash(value)}
+	}
+	return nil
+}
+
+// passwordHash is how passwords are stored and compared: the hex SHA-256 of the password, so a comparison
+// takes the same time whatever the length of the password sent
+func passwordHash(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPassword reports whether password is one of the user's, comparing it with every password in
+// constant time. The caller must hold mu.
+func (u *aclUser) checkPassword(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	sent := []byte(passwordHash(password))
+	match := false
+	for _, hash := range u.passwords {
+		if subtle.ConstantTimeCompare(sent, []byte(hash)) == 1 {
+			match = true
+		}
+	}
+	return match
+}
+
+// authenticate checks the credentials sent with AUTH or HELLO, switching the client to the user when
+// they match. A failure is counted, logged, and only answered once the delay of the host of the client
+// passed after its previous failure, at most maxAuthFailureDelay later. The correct credentials are
+// never delayed. The caller must hold mu and be running a command.
+func (c *Client) authenticate(username, password string) bool {
+	host := c.remoteHost()
+	if u := aclUsers[username]; u != nil && u.checkPassword(password) {
+		c.user, c.authenticated = u, true
+		delete(authThrottles, host)
+		return true
+	}
+
+	authFailures++
+	addACLLogEntry(c, &aclDenial{reason: aclDeniedAuth, object: "AUTH", username: username}, "toplevel")
+	if host == "" {
+		return false
+	}
+	now := time.Now()
+	throttle := authThrottles[host]
+	if throttle == nil || now.Sub(throttle.last) > authFailureWindow {
+		expireAuthThrottles(now)
+		throttle = &authThrottle{}
+		authThrottles[host] = throttle
+	}
+	throttle.failures++
+	throttle.last = now
+	// the failure is answered after the ones of the host queued before it, the queue being capped
+	reply := now
+	if throttle.next.After(now) {
+		reply = throttle.next
+	}
+	reply = reply.Add(throttle.delay())
+	if latest := now.Add(maxAuthFailureDelay); reply.After(latest) {
+		reply = latest
+	}
+	throttle.next = reply
+	// EXEC can't wait, the failure is still counted
+	if !denyBlocking {
+		delay := reply.Sub(now)
+		fmt.Printf("AUTH failed for client id=%d from %s, replying in %v\n", c.id, host, delay)
+		withoutLock(func() { time.Sleep(delay) })
+	}
+	return false
+}
+
+// expireAuthThrottles forgets the hosts without a failure for authFailureWindow. The caller must hold mu.
+func expireAuthThrottles(now time.Time) {
+	for host, throttle := range authThrottles {
+		if now.Sub(throttle.last) > authFailureWindow {
+			delete(authThrottles, host)
+		}
+	}
+}
+
+// remoteHost is the address the client connects from without its port, the socket path for a Unix socket
+// and empty without a connection
+func (c *Client) remoteHost() string {
+	addr, _ := c.addrs()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// handleAuth implements AUTH [username] password, the username being default when left out
+func handleAuth(c *Client, args ...BulkString) ([]byte, error) {
+	if len(args) > 3 {
+		return errorReply(errSyntax.Error())
+	}
+	user, password := "default", *args[1].Value
+	if len(args) == 3 {
+		user, password = *args[1].Value, *args[2].Value
+	} else if defaultUser.nopass {
+		return errorReply("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+	if !c.authenticate(user, password) {
+		return errorReply(wrongPassError)
+	}
+	return []byte("+OK\r\n"), nil
+}
+
+// handleQuit replies and has the connection closed once the reply is written
+func handleQuit(c *Client, args ...BulkString) ([]byte, error) {
+	c.closeAfterReply = true
+	return []byte("+OK\r\n"), nil
+}
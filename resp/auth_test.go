@@ -0,0 +1,185 @@
+package resp
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fastAuthFailures shortens the delay of failed authentications for the test
+func fastAuthFailures(t *testing.T, delay time.Duration) {
+	t.Helper()
+	savedDelay, savedMax := authFailureDelay, maxAuthFailureDelay
+	authFailureDelay, maxAuthFailureDelay = delay, 100*delay
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		authFailureDelay, maxAuthFailureDelay = savedDelay, savedMax
+		clear(authThrottles)
+	})
+}
+
+func TestAuth(t *testing.T) {
+	fastAuthFailures(t, time.Millisecond)
+	runCommandCases(t, []commandCase{
+		{"no password", []string{"AUTH", "secret"}, "-ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?\r\n"},
+		{"default user without password", []string{"AUTH", "default", "anything"}, "+OK\r\n"},
+	})
+	before, _ := subscriber(t)
+
+	setConfig(t, "requirepass", "secret")
+	mu.RLock()
+	failures := authFailures
+	mu.RUnlock()
+	c, _ := subscriber(t)
+	runClientCommandCases(t, c, []commandCase{
+		{"get", []string{"GET", "auth:key"}, "-NOAUTH Authentication required.\r\n"},
+		{"ping", []string{"PING"}, "-NOAUTH Authentication required.\r\n"},
+		{"unknown", []string{"NOSUCHCOMMAND"}, "-ERR unknown command 'NOSUCHCOMMAND', with args beginning with: \r\n"},
+		{"hello", []string{"HELLO", "2"}, "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n"},
+		{"wrong password", []string{"AUTH", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{"wrong user", []string{"AUTH", "someone", "secret"}, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{"too many arguments", []string{"AUTH", "default", "secret", "extra"}, "-ERR syntax error\r\n"},
+		{"auth", []string{"AUTH", "secret"}, "+OK\r\n"},
+		{"get authenticated", []string{"GET", "auth:key"}, "$-1\r\n"},
+		{"reset", []string{"RESET"}, "+RESET\r\n"},
+		{"get after reset", []string{"GET", "auth:key"}, "-NOAUTH Authentication required.\r\n"},
+		{"auth default", []string{"AUTH", "default", "secret"}, "+OK\r\n"},
+		{"get again", []string{"GET", "auth:key"}, "$-1\r\n"},
+	})
+	mu.RLock()
+	if authFailures != failures+2 {
+		t.Errorf("expected 2 more failures, got %d", authFailures-failures)
+	}
+	mu.RUnlock()
+
+	// clients connected before the password was set keep going, so do the ones without a connection
+	runClientCommandCases(t, before, []commandCase{{"connected before", []string{"GET", "auth:key"}, "$-1\r\n"}})
+	runCommandCases(t, []commandCase{{"no connection", []string{"GET", "auth:key"}, "$-1\r\n"}})
+}
+
+func TestHelloAuth(t *testing.T) {
+	fastAuthFailures(t, time.Millisecond)
+	setConfig(t, "requirepass", "secret")
+	c, r := subscriber(t)
+	runClientCommandCases(t, c, []commandCase{
+		{"wrong password", []string{"HELLO", "3", "AUTH", "default", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{"missing password", []string{"HELLO", "3", "AUTH", "default"}, "-ERR Syntax error in HELLO option 'AUTH'\r\n"},
+	})
+	helloResp3(t, c, r, "AUTH", "default", "secret", "SETNAME", "authed")
+	if c.name != "authed" {
+		t.Errorf("expected the name to be set, got %q", c.name)
+	}
+	runClientCommandCases(t, c, []commandCase{{"get", []string{"GET", "auth:key"}, ""}})
+	expectOutput(t, r, "$-1\r\n")
+}
+
+func TestAuthFailureDelay(t *testing.T) {
+	fastAuthFailures(t, 20*time.Millisecond)
+	setConfig(t, "requirepass", "secret")
+	c, _ := subscriber(t)
+	for i, minimum := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond} {
+		start := time.Now()
+		runClientCommandCases(t, c, []commandCase{
+			{"wrong password", []string{"AUTH", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		})
+		if elapsed := time.Since(start); elapsed < minimum {
+			t.Errorf("failure %d: expected a delay of at least %v, got %v", i+1, minimum, elapsed)
+		}
+	}
+
+	// other clients run meanwhile
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Execute(respCommand("AUTH", "wrong"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	runCommandCases(t, []commandCase{{"get", []string{"GET", "auth:key"}, "$-1\r\n"}})
+	select {
+	case <-done:
+		t.Error("expected the failure to be delayed")
+	default:
+	}
+	<-done
+
+	// a success forgives the host
+	runClientCommandCases(t, c, []commandCase{{"auth", []string{"AUTH", "secret"}, "+OK\r\n"}})
+	start := time.Now()
+	runClientCommandCases(t, c, []commandCase{
+		{"wrong password", []string{"AUTH", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+	})
+	if elapsed := time.Since(start); elapsed > 80*time.Millisecond {
+		t.Errorf("expected the delay to start over, got %v", elapsed)
+	}
+}
+
+// authFailuresInParallel sends n wrong passwords from new connections at once, returning how long the
+// slowest reply took once they are all answered
+func authFailuresInParallel(t *testing.T, n int) <-chan time.Duration {
+	t.Helper()
+	slowest := make(chan time.Duration, 1)
+	var wg sync.WaitGroup
+	var longest time.Duration
+	var lock sync.Mutex
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		c, _ := subscriber(t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Execute(respCommand("AUTH", "wrong"))
+			lock.Lock()
+			longest = max(longest, time.Since(start))
+			lock.Unlock()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		slowest <- longest
+	}()
+	return slowest
+}
+
+// the failures of a host are answered one after the other whatever the connection, without holding
+// back the correct password or delaying a failure more than maxAuthFailureDelay
+func TestAuthFailureDelayPerHost(t *testing.T) {
+	fastAuthFailures(t, 40*time.Millisecond)
+	setConfig(t, "requirepass", "secret")
+
+	// the delays of 40, 80 and 160ms add up
+	slowest := authFailuresInParallel(t, 3)
+	time.Sleep(10 * time.Millisecond)
+	c, _ := subscriber(t)
+	start := time.Now()
+	runClientCommandCases(t, c, []commandCase{{"auth", []string{"AUTH", "secret"}, "+OK\r\n"}})
+	if elapsed := time.Since(start); elapsed > 30*time.Millisecond {
+		t.Errorf("expected the correct password not to wait for the failures, got %v", elapsed)
+	}
+	if elapsed := <-slowest; elapsed < 280*time.Millisecond {
+		t.Errorf("expected the failures to be answered one after the other, the last after %v", elapsed)
+	}
+
+	// no failure waits longer than maxAuthFailureDelay
+	mu.Lock()
+	maxAuthFailureDelay = 120 * time.Millisecond
+	clear(authThrottles)
+	mu.Unlock()
+	if elapsed := <-authFailuresInParallel(t, 3); elapsed > 220*time.Millisecond {
+		t.Errorf("expected the queued failures to be answered within the cap, the last after %v", elapsed)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	setConfig(t, "requirepass", "secret")
+	c, r := subscriber(t)
+	helloResp3(t, c, r, "AUTH", "default", "secret")
+	runClientCommandCases(t, c, []commandCase{{"quit", []string{"QUIT"}, ""}})
+	if !c.CloseAfterReply() {
+		t.Fatal("expected the connection to be closed after QUIT")
+	}
+	expectOutput(t, r, "+OK\r\n")
+
+	unauthenticated, _ := subscriber(t)
+	runClientCommandCases(t, unauthenticated, []commandCase{{"quit", []string{"QUIT"}, "+OK\r\n"}})
+}
@@ -0,0 +1,67 @@
+package resp
+
+// replBacklog keeps the end of the replication stream in a circular buffer, so a replica that lost
+// its link can get the part it missed instead of a new snapshot. Offsets are those of the stream,
+// the first byte of the stream having offset 1 as in Redis.
+type replBacklog struct {
+	buf []byte
+	// idx is where the next byte is written
+	idx int
+	// histlen is how many bytes of buf hold data
+	histlen int
+	// start is the offset of the oldest byte held
+	start int64
+}
+
+// newReplBacklog returns an empty backlog of size bytes whose first byte will have offset start
+func newReplBacklog(size int, start int64) *replBacklog {
+	return &replBacklog{buf: make([]byte, size), start: start}
+}
+
+// feed appends p, dropping the oldest bytes once the buffer is full
+func (b *replBacklog) feed(p []byte) {
+	size := len(b.buf)
+	if len(p) > size {
+		b.start += int64(len(p) - size)
+		p = p[len(p)-size:]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % size
+		p = p[n:]
+		b.histlen += n
+	}
+	if b.histlen > size {
+		b.start += int64(b.histlen - size)
+		b.histlen = size
+	}
+}
+
+// since returns the bytes from offset to the end of the stream, reporting false when offset is not
+// in the backlog anymore or not yet
+func (b *replBacklog) since(offset int64) ([]byte, bool) {
+	if offset < b.start || offset > b.start+int64(b.histlen) {
+		return nil, false
+	}
+	skip := int(offset - b.start)
+	n := b.histlen - skip
+	first := (b.idx - b.histlen + skip + len(b.buf)) % len(b.buf)
+	out := make([]byte, 0, n)
+	if first+n <= len(b.buf) {
+		return append(out, b.buf[first:first+n]...), true
+	}
+	out = append(out, b.buf[first:]...)
+	return append(out, b.buf[:n-(len(b.buf)-first)]...), true
+}
+
+// resize changes the size of the backlog, keeping as much of the end of the stream as fits
+func (b *replBacklog) resize(size int) {
+	data, _ := b.since(b.start)
+	if len(data) > size {
+		b.start += int64(len(data) - size)
+		data = data[len(data)-size:]
+	}
+	b.buf = make([]byte, size)
+	b.idx = copy(b.buf, data) % size
+	b.histlen = len(data)
+}
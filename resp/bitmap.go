@@ -0,0 +1,669 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// protoMaxBulkLen is the largest string a bit offset may address, the 512MB Redis default
+const protoMaxBulkLen = 512 * 1024 * 1024
+
+var errBitOffset = errors.New("ERR bit offset is not an integer or out of range")
+
+// lookupString returns the string stored at key. The caller must hold mu.
+func lookupString(key string) (value string, exists bool, err error) {
+	entry, ok := lookupEntry(key)
+	if !ok {
+		return "", false, nil
+	}
+	value, ok = entry.value.(string)
+	if !ok {
+		return "", false, errWrongType
+	}
+	return value, true, nil
+}
+
+// storeString replaces the string at key while keeping its expiration. The caller must hold mu.
+func storeString(key string, value []byte) {
+	entry, _ := lookupEntry(key)
+	setKey(key, StoreEntry{value: string(value), expiration: entry.expiration})
+}
+
+// parseBitOffset parses a bit offset; with bitWidth > 0 the "#N" form addresses the Nth field of that width
+func parseBitOffset(raw string, bitWidth int) (uint64, error) {
+	useHash := bitWidth > 0 && strings.HasPrefix(raw, "#")
+	if useHash {
+		raw = raw[1:]
+	}
+	offset, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, errBitOffset
+	}
+	if useHash {
+		offset *= int64(bitWidth)
+	}
+	if offset < 0 || offset>>3 >= protoMaxBulkLen {
+		return 0, errBitOffset
+	}
+	return uint64(offset), nil
+}
+
+// growTo returns b extended with zero bytes so that it is at least n bytes long
+func growTo(b []byte, n uint64) []byte {
+	if uint64(len(b)) >= n {
+		return b
+	}
+	return append(b, make([]byte, n-uint64(len(b)))...)
+}
+
+// getBit reads bit offset of b, where bit 0 is the most significant bit of the first byte
+func getBit(b []byte, offset uint64) int {
+	byteIdx := offset >> 3
+	if byteIdx >= uint64(len(b)) {
+		return 0
+	}
+	return int(b[byteIdx]>>(7-offset&7)) & 1
+}
+
+func setBit(b []byte, offset uint64, on int) {
+	mask := byte(1) << (7 - offset&7)
+	if on == 1 {
+		b[offset>>3] |= mask
+	} else {
+		b[offset>>3] &^= mask
+	}
+}
+
+// handleSetBit sets or clears one bit of a string, growing it as needed, and returns the previous bit
+func handleSetBit(args ...BulkString) ([]byte, error) {
+	if len(args) != 4 {
+		return wrongArgsReply("setbit")
+	}
+	offset, err := parseBitOffset(*args[2].Value, 0)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	on, err := strconv.ParseInt(*args[3].Value, 10, 64)
+	if err != nil || on&^1 != 0 {
+		return errorReply("ERR bit is not an integer or out of range")
+	}
+
+	key := *args[1].Value
+	value, _, err := lookupString(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	b := growTo([]byte(value), offset>>3+1)
+	old := getBit(b, offset)
+	setBit(b, offset, int(on))
+	storeString(key, b)
+	notifyKeyspaceEvent(notifyString, "setbit", key, currentDB.id)
+
+	return SerializeInteger(Integer{Value: old})
+}
+
+// handleGetBit returns one bit of a string, 0 past its end or when the key does not exist
+func handleGetBit(args ...BulkString) ([]byte, error) {
+	if len(args) != 3 {
+		return wrongArgsReply("getbit")
+	}
+	offset, err := parseBitOffset(*args[2].Value, 0)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	value, _, err := lookupString(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	return SerializeInteger(Integer{Value: getBit([]byte(value), offset)})
+}
+
+// bitRange resolves a start/end pair in BYTE or BIT units over a string of length strLen into an inclusive bit range.
+// Negative indexes count from the end; empty is true when nothing is covered.
+func bitRange(start, end int64, isBit bool, strLen int64) (first, last int64, empty bool) {
+	total := strLen
+	if isBit {
+		total <<= 3
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	start = max(start, 0)
+	end = max(end, 0)
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return 0, 0, true
+	}
+	if isBit {
+		return start, end, false
+	}
+	return start << 3, end<<3 + 7, false
+}
+
+// parseBitUnit parses the optional BYTE|BIT argument of BITCOUNT and BITPOS
+func parseBitUnit(arg BulkString) (bool, error) {
+	switch strings.ToUpper(*arg.Value) {
+	case "BIT":
+		return true, nil
+	case "BYTE":
+		return false, nil
+	}
+	return false, errSyntax
+}
+
+// handleBitCount counts the set bits of a string, optionally within a BYTE or BIT range
+func handleBitCount(args ...BulkString) ([]byte, error) {
+	if len(args) < 2 {
+		return wrongArgsReply("bitcount")
+	}
+	if len(args) == 3 || len(args) > 5 {
+		return errorReply(errSyntax.Error())
+	}
+
+	var start, end int64
+	isBit, ranged := false, len(args) > 2
+	var err error
+	if ranged {
+		if start, err = parseInt(args[2]); err != nil {
+			return errorReply(err.Error())
+		}
+		if end, err = parseInt(args[3]); err != nil {
+			return errorReply(err.Error())
+		}
+		if len(args) == 5 {
+			if isBit, err = parseBitUnit(args[4]); err != nil {
+				return errorReply(err.Error())
+			}
+		}
+	}
+
+	value, exists, err := lookupString(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if !exists {
+		return SerializeInteger(Integer{Value: 0})
+	}
+
+	b := []byte(value)
+	if !ranged {
+		start, end = 0, -1
+	} else if start < 0 && end < 0 && start > end {
+		return SerializeInteger(Integer{Value: 0})
+	}
+	first, last, empty := bitRange(start, end, isBit, int64(len(b)))
+	if empty {
+		return SerializeInteger(Integer{Value: 0})
+	}
+	return SerializeInteger(Integer{Value: popcountRange(b, first, last)})
+}
+
+// popcountRange counts the set bits between the inclusive bit offsets first and last
+func popcountRange(b []byte, first, last int64) int {
+	count := 0
+	for first <= last && first&7 != 0 {
+		count += getBit(b, uint64(first))
+		first++
+	}
+	for ; first+7 <= last; first += 8 {
+		count += bits.OnesCount8(b[first>>3])
+	}
+	for ; first <= last; first++ {
+		count += getBit(b, uint64(first))
+	}
+	return count
+}
+
+// handleBitPos returns the position of the first bit set to 0 or 1, optionally within a BYTE or BIT range
+func handleBitPos(args ...BulkString) ([]byte, error) {
+	if len(args) < 3 {
+		return wrongArgsReply("bitpos")
+	}
+	if len(args) > 6 {
+		return errorReply(errSyntax.Error())
+	}
+
+	bit, err := parseInt(args[2])
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if bit != 0 && bit != 1 {
+		return errorReply("ERR The bit argument must be 1 or 0.")
+	}
+
+	var start, end int64 = 0, -1
+	isBit, endGiven := false, len(args) >= 5
+	if len(args) >= 4 {
+		if start, err = parseInt(args[3]); err != nil {
+			return errorReply(err.Error())
+		}
+	}
+	if len(args) == 6 {
+		if isBit, err = parseBitUnit(args[5]); err != nil {
+			return errorReply(err.Error())
+		}
+	}
+	if endGiven {
+		if end, err = parseInt(args[4]); err != nil {
+			return errorReply(err.Error())
+		}
+	}
+
+	value, exists, err := lookupString(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	// a missing key is an infinite run of zero bits
+	if !exists {
+		if bit == 1 {
+			return SerializeInteger(Integer{Value: -1})
+		}
+		return SerializeInteger(Integer{Value: 0})
+	}
+
+	b := []byte(value)
+	first, last, empty := bitRange(start, end, isBit, int64(len(b)))
+	if empty {
+		return SerializeInteger(Integer{Value: -1})
+	}
+	for pos := first; pos <= last; pos++ {
+		if int64(getBit(b, uint64(pos))) == bit {
+			return SerializeInteger(Integer{Value: int(pos)})
+		}
+	}
+
+	// without an explicit end the string is considered padded with zeros on the right
+	if bit == 0 && !endGiven {
+		return SerializeInteger(Integer{Value: int(last + 1)})
+	}
+	return SerializeInteger(Integer{Value: -1})
+}
+
+// handleBitOp combines strings bitwise into destkey: AND, OR, XOR, NOT, DIFF, DIFF1, ANDOR and ONE
+func handleBitOp(args ...BulkString) ([]byte, error) {
+	if len(args) < 4 {
+		return wrongArgsReply("bitop")
+	}
+	op := strings.ToUpper(*args[1].Value)
+	dest := *args[2].Value
+	srcKeys := args[3:]
+
+	switch op {
+	case "AND", "OR", "XOR", "ONE":
+	case "NOT":
+		if len(srcKeys) != 1 {
+			return errorReply("ERR BITOP NOT must be called with a single source key.")
+		}
+	case "DIFF", "DIFF1", "ANDOR":
+		if len(srcKeys) < 2 {
+			return errorReply(fmt.Sprintf("ERR BITOP %s must be called with at least two source keys.", op))
+		}
+	default:
+		return errorReply(errSyntax.Error())
+	}
+
+	sources := make([][]byte, len(srcKeys))
+	maxLen := 0
+	for i, arg := range srcKeys {
+		value, _, err := lookupString(*arg.Value)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		sources[i] = []byte(value)
+		maxLen = max(maxLen, len(value))
+	}
+
+	if maxLen == 0 {
+		if dbDelete(dest) {
+			notifyKeyspaceEvent(notifyGeneric, "del", dest, currentDB.id)
+		}
+		return SerializeInteger(Integer{Value: 0})
+	}
+
+	byteAt := func(src []byte, i int) byte {
+		if i < len(src) {
+			return src[i]
+		}
+		return 0
+	}
+
+	result := make([]byte, maxLen)
+	for i := range result {
+		first := byteAt(sources[0], i)
+		var others byte // OR of every source after the first
+		for _, src := range sources[1:] {
+			others |= byteAt(src, i)
+		}
+
+		switch op {
+		case "AND":
+			out := first
+			for _, src := range sources[1:] {
+				out &= byteAt(src, i)
+			}
+			result[i] = out
+		case "OR":
+			result[i] = first | others
+		case "XOR":
+			out := first
+			for _, src := range sources[1:] {
+				out ^= byteAt(src, i)
+			}
+			result[i] = out
+		case "NOT":
+			result[i] = ^first
+		case "DIFF":
+			result[i] = first &^ others
+		case "DIFF1":
+			result[i] = others &^ first
+		case "ANDOR":
+			result[i] = first & others
+		case "ONE":
+			var seen, once byte
+			for _, src := range sources {
+				b := byteAt(src, i)
+				once = (once &^ b) | (b &^ seen)
+				seen |= b
+			}
+			result[i] = once
+		}
+	}
+
+	setKey(dest, StoreEntry{value: string(result)})
+	notifyKeyspaceEvent(notifyString, "set", dest, currentDB.id)
+	return SerializeInteger(Integer{Value: maxLen})
+}
+
+type bitfieldOverflow int
+
+const (
+	overflowWrap bitfieldOverflow = iota
+	overflowSat
+	overflowFail
+)
+
+type bitfieldOpcode int
+
+const (
+	bitfieldGet bitfieldOpcode = iota
+	bitfieldSet
+	bitfieldIncrBy
+)
+
+type bitfieldOp struct {
+	opcode   bitfieldOpcode
+	offset   uint64
+	bits     int
+	signed   bool
+	value    int64
+	overflow bitfieldOverflow
+}
+
+// parseBitfieldType parses encodings such as i16 or u8
+func parseBitfieldType(raw string) (signed bool, width int, err error) {
+	err = errors.New("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	if raw == "" {
+		return false, 0, err
+	}
+	switch raw[0] {
+	case 'i', 'I':
+		signed = true
+	case 'u', 'U':
+	default:
+		return false, 0, err
+	}
+	n, convErr := strconv.ParseInt(raw[1:], 10, 64)
+	if convErr != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, err
+	}
+	return signed, int(n), nil
+}
+
+func getUnsignedBitfield(b []byte, offset uint64, width int) uint64 {
+	var value uint64
+	for i := 0; i < width; i++ {
+		value = value<<1 | uint64(getBit(b, offset+uint64(i)))
+	}
+	return value
+}
+
+func getSignedBitfield(b []byte, offset uint64, width int) int64 {
+	value := getUnsignedBitfield(b, offset, width)
+	// sign extend from the top bit of the field
+	if width < 64 && value&(1<<(width-1)) != 0 {
+		value |= math.MaxUint64 << width
+	}
+	return int64(value)
+}
+
+func setBitfield(b []byte, offset uint64, width int, value uint64) {
+	for i := 0; i < width; i++ {
+		setBit(b, offset+uint64(i), int(value>>(width-1-i))&1)
+	}
+}
+
+// checkUnsignedOverflow reports whether value+incr leaves the range of an unsigned field,
+// returning the value the overflow policy replaces it with
+func checkUnsignedOverflow(value uint64, incr int64, width int, policy bitfieldOverflow) (bool, uint64) {
+	maxValue := uint64(1)<<width - 1
+	maxIncr := int64(maxValue - value)
+	minIncr := -int64(value)
+
+	wrap := func() uint64 {
+		return (value + uint64(incr)) &^ (math.MaxUint64 << width)
+	}
+
+	if value > maxValue || (incr > 0 && incr > maxIncr) {
+		if policy == overflowWrap {
+			return true, wrap()
+		}
+		return true, maxValue
+	}
+	if incr < 0 && incr < minIncr {
+		if policy == overflowWrap {
+			return true, wrap()
+		}
+		return true, 0
+	}
+	return false, 0
+}
+
+// checkSignedOverflow is the signed counterpart of checkUnsignedOverflow
+func checkSignedOverflow(value, incr int64, width int, policy bitfieldOverflow) (bool, int64) {
+	maxValue := int64(math.MaxInt64)
+	if width < 64 {
+		maxValue = int64(1)<<(width-1) - 1
+	}
+	minValue := -maxValue - 1
+	maxIncr := int64(uint64(maxValue) - uint64(value))
+	minIncr := minValue - value
+
+	wrap := func() int64 {
+		c := uint64(value) + uint64(incr)
+		if width < 64 {
+			mask := uint64(math.MaxUint64) << width
+			if c&(1<<(width-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c)
+	}
+
+	if value > maxValue || (width != 64 && incr > maxIncr) || (value >= 0 && incr > 0 && incr > maxIncr) {
+		if policy == overflowWrap {
+			return true, wrap()
+		}
+		return true, maxValue
+	}
+	if value < minValue || (width != 64 && incr < minIncr) || (value < 0 && incr < 0 && incr < minIncr) {
+		if policy == overflowWrap {
+			return true, wrap()
+		}
+		return true, minValue
+	}
+	return false, 0
+}
+
+func handleBitField(args ...BulkString) ([]byte, error) {
+	return bitfield(args, false)
+}
+
+func handleBitFieldRO(args ...BulkString) ([]byte, error) {
+	return bitfield(args, true)
+}
+
+// bitfield serves BITFIELD and BITFIELD_RO, running GET, SET and INCRBY operations on arbitrary width integers
+func bitfield(args []BulkString, readOnlyCmd bool) ([]byte, error) {
+	name := "bitfield"
+	if readOnlyCmd {
+		name = "bitfield_ro"
+	}
+	if len(args) < 2 {
+		return wrongArgsReply(name)
+	}
+
+	var ops []bitfieldOp
+	overflow := overflowWrap
+	readOnly := true
+	highestWrite := uint64(0)
+
+	for j := 2; j < len(args); j++ {
+		remaining := len(args) - j - 1
+		sub := strings.ToUpper(*args[j].Value)
+
+		var op bitfieldOp
+		switch {
+		case sub == "GET" && remaining >= 2:
+			op.opcode = bitfieldGet
+		case sub == "SET" && remaining >= 3:
+			op.opcode = bitfieldSet
+		case sub == "INCRBY" && remaining >= 3:
+			op.opcode = bitfieldIncrBy
+		case sub == "OVERFLOW" && remaining >= 1:
+			j++
+			switch strings.ToUpper(*args[j].Value) {
+			case "WRAP":
+				overflow = overflowWrap
+			case "SAT":
+				overflow = overflowSat
+			case "FAIL":
+				overflow = overflowFail
+			default:
+				return errorReply("ERR Invalid OVERFLOW type specified")
+			}
+			continue
+		default:
+			return errorReply(errSyntax.Error())
+		}
+
+		var err error
+		if op.signed, op.bits, err = parseBitfieldType(*args[j+1].Value); err != nil {
+			return errorReply(err.Error())
+		}
+		if op.offset, err = parseBitOffset(*args[j+2].Value, op.bits); err != nil {
+			return errorReply(err.Error())
+		}
+		if op.opcode != bitfieldGet {
+			readOnly = false
+			highestWrite = max(highestWrite, op.offset+uint64(op.bits)-1)
+			if op.value, err = parseInt(args[j+3]); err != nil {
+				return errorReply(err.Error())
+			}
+			j++
+		}
+		op.overflow = overflow
+		ops = append(ops, op)
+		j += 2
+	}
+
+	if !readOnly && readOnlyCmd {
+		return errorReply("ERR BITFIELD_RO only supports the GET subcommand")
+	}
+
+	key := *args[1].Value
+	value, _, err := lookupString(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	b := []byte(value)
+	if !readOnly {
+		b = growTo(b, highestWrite>>3+1)
+	}
+
+	replies := make([]RESPData, 0, len(ops))
+	for _, op := range ops {
+		if op.opcode == bitfieldGet {
+			if op.signed {
+				replies = append(replies, Integer{Value: int(getSignedBitfield(b, op.offset, op.bits))})
+			} else {
+				replies = append(replies, Integer{Value: int(getUnsignedBitfield(b, op.offset, op.bits))})
+			}
+			continue
+		}
+
+		var overflowed bool
+		var newValue uint64
+		var reply int64
+		if op.signed {
+			old := getSignedBitfield(b, op.offset, op.bits)
+			var wrapped int64
+			if op.opcode == bitfieldIncrBy {
+				overflowed, wrapped = checkSignedOverflow(old, op.value, op.bits, op.overflow)
+				result := old + op.value
+				if overflowed {
+					result = wrapped
+				}
+				newValue, reply = uint64(result), result
+			} else {
+				result := op.value
+				if overflowed, wrapped = checkSignedOverflow(result, 0, op.bits, op.overflow); overflowed {
+					result = wrapped
+				}
+				newValue, reply = uint64(result), old
+			}
+		} else {
+			old := getUnsignedBitfield(b, op.offset, op.bits)
+			var wrapped uint64
+			if op.opcode == bitfieldIncrBy {
+				result := old + uint64(op.value)
+				if overflowed, wrapped = checkUnsignedOverflow(old, op.value, op.bits, op.overflow); overflowed {
+					result = wrapped
+				}
+				newValue, reply = result, int64(result)
+			} else {
+				result := uint64(op.value)
+				if overflowed, wrapped = checkUnsignedOverflow(result, 0, op.bits, op.overflow); overflowed {
+					result = wrapped
+				}
+				newValue, reply = result, int64(old)
+			}
+		}
+
+		// with OVERFLOW FAIL nothing is written and the operation replies nil
+		if overflowed && op.overflow == overflowFail {
+			replies = append(replies, BulkString{})
+			continue
+		}
+		setBitfield(b, op.offset, op.bits, newValue)
+		replies = append(replies, Integer{Value: int(reply)})
+	}
+
+	if !readOnly {
+		storeString(key, b)
+		notifyKeyspaceEvent(notifyString, "setbit", key, currentDB.id)
+	}
+	return SerializeArray(Array{Elements: &replies})
+}
@@ -0,0 +1,79 @@
+package resp
+
+import "testing"
+
+func TestBitmapCommands(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"setbit", []string{"SETBIT", "bm:one", "7", "1"}, ":0\r\n"},
+		{"setbit returns old bit", []string{"SETBIT", "bm:one", "7", "0"}, ":1\r\n"},
+		{"setbit again", []string{"SETBIT", "bm:one", "7", "1"}, ":0\r\n"},
+		{"get after setbit", []string{"GET", "bm:one"}, "$1\r\n\x01\r\n"},
+		{"getbit", []string{"GETBIT", "bm:one", "7"}, ":1\r\n"},
+		{"getbit past end", []string{"GETBIT", "bm:one", "100"}, ":0\r\n"},
+		{"bad bit", []string{"SETBIT", "bm:one", "1", "2"}, "-ERR bit is not an integer or out of range\r\n"},
+		{"bad offset", []string{"SETBIT", "bm:one", "-1", "1"}, "-ERR bit offset is not an integer or out of range\r\n"},
+
+		{"set foobar", []string{"SET", "bm:foobar", "foobar"}, "+OK\r\n"},
+		{"bitcount", []string{"BITCOUNT", "bm:foobar"}, ":26\r\n"},
+		{"bitcount first byte", []string{"BITCOUNT", "bm:foobar", "0", "0"}, ":4\r\n"},
+		{"bitcount second byte", []string{"BITCOUNT", "bm:foobar", "1", "1", "BYTE"}, ":6\r\n"},
+		{"bitcount bit range", []string{"BITCOUNT", "bm:foobar", "5", "30", "BIT"}, ":17\r\n"},
+		{"bitcount missing end", []string{"BITCOUNT", "bm:foobar", "1"}, "-ERR syntax error\r\n"},
+		{"bitcount missing key", []string{"BITCOUNT", "bm:missing"}, ":0\r\n"},
+
+		{"set leading ones", []string{"SET", "bm:pos0", "\xff\xf0\x00"}, "+OK\r\n"},
+		{"bitpos first clear", []string{"BITPOS", "bm:pos0", "0"}, ":12\r\n"},
+		{"set leading zeros", []string{"SET", "bm:pos1", "\x00\xff\xf0"}, "+OK\r\n"},
+		{"bitpos first set from 0", []string{"BITPOS", "bm:pos1", "1", "0"}, ":8\r\n"},
+		{"bitpos first set from 2", []string{"BITPOS", "bm:pos1", "1", "2"}, ":16\r\n"},
+		{"bitpos bit range", []string{"BITPOS", "bm:pos1", "1", "7", "15", "BIT"}, ":8\r\n"},
+		{"set all ones", []string{"SET", "bm:ones", "\xff\xff"}, "+OK\r\n"},
+		{"bitpos clear padding", []string{"BITPOS", "bm:ones", "0"}, ":16\r\n"},
+		{"bitpos clear in explicit range", []string{"BITPOS", "bm:ones", "0", "0", "-1"}, ":-1\r\n"},
+		{"bitpos missing key", []string{"BITPOS", "bm:missing", "1"}, ":-1\r\n"},
+		{"bitpos bad bit", []string{"BITPOS", "bm:ones", "2"}, "-ERR The bit argument must be 1 or 0.\r\n"},
+
+		{"set abcdef", []string{"SET", "bm:abcdef", "abcdef"}, "+OK\r\n"},
+		{"bitop and", []string{"BITOP", "AND", "bm:and", "bm:foobar", "bm:abcdef"}, ":6\r\n"},
+		{"get and", []string{"GET", "bm:and"}, "$6\r\n`bc`ab\r\n"},
+		{"bitop not", []string{"BITOP", "NOT", "bm:not", "bm:one"}, ":1\r\n"},
+		{"get not", []string{"GET", "bm:not"}, "$1\r\n\xfe\r\n"},
+		{"bitop not arity", []string{"BITOP", "NOT", "bm:not", "bm:one", "bm:foobar"}, "-ERR BITOP NOT must be called with a single source key.\r\n"},
+		{"set a", []string{"SET", "bm:a", "\xf0"}, "+OK\r\n"},
+		{"set b", []string{"SET", "bm:b", "\x3c"}, "+OK\r\n"},
+		{"set c", []string{"SET", "bm:c", "\x0f"}, "+OK\r\n"},
+		{"bitop diff", []string{"BITOP", "DIFF", "bm:diff", "bm:a", "bm:b", "bm:c"}, ":1\r\n"},
+		{"get diff", []string{"GET", "bm:diff"}, "$1\r\n\xc0\r\n"},
+		{"bitop diff1", []string{"BITOP", "DIFF1", "bm:diff1", "bm:a", "bm:b", "bm:c"}, ":1\r\n"},
+		{"get diff1", []string{"GET", "bm:diff1"}, "$1\r\n\x0f\r\n"},
+		{"bitop andor", []string{"BITOP", "ANDOR", "bm:andor", "bm:a", "bm:b", "bm:c"}, ":1\r\n"},
+		{"get andor", []string{"GET", "bm:andor"}, "$1\r\n\x30\r\n"},
+		{"bitop one", []string{"BITOP", "ONE", "bm:onehot", "bm:a", "bm:b", "bm:c"}, ":1\r\n"},
+		{"get one", []string{"GET", "bm:onehot"}, "$1\r\n\xc3\r\n"},
+		{"bitop diff arity", []string{"BITOP", "DIFF", "bm:diff", "bm:a"}, "-ERR BITOP DIFF must be called with at least two source keys.\r\n"},
+		{"bitop empty result", []string{"BITOP", "OR", "bm:empty", "bm:missing"}, ":0\r\n"},
+		{"bitop unknown", []string{"BITOP", "NAND", "bm:x", "bm:a"}, "-ERR syntax error\r\n"},
+	})
+}
+
+func TestBitFieldCommands(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"incrby and get", []string{"BITFIELD", "bf:doc", "INCRBY", "i5", "100", "1", "GET", "u4", "0"}, "*2\r\n:1\r\n:0\r\n"},
+		{"sat 1", []string{"BITFIELD", "bf:sat", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"}, "*2\r\n:1\r\n:1\r\n"},
+		{"sat 2", []string{"BITFIELD", "bf:sat", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"}, "*2\r\n:2\r\n:2\r\n"},
+		{"sat 3", []string{"BITFIELD", "bf:sat", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"}, "*2\r\n:3\r\n:3\r\n"},
+		{"sat wraps first", []string{"BITFIELD", "bf:sat", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"}, "*2\r\n:0\r\n:3\r\n"},
+		{"fail", []string{"BITFIELD", "bf:sat", "OVERFLOW", "FAIL", "INCRBY", "u2", "102", "1"}, "*1\r\n$-1\r\n"},
+		{"signed set", []string{"BITFIELD", "bf:signed", "SET", "i8", "0", "-100", "GET", "u8", "0", "GET", "i8", "#0"}, "*3\r\n:0\r\n:156\r\n:-100\r\n"},
+		{"signed wrap", []string{"BITFIELD", "bf:signed", "INCRBY", "i8", "0", "-100"}, "*1\r\n:56\r\n"},
+		{"signed sat", []string{"BITFIELD", "bf:signed", "OVERFLOW", "SAT", "INCRBY", "i8", "0", "100"}, "*1\r\n:127\r\n"},
+		{"unsigned set wraps", []string{"BITFIELD", "bf:signed", "SET", "u8", "#1", "257", "GET", "u8", "8"}, "*2\r\n:0\r\n:1\r\n"},
+		{"i64 roundtrip", []string{"BITFIELD", "bf:wide", "SET", "i64", "3", "-9223372036854775808", "GET", "i64", "3"}, "*2\r\n:0\r\n:-9223372036854775808\r\n"},
+		{"bad type", []string{"BITFIELD", "bf:x", "GET", "u64", "0"}, "-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.\r\n"},
+		{"bad overflow", []string{"BITFIELD", "bf:x", "OVERFLOW", "MAYBE"}, "-ERR Invalid OVERFLOW type specified\r\n"},
+		{"ro get", []string{"BITFIELD_RO", "bf:signed", "GET", "i8", "0"}, "*1\r\n:127\r\n"},
+		{"ro set", []string{"BITFIELD_RO", "bf:signed", "SET", "i8", "0", "1"}, "-ERR BITFIELD_RO only supports the GET subcommand\r\n"},
+		{"get missing key", []string{"BITFIELD", "bf:missing", "GET", "u8", "0"}, "*1\r\n:0\r\n"},
+		{"get does not create", []string{"BITCOUNT", "bf:missing"}, ":0\r\n"},
+	})
+}
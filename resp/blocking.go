@@ -0,0 +1,100 @@
+package resp
+
+import "time"
+
+// keyWaiter is a client blocked until one of its keys receives new data
+type keyWaiter struct {
+	db    *database
+	keys  []string
+	ready chan struct{}
+	fired bool
+	// disconnected ends the wait when the connection of the client is gone
+	disconnected <-chan struct{}
+}
+
+// denyBlocking is set while EXEC runs its queue, so blocking commands time out at once instead, guarded by mu
+var denyBlocking bool
+
+// blockOnKeys registers a waiter of the running command for keys of the current database. The caller
+// must hold mu.
+func blockOnKeys(keys []string) *keyWaiter {
+	w := &keyWaiter{db: currentDB, keys: keys, ready: make(chan struct{})}
+	if currentClient != nil {
+		w.disconnected = currentClient.disconnected
+	}
+	for _, key := range keys {
+		currentDB.blockingKeys[key] = append(currentDB.blockingKeys[key], w)
+	}
+	return w
+}
+
+// signalKeyAsReady wakes every client blocked on key of the current database. The caller must hold mu.
+func signalKeyAsReady(key string) {
+	currentDB.signalKeyAsReady(key)
+}
+
+func (db *database) signalKeyAsReady(key string) {
+	for _, w := range db.blockingKeys[key] {
+		w.fire()
+	}
+}
+
+// signalReadyKeys wakes the clients blocked on keys that exist in db, after its contents were swapped in.
+// The caller must hold mu.
+func (db *database) signalReadyKeys() {
+	for key := range db.blockingKeys {
+		if _, exists := db.entries[key]; exists {
+			db.signalKeyAsReady(key)
+		}
+	}
+}
+
+func (w *keyWaiter) fire() {
+	if !w.fired {
+		w.fired = true
+		close(w.ready)
+	}
+}
+
+// wait releases mu until the waiter fires, timeout passes or the client disconnects, a zero timeout
+// waiting forever.
+// It returns with mu held again, the waiter's database selected and the waiter unregistered,
+// reporting whether it was woken.
+func (w *keyWaiter) wait(timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	woken := false
+	withoutLock(func() {
+		select {
+		case <-w.ready:
+			woken = true
+		case <-expired:
+		case <-w.disconnected:
+		}
+	})
+
+	w.unregister()
+	return woken
+}
+
+func (w *keyWaiter) unregister() {
+	for _, key := range w.keys {
+		waiters := w.db.blockingKeys[key]
+		for i, other := range waiters {
+			if other == w {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(w.db.blockingKeys, key)
+		} else {
+			w.db.blockingKeys[key] = waiters
+		}
+	}
+}
@@ -0,0 +1,805 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// command is an entry of the command table
+type command struct {
+	handler func(...BulkString) ([]byte, error)
+	// clientHandler replaces handler for commands that need the connection state
+	clientHandler func(*Client, ...BulkString) ([]byte, error)
+	arity         int
+	flags         commandFlags
+	// categories are the ACL categories of the command besides the ones its flags imply
+	categories aclCategory
+	keys       []keySpec
+	// subcommands with flags and categories of their own, by their lower case name, the other ones
+	// having the command's
+	subcommands map[string]command
+}
+
+// commandFlags describe what a command does, for the checks made before running it
+type commandFlags int
+
+const (
+	// cmdWrite commands may modify the dataset, they are rejected on read only replicas
+	cmdWrite commandFlags = 1 << iota
+	// cmdReadOnly commands only read the dataset
+	cmdReadOnly
+	// cmdAdmin commands manage the server
+	cmdAdmin
+	cmdPubSub
+	// cmdFast commands run in constant or logarithmic time
+	cmdFast
+	// cmdBlocking commands may wait for other clients
+	cmdBlocking
+)
+
+// keyFlags tell how a command uses a key: keyRead commands return data of the key, keyWrite ones
+// insert, update or delete it. A key with neither, like the one of WATCH, is only looked at. keyNotKey
+// marks the shard channels, which are no keys but are sent to the node serving their slot like keys are.
+type keyFlags int
+
+const (
+	keyRead keyFlags = 1 << iota
+	keyWrite
+	keyNotKey
+)
+
+// keySpec locates keys among the arguments of a command. The first key is the argument at begin, or the one
+// after keyword when searching from begin. The last one is last arguments further, or counted from the end
+// when negative, keys being step arguments apart. With half only the first half of them are keys, the rest
+// being their arguments.
+type keySpec struct {
+	flags   keyFlags
+	begin   int
+	keyword string
+	last    int
+	step    int
+	half    bool
+}
+
+// keyAt is the spec of a single key at index
+func keyAt(index int, flags keyFlags) keySpec {
+	return keySpec{flags: flags, begin: index}
+}
+
+// keysFrom is the spec of keys from index up to the last argument
+func keysFrom(index, step int, flags keyFlags) keySpec {
+	return keySpec{flags: flags, begin: index, last: -1, step: step}
+}
+
+// keyAfter is the spec of a single key following keyword
+func keyAfter(keyword string, from int, flags keyFlags) keySpec {
+	return keySpec{flags: flags, begin: from, keyword: keyword}
+}
+
+// streamsKeys is the spec of the keys of XREAD and XREADGROUP, the first half of the arguments after STREAMS
+func streamsKeys(flags keyFlags) keySpec {
+	return keySpec{flags: flags, begin: 1, keyword: "STREAMS", last: -1, step: 1, half: true}
+}
+
+// commandKey is a key a command is called with and how it uses it
+type commandKey struct {
+	key   string
+	flags keyFlags
+}
+
+// commandKeys returns the keys among args according to the key specs of cmd
+func (cmd command) commandKeys(args []BulkString) []commandKey {
+	var keys []commandKey
+	for _, spec := range cmd.keys {
+		first := spec.begin
+		if spec.keyword != "" {
+			first = -1
+			for i := spec.begin; i < len(args); i++ {
+				if strings.EqualFold(*args[i].Value, spec.keyword) {
+					first = i + 1
+					break
+				}
+			}
+			if first < 0 {
+				continue
+			}
+		}
+		if first >= len(args) {
+			continue
+		}
+		last := first + spec.last
+		if spec.last < 0 {
+			last = len(args) + spec.last
+		}
+		if spec.half {
+			last = first + (last-first+1)/2 - 1
+		}
+		step := max(spec.step, 1)
+		for i := first; i <= last && i < len(args); i += step {
+			keys = append(keys, commandKey{*args[i].Value, spec.flags})
+		}
+	}
+	return keys
+}
+
+func (cmd command) arityOK(argc int) bool {
+	if cmd.arity > 0 {
+		return argc == cmd.arity
+	}
+	return argc >= -cmd.arity
+}
+
+// Client holds the state of one connection, such as its selected database or an open transaction
+type Client struct {
+	db      *database
+	multi   *multiState
+	watched []watchedKey
+	// dirtyCAS is set when a watched key was modified, so the next EXEC must fail
+	dirtyCAS bool
+
+	// conn is nil for clients without a connection, like the one loading the AOF
+	conn    net.Conn
+	writeMu sync.Mutex
+	// disconnected is closed once the connection is gone, waking a blocked command of the client
+	disconnected   chan struct{}
+	disconnectOnce sync.Once
+	// master is set for the client applying the replication stream of our master
+	master bool
+	// aofLoader is set for the client replaying the AOF, which like the master is never redirected
+	aofLoader bool
+	// replica is set once the connection announced itself as a replica
+	replica *replica
+	// woff is the replication offset after the last write of the client, which WAIT waits for
+	woff int64
+
+	id int64
+	// resp is the protocol version picked with HELLO, 2 or 3
+	resp int
+	name string
+	// channels, patterns and shardChannels are the Pub/Sub subscriptions of the client, guarded by mu
+	channels      map[string]struct{}
+	patterns      map[string]struct{}
+	shardChannels map[string]struct{}
+	// out is set once the connection is written by a goroutine of its own, see startOutput
+	out *clientOutput
+	// tracking is nil unless CLIENT TRACKING is on
+	tracking *trackingState
+	// deferred are the messages the running command caused for the client, sent after its reply
+	deferred [][]byte
+	// authenticated is set once the client sent the password, or if none was required when it connected
+	authenticated bool
+	// closeAfterReply is set by QUIT
+	closeAfterReply bool
+	// user is the ACL user the client runs commands as, nil for clients without a connection which may
+	// run anything
+	user *aclUser
+	// created is when the client connected and lastInteraction the Unix time in milliseconds of its last
+	// command, for CLIENT LIST
+	created         time.Time
+	lastInteraction atomic.Int64
+	// asking is set by ASKING, letting the next command use a slot being imported from another node
+	asking bool
+}
+
+// nextClientID numbers the clients in the order they are created
+var nextClientID atomic.Int64
+
+func NewClient() *Client {
+	c := &Client{db: databases[0], id: nextClientID.Add(1), resp: 2, authenticated: true, created: time.Now(), disconnected: make(chan struct{})}
+	c.lastInteraction.Store(c.created.UnixMilli())
+	return c
+}
+
+// NewConnClient returns a client for conn, which replies are written to with Write
+func NewConnClient(conn net.Conn) *Client {
+	c := NewClient()
+	c.conn = conn
+	mu.Lock()
+	c.user = defaultUser
+	c.authenticated = !defaultUser.authRequired()
+	clientsByID[c.id] = c
+	mu.Unlock()
+	return c
+}
+
+// Write sends data to the client's connection. Replies and data sent from other goroutines,
+// like the replication stream, are written whole one after the other. Once the connection has
+// a writer goroutine the data is queued for it.
+func (c *Client) Write(p []byte) (int, error) {
+	if c.out != nil {
+		c.out.queue(p, outputLimit{})
+		return len(p), nil
+	}
+	return c.writeConn(p)
+}
+
+func (c *Client) writeConn(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.Write(p)
+}
+
+// CloseAfterReply reports whether the client asked for its connection to be closed, in which case it
+// returns once the replies sent so far are written
+func (c *Client) CloseAfterReply() bool {
+	if c.closeAfterReply && c.out != nil {
+		c.out.flush()
+	}
+	return c.closeAfterReply
+}
+
+// Disconnect tells the client its connection is gone, which ends a blocked command of the client at once.
+// It may be called while a command runs, unlike Close which must still follow once it returned.
+func (c *Client) Disconnect() {
+	c.disconnectOnce.Do(func() { close(c.disconnected) })
+}
+
+// Close releases what the client holds in the shared state once its connection is gone
+func (c *Client) Close() {
+	c.Disconnect()
+	mu.Lock()
+	defer mu.Unlock()
+	c.unwatchAllKeys()
+	c.unsubscribeAll()
+	c.disableTracking()
+	delete(clientsByID, c.id)
+	if c.replica != nil {
+		freeReplica(c.replica)
+	}
+	if c.out != nil {
+		c.out.close()
+	}
+}
+
+// Execute parses one RESP command sent by the client, runs it and returns the serialized reply.
+// An error means the input was not a valid command and the connection should be closed.
+func (c *Client) Execute(data []byte) ([]byte, error) {
+	respData, _, err := ParseByteDataToResp(data)
+	if err != nil {
+		return []byte(""), err
+	}
+
+	val, ok := respData.(Array)
+	if !ok || val.Elements == nil || len(*val.Elements) < 1 {
+		return []byte(""), fmt.Errorf("invalid command")
+	}
+
+	args := make([]BulkString, len(*val.Elements))
+	for i, elem := range *val.Elements {
+		arg, ok := elem.(BulkString)
+		if !ok || arg.Value == nil {
+			return []byte(""), fmt.Errorf("invalid command")
+		}
+		args[i] = arg
+	}
+
+	return c.processCommand(args)
+}
+
+// processCommand looks the command up, checks its arity and either queues it inside MULTI
+// or runs it while holding the keyspace exclusively
+func (c *Client) processCommand(args []BulkString) ([]byte, error) {
+	name := strings.ToUpper(*args[0].Value)
+	c.lastInteraction.Store(time.Now().UnixMilli())
+	// CLIENT CACHING only applies to the command that follows it
+	defer c.endTrackingCaching(name)
+	cmd, ok := commands[name]
+	if !ok {
+		c.flagTransaction()
+		return errorReply(unknownCommandError(args))
+	}
+	if !cmd.arityOK(len(args)) {
+		c.flagTransaction()
+		return wrongArgsReply(name)
+	}
+
+	mu.RLock()
+	debugDenied := name == "DEBUG" && !c.allowProtectedAction(config.enableDebugCommand)
+	authRequired := c.authRequired()
+	denial := c.checkPermissions(name, cmd, args)
+	mu.RUnlock()
+	if debugDenied {
+		c.flagTransaction()
+		return errorReply(debugNotAllowedError)
+	}
+	if authRequired && !noAuthCommands[name] {
+		c.flagTransaction()
+		return errorReply(noAuthError)
+	}
+	if denial != nil {
+		mu.Lock()
+		addACLLogEntry(c, denial, "toplevel")
+		mu.Unlock()
+		c.flagTransaction()
+		return errorReply("NOPERM " + denial.message(false))
+	}
+
+	// a RESP2 connection carries the messages of its subscriptions instead of replies
+	if c.resp == 2 && c.subscribed() && !subscriberCommands[name] {
+		return errorReply(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(name)))
+	}
+
+	mu.RLock()
+	readOnly := cmd.flags&cmdWrite != 0 && !c.master && replicaReadOnly()
+	mu.RUnlock()
+	if readOnly {
+		c.flagTransaction()
+		return errorReply("READONLY You can't write against a read only replica.")
+	}
+
+	// ASKING only applies to the command that follows it, or to the transaction it is in
+	defer func() {
+		if name != "ASKING" && c.multi == nil {
+			c.asking = false
+		}
+	}()
+	mu.RLock()
+	redirect := c.clusterRedirect(name, cmd, args)
+	mu.RUnlock()
+	if redirect != "" {
+		// the queued commands were checked already, the slots moved since
+		if name == "EXEC" && c.multi != nil {
+			mu.Lock()
+			c.multi = nil
+			c.unwatchAllKeys()
+			mu.Unlock()
+		} else {
+			c.flagTransaction()
+		}
+		return errorReply(redirect)
+	}
+
+	if c.multi != nil && !multiControlCommands[name] {
+		if noMultiCommands[name] {
+			c.flagTransaction()
+			return errorReply("ERR Command not allowed inside a transaction")
+		}
+		c.multi.commands = append(c.multi.commands, queuedCommand{cmd: cmd, args: args})
+		return []byte("+QUEUED\r\n"), nil
+	}
+
+	// SHUTDOWN goes through during a shutdown so it can be aborted, and the replicas' REPLCONF so
+	// the shutdown sees them catch up
+	if name == "SHUTDOWN" || (c.replica != nil && name == "REPLCONF") {
+		resumeCommand()
+	} else {
+		beginCommand()
+	}
+	defer endCommand()
+	mu.Lock()
+	defer mu.Unlock()
+	selectDB(c.db)
+	reply, err := c.call(cmd, args)
+	// the change reaches the AOF before the client sees the reply
+	flushAppendOnlyFile()
+	// queued under mu, so messages published after the command follow its reply
+	if c.out != nil && err == nil {
+		c.out.queue(reply, outputLimit{})
+		reply = nil
+	}
+	c.sendDeferredMessages()
+	return reply, err
+}
+
+// currentClient is the client whose command is running and currentCommandFlags the flags of the command,
+// guarded by mu
+var (
+	currentClient       *Client
+	currentCommandFlags commandFlags
+)
+
+// call runs a command that already passed the checks of processCommand and propagates it
+// when it changed the dataset. The caller must hold mu.
+func (c *Client) call(cmd command, args []BulkString) ([]byte, error) {
+	db := currentDB
+	saved, savedClient, savedFlags := propagation, currentClient, currentCommandFlags
+	propagation = propagationState{dirtyStart: dirty}
+	currentClient, currentCommandFlags = c, cmd.flags
+	defer func() { propagation, currentClient, currentCommandFlags = saved, savedClient, savedFlags }()
+
+	var reply []byte
+	var err error
+	if cmd.clientHandler != nil {
+		reply, err = cmd.clientHandler(c, args...)
+	} else {
+		reply, err = cmd.handler(args...)
+	}
+
+	// a save resets the counter, which is not a change
+	if dirty > propagation.dirtyStart && !propagation.prevented {
+		argv := propagation.rewritten
+		if argv == nil {
+			argv = commandArgs(args)
+		}
+		propagateCommand(db, argv)
+	}
+	return reply, err
+}
+
+// withoutLock runs fn with mu released, for commands that wait on other clients, restoring the state
+// of the running command afterwards. The caller must hold mu and be running a command.
+func withoutLock(fn func()) {
+	db := currentDB
+	// other commands run meanwhile, their changes are not part of this one
+	saved, dirtyBefore := propagation, dirty
+	endCommand()
+	mu.Unlock()
+
+	fn()
+
+	mu.Lock()
+	resumeCommand()
+	saved.dirtyStart += dirty - dirtyBefore
+	propagation = saved
+	selectDB(db)
+}
+
+func unknownCommandError(args []BulkString) string {
+	var quoted strings.Builder
+	for _, arg := range args[1:] {
+		if quoted.Len() >= 128 {
+			break
+		}
+		value := *arg.Value
+		if room := 128 - quoted.Len(); len(value) > room {
+			value = value[:room]
+		}
+		fmt.Fprintf(&quoted, "'%s' ", value)
+	}
+
+	name := *args[0].Value
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", name, quoted.String())
+}
+
+// maxBulkLen is the size limit of a single argument, like proto-max-bulk-len
+const maxBulkLen = 512 << 20
+
+var errCommandFormat = errors.New("Protocol error: invalid multibulk")
+
+// readCommand reads the next command sent as a RESP array, from a connection or an AOF, returning its
+// bytes and name. io.EOF means the input ended between commands, io.ErrUnexpectedEOF that it ended
+// inside one.
+func readCommand(r *bufio.Reader) ([]byte, string, error) {
+	var frame []byte
+	readLine := func(prefix byte) (int, error) {
+		line, err := r.ReadBytes('\n')
+		frame = append(frame, line...)
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+			return 0, errCommandFormat
+		}
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return 0, errCommandFormat
+		}
+		return n, nil
+	}
+
+	if _, err := r.Peek(1); err != nil {
+		return nil, "", io.EOF
+	}
+	argc, err := readLine('*')
+	if err != nil {
+		return nil, "", err
+	}
+	if argc < 1 {
+		return nil, "", errCommandFormat
+	}
+	var name string
+	for i := 0; i < argc; i++ {
+		size, err := readLine('$')
+		if err != nil {
+			return nil, "", err
+		}
+		if size < 0 || size > maxBulkLen {
+			return nil, "", errCommandFormat
+		}
+		data := make([]byte, size+2)
+		n, err := io.ReadFull(r, data)
+		frame = append(frame, data[:n]...)
+		if err != nil {
+			return nil, "", io.ErrUnexpectedEOF
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, "", errCommandFormat
+		}
+		if i == 0 {
+			name = string(data[:size])
+		}
+	}
+	return frame, name, nil
+}
+
+// frameArgs returns the arguments of a command read with readCommand
+func frameArgs(frame []byte) []string {
+	data, _, err := ParseByteDataToResp(frame)
+	array, ok := data.(Array)
+	if err != nil || !ok || array.Elements == nil {
+		return nil
+	}
+	var args []string
+	for _, elem := range *array.Elements {
+		if arg, ok := elem.(BulkString); ok && arg.Value != nil {
+			args = append(args, *arg.Value)
+		}
+	}
+	return args
+}
+
+// ReadCommand reads the next command a client sent on its connection, to be passed to Execute
+func ReadCommand(r *bufio.Reader) ([]byte, error) {
+	frame, _, err := readCommand(r)
+	return frame, err
+}
+
+// handleHello switches the connection to the protocol version protover and describes the server,
+// optionally naming the client with SETNAME
+func handleHello(c *Client, args ...BulkString) ([]byte, error) {
+	proto := c.resp
+	if len(args) > 1 {
+		v, err := strconv.ParseInt(*args[1].Value, 10, 64)
+		if err != nil {
+			return errorReply("ERR Protocol version is not an integer or out of range")
+		}
+		if v < 2 || v > 3 {
+			return errorReply("NOPROTO unsupported protocol version")
+		}
+		proto = int(v)
+	}
+	name := c.name
+	var user, password *string
+	for i := 2; i < len(args); i++ {
+		if strings.EqualFold(*args[i].Value, "AUTH") && i+2 < len(args) {
+			user, password = args[i+1].Value, args[i+2].Value
+			i += 2
+			continue
+		}
+		if strings.EqualFold(*args[i].Value, "SETNAME") && i+1 < len(args) {
+			name = *args[i+1].Value
+			if strings.ContainsAny(name, " \n") {
+				return errorReply("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			i++
+			continue
+		}
+		return errorReply(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", *args[i].Value))
+	}
+	if user != nil && !c.authenticate(*user, *password) {
+		return errorReply(wrongPassError)
+	}
+	if c.authRequired() {
+		return errorReply("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+	c.resp, c.name = proto, name
+	// pushes may arrive any time on a RESP3 connection, like the invalidations redirected to it
+	if c.resp == 3 {
+		c.startOutput()
+	}
+
+	role := "master"
+	if replicationState.masterHost != "" {
+		role = "replica"
+	}
+	elements := []RESPData{
+		bulkString("server"), bulkString("redis"),
+		bulkString("version"), bulkString(redisVersion),
+		bulkString("proto"), Integer{Value: c.resp},
+		bulkString("id"), Integer{Value: int(c.id)},
+		bulkString("mode"), bulkString("standalone"),
+		bulkString("role"), bulkString(role),
+		bulkString("modules"), Array{Elements: &[]RESPData{}},
+	}
+	return c.mapReply(elements)
+}
+
+// mapReply serializes key value pairs as a map for RESP3 clients and a flat array for RESP2 ones
+func (c *Client) mapReply(elements []RESPData) ([]byte, error) {
+	return SerializeRESPDataToBytes(c.mapOf(elements))
+}
+
+// mapOf is the map of key value pairs for the protocol of the client, to nest in a reply
+func (c *Client) mapOf(elements []RESPData) RESPData {
+	if c.resp == 3 {
+		return Map{Elements: &elements}
+	}
+	return Array{Elements: &elements}
+}
+
+// handleReset brings the connection back to the state of a new one: no transaction, watched keys or
+// subscriptions, RESP2, the first database and not authenticated when a password is required
+func handleReset(c *Client, args ...BulkString) ([]byte, error) {
+	c.multi = nil
+	c.asking = false
+	c.unwatchAllKeys()
+	c.unsubscribeAll()
+	c.disableTracking()
+	c.resp = 2
+	c.name = ""
+	c.db = databases[0]
+	if c.conn != nil {
+		c.user = defaultUser
+		c.authenticated = !defaultUser.authRequired()
+	}
+	return []byte("+RESET\r\n"), nil
+}
+
+// handleClient implements the CLIENT subcommands about the connection itself
+func handleClient(c *Client, args ...BulkString) ([]byte, error) {
+	sub := strings.ToUpper(*args[1].Value)
+	switch {
+	case sub == "ID" && len(args) == 2:
+		return SerializeInteger(Integer{Value: int(c.id)})
+	case sub == "INFO" && len(args) == 2:
+		return SerializeBulkString(bulkString(c.info() + "\n"))
+	case sub == "LIST":
+		return clientList(args[2:])
+	case sub == "TRACKING" && len(args) >= 3:
+		return clientTracking(c, args)
+	case sub == "CACHING" && len(args) == 3:
+		return clientCaching(c, args)
+	case sub == "GETREDIR" && len(args) == 2:
+		return clientGetRedir(c)
+	case sub == "TRACKINGINFO" && len(args) == 2:
+		return clientTrackingInfo(c)
+	case sub == "HELP" && len(args) == 2:
+		return helpReply(
+			"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CACHING (YES|NO)",
+			"    Enable/disable tracking of the keys for next command in OPTIN/OPTOUT modes.",
+			"GETREDIR",
+			"    Return the client ID we are redirecting to when tracking is enabled.",
+			"ID",
+			"    Return the ID of the current connection.",
+			"INFO",
+			"    Return information about the current client connection.",
+			"LIST [options ...]",
+			"    Return information about client connections. Options:",
+			"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+			"      Return clients of specified type.",
+			"    * ID <client-id> [<client-id> ...]",
+			"      Return clients of specified IDs only.",
+			"TRACKING (ON|OFF) [REDIRECT <id>] [BCAST] [PREFIX <prefix> [...]]",
+			"         [OPTIN] [OPTOUT] [NOLOOP]",
+			"    Control server assisted client side caching.",
+			"TRACKINGINFO",
+			"    Report tracking status for the current connection.",
+			"HELP",
+			"    Print this help.",
+		)
+	}
+	return subcommandSyntaxReply("client", *args[1].Value)
+}
+
+// addrs are the remote and local addresses of the connection as CLIENT LIST shows them, both being the
+// path of the socket followed by :0 for a Unix socket
+func (c *Client) addrs() (addr, laddr string) {
+	if c.conn == nil {
+		return "", ""
+	}
+	local := c.conn.LocalAddr()
+	if local.Network() == "unix" {
+		addr = local.String() + ":0"
+		return addr, addr
+	}
+	return c.conn.RemoteAddr().String(), local.String()
+}
+
+// clientType is the type CLIENT LIST TYPE filters on
+func (c *Client) clientType() string {
+	switch {
+	case c.master:
+		return "master"
+	case c.replica != nil:
+		return "replica"
+	case c.subscribed():
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// flags are the letters CLIENT LIST shows for the state of the client, N when there is none
+func (c *Client) flags() string {
+	var flags strings.Builder
+	for _, f := range []struct {
+		set  bool
+		flag byte
+	}{
+		{c.replica != nil, 'S'},
+		{c.master, 'M'},
+		{c.subscribed(), 'P'},
+		{c.multi != nil, 'x'},
+		{c.tracking != nil, 't'},
+		{c.tracking != nil && c.tracking.brokenRedirect, 'R'},
+		{c.tracking != nil && c.tracking.bcast, 'B'},
+		{c.dirtyCAS, 'd'},
+		{c.closeAfterReply, 'c'},
+		{c.conn != nil && c.conn.LocalAddr().Network() == "unix", 'U'},
+	} {
+		if f.set {
+			flags.WriteByte(f.flag)
+		}
+	}
+	if flags.Len() == 0 {
+		return "N"
+	}
+	return flags.String()
+}
+
+// info describes the client in a line of CLIENT LIST, which ACL LOG also shows. The caller must hold mu.
+func (c *Client) info() string {
+	addr, laddr := c.addrs()
+	user := "default"
+	if c.user != nil {
+		user = c.user.name
+	}
+	multi, redirect := -1, int64(-1)
+	if c.multi != nil {
+		multi = len(c.multi.commands)
+	}
+	if c.tracking != nil {
+		redirect = c.tracking.redirect
+	}
+	now := time.Now()
+	idle := now.Sub(time.UnixMilli(c.lastInteraction.Load()))
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d ssub=%d multi=%d watch=%d user=%s redir=%d resp=%d",
+		c.id, addr, laddr, c.name, int64(now.Sub(c.created).Seconds()), int64(idle.Seconds()), c.flags(), c.db.id,
+		len(c.channels), len(c.patterns), len(c.shardChannels), multi, len(c.watched), user, redirect, c.resp)
+}
+
+// clientList implements CLIENT LIST [TYPE type] [ID id...], one line per connection in the order they connected
+func clientList(args []BulkString) ([]byte, error) {
+	clientType := ""
+	var ids map[int64]bool
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(*args[i].Value); {
+		case option == "TYPE" && i+1 < len(args):
+			i++
+			clientType = strings.ToLower(*args[i].Value)
+			if clientType == "slave" {
+				clientType = "replica"
+			}
+			if clientType != "normal" && clientType != "master" && clientType != "replica" && clientType != "pubsub" {
+				return errorReply(fmt.Sprintf("ERR Unknown client type '%s'", *args[i].Value))
+			}
+		case option == "ID" && i+1 < len(args):
+			ids = make(map[int64]bool)
+			for i++; i < len(args); i++ {
+				id, err := strconv.ParseInt(*args[i].Value, 10, 64)
+				if err != nil || id <= 0 {
+					return errorReply("ERR Invalid client ID")
+				}
+				ids[id] = true
+			}
+		default:
+			return errorReply(errSyntax.Error())
+		}
+	}
+
+	clients := make([]*Client, 0, len(clientsByID))
+	for id, c := range clientsByID {
+		if (ids == nil || ids[id]) && (clientType == "" || c.clientType() == clientType) {
+			clients = append(clients, c)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	var list strings.Builder
+	for _, c := range clients {
+		list.WriteString(c.info())
+		list.WriteByte('\n')
+	}
+	return SerializeBulkString(bulkString(list.String()))
+}
@@ -0,0 +1,691 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clusterPingInterval is how often a node pings every other one over the cluster bus
+var clusterPingInterval = time.Second
+
+// clusterNode is a node of the cluster as this node knows it
+type clusterNode struct {
+	id    string
+	ip    string
+	port  int
+	cport int
+	// configEpoch orders the claims of the nodes on the slots, the highest one winning
+	configEpoch uint64
+	// pingSent is when the PING the node has not answered yet was sent, pongReceived when it last answered
+	pingSent     time.Time
+	pongReceived time.Time
+	// linked is set while the bus connection to the node is up, forgotten once the node left the cluster
+	linked    bool
+	forgotten bool
+}
+
+// cluster is the state of cluster mode, guarded by mu
+var cluster = struct {
+	myself *clusterNode
+	nodes  map[string]*clusterNode
+	// slots are the owners of the hash slots, nil for the unassigned ones
+	slots [clusterSlots]*clusterNode
+	// migrating are the slots of this node moving to other nodes and importing the ones moving here
+	migrating map[int]*clusterNode
+	importing map[int]*clusterNode
+	// currentEpoch is the highest epoch seen in the cluster
+	currentEpoch     uint64
+	messagesSent     int64
+	messagesReceived int64
+}{
+	nodes:     map[string]*clusterNode{},
+	migrating: map[int]*clusterNode{},
+	importing: map[int]*clusterNode{},
+}
+
+func setClusterNodeTimeout(value string) error {
+	timeout, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || timeout <= 0 {
+		return errors.New("argument must be greater than 0")
+	}
+	config.clusterNodeTimeout = timeout
+	return nil
+}
+
+// clusterBusPort is the port of the cluster bus. The caller must hold mu.
+func clusterBusPort() int {
+	if config.clusterPort != 0 {
+		return config.clusterPort
+	}
+	return config.port + 10000
+}
+
+func clusterNodeTimeout() time.Duration {
+	return time.Duration(config.clusterNodeTimeout) * time.Millisecond
+}
+
+// InitCluster loads the state of the node from the cluster config file, creating a new node when there
+// is none, and listens to the other nodes on the cluster bus. It does nothing unless cluster mode is on.
+func InitCluster() error {
+	mu.Lock()
+	if !config.clusterEnabled {
+		mu.Unlock()
+		return nil
+	}
+	err := loadClusterConfig()
+	if err == nil {
+		err = saveClusterConfig()
+	}
+	port := clusterBusPort()
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	listeners, err := Listen(port, false)
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		go serveClusterBus(l)
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, n := range cluster.nodes {
+		if n != cluster.myself {
+			go n.runLink()
+		}
+	}
+	return nil
+}
+
+func clusterConfigPath() string {
+	return filepath.Join(config.dir, config.clusterConfigFile)
+}
+
+// loadClusterConfig reads the nodes, their slots and the current epoch from the cluster config file, in
+// the format of CLUSTER NODES. A node is created when there is no file. The caller must hold mu.
+func loadClusterConfig() error {
+	data, err := os.ReadFile(clusterConfigPath())
+	if os.IsNotExist(err) {
+		myself := &clusterNode{id: newReplicationID()}
+		cluster.myself, cluster.nodes[myself.id] = myself, myself
+		fmt.Printf("No cluster configuration found, I'm %s\n", myself.id)
+	} else if err != nil {
+		return err
+	} else if err := parseClusterConfig(string(data)); err != nil {
+		return err
+	}
+	cluster.myself.port, cluster.myself.cport = config.port, clusterBusPort()
+	if config.clusterAnnounceIP != "" {
+		cluster.myself.ip = config.clusterAnnounceIP
+	}
+	return nil
+}
+
+func parseClusterConfig(data string) error {
+	type openSlot struct {
+		slot      int
+		importing bool
+		id        string
+	}
+	var open []openSlot
+	claims := map[*clusterNode][]string{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					cluster.currentEpoch, _ = strconv.ParseUint(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		corrupted := fmt.Errorf("Unrecoverable error: corrupted cluster config file \"%s\".", line)
+		if len(fields) < 8 {
+			return corrupted
+		}
+		n := &clusterNode{id: fields[0]}
+		var err error
+		if n.ip, n.port, n.cport, err = parseNodeAddress(fields[1]); err != nil {
+			return corrupted
+		}
+		if n.configEpoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+			return corrupted
+		}
+		for _, flag := range strings.Split(fields[2], ",") {
+			if flag == "myself" {
+				cluster.myself = n
+			}
+		}
+		cluster.nodes[n.id] = n
+		for _, field := range fields[8:] {
+			// the slots moving from or to this node are written [slot->-id] and [slot-<-id]
+			if strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]") {
+				inner := strings.Trim(field, "[]")
+				first, id, migrating := strings.Cut(inner, "->-")
+				importing := false
+				if !migrating {
+					first, id, importing = strings.Cut(inner, "-<-")
+				}
+				slot, err := strconv.Atoi(first)
+				if !migrating && !importing || err != nil || slot < 0 || slot >= clusterSlots {
+					return corrupted
+				}
+				open = append(open, openSlot{slot, importing, id})
+				continue
+			}
+			claims[n] = append(claims[n], field)
+		}
+	}
+	if cluster.myself == nil {
+		return errors.New("Unrecoverable error: the cluster config file has no node flagged as myself.")
+	}
+	for n, ranges := range claims {
+		for _, r := range ranges {
+			start, end, err := parseSlotRange(r)
+			if err != nil {
+				return fmt.Errorf("Unrecoverable error: invalid slot range %s in the cluster config file.", r)
+			}
+			for slot := start; slot <= end; slot++ {
+				cluster.slots[slot] = n
+			}
+		}
+	}
+	for _, o := range open {
+		n := cluster.nodes[o.id]
+		if n == nil {
+			return fmt.Errorf("Unrecoverable error: unknown node %s in the cluster config file.", o.id)
+		}
+		if o.importing {
+			cluster.importing[o.slot] = n
+		} else {
+			cluster.migrating[o.slot] = n
+		}
+	}
+	return nil
+}
+
+// parseNodeAddress reads the ip:port@cport address of a node
+func parseNodeAddress(s string) (ip string, port, cport int, err error) {
+	at := strings.LastIndexByte(s, '@')
+	colon := strings.LastIndexByte(s[:max(at, 0)], ':')
+	if at < 0 || colon < 0 {
+		return "", 0, 0, errors.New("invalid address")
+	}
+	if port, err = strconv.Atoi(s[colon+1 : at]); err != nil {
+		return "", 0, 0, err
+	}
+	if cport, err = strconv.Atoi(s[at+1:]); err != nil {
+		return "", 0, 0, err
+	}
+	return s[:colon], port, cport, nil
+}
+
+// parseSlotRange reads a slot or a start-end range of slots
+func parseSlotRange(s string) (int, int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	start, err := strconv.Atoi(first)
+	end := start
+	if err == nil && isRange {
+		end, err = strconv.Atoi(last)
+	}
+	if err != nil || start < 0 || end < start || end >= clusterSlots {
+		return 0, 0, errors.New("invalid slot range")
+	}
+	return start, end, nil
+}
+
+// saveClusterConfig writes the cluster config file, replacing the previous one at once. The caller must hold mu.
+func saveClusterConfig() error {
+	content := fmt.Sprintf("%svars currentEpoch %d lastVoteEpoch 0\n", clusterNodesDescription(), cluster.currentEpoch)
+	path := clusterConfigPath()
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("Could not save the cluster config file %s: %v", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Could not save the cluster config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// saveClusterConfigOrLog saves the cluster config file after a change that must not fail. The caller must hold mu.
+func saveClusterConfigOrLog() {
+	if err := saveClusterConfig(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// clusterStateOK reports whether the cluster serves keys: with cluster-require-full-coverage only while
+// every slot is served by a node that isn't failing. The caller must hold mu.
+func clusterStateOK() bool {
+	if !config.clusterRequireFullCoverage {
+		return true
+	}
+	for _, n := range cluster.slots {
+		if n == nil || n.failing() {
+			return false
+		}
+	}
+	return true
+}
+
+// failing reports whether the node did not answer a PING for the node timeout. The caller must hold mu.
+func (n *clusterNode) failing() bool {
+	return n != cluster.myself && !n.pingSent.IsZero() && time.Since(n.pingSent) > clusterNodeTimeout()
+}
+
+// assignSlot makes n the owner of slot, unassigning it when nil, and drops the shard channel
+// subscriptions of the slot when this node stops serving it. The caller must hold mu.
+func assignSlot(slot int, n *clusterNode) {
+	if cluster.slots[slot] == cluster.myself && n != cluster.myself {
+		removeShardChannelsInSlot(slot)
+	}
+	cluster.slots[slot] = n
+}
+
+// slotRanges returns the ranges of the slots owned by n, single slots standing alone. The caller must hold mu.
+func slotRanges(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cluster.slots[slot] != n {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1][1] == slot-1 {
+			ranges[len(ranges)-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+func formatSlotRange(r [2]int) string {
+	if r[0] == r[1] {
+		return strconv.Itoa(r[0])
+	}
+	return fmt.Sprintf("%d-%d", r[0], r[1])
+}
+
+// sortedNodes returns the nodes of the cluster ordered by ID. The caller must hold mu.
+func sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cluster.nodes))
+	for _, id := range sortedNames(cluster.nodes) {
+		nodes = append(nodes, cluster.nodes[id])
+	}
+	return nodes
+}
+
+// clusterNodesDescription is the reply of CLUSTER NODES, one line per node. The caller must hold mu.
+func clusterNodesDescription() string {
+	var b strings.Builder
+	for _, n := range sortedNodes() {
+		flags := "master"
+		if n == cluster.myself {
+			flags = "myself,master"
+		} else if n.failing() {
+			flags = "master,fail?"
+		}
+		linkState := "disconnected"
+		if n == cluster.myself || n.linked {
+			linkState = "connected"
+		}
+		fmt.Fprintf(&b, "%s %s:%d@%d %s - %d %d %d %s", n.id, n.ip, n.port, n.cport, flags,
+			unixMilli(n.pingSent), unixMilli(n.pongReceived), n.configEpoch, linkState)
+		for _, r := range slotRanges(n) {
+			b.WriteString(" " + formatSlotRange(r))
+		}
+		if n == cluster.myself {
+			for _, slot := range sortedSlots(cluster.migrating) {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, cluster.migrating[slot].id)
+			}
+			for _, slot := range sortedSlots(cluster.importing) {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, cluster.importing[slot].id)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func sortedSlots(m map[int]*clusterNode) []int {
+	slots := make([]int, 0, len(m))
+	for slot := range m {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// keyExistsInDB0 reports whether key is set in the only database of cluster mode, without expiring it.
+// The caller must hold mu.
+func keyExistsInDB0(key string) bool {
+	entry, exists := databases[0].entries[key]
+	return exists && !entry.expired(time.Now())
+}
+
+// clusterRedirect returns the error sending the client to the node serving the keys of its command, or
+// of its transaction for EXEC, none when this node serves them. The caller must hold mu.
+func (c *Client) clusterRedirect(name string, cmd command, args []BulkString) string {
+	if !config.clusterEnabled || c.master || c.aofLoader {
+		return ""
+	}
+	cmds := []queuedCommand{{cmd: cmd, args: args}}
+	if name == "EXEC" {
+		if c.multi == nil {
+			return ""
+		}
+		cmds = c.multi.commands
+	}
+
+	slot, multipleKeys := -1, false
+	var first string
+	var keys []commandKey
+	for _, q := range cmds {
+		for _, k := range q.cmd.commandKeys(q.args) {
+			s := keyHashSlot(k.key)
+			switch {
+			case slot < 0:
+				if cluster.slots[s] == nil {
+					return "CLUSTERDOWN Hash slot not served"
+				}
+				slot, first = s, k.key
+			case s != slot:
+				return "CROSSSLOT Keys in request don't hash to the same slot"
+			case k.key != first:
+				multipleKeys = true
+			}
+			keys = append(keys, k)
+		}
+	}
+	if slot < 0 {
+		return ""
+	}
+	if !clusterStateOK() {
+		return "CLUSTERDOWN The cluster is down"
+	}
+
+	// keys of a slot being moved are served where they are, the missing ones being looked for on the other node
+	migrating, importing := cluster.migrating[slot], cluster.importing[slot]
+	missing := 0
+	if migrating != nil || importing != nil {
+		for _, k := range keys {
+			if k.flags&keyNotKey == 0 && !keyExistsInDB0(k.key) {
+				missing++
+			}
+		}
+	}
+	if migrating != nil && missing > 0 {
+		return fmt.Sprintf("ASK %d %s:%d", slot, migrating.ip, migrating.port)
+	}
+	if importing != nil && c.asking {
+		if multipleKeys && missing > 0 {
+			return "TRYAGAIN Multiple keys request during rehashing of slot"
+		}
+		return ""
+	}
+	if owner := cluster.slots[slot]; owner != cluster.myself {
+		return fmt.Sprintf("MOVED %d %s:%d", slot, owner.ip, owner.port)
+	}
+	return ""
+}
+
+// clusterMessage is a message of this node on the cluster bus: PING, PONG or MEET followed by who this
+// node is, its epochs, its slots and the nodes it knows. The caller must hold mu.
+func clusterMessage(typ string) []byte {
+	myself := cluster.myself
+	var ranges []string
+	for _, r := range slotRanges(myself) {
+		ranges = append(ranges, formatSlotRange(r))
+	}
+	args := []string{typ, myself.id, config.clusterAnnounceIP, strconv.Itoa(myself.port), strconv.Itoa(myself.cport),
+		strconv.FormatUint(myself.configEpoch, 10), strconv.FormatUint(cluster.currentEpoch, 10), strings.Join(ranges, ",")}
+	for _, n := range sortedNodes() {
+		if n != myself {
+			args = append(args, n.id, n.ip, strconv.Itoa(n.port), strconv.Itoa(n.cport))
+		}
+	}
+	cluster.messagesSent++
+	return appendCommand(nil, args)
+}
+
+// processClusterMessage applies a message of the node at remoteHost, localHost being our address on the
+// connection. Unknown nodes are only added when they MEET this node or answer its MEET, the ones they
+// know being added along. The caller must hold mu.
+func processClusterMessage(args []string, remoteHost, localHost string, meet bool) {
+	if len(args) < 8 || (len(args)-8)%4 != 0 || args[1] == cluster.myself.id {
+		return
+	}
+	cluster.messagesReceived++
+	typ, id, ip := args[0], args[1], args[2]
+	port, err1 := strconv.Atoi(args[3])
+	cport, err2 := strconv.Atoi(args[4])
+	configEpoch, err3 := strconv.ParseUint(args[5], 10, 64)
+	currentEpoch, err4 := strconv.ParseUint(args[6], 10, 64)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return
+	}
+	if ip == "" {
+		ip = remoteHost
+	}
+
+	// a node learns its address from the others unless it announces one
+	if typ != "PONG" && config.clusterAnnounceIP == "" && (typ == "MEET" || cluster.myself.ip == "") && localHost != "" {
+		cluster.myself.ip = localHost
+	}
+	changed := false
+	sender := cluster.nodes[id]
+	if sender == nil {
+		if typ != "MEET" && !meet {
+			return
+		}
+		sender = addClusterNode(id, ip, port, cport)
+		changed = true
+	}
+	if sender.ip != ip || sender.port != port || sender.cport != cport || sender.configEpoch != configEpoch {
+		sender.ip, sender.port, sender.cport, sender.configEpoch = ip, port, cport, configEpoch
+		changed = true
+	}
+	if typ == "PONG" {
+		sender.pongReceived, sender.pingSent = time.Now(), time.Time{}
+	}
+	if currentEpoch > cluster.currentEpoch {
+		cluster.currentEpoch = currentEpoch
+		changed = true
+	}
+
+	// a claim wins over the one of an older config epoch
+	if args[7] != "" {
+		for _, r := range strings.Split(args[7], ",") {
+			start, end, err := parseSlotRange(r)
+			if err != nil {
+				continue
+			}
+			for slot := start; slot <= end; slot++ {
+				owner := cluster.slots[slot]
+				if owner == sender || cluster.importing[slot] != nil {
+					continue
+				}
+				if owner == nil || owner.configEpoch < sender.configEpoch {
+					assignSlot(slot, sender)
+					delete(cluster.migrating, slot)
+					changed = true
+				}
+			}
+		}
+	}
+	// of two nodes with the same config epoch the one with the greater ID moves to a new one
+	if sender.configEpoch == cluster.myself.configEpoch && cluster.myself.id > sender.id {
+		cluster.currentEpoch++
+		cluster.myself.configEpoch = cluster.currentEpoch
+		changed = true
+	}
+
+	for i := 8; i+3 < len(args); i += 4 {
+		if _, known := cluster.nodes[args[i]]; known || args[i] == cluster.myself.id {
+			continue
+		}
+		port, err1 := strconv.Atoi(args[i+2])
+		cport, err2 := strconv.Atoi(args[i+3])
+		if err1 == nil && err2 == nil && args[i+1] != "" {
+			addClusterNode(args[i], args[i+1], port, cport)
+			changed = true
+		}
+	}
+	if changed {
+		saveClusterConfigOrLog()
+	}
+}
+
+// addClusterNode adds a node to the cluster and starts pinging it. The caller must hold mu.
+func addClusterNode(id, ip string, port, cport int) *clusterNode {
+	n := &clusterNode{id: id, ip: ip, port: port, cport: cport}
+	cluster.nodes[id] = n
+	go n.runLink()
+	return n
+}
+
+// runLink keeps a bus connection to the node, reconnecting every clusterPingInterval, until it is forgotten
+func (n *clusterNode) runLink() {
+	for {
+		mu.Lock()
+		forgotten := n.forgotten
+		if n.pingSent.IsZero() {
+			n.pingSent = time.Now()
+		}
+		address, timeout := net.JoinHostPort(n.ip, strconv.Itoa(n.cport)), clusterNodeTimeout()
+		mu.Unlock()
+		if forgotten {
+			return
+		}
+		if conn, err := net.DialTimeout("tcp", address, timeout); err == nil {
+			n.ping(conn, timeout)
+			conn.Close()
+			mu.Lock()
+			n.linked = false
+			mu.Unlock()
+		}
+		time.Sleep(clusterPingInterval)
+	}
+}
+
+// ping sends the node a PING and reads its PONG every clusterPingInterval until the connection fails
+func (n *clusterNode) ping(conn net.Conn, timeout time.Duration) {
+	r := bufio.NewReader(conn)
+	localHost, remoteHost := hostOf(conn.LocalAddr()), hostOf(conn.RemoteAddr())
+	for {
+		mu.Lock()
+		if n.forgotten {
+			mu.Unlock()
+			return
+		}
+		n.linked = true
+		if n.pingSent.IsZero() {
+			n.pingSent = time.Now()
+		}
+		msg := clusterMessage("PING")
+		mu.Unlock()
+
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+		frame, _, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		processClusterMessage(frameArgs(frame), remoteHost, localHost, false)
+		mu.Unlock()
+		time.Sleep(clusterPingInterval)
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func serveClusterBus(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handleClusterBusConn(conn)
+	}
+}
+
+// handleClusterBusConn answers the PING and MEET messages the other nodes send on conn with a PONG
+func handleClusterBusConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	localHost, remoteHost := hostOf(conn.LocalAddr()), hostOf(conn.RemoteAddr())
+	for {
+		frame, name, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		name = strings.ToUpper(name)
+		if name != "PING" && name != "MEET" {
+			continue
+		}
+		mu.Lock()
+		processClusterMessage(frameArgs(frame), remoteHost, localHost, false)
+		reply := clusterMessage("PONG")
+		mu.Unlock()
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// clusterMeet sends a MEET to the node at ip, adding it to the cluster once it answers
+func clusterMeet(ip string, cport int) {
+	mu.Lock()
+	msg, timeout := clusterMessage("MEET"), clusterNodeTimeout()
+	mu.Unlock()
+	address := net.JoinHostPort(ip, strconv.Itoa(cport))
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		fmt.Printf("Unable to meet the node at %s: %v\n", address, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(msg); err != nil {
+		fmt.Printf("Unable to meet the node at %s: %v\n", address, err)
+		return
+	}
+	frame, _, err := readCommand(bufio.NewReader(conn))
+	if err != nil {
+		fmt.Printf("Unable to meet the node at %s: %v\n", address, err)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	processClusterMessage(frameArgs(frame), ip, hostOf(conn.LocalAddr()), true)
+}
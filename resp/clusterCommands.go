@@ -0,0 +1,345 @@
+package resp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const clusterDisabledError = "ERR This instance has cluster support disabled"
+
+// handleCluster implements the CLUSTER subcommands, which are only available in cluster mode
+func handleCluster(c *Client, args ...BulkString) ([]byte, error) {
+	sub := strings.ToUpper(*args[1].Value)
+	if sub == "HELP" && len(args) == 2 {
+		return clusterHelp()
+	}
+	if !config.clusterEnabled {
+		return errorReply(clusterDisabledError)
+	}
+	switch {
+	case sub == "INFO" && len(args) == 2:
+		return SerializeBulkString(bulkString(clusterInfo()))
+	case sub == "MYID" && len(args) == 2:
+		return SerializeBulkString(bulkString(cluster.myself.id))
+	case sub == "NODES" && len(args) == 2:
+		return SerializeBulkString(bulkString(clusterNodesDescription()))
+	case sub == "KEYSLOT" && len(args) == 3:
+		return SerializeInteger(Integer{Value: keyHashSlot(*args[2].Value)})
+	case sub == "COUNTKEYSINSLOT" && len(args) == 3:
+		slot, err := strconv.Atoi(*args[2].Value)
+		if err != nil || slot < 0 || slot >= clusterSlots {
+			return errorReply("ERR Invalid slot")
+		}
+		return SerializeInteger(Integer{Value: len(keysInSlot(slot, -1))})
+	case sub == "GETKEYSINSLOT" && len(args) == 4:
+		slot, err1 := strconv.Atoi(*args[2].Value)
+		count, err2 := strconv.Atoi(*args[3].Value)
+		if err1 != nil || err2 != nil || slot < 0 || slot >= clusterSlots || count < 0 {
+			return errorReply("ERR Invalid slot or number of keys")
+		}
+		return SerializeArray(bulkStrings(keysInSlot(slot, count)))
+	case sub == "SLOTS" && len(args) == 2:
+		return SerializeArray(clusterSlotsReply())
+	case sub == "SHARDS" && len(args) == 2:
+		return SerializeArray(clusterShards(c))
+	case (sub == "ADDSLOTS" || sub == "DELSLOTS") && len(args) >= 3:
+		return clusterChangeSlots(sub == "ADDSLOTS", args[2:], false)
+	case (sub == "ADDSLOTSRANGE" || sub == "DELSLOTSRANGE") && len(args) >= 4 && len(args)%2 == 0:
+		return clusterChangeSlots(sub == "ADDSLOTSRANGE", args[2:], true)
+	case sub == "SETSLOT" && len(args) >= 4:
+		return clusterSetSlot(args[2:])
+	case sub == "MEET" && (len(args) == 4 || len(args) == 5):
+		return clusterMeetCommand(args[2:])
+	}
+	return subcommandSyntaxReply("cluster", *args[1].Value)
+}
+
+func clusterHelp() ([]byte, error) {
+	return helpReply(
+		"CLUSTER <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"ADDSLOTS <slot> [<slot> ...]",
+		"    Assign slots to current node.",
+		"ADDSLOTSRANGE <start slot> <end slot> [<start slot> <end slot> ...]",
+		"    Assign slots which are between <start-slot> and <end-slot> to current node.",
+		"COUNTKEYSINSLOT <slot>",
+		"    Return the number of keys in <slot>.",
+		"DELSLOTS <slot> [<slot> ...]",
+		"    Delete slots information from current node.",
+		"DELSLOTSRANGE <start slot> <end slot> [<start slot> <end slot> ...]",
+		"    Delete slots information which are between <start-slot> and <end-slot> from current node.",
+		"GETKEYSINSLOT <slot> <count>",
+		"    Return key names stored by current node in a slot.",
+		"INFO",
+		"    Return information about the cluster.",
+		"KEYSLOT <key>",
+		"    Return the hash slot for <key>.",
+		"MEET <ip> <port> [<bus-port>]",
+		"    Connect nodes into a working cluster.",
+		"MYID",
+		"    Return the node id.",
+		"NODES",
+		"    Return cluster configuration seen by node. Output format:",
+		"    <id> <ip:port@bus-port> <flags> <master> <pings> <pongs> <epoch> <link> <slot> ...",
+		"SETSLOT <slot> (IMPORTING <node-id>|MIGRATING <node-id>|STABLE|NODE <node-id>)",
+		"    Set slot state.",
+		"SHARDS",
+		"    Return information about slot range mappings and the nodes associated with them.",
+		"SLOTS",
+		"    Return information about slots range mappings. Each range is made of:",
+		"    start, end, master and replicas IP addresses, ports and ids",
+		"HELP",
+		"    Print this help.",
+	)
+}
+
+// handleAsking lets the next command use a slot this node is importing
+func handleAsking(c *Client, args ...BulkString) ([]byte, error) {
+	if !config.clusterEnabled {
+		return errorReply(clusterDisabledError)
+	}
+	c.asking = true
+	return []byte("+OK\r\n"), nil
+}
+
+// clusterInfo is the reply of CLUSTER INFO. The caller must hold mu.
+func clusterInfo() string {
+	state, assigned, pfail := "ok", 0, 0
+	if !clusterStateOK() {
+		state = "fail"
+	}
+	for _, n := range cluster.slots {
+		if n != nil {
+			assigned++
+			if n.failing() {
+				pfail++
+			}
+		}
+	}
+	size := 0
+	for _, n := range cluster.nodes {
+		if len(slotRanges(n)) > 0 {
+			size++
+		}
+	}
+	lines := []string{
+		"cluster_state:" + state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		"cluster_slots_fail:0",
+		fmt.Sprintf("cluster_known_nodes:%d", len(cluster.nodes)),
+		fmt.Sprintf("cluster_size:%d", size),
+		fmt.Sprintf("cluster_current_epoch:%d", cluster.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", cluster.myself.configEpoch),
+		fmt.Sprintf("cluster_stats_messages_sent:%d", cluster.messagesSent),
+		fmt.Sprintf("cluster_stats_messages_received:%d", cluster.messagesReceived),
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// keysInSlot returns the keys of slot, sorted, at most count of them unless count is negative. Cluster
+// mode only uses the first database. The caller must hold mu.
+func keysInSlot(slot, count int) []string {
+	var keys []string
+	for _, key := range sortedNames(databases[0].entries) {
+		if count >= 0 && len(keys) == count {
+			break
+		}
+		if keyHashSlot(key) == slot && keyExistsInDB0(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// clusterSlotsReply lists the slot ranges with the node serving each. The caller must hold mu.
+func clusterSlotsReply() Array {
+	var ranges []RESPData
+	for start := 0; start < clusterSlots; {
+		n := cluster.slots[start]
+		end := start
+		for end+1 < clusterSlots && cluster.slots[end+1] == n {
+			end++
+		}
+		if n != nil {
+			ranges = append(ranges, Array{Elements: &[]RESPData{
+				Integer{Value: start},
+				Integer{Value: end},
+				Array{Elements: &[]RESPData{bulkString(n.ip), Integer{Value: n.port}, bulkString(n.id), Array{Elements: &[]RESPData{}}}},
+			}})
+		}
+		start = end + 1
+	}
+	if ranges == nil {
+		ranges = []RESPData{}
+	}
+	return Array{Elements: &ranges}
+}
+
+// clusterShards describes every node with its slots, each being a shard of its own without replicas.
+// The caller must hold mu.
+func clusterShards(c *Client) Array {
+	shards := []RESPData{}
+	for _, n := range sortedNodes() {
+		slots := []RESPData{}
+		for _, r := range slotRanges(n) {
+			slots = append(slots, Integer{Value: r[0]}, Integer{Value: r[1]})
+		}
+		health := "online"
+		if n.failing() {
+			health = "failed"
+		}
+		node := c.mapOf([]RESPData{
+			bulkString("id"), bulkString(n.id),
+			bulkString("port"), Integer{Value: n.port},
+			bulkString("ip"), bulkString(n.ip),
+			bulkString("endpoint"), bulkString(n.ip),
+			bulkString("role"), bulkString("master"),
+			bulkString("replication-offset"), Integer{Value: int(replicationState.offset)},
+			bulkString("health"), bulkString(health),
+		})
+		shards = append(shards, c.mapOf([]RESPData{
+			bulkString("slots"), Array{Elements: &slots},
+			bulkString("nodes"), Array{Elements: &[]RESPData{node}},
+		}))
+	}
+	return Array{Elements: &shards}
+}
+
+// parseSlot reads a slot argument
+func parseSlot(arg BulkString) (int, bool) {
+	slot, err := strconv.Atoi(*arg.Value)
+	return slot, err == nil && slot >= 0 && slot < clusterSlots
+}
+
+// clusterChangeSlots assigns slots to this node or unassigns them, given one by one or as start end pairs
+// with ranges. Nothing changes unless every slot can.
+func clusterChangeSlots(add bool, args []BulkString, ranges bool) ([]byte, error) {
+	var slots []int
+	for i := 0; i < len(args); i++ {
+		start, ok := parseSlot(args[i])
+		if !ok {
+			return errorReply("ERR Invalid or out of range slot")
+		}
+		end := start
+		if ranges {
+			i++
+			if end, ok = parseSlot(args[i]); !ok {
+				return errorReply("ERR Invalid or out of range slot")
+			}
+			if start > end {
+				return errorReply(fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", start, end))
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+
+	seen := map[int]bool{}
+	for _, slot := range slots {
+		if seen[slot] {
+			return errorReply(fmt.Sprintf("ERR Slot %d specified multiple times", slot))
+		}
+		seen[slot] = true
+		if add && cluster.slots[slot] != nil {
+			return errorReply(fmt.Sprintf("ERR Slot %d is already busy", slot))
+		}
+		if !add && cluster.slots[slot] == nil {
+			return errorReply(fmt.Sprintf("ERR Slot %d is already unassigned", slot))
+		}
+	}
+	for _, slot := range slots {
+		if add {
+			delete(cluster.importing, slot)
+			assignSlot(slot, cluster.myself)
+		} else {
+			assignSlot(slot, nil)
+		}
+	}
+	saveClusterConfigOrLog()
+	return []byte("+OK\r\n"), nil
+}
+
+// clusterSetSlot moves a slot between nodes: MIGRATING on the node it leaves and IMPORTING on the one it
+// goes to while the keys move, then NODE on both once they did, STABLE dropping the move
+func clusterSetSlot(args []BulkString) ([]byte, error) {
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return errorReply("ERR Invalid or out of range slot")
+	}
+	action := strings.ToUpper(*args[1].Value)
+	if action == "STABLE" {
+		if len(args) != 2 {
+			return errorReply(errSyntax.Error())
+		}
+		delete(cluster.migrating, slot)
+		delete(cluster.importing, slot)
+		saveClusterConfigOrLog()
+		return []byte("+OK\r\n"), nil
+	}
+	if len(args) != 3 || action != "MIGRATING" && action != "IMPORTING" && action != "NODE" {
+		return errorReply(errSyntax.Error())
+	}
+	n := cluster.nodes[*args[2].Value]
+	if n == nil {
+		return errorReply("ERR I don't know about node " + *args[2].Value)
+	}
+
+	switch action {
+	case "MIGRATING":
+		if cluster.slots[slot] != cluster.myself {
+			return errorReply(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		if n == cluster.myself {
+			return errorReply(fmt.Sprintf("ERR I'm the owner of hash slot %d. I can't migrate it to myself", slot))
+		}
+		cluster.migrating[slot] = n
+	case "IMPORTING":
+		if cluster.slots[slot] == cluster.myself {
+			return errorReply(fmt.Sprintf("ERR We are already owner of hash slot %d", slot))
+		}
+		if n == cluster.myself {
+			return errorReply(fmt.Sprintf("ERR I'm the owner of hash slot %d. I can't import it from myself", slot))
+		}
+		cluster.importing[slot] = n
+	case "NODE":
+		if cluster.slots[slot] == cluster.myself && n != cluster.myself && len(keysInSlot(slot, 1)) > 0 {
+			return errorReply(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		if n != cluster.myself {
+			delete(cluster.migrating, slot)
+		}
+		// the slot imported is claimed with a new epoch, so the other nodes prefer this claim
+		if n == cluster.myself && cluster.importing[slot] != nil {
+			delete(cluster.importing, slot)
+			cluster.currentEpoch++
+			cluster.myself.configEpoch = cluster.currentEpoch
+		}
+		assignSlot(slot, n)
+	}
+	saveClusterConfigOrLog()
+	return []byte("+OK\r\n"), nil
+}
+
+// clusterMeetCommand adds the node at the address to the cluster once it answers the MEET sent meanwhile
+func clusterMeetCommand(args []BulkString) ([]byte, error) {
+	ip := *args[0].Value
+	port, err := strconv.Atoi(*args[1].Value)
+	if err != nil || port < 0 || port > 65535 {
+		return errorReply("ERR Invalid base port specified: " + *args[1].Value)
+	}
+	cport := port + 10000
+	if len(args) == 3 {
+		if cport, err = strconv.Atoi(*args[2].Value); err != nil || cport < 0 || cport > 65535 {
+			return errorReply("ERR Invalid bus port specified: " + *args[2].Value)
+		}
+	}
+	if net.ParseIP(ip) == nil {
+		return errorReply(fmt.Sprintf("ERR Invalid node address specified: %s:%d", ip, port))
+	}
+	go clusterMeet(ip, cport)
+	return []byte("+OK\r\n"), nil
+}
@@ -0,0 +1,223 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enableCluster turns on cluster mode for the test with a new node keeping its state in a temporary directory
+func enableCluster(t *testing.T) {
+	t.Helper()
+	useTempDir(t)
+	mu.Lock()
+	defer mu.Unlock()
+	config.clusterEnabled = true
+	if err := loadClusterConfig(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		resetClusterState()
+		config.clusterEnabled = false
+	})
+}
+
+// resetClusterState forgets every node, stopping their links
+func resetClusterState() {
+	for _, n := range cluster.nodes {
+		n.forgotten = true
+	}
+	cluster.myself, cluster.nodes, cluster.slots = nil, map[string]*clusterNode{}, [clusterSlots]*clusterNode{}
+	cluster.migrating, cluster.importing = map[int]*clusterNode{}, map[int]*clusterNode{}
+	cluster.currentEpoch = 0
+}
+
+// keyInSlot returns a key of slot
+func keyInSlot(slot int) string {
+	for i := 0; ; i++ {
+		if key := "key:" + strconv.Itoa(i); keyHashSlot(key) == slot {
+			return key
+		}
+	}
+}
+
+func TestClusterCommands(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"disabled", []string{"CLUSTER", "INFO"}, "-" + clusterDisabledError + "\r\n"},
+		{"asking disabled", []string{"ASKING"}, "-" + clusterDisabledError + "\r\n"},
+	})
+	enableCluster(t)
+	mu.RLock()
+	myID := cluster.myself.id
+	mu.RUnlock()
+
+	runCommandCases(t, []commandCase{
+		{"myid", []string{"CLUSTER", "MYID"}, "$40\r\n" + myID + "\r\n"},
+		{"keyslot", []string{"CLUSTER", "KEYSLOT", "{bar}.x"}, ":5061\r\n"},
+		{"addslots", []string{"CLUSTER", "ADDSLOTSRANGE", "0", "16383"}, "+OK\r\n"},
+		{"busy", []string{"CLUSTER", "ADDSLOTS", "5"}, "-ERR Slot 5 is already busy\r\n"},
+		{"delslots", []string{"CLUSTER", "DELSLOTS", "5"}, "+OK\r\n"},
+		{"unassigned", []string{"CLUSTER", "DELSLOTS", "5", "6"}, "-ERR Slot 5 is already unassigned\r\n"},
+		{"twice", []string{"CLUSTER", "ADDSLOTS", "5", "5"}, "-ERR Slot 5 specified multiple times\r\n"},
+		{"out of range", []string{"CLUSTER", "ADDSLOTS", "16384"}, "-ERR Invalid or out of range slot\r\n"},
+		{"reversed range", []string{"CLUSTER", "ADDSLOTSRANGE", "6", "5"}, "-ERR start slot number 6 is greater than end slot number 5\r\n"},
+		{"addslot", []string{"CLUSTER", "ADDSLOTS", "5"}, "+OK\r\n"},
+
+		{"set", []string{"SET", "foo", "v"}, "+OK\r\n"},
+		{"set tagged", []string{"SET", "{foo}.x", "v"}, "+OK\r\n"},
+		{"count", []string{"CLUSTER", "COUNTKEYSINSLOT", "12182"}, ":2\r\n"},
+		{"count invalid", []string{"CLUSTER", "COUNTKEYSINSLOT", "-1"}, "-ERR Invalid slot\r\n"},
+		{"getkeys", []string{"CLUSTER", "GETKEYSINSLOT", "12182", "1"}, "*1\r\n$3\r\nfoo\r\n"},
+		{"getkeys invalid", []string{"CLUSTER", "GETKEYSINSLOT", "12182", "-1"}, "-ERR Invalid slot or number of keys\r\n"},
+		{"slots", []string{"CLUSTER", "SLOTS"}, fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*4\r\n$0\r\n\r\n:6379\r\n$40\r\n%s\r\n*0\r\n", myID)},
+		{"select", []string{"SELECT", "1"}, "-ERR SELECT is not allowed in cluster mode\r\n"},
+		{"select 0", []string{"SELECT", "0"}, "+OK\r\n"},
+		{"swapdb", []string{"SWAPDB", "0", "1"}, "-ERR SWAPDB is not allowed in cluster mode\r\n"},
+		{"setslot unknown", []string{"CLUSTER", "SETSLOT", "5", "MIGRATING", "nope"}, "-ERR I don't know about node nope\r\n"},
+		{"unknown", []string{"CLUSTER", "NOPE"}, "-ERR unknown subcommand or wrong number of arguments for 'NOPE'. Try CLUSTER HELP.\r\n"},
+		{"del", []string{"DEL", "foo", "{foo}.x"}, ":2\r\n"},
+	})
+
+	reply, _ := ExecuteRespData(respCommand("CLUSTER", "INFO"))
+	if !strings.Contains(string(reply), "cluster_state:ok\r\ncluster_slots_assigned:16384\r\n") {
+		t.Errorf("expected the cluster to be ok, got %q", reply)
+	}
+	reply, _ = ExecuteRespData(respCommand("CLUSTER", "NODES"))
+	if expected := fmt.Sprintf("%s :6379@16379 myself,master - 0 0 0 connected 0-16383\n", myID); string(reply) != fmt.Sprintf("$%d\r\n%s\r\n", len(expected), expected) {
+		t.Errorf("expected %q, got %q", expected, reply)
+	}
+
+	// the state is read back from the cluster config file
+	mu.Lock()
+	cluster.migrating[7] = cluster.myself
+	saveClusterConfigOrLog()
+	resetClusterState()
+	err := loadClusterConfig()
+	mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if cluster.myself == nil || cluster.myself.id != myID || cluster.slots[16383] != cluster.myself || cluster.migrating[7] != cluster.myself {
+		t.Errorf("expected the node to be loaded from the config file, got %+v", cluster.myself)
+	}
+}
+
+// peerID is the ID of the node the tests pretend to be, greater than any other so it keeps its epoch
+var peerID = strings.Repeat("f", 40)
+
+// peerMessage is a message of the cluster bus from the node of the test
+func peerMessage(typ string, epoch int, slots string) []byte {
+	return appendCommand(nil, []string{typ, peerID, "", "7001", strconv.Itoa(closedPort), strconv.Itoa(epoch), strconv.Itoa(epoch), slots})
+}
+
+// closedPort is a port nothing listens on, for the cluster bus of the node of the test
+var closedPort = func() int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 1
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}()
+
+// sendPeerMessage sends a message to the cluster bus, returning what the node answered
+func sendPeerMessage(t *testing.T, conn net.Conn, r *bufio.Reader, msg []byte) []string {
+	t.Helper()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	frame, _, err := readCommand(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frameArgs(frame)
+}
+
+func TestClusterRedirections(t *testing.T) {
+	enableCluster(t)
+	peerConn, busConn := connPair(t)
+	peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	go handleClusterBusConn(busConn)
+	bus := bufio.NewReader(peerConn)
+
+	// only a MEET adds an unknown node
+	sendPeerMessage(t, peerConn, bus, peerMessage("PING", 0, "8192-16383"))
+	mu.RLock()
+	known := len(cluster.nodes)
+	mu.RUnlock()
+	if known != 1 {
+		t.Fatalf("expected a PING of an unknown node to be ignored, got %d nodes", known)
+	}
+	runCommandCases(t, []commandCase{{"addslots", []string{"CLUSTER", "ADDSLOTSRANGE", "0", "8191"}, "+OK\r\n"}})
+	pong := sendPeerMessage(t, peerConn, bus, peerMessage("MEET", 0, "8192-16383"))
+	mu.RLock()
+	myID := cluster.myself.id
+	mu.RUnlock()
+	if len(pong) < 8 || pong[0] != "PONG" || pong[1] != myID || pong[7] != "0-8191" {
+		t.Fatalf("expected a PONG with our slots, got %v", pong)
+	}
+
+	slot0 := keyInSlot(0)
+	c := NewClient()
+	runClientCommandCases(t, c, []commandCase{
+		{"served", []string{"SET", "bar", "v"}, "+OK\r\n"},
+		{"moved", []string{"GET", "foo"}, "-MOVED 12182 127.0.0.1:7001\r\n"},
+		{"crossslot", []string{"DEL", "bar", slot0}, "-CROSSSLOT Keys in request don't hash to the same slot\r\n"},
+		{"same slot", []string{"DEL", "{bar}.a", "{bar}.b"}, ":0\r\n"},
+		{"spublish", []string{"SPUBLISH", "foo", "hi"}, "-MOVED 12182 127.0.0.1:7001\r\n"},
+		{"no keys", []string{"PING"}, "+PONG\r\n"},
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"queued moved", []string{"GET", "foo"}, "-MOVED 12182 127.0.0.1:7001\r\n"},
+		{"exec", []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+
+		// the missing keys of a slot moving away are asked for on the other node
+		{"migrating", []string{"CLUSTER", "SETSLOT", "5061", "MIGRATING", peerID}, "+OK\r\n"},
+		{"existing", []string{"GET", "bar"}, "$1\r\nv\r\n"},
+		{"ask", []string{"GET", "{bar}.missing"}, "-ASK 5061 127.0.0.1:7001\r\n"},
+		{"stable", []string{"CLUSTER", "SETSLOT", "5061", "STABLE"}, "+OK\r\n"},
+
+		// and a slot moving here is only served after ASKING
+		{"importing", []string{"CLUSTER", "SETSLOT", "12182", "IMPORTING", peerID}, "+OK\r\n"},
+		{"not asking", []string{"GET", "foo"}, "-MOVED 12182 127.0.0.1:7001\r\n"},
+		{"asking", []string{"ASKING"}, "+OK\r\n"},
+		{"asked", []string{"SET", "foo", "v"}, "+OK\r\n"},
+		{"asking once", []string{"GET", "foo"}, "-MOVED 12182 127.0.0.1:7001\r\n"},
+		{"asking again", []string{"ASKING"}, "+OK\r\n"},
+		{"tryagain", []string{"DEL", "foo", "{foo}.missing"}, "-TRYAGAIN Multiple keys request during rehashing of slot\r\n"},
+		{"node", []string{"CLUSTER", "SETSLOT", "12182", "NODE", myID}, "+OK\r\n"},
+		{"imported", []string{"GET", "foo"}, "$1\r\nv\r\n"},
+
+		{"unassigned", []string{"CLUSTER", "DELSLOTS", "0"}, "+OK\r\n"},
+		{"not served", []string{"GET", slot0}, "-CLUSTERDOWN Hash slot not served\r\n"},
+		{"down", []string{"GET", "bar"}, "-CLUSTERDOWN The cluster is down\r\n"},
+	})
+	setConfig(t, "cluster-require-full-coverage", "no")
+	runClientCommandCases(t, c, []commandCase{{"partial coverage", []string{"GET", "bar"}, "$1\r\nv\r\n"}})
+
+	reply, _ := ExecuteRespData(respCommand("CLUSTER", "NODES"))
+	if !strings.Contains(string(reply), fmt.Sprintf("%s 127.0.0.1:7001@%d master - ", peerID, closedPort)) || !strings.Contains(string(reply), " 8192-12181 12183-16383\n") {
+		t.Errorf("expected the peer in the nodes, got %q", reply)
+	}
+
+	// a newer claim of the peer takes over the slot, unsubscribing the clients of its shard channels
+	sub, r := subscriber(t)
+	runClientCommandCases(t, sub, []commandCase{{"ssubscribe", []string{"SSUBSCRIBE", "bar"}, ""}})
+	expectOutput(t, r, "*3\r\n$10\r\nssubscribe\r\n$3\r\nbar\r\n:1\r\n")
+	sendPeerMessage(t, peerConn, bus, peerMessage("PING", 100, "5061,8192-12181"))
+	expectOutput(t, r, "*3\r\n$12\r\nsunsubscribe\r\n$3\r\nbar\r\n:0\r\n")
+	runClientCommandCases(t, c, []commandCase{
+		{"moved away", []string{"GET", "bar"}, "-MOVED 5061 127.0.0.1:7001\r\n"},
+	})
+	reply, _ = ExecuteRespData(respCommand("CLUSTER", "SHARDS"))
+	if !strings.Contains(string(reply), "$5\r\nslots\r\n*6\r\n:5061\r\n:5061\r\n:8192\r\n:12181\r\n:12183\r\n:16383\r\n") {
+		t.Errorf("expected the slots of the peer among the shards, got %q", reply)
+	}
+}
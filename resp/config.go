@@ -0,0 +1,649 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// saveParam is a `save <seconds> <changes>` rule: snapshot once that many changes are that old
+type saveParam struct {
+	seconds int64
+	changes int
+}
+
+// config holds the server settings, set from the command line or a config file at startup
+// and afterwards through CONFIG SET, guarded by mu
+var config = struct {
+	dir              string
+	dbFilename       string
+	saveParams       []saveParam
+	rdbCompression   bool
+	rdbChecksum      bool
+	appendOnly       bool
+	appendFsync      string
+	appendFilename   string
+	appendDirname    string
+	aofLoadTruncated bool
+
+	shutdownOnSigint  shutdownFlags
+	shutdownOnSigterm shutdownFlags
+	// shutdownTimeout is how many seconds a shutdown waits for the replicas to catch up, 0 not waiting
+	shutdownTimeout int
+
+	port            int
+	replicaReadOnly bool
+	replBacklogSize int64
+	// replDisklessSync streams snapshots to the replicas, starting replDisklessSyncDelay seconds after the
+	// first one asked so others can share it, and replDisklessLoad is how a replica loads one
+	replDisklessSync      bool
+	replDisklessSyncDelay int
+	replDisklessLoad      string
+
+	clientOutputBufferLimit [3]outputLimit
+	// notifyKeyspaceEvents holds the notify classes of the keyspace events published
+	notifyKeyspaceEvents int
+
+	// requirepass is the password of the default user, none when empty, and masteruser and masterauth
+	// the credentials a replica sends its master
+	requirepass string
+	masteruser  string
+	masterauth  string
+
+	// aclFile is where ACL LOAD and ACL SAVE read and write the users, aclLogMaxLen the length of ACL LOG
+	// and aclPubsubDefault whether new users may use every channel
+	aclFile          string
+	aclLogMaxLen     int
+	aclPubsubDefault bool
+
+	// tlsPort is the port of the TLS listener, none when 0. tlsCertFile and tlsKeyFile are the certificate
+	// the server presents, to its master too when tlsReplication is set, tlsCACertFile the authorities
+	// certificates are checked against and tlsAuthClients whether clients need one: yes, no or optional.
+	tlsPort        int
+	tlsCertFile    string
+	tlsKeyFile     string
+	tlsCACertFile  string
+	tlsAuthClients string
+	tlsReplication bool
+
+	// unixSocket is the path of a Unix socket to listen on, with the unixSocketPerm permissions when set
+	unixSocket     string
+	unixSocketPerm os.FileMode
+
+	// bind are the addresses the TCP listeners are on, protectedMode refuses the connections from other
+	// hosts while the default user has no password, and enableProtectedConfigs and enableDebugCommand
+	// allow changing the protected parameters and running DEBUG: yes, no or local for local connections only
+	bind                   []string
+	protectedMode          bool
+	enableProtectedConfigs string
+	enableDebugCommand     string
+
+	// clusterEnabled turns on cluster mode, the state of the node being kept in clusterConfigFile inside dir.
+	// The cluster bus listens on clusterPort, port + 10000 when 0, and the other nodes are told clusterAnnounceIP
+	// when set. A node not answering for clusterNodeTimeout milliseconds is flagged as failing, and with
+	// clusterRequireFullCoverage keys are only served while every slot is.
+	clusterEnabled             bool
+	clusterConfigFile          string
+	clusterPort                int
+	clusterAnnounceIP          string
+	clusterNodeTimeout         int64
+	clusterRequireFullCoverage bool
+}{
+	dir:              ".",
+	dbFilename:       "dump.rdb",
+	saveParams:       []saveParam{{3600, 1}, {300, 100}, {60, 10000}},
+	rdbCompression:   true,
+	rdbChecksum:      true,
+	appendFsync:      "everysec",
+	appendFilename:   "appendonly.aof",
+	appendDirname:    "appendonlydir",
+	aofLoadTruncated: true,
+	shutdownTimeout:  10,
+	port:             6379,
+	replicaReadOnly:  true,
+	replBacklogSize:  1024 * 1024,
+
+	replDisklessSyncDelay: 5,
+	replDisklessLoad:      "disabled",
+
+	aclLogMaxLen: 128,
+
+	tlsAuthClients: "yes",
+
+	bind:                   []string{"*", "-::*"},
+	protectedMode:          true,
+	enableProtectedConfigs: "no",
+	enableDebugCommand:     "no",
+
+	clusterConfigFile:          "nodes.conf",
+	clusterNodeTimeout:         15000,
+	clusterRequireFullCoverage: true,
+
+	clientOutputBufferLimit: [3]outputLimit{
+		classNormal:  {},
+		classReplica: {hard: 256 << 20, soft: 64 << 20, softSeconds: 60},
+		classPubSub:  {hard: 32 << 20, soft: 8 << 20, softSeconds: 60},
+	},
+}
+
+// configParam is an entry of the config table
+type configParam struct {
+	get func() string
+	set func(value string) error
+	// immutable parameters can only be set at startup
+	immutable bool
+	// protected parameters can only be changed by the connections enable-protected-configs allows
+	protected bool
+	// apply puts the parameter to use once all the parameters of a CONFIG SET are set, so the ones
+	// going together like a certificate and its key can change at once
+	apply func() error
+}
+
+// configs maps every parameter name to its accessors, filled in init since the setters reach back into the table
+var configs map[string]configParam
+
+func init() {
+	configs = map[string]configParam{
+		"dir":            {get: func() string { return config.dir }, set: setDir, protected: true},
+		"dbfilename":     {get: func() string { return config.dbFilename }, set: setDBFilename, protected: true},
+		"save":           {get: formatSaveParams, set: setSaveParams},
+		"rdbcompression": boolConfig(&config.rdbCompression),
+		"rdbchecksum":    boolConfig(&config.rdbChecksum),
+		"appendonly":     {get: func() string { return formatYesNo(config.appendOnly) }, set: setAppendOnly},
+		"appendfsync":    {get: func() string { return config.appendFsync }, set: setAppendFsync},
+		"appendfilename": {get: func() string { return config.appendFilename }, set: filenameSetter(&config.appendFilename), immutable: true},
+		"appenddirname":  {get: func() string { return config.appendDirname }, set: filenameSetter(&config.appendDirname), immutable: true},
+
+		"aof-load-truncated": boolConfig(&config.aofLoadTruncated),
+
+		"shutdown-on-sigint":  {get: func() string { return formatShutdownFlags(config.shutdownOnSigint) }, set: shutdownFlagsSetter(&config.shutdownOnSigint)},
+		"shutdown-on-sigterm": {get: func() string { return formatShutdownFlags(config.shutdownOnSigterm) }, set: shutdownFlagsSetter(&config.shutdownOnSigterm)},
+		"shutdown-timeout":    {get: func() string { return strconv.Itoa(config.shutdownTimeout) }, set: setShutdownTimeout},
+
+		"port":              {get: func() string { return strconv.Itoa(config.port) }, set: portSetter(&config.port), immutable: true},
+		"replicaof":         {get: formatReplicaOf, set: setReplicaOf, immutable: true},
+		"replica-read-only": boolConfig(&config.replicaReadOnly),
+		"repl-backlog-size": {get: func() string { return strconv.FormatInt(config.replBacklogSize, 10) }, set: setReplBacklogSize},
+
+		"repl-diskless-sync":       boolConfig(&config.replDisklessSync),
+		"repl-diskless-sync-delay": {get: func() string { return strconv.Itoa(config.replDisklessSyncDelay) }, set: setReplDisklessSyncDelay},
+		"repl-diskless-load":       {get: func() string { return config.replDisklessLoad }, set: setReplDisklessLoad},
+
+		"client-output-buffer-limit": {get: formatOutputLimits, set: setOutputLimits},
+		"notify-keyspace-events":     {get: formatNotifyKeyspaceEvents, set: setNotifyKeyspaceEvents},
+
+		"requirepass": {get: func() string { return config.requirepass }, set: setRequirepass},
+		"masteruser":  stringConfig(&config.masteruser),
+		"masterauth":  stringConfig(&config.masterauth),
+
+		"aclfile":            {get: func() string { return config.aclFile }, set: stringConfig(&config.aclFile).set, immutable: true},
+		"acllog-max-len":     {get: func() string { return strconv.Itoa(config.aclLogMaxLen) }, set: setACLLogMaxLen},
+		"acl-pubsub-default": {get: formatACLPubsubDefault, set: setACLPubsubDefault},
+
+		"tls-port":         {get: func() string { return strconv.Itoa(config.tlsPort) }, set: portSetter(&config.tlsPort), immutable: true},
+		"tls-cert-file":    tlsConfig(stringConfig(&config.tlsCertFile)),
+		"tls-key-file":     tlsConfig(stringConfig(&config.tlsKeyFile)),
+		"tls-ca-cert-file": tlsConfig(stringConfig(&config.tlsCACertFile)),
+		"tls-auth-clients": tlsConfig(configParam{get: func() string { return config.tlsAuthClients }, set: setTLSAuthClients}),
+		"tls-replication":  tlsConfig(boolConfig(&config.tlsReplication)),
+
+		"unixsocket":     {get: func() string { return config.unixSocket }, set: stringConfig(&config.unixSocket).set, immutable: true},
+		"unixsocketperm": {get: formatUnixSocketPerm, set: setUnixSocketPerm, immutable: true},
+
+		"bind":                     {get: func() string { return strings.Join(config.bind, " ") }, set: setBind, immutable: true},
+		"protected-mode":           boolConfig(&config.protectedMode),
+		"enable-protected-configs": {get: func() string { return config.enableProtectedConfigs }, set: protectedActionSetter(&config.enableProtectedConfigs), immutable: true},
+		"enable-debug-command":     {get: func() string { return config.enableDebugCommand }, set: protectedActionSetter(&config.enableDebugCommand), immutable: true},
+
+		"cluster-enabled":               {get: func() string { return formatYesNo(config.clusterEnabled) }, set: boolConfig(&config.clusterEnabled).set, immutable: true},
+		"cluster-config-file":           {get: func() string { return config.clusterConfigFile }, set: filenameSetter(&config.clusterConfigFile), immutable: true},
+		"cluster-port":                  {get: func() string { return strconv.Itoa(config.clusterPort) }, set: portSetter(&config.clusterPort), immutable: true},
+		"cluster-announce-ip":           stringConfig(&config.clusterAnnounceIP),
+		"cluster-node-timeout":          {get: func() string { return strconv.FormatInt(config.clusterNodeTimeout, 10) }, set: setClusterNodeTimeout},
+		"cluster-require-full-coverage": boolConfig(&config.clusterRequireFullCoverage),
+	}
+}
+
+func boolConfig(p *bool) configParam {
+	return configParam{
+		get: func() string { return formatYesNo(*p) },
+		set: func(value string) error {
+			v, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			*p = v
+			return nil
+		},
+	}
+}
+
+func stringConfig(p *string) configParam {
+	return configParam{
+		get: func() string { return *p },
+		set: func(value string) error {
+			*p = value
+			return nil
+		},
+	}
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+// filenameSetter accepts a plain file name, which is looked up in dir
+func filenameSetter(p *string) func(string) error {
+	return func(value string) error {
+		if value == "" || value != filepath.Base(value) {
+			return errors.New("must be a file name, not a path")
+		}
+		*p = value
+		return nil
+	}
+}
+
+func setAppendFsync(value string) error {
+	switch v := strings.ToLower(value); v {
+	case "always", "everysec", "no":
+		config.appendFsync = v
+		return nil
+	}
+	return errors.New("argument(s) must be one of the following: always, everysec, no")
+}
+
+// portSetter accepts a TCP port, 0 meaning no listener
+func portSetter(p *int) func(string) error {
+	return func(value string) error {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			return errors.New("argument must be between 0 and 65535 inclusive")
+		}
+		*p = port
+		return nil
+	}
+}
+
+// parseMemory reads a size in bytes with an optional unit: k, m and g are powers of 1000, kb, mb
+// and gb powers of 1024
+func parseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024}, {"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1}}
+	v, mul := strings.ToLower(value), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mul = strings.TrimSuffix(v, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/mul {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// setReplBacklogSize resizes the backlog of a running master, keeping the end of the stream
+func setReplBacklogSize(value string) error {
+	size, err := parseMemory(value)
+	if err != nil {
+		return err
+	}
+	if size < 1 {
+		return errors.New("argument must be between 1 and 9223372036854775807 inclusive")
+	}
+	config.replBacklogSize = size
+	if replicationState.backlog != nil {
+		replicationState.backlog.resize(backlogSize(size))
+	}
+	return nil
+}
+
+// Port is the TCP port the server listens on
+func Port() int {
+	return config.port
+}
+
+func setReplDisklessSyncDelay(value string) error {
+	delay, err := strconv.Atoi(value)
+	if err != nil || delay < 0 {
+		return errors.New("argument must be between 0 and 2147483647 inclusive")
+	}
+	config.replDisklessSyncDelay = delay
+	return nil
+}
+
+func setReplDisklessLoad(value string) error {
+	switch v := strings.ToLower(value); v {
+	case "disabled", "on-empty-db", "swapdb":
+		config.replDisklessLoad = v
+		return nil
+	}
+	return errors.New("argument(s) must be one of the following: disabled, on-empty-db, swapdb")
+}
+
+func formatReplicaOf() string {
+	if replicationState.masterHost == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %d", replicationState.masterHost, replicationState.masterPort)
+}
+
+// setReplicaOf applies the replicaof directive, the replication routine connecting once the server started
+func setReplicaOf(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return errors.New("wrong number of arguments")
+	}
+	if strings.EqualFold(fields[0], "no") && strings.EqualFold(fields[1], "one") {
+		return nil
+	}
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port < 0 || port > 65535 {
+		return errors.New("Invalid master port")
+	}
+	replicationSetMaster(fields[0], port)
+	return nil
+}
+
+func setDir(value string) error {
+	abs, err := filepath.Abs(value)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", value)
+	}
+	config.dir = abs
+	return nil
+}
+
+func setDBFilename(value string) error {
+	if value != filepath.Base(value) {
+		return errors.New("dbfilename can't be a path, just a filename")
+	}
+	config.dbFilename = value
+	return nil
+}
+
+func formatSaveParams() string {
+	parts := make([]string, 0, len(config.saveParams)*2)
+	for _, p := range config.saveParams {
+		parts = append(parts, strconv.FormatInt(p.seconds, 10), strconv.Itoa(p.changes))
+	}
+	return strings.Join(parts, " ")
+}
+
+// setSaveParams replaces the save rules with "<seconds> <changes>" pairs, an empty value disabling snapshots
+func setSaveParams(value string) error {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return errors.New("Invalid save parameters")
+	}
+	params := make([]saveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return errors.New("Invalid save parameters")
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return errors.New("Invalid save parameters")
+		}
+		params = append(params, saveParam{seconds, changes})
+	}
+	config.saveParams = params
+	return nil
+}
+
+// LoadConfig applies the command line of the server: an optional config file followed by
+// `--name value...` options, like redis-server
+func LoadConfig(args []string) error {
+	var directives [][]string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		fileDirectives, err := readConfigFile(args[0])
+		if err != nil {
+			return err
+		}
+		directives = fileDirectives
+		args = args[1:]
+	}
+
+	for len(args) > 0 {
+		if !strings.HasPrefix(args[0], "--") {
+			return fmt.Errorf("invalid argument '%s', options must start with --", args[0])
+		}
+		directive := []string{strings.TrimPrefix(args[0], "--")}
+		args = args[1:]
+		for len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+			directive = append(directive, args[0])
+			args = args[1:]
+		}
+		directives = append(directives, directive)
+	}
+
+	// save lines add up, the first one replacing the default rules
+	var saveRules []string
+	var users [][]string
+	for _, directive := range directives {
+		name := strings.ToLower(directive[0])
+		value := strings.Join(directive[1:], " ")
+		if name == "save" {
+			saveRules = append(saveRules, value)
+			continue
+		}
+		if name == "user" {
+			users = append(users, directive[1:])
+			continue
+		}
+		param, ok := configs[name]
+		if !ok {
+			return fmt.Errorf("bad directive or wrong number of arguments: '%s'", directive[0])
+		}
+		if err := param.set(value); err != nil {
+			return fmt.Errorf("invalid value for '%s': %v", name, err)
+		}
+	}
+	if saveRules != nil {
+		if err := setSaveParams(strings.Join(saveRules, " ")); err != nil {
+			return fmt.Errorf("invalid value for 'save': %v", err)
+		}
+	}
+	if err := applyTLSConfig(); err != nil {
+		return fmt.Errorf("failed to configure TLS: %v", err)
+	}
+	return loadConfigUsers(users)
+}
+
+// readConfigFile splits a redis.conf style file into directives, one per line
+func readConfigFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var directives [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields, err := splitConfigLine(line)
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, fields)
+	}
+	return directives, scanner.Err()
+}
+
+// splitConfigLine splits a config line into words, honouring double and single quotes
+func splitConfigLine(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return fields, nil
+		}
+		quote := line[0]
+		if quote != '"' && quote != '\'' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		var field strings.Builder
+		i := 1
+		for ; i < len(line) && line[i] != quote; i++ {
+			if line[i] == '\\' && quote == '"' && i+1 < len(line) {
+				i++
+				switch line[i] {
+				case 'n':
+					field.WriteByte('\n')
+				case 't':
+					field.WriteByte('\t')
+				default:
+					field.WriteByte(line[i])
+				}
+				continue
+			}
+			field.WriteByte(line[i])
+		}
+		if i == len(line) {
+			return nil, errors.New("unbalanced quotes in configuration line")
+		}
+		fields = append(fields, field.String())
+		line = line[i+1:]
+	}
+}
+
+// handleConfig implements CONFIG GET and CONFIG SET
+func handleConfig(c *Client, args ...BulkString) ([]byte, error) {
+	sub := strings.ToUpper(*args[1].Value)
+	switch {
+	case sub == "GET" && len(args) >= 3:
+		return configGet(args[2:])
+	case sub == "SET" && len(args) >= 4 && len(args)%2 == 0:
+		return configSet(c, args[2:])
+	case sub == "HELP" && len(args) == 2:
+		return helpReply(
+			"CONFIG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"GET <pattern>",
+			"    Return parameters matching the glob-like <pattern> and their values.",
+			"SET <directive> <value>",
+			"    Set the configuration <directive> to <value>.",
+			"HELP",
+			"    Print this help.",
+		)
+	}
+	return subcommandSyntaxReply("config", *args[1].Value)
+}
+
+func configGet(patterns []BulkString) ([]byte, error) {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		for _, pattern := range patterns {
+			if stringMatch(*pattern.Value, name, true) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	elements := make([]RESPData, 0, len(names)*2)
+	for _, name := range names {
+		elements = append(elements, bulkString(name), bulkString(configs[name].get()))
+	}
+	return SerializeArray(Array{Elements: &elements})
+}
+
+// configSet applies name value pairs for c, restoring the previous values if any of them is rejected
+func configSet(c *Client, pairs []BulkString) ([]byte, error) {
+	type applied struct {
+		param configParam
+		old   string
+	}
+	var done []applied
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(pairs); i += 2 {
+		name := strings.ToLower(*pairs[i].Value)
+		param, ok := configs[name]
+		if !ok {
+			return errorReply(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", *pairs[i].Value))
+		}
+		if param.immutable {
+			return errorReply(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name))
+		}
+		if param.protected && !c.allowProtectedAction(config.enableProtectedConfigs) {
+			return errorReply(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set protected config", name))
+		}
+		if seen[name] {
+			return errorReply(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name))
+		}
+		seen[name] = true
+	}
+
+	// a rejected value or a failure to apply them puts the previous values back in use
+	rollback := func() {
+		for j := len(done) - 1; j >= 0; j-- {
+			done[j].param.set(done[j].old)
+		}
+		for _, d := range done {
+			if d.param.apply != nil {
+				d.param.apply()
+			}
+		}
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		name := strings.ToLower(*pairs[i].Value)
+		param := configs[name]
+		old := param.get()
+		if err := param.set(*pairs[i+1].Value); err != nil {
+			rollback()
+			return errorReply(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", name, err))
+		}
+		done = append(done, applied{param, old})
+	}
+	for i, d := range done {
+		if d.param.apply == nil {
+			continue
+		}
+		if err := d.param.apply(); err != nil {
+			rollback()
+			return errorReply(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", strings.ToLower(*pairs[2*i].Value), err))
+		}
+	}
+	return []byte("+OK\r\n"), nil
+}
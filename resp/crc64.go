@@ -0,0 +1,11 @@
+package resp
+
+import "hash/crc64"
+
+// crc64Table is the reflected Jones polynomial Redis uses for RDB and DUMP checksums
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Update extends a Redis CRC64, which starts at zero and has no final xor unlike hash/crc64
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
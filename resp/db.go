@@ -0,0 +1,224 @@
+package resp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// databaseCount is the number of logical databases SELECT can pick from
+const databaseCount = 16
+
+// database is one logical keyspace together with the clients watching or blocked on its keys
+type database struct {
+	id           int
+	entries      map[string]StoreEntry
+	watchedKeys  map[string][]*Client
+	blockingKeys map[string][]*keyWaiter
+}
+
+func newDatabase(id int) *database {
+	return &database{
+		id:           id,
+		entries:      make(map[string]StoreEntry),
+		watchedKeys:  make(map[string][]*Client),
+		blockingKeys: make(map[string][]*keyWaiter),
+	}
+}
+
+var databases = func() []*database {
+	dbs := make([]*database, databaseCount)
+	for i := range dbs {
+		dbs[i] = newDatabase(i)
+	}
+	return dbs
+}()
+
+// currentDB is the database of the command being run and store its keyspace.
+// The dispatcher points them at the client's selected database before every command, guarded by mu.
+var currentDB = databases[0]
+
+// selectDB makes db the keyspace handlers work on. The caller must hold mu.
+func selectDB(db *database) {
+	currentDB = db
+	store = db.entries
+}
+
+var errDBIndex = errors.New("ERR DB index is out of range")
+
+func parseDBIndex(arg BulkString) (int, error) {
+	id, err := strconv.Atoi(*arg.Value)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if id < 0 || id >= databaseCount {
+		return 0, errDBIndex
+	}
+	return id, nil
+}
+
+// dirty counts the changes to the keyspace since the last successful save, guarded by mu
+var dirty int
+
+// signalModifiedKey is the hook every command goes through after changing or deleting key.
+// The caller must hold mu.
+func signalModifiedKey(db *database, key string) {
+	dirty++
+	db.touchWatchedKey(key)
+	trackingInvalidateKey(key)
+}
+
+// expireIfNeeded deletes key when its time to live has passed, reporting whether it did.
+// The deletion is logged as a DEL of its own rather than counted as a change by the running command.
+// A replica only reports the key as expired to its clients and waits for the DEL of its master,
+// which sees the key as it still is. The caller must hold mu.
+func expireIfNeeded(db *database, key string) bool {
+	entry, exists := db.entries[key]
+	if !exists || !entry.expired(time.Now()) {
+		return false
+	}
+	if replicationState.masterHost != "" {
+		return currentClient == nil || !currentClient.master
+	}
+	delete(db.entries, key)
+	db.touchWatchedKey(key)
+	trackingInvalidateKey(key)
+	propagateDeletion(db, key)
+	notifyKeyspaceEvent(notifyExpired, "expired", key, db.id)
+	return true
+}
+
+// setKey stores entry at key of the current database. The caller must hold mu.
+func setKey(key string, entry StoreEntry) {
+	if _, exists := store[key]; !exists {
+		notifyKeyspaceEvent(notifyNew, "new", key, currentDB.id)
+	}
+	store[key] = entry
+	signalModifiedKey(currentDB, key)
+}
+
+// dbDelete removes key from the current database, reporting whether it existed. The caller must hold mu.
+func dbDelete(key string) bool {
+	if expireIfNeeded(currentDB, key) {
+		return false
+	}
+	if _, exists := store[key]; !exists {
+		return false
+	}
+	delete(store, key)
+	signalModifiedKey(currentDB, key)
+	return true
+}
+
+// handleSelect changes the database the client works on
+func handleSelect(c *Client, args ...BulkString) ([]byte, error) {
+	id, err := parseDBIndex(args[1])
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if id != 0 && config.clusterEnabled {
+		return errorReply("ERR SELECT is not allowed in cluster mode")
+	}
+	c.db = databases[id]
+	selectDB(c.db)
+	return []byte("+OK\r\n"), nil
+}
+
+// handleSwapDB exchanges the contents of two databases; clients stay connected to the same index
+func handleSwapDB(args ...BulkString) ([]byte, error) {
+	if config.clusterEnabled {
+		return errorReply("ERR SWAPDB is not allowed in cluster mode")
+	}
+	id1, err := parseDBIndex(args[1])
+	if err != nil {
+		if err == errDBIndex {
+			return errorReply("ERR DB index is out of range")
+		}
+		return errorReply("ERR invalid first DB index")
+	}
+	id2, err := parseDBIndex(args[2])
+	if err != nil {
+		if err == errDBIndex {
+			return errorReply("ERR DB index is out of range")
+		}
+		return errorReply("ERR invalid second DB index")
+	}
+	if id1 == id2 {
+		return []byte("+OK\r\n"), nil
+	}
+
+	db1, db2 := databases[id1], databases[id2]
+	db1.touchAllWatchedKeys(db2)
+	db2.touchAllWatchedKeys(db1)
+	db1.entries, db2.entries = db2.entries, db1.entries
+	selectDB(currentDB)
+	dirty++
+
+	// clients blocked on either database may now find their keys
+	db1.signalReadyKeys()
+	db2.signalReadyKeys()
+	return []byte("+OK\r\n"), nil
+}
+
+// parseFlushMode accepts the optional ASYNC or SYNC argument of FLUSHDB and FLUSHALL, both flushing at once
+func parseFlushMode(args []BulkString) error {
+	if len(args) > 2 {
+		return errSyntax
+	}
+	if len(args) == 2 {
+		mode := strings.ToUpper(*args[1].Value)
+		if mode != "ASYNC" && mode != "SYNC" {
+			return errSyntax
+		}
+	}
+	return nil
+}
+
+func (db *database) flush() {
+	db.touchAllWatchedKeys(nil)
+	dirty += len(db.entries)
+	clear(db.entries)
+}
+
+// handleFlushDB removes every key of the selected database
+func handleFlushDB(args ...BulkString) ([]byte, error) {
+	if err := parseFlushMode(args); err != nil {
+		return errorReply(err.Error())
+	}
+	currentDB.flush()
+	// counted even when the database was empty, so the flush still reaches the AOF and the replicas
+	dirty++
+	trackingInvalidateKeysOnFlush()
+	return []byte("+OK\r\n"), nil
+}
+
+// handleFlushAll removes every key of every database
+func handleFlushAll(args ...BulkString) ([]byte, error) {
+	if err := parseFlushMode(args); err != nil {
+		return errorReply(err.Error())
+	}
+	for _, db := range databases {
+		db.flush()
+	}
+	dirty++
+	trackingInvalidateKeysOnFlush()
+	return []byte("+OK\r\n"), nil
+}
+
+// handleDBSize returns the number of keys in the selected database
+func handleDBSize(args ...BulkString) ([]byte, error) {
+	return SerializeInteger(Integer{Value: len(store)})
+}
+
+// handleDel removes the given keys and returns how many existed
+func handleDel(args ...BulkString) ([]byte, error) {
+	deleted := 0
+	for _, arg := range args[1:] {
+		if dbDelete(*arg.Value) {
+			notifyKeyspaceEvent(notifyGeneric, "del", *arg.Value, currentDB.id)
+			deleted++
+		}
+	}
+	return SerializeInteger(Integer{Value: deleted})
+}
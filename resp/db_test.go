@@ -0,0 +1,56 @@
+package resp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDatabases(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"select", []string{"SELECT", "9"}, "+OK\r\n"},
+		{"flush", []string{"FLUSHDB"}, "+OK\r\n"},
+		{"set", []string{"SET", "db:a", "nine"}, "+OK\r\n"},
+		{"set another", []string{"SET", "db:b", "nine"}, "+OK\r\n"},
+		{"dbsize", []string{"DBSIZE"}, ":2\r\n"},
+		{"del", []string{"DEL", "db:a", "db:missing"}, ":1\r\n"},
+		{"deleted", []string{"GET", "db:a"}, "$-1\r\n"},
+
+		{"select other", []string{"SELECT", "10"}, "+OK\r\n"},
+		{"flush other", []string{"FLUSHDB", "SYNC"}, "+OK\r\n"},
+		{"keys are per db", []string{"GET", "db:b"}, "$-1\r\n"},
+		{"swapdb", []string{"SWAPDB", "9", "10"}, "+OK\r\n"},
+		{"swapped in", []string{"GET", "db:b"}, "$4\r\nnine\r\n"},
+		{"swapped out", []string{"SELECT", "9"}, "+OK\r\n"},
+		{"empty now", []string{"DBSIZE"}, ":0\r\n"},
+		{"flush bad mode", []string{"FLUSHDB", "LATER"}, "-ERR syntax error\r\n"},
+
+		{"select out of range", []string{"SELECT", "16"}, "-ERR DB index is out of range\r\n"},
+		{"select not a number", []string{"SELECT", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{"swapdb bad index", []string{"SWAPDB", "x", "1"}, "-ERR invalid first DB index\r\n"},
+		{"swapdb out of range", []string{"SWAPDB", "0", "99"}, "-ERR DB index is out of range\r\n"},
+	})
+	if NewClient().db != databases[0] {
+		t.Error("new clients should start on database 0")
+	}
+}
+
+func TestBlockedReadSurvivesSelect(t *testing.T) {
+	reader, writer := NewClient(), NewClient()
+	runClientCommandCases(t, reader, []commandCase{{"select", []string{"SELECT", "3"}, "+OK\r\n"}})
+	runClientCommandCases(t, writer, []commandCase{{"select", []string{"SELECT", "3"}, "+OK\r\n"}})
+
+	done := make(chan string)
+	go func() {
+		result, _ := reader.Execute(respCommand("XREAD", "BLOCK", "2000", "STREAMS", "db:stream", "$"))
+		done <- string(result)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// a write to the same key of another database must not wake the reader
+	NewClient().Execute(respCommand("XADD", "db:stream", "1-1", "f", "v"))
+	runClientCommandCases(t, writer, []commandCase{{"add", []string{"XADD", "db:stream", "2-1", "f", "v"}, "$3\r\n2-1\r\n"}})
+
+	expected := "*1\r\n*2\r\n$9\r\ndb:stream\r\n*1\r\n*2\r\n$3\r\n2-1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"
+	if got := <-done; got != expected {
+		t.Errorf("expected %q, but got %q", expected, got)
+	}
+}
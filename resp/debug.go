@@ -0,0 +1,34 @@
+package resp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const debugNotAllowedError = "ERR DEBUG command not allowed. If the enable-debug-command option is set to \"local\", you can run it from a local connection, " +
+	"otherwise you need to set this option in the configuration file, and then restart the server."
+
+// handleDebug implements the DEBUG subcommands, which enable-debug-command restricts
+func handleDebug(args ...BulkString) ([]byte, error) {
+	sub := strings.ToUpper(*args[1].Value)
+	switch {
+	case sub == "SLEEP" && len(args) == 3:
+		seconds, err := strconv.ParseFloat(*args[2].Value, 64)
+		if err != nil {
+			return errorReply("ERR value is not a valid float")
+		}
+		// the server stops serving commands meanwhile, like during a slow one
+		time.Sleep(time.Duration(seconds * float64(time.Second)))
+		return []byte("+OK\r\n"), nil
+	case sub == "HELP" && len(args) == 2:
+		return helpReply(
+			"DEBUG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"SLEEP <seconds>",
+			"    Stop the server for <seconds>. Decimals allowed.",
+			"HELP",
+			"    Print this help.",
+		)
+	}
+	return subcommandSyntaxReply("debug", *args[1].Value)
+}
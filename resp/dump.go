@@ -0,0 +1,184 @@
+package resp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A DUMP payload is the RDB encoding of a single value: its type byte and the object, followed by
+// the RDB version as 2 little endian bytes and a CRC64 of everything before it as 8 little endian
+// bytes, so values move between this server and Redis.
+
+var (
+	errDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+	errBadFormat   = errors.New("ERR Bad data format")
+	errBusyKey     = errors.New("BUSYKEY Target key name already exists.")
+)
+
+// createDumpPayload serializes value the way DUMP returns it
+func createDumpPayload(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	w := &rdbWriter{w: &buf, compress: config.rdbCompression}
+	w.writeObjectType(value)
+	w.writeObject(value)
+	if w.err != nil {
+		return nil, w.err
+	}
+	payload := binary.LittleEndian.AppendUint16(buf.Bytes(), rdbVersion)
+	return binary.LittleEndian.AppendUint64(payload, crc64Update(0, payload)), nil
+}
+
+// verifyDumpPayload checks the footer of a payload: a version we can read and a matching checksum
+func verifyDumpPayload(payload []byte) error {
+	if len(payload) < 10 {
+		return errDumpPayload
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > rdbMaxLoadVersion {
+		return errDumpPayload
+	}
+	if crc64Update(0, payload[:len(payload)-8]) != binary.LittleEndian.Uint64(footer[2:]) {
+		return errDumpPayload
+	}
+	return nil
+}
+
+// loadDumpPayload decodes the value of a verified payload, which must be used up entirely
+func loadDumpPayload(payload []byte) (any, error) {
+	data := bytes.NewReader(payload[:len(payload)-10])
+	r := &rdbReader{r: data}
+	typ, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	value, err := r.readObject(typ)
+	if err != nil {
+		return nil, err
+	}
+	if data.Len() > 0 {
+		return nil, errRDBCorrupt
+	}
+	return value, nil
+}
+
+// handleDump returns the serialized value stored at key, or nil when it doesn't exist
+func handleDump(args ...BulkString) ([]byte, error) {
+	entry, exists := lookupEntry(*args[1].Value)
+	if !exists {
+		return []byte("$-1\r\n"), nil
+	}
+	payload, err := createDumpPayload(entry.value)
+	if err != nil {
+		return errorReply("ERR " + err.Error())
+	}
+	return SerializeBulkString(bulkString(string(payload)))
+}
+
+// restoreOptions are the flags of RESTORE after the payload
+type restoreOptions struct {
+	replace bool
+	absTTL  bool
+	// idleTime and freq are validated for compatibility, there is no eviction policy that would use them
+	idleTime int64
+	freq     int64
+}
+
+func parseRestoreOptions(args []BulkString) (restoreOptions, error) {
+	opts := restoreOptions{idleTime: -1, freq: -1}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(*args[i].Value) {
+		case "REPLACE":
+			opts.replace = true
+		case "ABSTTL":
+			opts.absTTL = true
+		case "IDLETIME":
+			if i+1 >= len(args) || opts.freq != -1 {
+				return opts, errSyntax
+			}
+			i++
+			v, err := strconv.ParseInt(*args[i].Value, 10, 64)
+			if err != nil {
+				return opts, errNotInteger
+			}
+			if v < 0 {
+				return opts, errors.New("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			opts.idleTime = v
+		case "FREQ":
+			if i+1 >= len(args) || opts.idleTime != -1 {
+				return opts, errSyntax
+			}
+			i++
+			v, err := strconv.ParseInt(*args[i].Value, 10, 64)
+			if err != nil {
+				return opts, errNotInteger
+			}
+			if v < 0 || v > 255 {
+				return opts, errors.New("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			opts.freq = v
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+// handleRestore creates key from a DUMP payload, with a time to live in milliseconds unless it is 0.
+// The TTL is relative unless ABSTTL is given, and an existing key is only overwritten with REPLACE.
+func handleRestore(args ...BulkString) ([]byte, error) {
+	key := *args[1].Value
+	opts, err := parseRestoreOptions(args[4:])
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if _, exists := lookupEntry(key); exists && !opts.replace {
+		return errorReply(errBusyKey.Error())
+	}
+	ttl, err := strconv.ParseInt(*args[2].Value, 10, 64)
+	if err != nil {
+		return errorReply(errNotInteger.Error())
+	}
+	if ttl < 0 {
+		return errorReply("ERR Invalid TTL value, must be >= 0")
+	}
+
+	payload := []byte(*args[3].Value)
+	if err := verifyDumpPayload(payload); err != nil {
+		return errorReply(err.Error())
+	}
+	value, err := loadDumpPayload(payload)
+	if err != nil {
+		return errorReply(errBadFormat.Error())
+	}
+
+	var expiration time.Time
+	if ttl > 0 {
+		if opts.absTTL {
+			expiration = time.UnixMilli(ttl)
+		} else {
+			expiration = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		// a key restored already expired is not created, only the one it replaces is deleted
+		if !expiration.After(time.Now()) {
+			if dbDelete(key) {
+				rewriteCommand("DEL", key)
+				notifyKeyspaceEvent(notifyGeneric, "del", key, currentDB.id)
+			}
+			return []byte("+OK\r\n"), nil
+		}
+	}
+
+	setKey(key, StoreEntry{value: value, expiration: expiration})
+	notifyKeyspaceEvent(notifyGeneric, "restore", key, currentDB.id)
+	// like SET, the relative expiration becomes an absolute one for the log
+	if ttl > 0 && !opts.absTTL {
+		argv := append(commandArgs(args[:2]), strconv.FormatInt(expiration.UnixMilli(), 10), *args[3].Value)
+		rewriteCommand(append(append(argv, commandArgs(args[4:])...), "ABSTTL")...)
+	}
+	return []byte("+OK\r\n"), nil
+}
@@ -0,0 +1,105 @@
+package resp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dumpPayload runs DUMP and returns the payload without the bulk string framing
+func dumpPayload(t *testing.T, client *Client, key string) string {
+	t.Helper()
+	result, err := client.Execute(respCommand("DUMP", key))
+	if err != nil {
+		t.Fatalf("DUMP %s: unexpected error: %v", key, err)
+	}
+	header, payload, found := strings.Cut(string(result), "\r\n")
+	if !found || !strings.HasPrefix(header, "$") || header == "$-1" {
+		t.Fatalf("DUMP %s: expected a bulk string, but got %q", key, result)
+	}
+	return strings.TrimSuffix(payload, "\r\n")
+}
+
+func TestDumpPayloadFormat(t *testing.T) {
+	client := NewClient()
+	runClientCommandCases(t, client, []commandCase{{"set", []string{"SET", "dump:int", "10"}, "+OK\r\n"}})
+
+	// the value encoded as a RDB integer, then the version and the checksum of both
+	payload := dumpPayload(t, client, "dump:int")
+	body := append([]byte{rdbTypeString, 0xc0, 10}, binary.LittleEndian.AppendUint16(nil, rdbVersion)...)
+	expected := binary.LittleEndian.AppendUint64(body, crc64Update(0, body))
+	if !bytes.Equal([]byte(payload), expected) {
+		t.Errorf("expected payload %q, but got %q", expected, payload)
+	}
+
+	runClientCommandCases(t, client, []commandCase{
+		{"missing key", []string{"DUMP", "dump:missing"}, "$-1\r\n"},
+		// the payload the Redis documentation shows for the value 10, dumped by Redis 6
+		{"restore from redis", []string{"RESTORE", "dump:redis", "0", "\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb"}, "+OK\r\n"},
+		{"restored value", []string{"GET", "dump:redis"}, "$2\r\n10\r\n"},
+	})
+}
+
+func TestDumpRestoreRoundTrip(t *testing.T) {
+	client := NewClient()
+	runClientCommandCases(t, client, []commandCase{
+		{"string", []string{"SET", "dump:string", strings.Repeat("abc", 20)}, "+OK\r\n"},
+		{"zset", []string{"GEOADD", "dump:zset", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"}, ":2\r\n"},
+		{"stream", []string{"XADD", "dump:stream", "1-1", "field", "value"}, "$3\r\n1-1\r\n"},
+		{"group", []string{"XGROUP", "CREATE", "dump:stream", "group", "0"}, "+OK\r\n"},
+		{"read", []string{"XREADGROUP", "GROUP", "group", "alice", "STREAMS", "dump:stream", ">"},
+			"*1\r\n*2\r\n$11\r\ndump:stream\r\n*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$5\r\nfield\r\n$5\r\nvalue\r\n"},
+	})
+
+	for _, key := range []string{"dump:string", "dump:zset", "dump:stream"} {
+		payload := dumpPayload(t, client, key)
+		runClientCommandCases(t, client, []commandCase{
+			{"restore " + key, []string{"RESTORE", key + ":copy", "0", payload}, "+OK\r\n"},
+			{"dump the copy", []string{"DUMP", key + ":copy"}, "$" + strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n"},
+		})
+	}
+	runClientCommandCases(t, client, []commandCase{
+		{"string copy", []string{"GET", "dump:string:copy"}, "$60\r\n" + strings.Repeat("abc", 20) + "\r\n"},
+		{"zset copy", []string{"GEODIST", "dump:zset:copy", "Palermo", "Catania"}, "$11\r\n166274.1516\r\n"},
+		{"stream copy", []string{"XPENDING", "dump:stream:copy", "group"},
+			"*4\r\n:1\r\n$3\r\n1-1\r\n$3\r\n1-1\r\n*1\r\n*2\r\n$5\r\nalice\r\n$1\r\n1\r\n"},
+	})
+}
+
+func TestRestoreOptions(t *testing.T) {
+	client := NewClient()
+	runClientCommandCases(t, client, []commandCase{{"set", []string{"SET", "restore:src", "value"}, "+OK\r\n"}})
+	payload := dumpPayload(t, client, "restore:src")
+	corrupt := []byte(payload)
+	corrupt[len(corrupt)-1] ^= 0xff
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+
+	runClientCommandCases(t, client, []commandCase{
+		{"busy key", []string{"RESTORE", "restore:src", "0", payload}, "-BUSYKEY Target key name already exists.\r\n"},
+		{"replace", []string{"RESTORE", "restore:src", "0", payload, "REPLACE"}, "+OK\r\n"},
+		{"bad checksum", []string{"RESTORE", "restore:dst", "0", string(corrupt)}, "-ERR DUMP payload version or checksum are wrong\r\n"},
+		{"short payload", []string{"RESTORE", "restore:dst", "0", "abc"}, "-ERR DUMP payload version or checksum are wrong\r\n"},
+		{"negative ttl", []string{"RESTORE", "restore:dst", "-1", payload}, "-ERR Invalid TTL value, must be >= 0\r\n"},
+		{"bad ttl", []string{"RESTORE", "restore:dst", "soon", payload}, "-ERR value is not an integer or out of range\r\n"},
+		{"idletime and freq", []string{"RESTORE", "restore:dst", "0", payload, "IDLETIME", "10", "FREQ", "5"}, "-ERR syntax error\r\n"},
+		{"bad idletime", []string{"RESTORE", "restore:dst", "0", payload, "IDLETIME", "-1"}, "-ERR Invalid IDLETIME value, must be >= 0\r\n"},
+		{"bad freq", []string{"RESTORE", "restore:dst", "0", payload, "FREQ", "256"}, "-ERR Invalid FREQ value, must be >= 0 and <= 255\r\n"},
+		{"unknown option", []string{"RESTORE", "restore:dst", "0", payload, "KEEPTTL"}, "-ERR syntax error\r\n"},
+		{"freq", []string{"RESTORE", "restore:dst", "0", payload, "FREQ", "5"}, "+OK\r\n"},
+		{"absttl", []string{"RESTORE", "restore:abs", future, payload, "ABSTTL", "IDLETIME", "10"}, "+OK\r\n"},
+		{"restored", []string{"GET", "restore:abs"}, "$5\r\nvalue\r\n"},
+		// a payload restored with a TTL in the past deletes the key it replaces and creates nothing
+		{"expired absttl", []string{"RESTORE", "restore:abs", "1", payload, "ABSTTL", "REPLACE"}, "+OK\r\n"},
+		{"deleted", []string{"GET", "restore:abs"}, "$-1\r\n"},
+	})
+
+	// a payload of a type we can't read
+	body := []byte{2, 0, 10, 0}
+	unknown := binary.LittleEndian.AppendUint64(body, crc64Update(0, body))
+	runClientCommandCases(t, client, []commandCase{
+		{"unknown type", []string{"RESTORE", "restore:dst2", "0", string(unknown)}, "-ERR Bad data format\r\n"},
+	})
+}
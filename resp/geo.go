@@ -0,0 +1,589 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errNotFloat = errors.New("ERR value is not a valid float")
+
+// geoSearchFlags tell georadiusGeneric which of the search commands it is serving
+type geoSearchFlags int
+
+const (
+	geoRadiusCoords geoSearchFlags = 1 << iota
+	geoRadiusMember
+	geoRadiusNoStore
+	geoSearch
+	geoSearchStore
+)
+
+const (
+	geoSortNone = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+// geoPoint is a search match with its position decoded and its distance from the center in meters
+type geoPoint struct {
+	member    string
+	score     float64
+	longitude float64
+	latitude  float64
+	dist      float64
+}
+
+// parseFloat parses a double the way Redis does, rejecting NaN; errMsg replaces the default error when set
+func parseFloat(arg BulkString, errMsg string) (float64, error) {
+	f, err := strconv.ParseFloat(*arg.Value, 64)
+	if err != nil || math.IsNaN(f) {
+		if errMsg != "" {
+			return 0, errors.New("ERR " + errMsg)
+		}
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// humanFloat formats a coordinate with 17 decimals and no trailing zeros
+func humanFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func distanceReply(meters float64) RESPData {
+	return bulkString(fmt.Sprintf("%.4f", meters))
+}
+
+func extractLongLat(args []BulkString) (float64, float64, error) {
+	longitude, err := parseFloat(args[0], "")
+	if err != nil {
+		return 0, 0, err
+	}
+	latitude, err := parseFloat(args[1], "")
+	if err != nil {
+		return 0, 0, err
+	}
+	if longitude < geoLongMin || longitude > geoLongMax || latitude < geoLatMin || latitude > geoLatMax {
+		return 0, 0, fmt.Errorf("ERR invalid longitude,latitude pair %f,%f", longitude, latitude)
+	}
+	return longitude, latitude, nil
+}
+
+// extractUnit returns how many meters one unit is
+func extractUnit(arg BulkString) (float64, error) {
+	switch strings.ToLower(*arg.Value) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, errors.New("ERR unsupported unit provided. please use M, KM, FT, MI")
+}
+
+func extractDistance(args []BulkString, s *geoShape) error {
+	radius, err := parseFloat(args[0], "need numeric radius")
+	if err != nil {
+		return err
+	}
+	if radius < 0 {
+		return errors.New("ERR radius cannot be negative")
+	}
+	conversion, err := extractUnit(args[1])
+	if err != nil {
+		return err
+	}
+	s.box, s.radius, s.conversion = false, radius, conversion
+	return nil
+}
+
+func extractBox(args []BulkString, s *geoShape) error {
+	width, err := parseFloat(args[0], "need numeric width")
+	if err != nil {
+		return err
+	}
+	height, err := parseFloat(args[1], "need numeric height")
+	if err != nil {
+		return err
+	}
+	if height < 0 || width < 0 {
+		return errors.New("ERR height or width cannot be negative")
+	}
+	conversion, err := extractUnit(args[2])
+	if err != nil {
+		return err
+	}
+	s.box, s.width, s.height, s.conversion = true, width, height, conversion
+	return nil
+}
+
+func longLatFromMember(z *sortedSet, member string) (float64, float64, error) {
+	score, ok := z.score(member)
+	if !ok {
+		return 0, 0, errors.New("ERR could not decode requested zset member")
+	}
+	longitude, latitude := decodeGeoScore(score)
+	return longitude, latitude, nil
+}
+
+// handleGeoAdd adds longitude, latitude, member triplets, taking the NX, XX and CH options of ZADD
+func handleGeoAdd(args ...BulkString) ([]byte, error) {
+	if len(args) < 5 {
+		return wrongArgsReply("geoadd")
+	}
+
+	nx, xx, ch := false, false, false
+	longIdx := 2
+parseOptions:
+	for ; longIdx < len(args); longIdx++ {
+		switch strings.ToUpper(*args[longIdx].Value) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break parseOptions
+		}
+	}
+	if (len(args)-longIdx)%3 != 0 || (nx && xx) {
+		return errorReply(errSyntax.Error())
+	}
+
+	type geoMember struct {
+		member string
+		score  float64
+	}
+	members := make([]geoMember, 0, (len(args)-longIdx)/3)
+	for i := longIdx; i < len(args); i += 3 {
+		longitude, latitude, err := extractLongLat(args[i : i+2])
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		hash, _ := geohashEncodeWGS84(longitude, latitude, geoStepMax)
+		members = append(members, geoMember{member: *args[i+2].Value, score: float64(align52Bits(hash))})
+	}
+
+	key := *args[1].Value
+	z, err := lookupSortedSet(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if z == nil {
+		if xx {
+			return SerializeInteger(Integer{Value: 0})
+		}
+		z = newSortedSet()
+		store[key] = StoreEntry{value: z}
+		notifyKeyspaceEvent(notifyNew, "new", key, currentDB.id)
+	}
+
+	added, changed := 0, 0
+	for _, m := range members {
+		current, exists := z.score(m.member)
+		switch {
+		case exists && !nx:
+			if current != m.score {
+				z.add(m.member, m.score)
+				changed++
+			}
+		case !exists && !xx:
+			z.add(m.member, m.score)
+			added++
+		}
+	}
+	if added+changed > 0 {
+		signalModifiedKey(currentDB, key)
+		notifyKeyspaceEvent(notifyZset, "zadd", key, currentDB.id)
+	}
+
+	if ch {
+		return SerializeInteger(Integer{Value: added + changed})
+	}
+	return SerializeInteger(Integer{Value: added})
+}
+
+// handleGeoDist returns the distance between two members in the requested unit
+func handleGeoDist(args ...BulkString) ([]byte, error) {
+	if len(args) < 4 {
+		return wrongArgsReply("geodist")
+	}
+
+	toMeters := 1.0
+	if len(args) == 5 {
+		var err error
+		if toMeters, err = extractUnit(args[4]); err != nil {
+			return errorReply(err.Error())
+		}
+	} else if len(args) > 5 {
+		return errorReply(errSyntax.Error())
+	}
+
+	z, err := lookupSortedSet(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if z == nil {
+		return BulkString{}.serialize()
+	}
+	score1, ok1 := z.score(*args[2].Value)
+	score2, ok2 := z.score(*args[3].Value)
+	if !ok1 || !ok2 {
+		return BulkString{}.serialize()
+	}
+
+	lon1, lat1 := decodeGeoScore(score1)
+	lon2, lat2 := decodeGeoScore(score2)
+	return distanceReply(geoDistance(lon1, lat1, lon2, lat2) / toMeters).serialize()
+}
+
+// handleGeoHash returns the standard 11 character geohash of each member
+func handleGeoHash(args ...BulkString) ([]byte, error) {
+	if len(args) < 2 {
+		return wrongArgsReply("geohash")
+	}
+
+	z, err := lookupSortedSet(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	hashes := make([]RESPData, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		score, ok := 0.0, false
+		if z != nil {
+			score, ok = z.score(*arg.Value)
+		}
+		if !ok {
+			hashes = append(hashes, BulkString{})
+			continue
+		}
+		hashes = append(hashes, bulkString(standardGeohash(score)))
+	}
+	return SerializeArray(Array{Elements: &hashes})
+}
+
+// handleGeoPos returns the longitude and latitude of each member
+func handleGeoPos(args ...BulkString) ([]byte, error) {
+	if len(args) < 2 {
+		return wrongArgsReply("geopos")
+	}
+
+	z, err := lookupSortedSet(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	positions := make([]RESPData, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		score, ok := 0.0, false
+		if z != nil {
+			score, ok = z.score(*arg.Value)
+		}
+		if !ok {
+			positions = append(positions, Array{})
+			continue
+		}
+		longitude, latitude := decodeGeoScore(score)
+		positions = append(positions, Array{Elements: &[]RESPData{
+			bulkString(humanFloat(longitude)),
+			bulkString(humanFloat(latitude)),
+		}})
+	}
+	return SerializeArray(Array{Elements: &positions})
+}
+
+// geoPointsInShape collects the members within the shape by scanning the score ranges of the nine boxes
+// around its center; with a limit it stops as soon as enough members were found
+func geoPointsInShape(z *sortedSet, s geoShape, limit int) []geoPoint {
+	areas := geoSearchAreas(s)
+	points := []geoPoint{}
+
+	lastProcessed := 0
+	for i, area := range areas {
+		if area.isZero() {
+			continue
+		}
+		// huge radiuses can make adjacent boxes identical, which would duplicate members
+		if lastProcessed != 0 && area == areas[lastProcessed] {
+			continue
+		}
+		if len(points) > 0 && limit > 0 && len(points) >= limit {
+			break
+		}
+
+		minScore := float64(align52Bits(area))
+		area.bits++
+		maxScore := float64(align52Bits(area))
+		z.ascendFrom(minScore, func(member string, score float64) bool {
+			if score >= maxScore {
+				return false
+			}
+			longitude, latitude := decodeGeoScore(score)
+			if dist, ok := s.distanceIfInside(longitude, latitude); ok {
+				points = append(points, geoPoint{member: member, score: score, longitude: longitude, latitude: latitude, dist: dist})
+			}
+			return limit == 0 || len(points) < limit
+		})
+		lastProcessed = i
+	}
+	return points
+}
+
+// georadiusGeneric implements GEOSEARCH, GEOSEARCHSTORE and the GEORADIUS family.
+// srcKeyIdx is the position of the source key, flags select how the center and the shape are given.
+func georadiusGeneric(args []BulkString, srcKeyIdx int, flags geoSearchFlags) ([]byte, error) {
+	z, err := lookupSortedSet(*args[srcKeyIdx].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	var storeKey *string
+	storeDist := false
+	shape := geoShape{}
+	baseArgs := 0
+	switch {
+	case flags&geoRadiusCoords != 0:
+		baseArgs = 6
+		if shape.longitude, shape.latitude, err = extractLongLat(args[2:4]); err != nil {
+			return errorReply(err.Error())
+		}
+		if err := extractDistance(args[4:6], &shape); err != nil {
+			return errorReply(err.Error())
+		}
+	case flags&geoRadiusMember != 0:
+		// without a source key the arguments are still parsed to pick the right empty reply
+		baseArgs = 5
+		if z != nil {
+			if shape.longitude, shape.latitude, err = longLatFromMember(z, *args[2].Value); err != nil {
+				return errorReply(err.Error())
+			}
+			if err := extractDistance(args[3:5], &shape); err != nil {
+				return errorReply(err.Error())
+			}
+		}
+	default:
+		baseArgs = 2
+		if flags&geoSearchStore != 0 {
+			baseArgs = 3
+			storeKey = args[1].Value
+		}
+	}
+
+	withDist, withHash, withCoord := false, false, false
+	fromMember, fromLonLat, byRadius, byBox := false, false, false, false
+	sortOrder := geoSortNone
+	anyMatch := false
+	count := int64(0)
+
+	remaining := len(args) - baseArgs
+	for i := 0; i < remaining; i++ {
+		pos := baseArgs + i
+		switch arg := strings.ToLower(*args[pos].Value); {
+		case arg == "withdist":
+			withDist = true
+		case arg == "withhash":
+			withHash = true
+		case arg == "withcoord":
+			withCoord = true
+		case arg == "any":
+			anyMatch = true
+		case arg == "asc":
+			sortOrder = geoSortAsc
+		case arg == "desc":
+			sortOrder = geoSortDesc
+		case arg == "count" && i+1 < remaining:
+			if count, err = parseInt(args[pos+1]); err != nil {
+				return errorReply(err.Error())
+			}
+			if count <= 0 {
+				return errorReply("ERR COUNT must be > 0")
+			}
+			i++
+		case (arg == "store" || arg == "storedist") && i+1 < remaining &&
+			flags&geoRadiusNoStore == 0 && flags&geoSearch == 0:
+			storeKey = args[pos+1].Value
+			storeDist = arg == "storedist"
+			i++
+		case arg == "storedist" && flags&geoSearchStore != 0:
+			storeDist = true
+		case arg == "frommember" && i+1 < remaining && flags&geoSearch != 0 && !fromLonLat:
+			if z != nil {
+				if shape.longitude, shape.latitude, err = longLatFromMember(z, *args[pos+1].Value); err != nil {
+					return errorReply(err.Error())
+				}
+			}
+			fromMember = true
+			i++
+		case arg == "fromlonlat" && i+2 < remaining && flags&geoSearch != 0 && !fromMember:
+			if shape.longitude, shape.latitude, err = extractLongLat(args[pos+1 : pos+3]); err != nil {
+				return errorReply(err.Error())
+			}
+			fromLonLat = true
+			i += 2
+		case arg == "byradius" && i+2 < remaining && flags&geoSearch != 0 && !byBox:
+			if err := extractDistance(args[pos+1:pos+3], &shape); err != nil {
+				return errorReply(err.Error())
+			}
+			byRadius = true
+			i += 2
+		case arg == "bybox" && i+3 < remaining && flags&geoSearch != 0 && !byRadius:
+			if err := extractBox(args[pos+1:pos+4], &shape); err != nil {
+				return errorReply(err.Error())
+			}
+			byBox = true
+			i += 3
+		default:
+			return errorReply(errSyntax.Error())
+		}
+	}
+
+	if storeKey != nil && (withDist || withHash || withCoord) {
+		name := "STORE option in GEORADIUS"
+		if flags&geoSearchStore != 0 {
+			name = "GEOSEARCHSTORE"
+		}
+		return errorReply(fmt.Sprintf("ERR %s is not compatible with WITHDIST, WITHHASH and WITHCOORD options", name))
+	}
+	if flags&geoSearch != 0 && !fromMember && !fromLonLat {
+		return errorReply(fmt.Sprintf("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", *args[0].Value))
+	}
+	if flags&geoSearch != 0 && !byRadius && !byBox {
+		return errorReply(fmt.Sprintf("ERR exactly one of BYRADIUS and BYBOX can be specified for %s", *args[0].Value))
+	}
+	if anyMatch && count == 0 {
+		return errorReply("ERR the ANY argument requires COUNT argument")
+	}
+
+	if z == nil {
+		if storeKey != nil {
+			if dbDelete(*storeKey) {
+				notifyKeyspaceEvent(notifyGeneric, "del", *storeKey, currentDB.id)
+			}
+			return SerializeInteger(Integer{Value: 0})
+		}
+		return SerializeArray(Array{Elements: &[]RESPData{}})
+	}
+
+	// the closest N members can only be found by sorting, unless any N will do
+	if count != 0 && sortOrder == geoSortNone && !anyMatch {
+		sortOrder = geoSortAsc
+	}
+
+	limit := 0
+	if anyMatch {
+		limit = int(count)
+	}
+	points := geoPointsInShape(z, shape, limit)
+
+	returned := len(points)
+	if count != 0 && int64(returned) > count {
+		returned = int(count)
+	}
+	switch sortOrder {
+	case geoSortAsc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case geoSortDesc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+	points = points[:returned]
+
+	if storeKey != nil {
+		if returned == 0 {
+			if dbDelete(*storeKey) {
+				notifyKeyspaceEvent(notifyGeneric, "del", *storeKey, currentDB.id)
+			}
+			return SerializeInteger(Integer{Value: 0})
+		}
+		stored := newSortedSet()
+		for _, p := range points {
+			score := p.score
+			if storeDist {
+				score = p.dist / shape.conversion
+			}
+			stored.add(p.member, score)
+		}
+		setKey(*storeKey, StoreEntry{value: stored})
+		event := "georadiusstore"
+		if flags&geoSearch != 0 {
+			event = "geosearchstore"
+		}
+		notifyKeyspaceEvent(notifyZset, event, *storeKey, currentDB.id)
+		return SerializeInteger(Integer{Value: returned})
+	}
+
+	results := make([]RESPData, 0, returned)
+	for _, p := range points {
+		if !withDist && !withHash && !withCoord {
+			results = append(results, bulkString(p.member))
+			continue
+		}
+		item := []RESPData{bulkString(p.member)}
+		if withDist {
+			item = append(item, distanceReply(p.dist/shape.conversion))
+		}
+		if withHash {
+			item = append(item, Integer{Value: int(p.score)})
+		}
+		if withCoord {
+			item = append(item, Array{Elements: &[]RESPData{
+				bulkString(humanFloat(p.longitude)),
+				bulkString(humanFloat(p.latitude)),
+			}})
+		}
+		results = append(results, Array{Elements: &item})
+	}
+	return SerializeArray(Array{Elements: &results})
+}
+
+func handleGeoSearch(args ...BulkString) ([]byte, error) {
+	if len(args) < 7 {
+		return wrongArgsReply("geosearch")
+	}
+	return georadiusGeneric(args, 1, geoSearch)
+}
+
+func handleGeoSearchStore(args ...BulkString) ([]byte, error) {
+	if len(args) < 8 {
+		return wrongArgsReply("geosearchstore")
+	}
+	return georadiusGeneric(args, 2, geoSearch|geoSearchStore)
+}
+
+func handleGeoRadius(args ...BulkString) ([]byte, error) {
+	if len(args) < 6 {
+		return wrongArgsReply("georadius")
+	}
+	return georadiusGeneric(args, 1, geoRadiusCoords)
+}
+
+func handleGeoRadiusRO(args ...BulkString) ([]byte, error) {
+	if len(args) < 6 {
+		return wrongArgsReply("georadius_ro")
+	}
+	return georadiusGeneric(args, 1, geoRadiusCoords|geoRadiusNoStore)
+}
+
+func handleGeoRadiusByMember(args ...BulkString) ([]byte, error) {
+	if len(args) < 5 {
+		return wrongArgsReply("georadiusbymember")
+	}
+	return georadiusGeneric(args, 1, geoRadiusMember)
+}
+
+func handleGeoRadiusByMemberRO(args ...BulkString) ([]byte, error) {
+	if len(args) < 5 {
+		return wrongArgsReply("georadiusbymember_ro")
+	}
+	return georadiusGeneric(args, 1, geoRadiusMember|geoRadiusNoStore)
+}
@@ -0,0 +1,100 @@
+package resp
+
+import "testing"
+
+func TestGeoCommands(t *testing.T) {
+	palermoCoord := "*2\r\n$20\r\n13.36138933897018433\r\n$20\r\n38.11555639549629859\r\n"
+	cataniaCoord := "*2\r\n$20\r\n15.08726745843887329\r\n$20\r\n37.50266842333162032\r\n"
+	runCommandCases(t, []commandCase{
+		{"add", []string{"GEOADD", "geo:sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"}, ":2\r\n"},
+		{"add existing nx", []string{"GEOADD", "geo:sicily", "NX", "13.361389", "38.115556", "Palermo"}, ":0\r\n"},
+		{"xx on missing key", []string{"GEOADD", "geo:none", "XX", "13.361389", "38.115556", "Palermo"}, ":0\r\n"},
+		{"xx does not create", []string{"GEOPOS", "geo:none", "Palermo"}, "*1\r\n*-1\r\n"},
+		{"nx and xx", []string{"GEOADD", "geo:sicily", "NX", "XX", "13.361389", "38.115556", "Palermo"}, "-ERR syntax error\r\n"},
+		{"bad pair", []string{"GEOADD", "geo:sicily", "200", "100", "Nowhere"}, "-ERR invalid longitude,latitude pair 200.000000,100.000000\r\n"},
+		{"bad float", []string{"GEOADD", "geo:sicily", "abc", "1", "Nowhere"}, "-ERR value is not a valid float\r\n"},
+
+		{"dist", []string{"GEODIST", "geo:sicily", "Palermo", "Catania"}, "$11\r\n166274.1516\r\n"},
+		{"dist km", []string{"GEODIST", "geo:sicily", "Palermo", "Catania", "km"}, "$8\r\n166.2742\r\n"},
+		{"dist mi", []string{"GEODIST", "geo:sicily", "Palermo", "Catania", "MI"}, "$8\r\n103.3182\r\n"},
+		{"dist missing member", []string{"GEODIST", "geo:sicily", "Foo", "Bar"}, "$-1\r\n"},
+		{"dist bad unit", []string{"GEODIST", "geo:sicily", "Palermo", "Catania", "yd"}, "-ERR unsupported unit provided. please use M, KM, FT, MI\r\n"},
+
+		{"hash", []string{"GEOHASH", "geo:sicily", "Palermo", "Catania", "Foo"}, "*3\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n$-1\r\n"},
+		{"pos", []string{"GEOPOS", "geo:sicily", "Palermo", "NonExisting"}, "*2\r\n" + palermoCoord + "*-1\r\n"},
+
+		{"radius", []string{"GEORADIUS", "geo:sicily", "15", "37", "200", "km", "WITHDIST"},
+			"*2\r\n*2\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n*2\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n"},
+		{"radius withhash", []string{"GEORADIUS", "geo:sicily", "15", "37", "200", "km", "WITHHASH", "ASC"},
+			"*2\r\n*2\r\n$7\r\nCatania\r\n:3479447370796909\r\n*2\r\n$7\r\nPalermo\r\n:3479099956230698\r\n"},
+		{"radius by member", []string{"GEORADIUSBYMEMBER", "geo:sicily", "Palermo", "100", "km"}, "*1\r\n$7\r\nPalermo\r\n"},
+		{"radius ro store", []string{"GEORADIUS_RO", "geo:sicily", "15", "37", "200", "km", "STORE", "geo:dest"}, "-ERR syntax error\r\n"},
+
+		{"edges", []string{"GEOADD", "geo:sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2"}, ":2\r\n"},
+		{"search radius", []string{"GEOSEARCH", "geo:sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"},
+			"*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n"},
+		{"search box", []string{"GEOSEARCH", "geo:sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "WITHCOORD", "WITHDIST"},
+			"*4\r\n" +
+				"*3\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n" + cataniaCoord +
+				"*3\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n" + palermoCoord +
+				"*3\r\n$5\r\nedge2\r\n$8\r\n279.7403\r\n*2\r\n$20\r\n17.24151045083999634\r\n$20\r\n38.78813451624225195\r\n" +
+				"*3\r\n$5\r\nedge1\r\n$8\r\n279.7405\r\n*2\r\n$19\r\n12.7584877610206604\r\n$20\r\n38.78813451624225195\r\n"},
+		{"search desc count", []string{"GEOSEARCH", "geo:sicily", "FROMMEMBER", "Palermo", "BYRADIUS", "500", "km", "DESC", "COUNT", "2"},
+			"*2\r\n$5\r\nedge2\r\n$7\r\nCatania\r\n"},
+		{"search count any", []string{"GEOSEARCH", "geo:sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "500", "km", "COUNT", "1", "ANY"},
+			"*1\r\n$7\r\nPalermo\r\n"},
+		{"search missing member", []string{"GEOSEARCH", "geo:sicily", "FROMMEMBER", "Rome", "BYRADIUS", "5", "km"},
+			"-ERR could not decode requested zset member\r\n"},
+		{"search without shape", []string{"GEOSEARCH", "geo:sicily", "FROMLONLAT", "15", "37", "ASC", "WITHDIST"},
+			"-ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH\r\n"},
+		{"search without center", []string{"GEOSEARCH", "geo:sicily", "BYRADIUS", "5", "km", "ASC", "WITHDIST"},
+			"-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH\r\n"},
+		{"any without count", []string{"GEOSEARCH", "geo:sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "5", "km", "ANY"},
+			"-ERR the ANY argument requires COUNT argument\r\n"},
+		{"search missing key", []string{"GEOSEARCH", "geo:missing", "FROMMEMBER", "Rome", "BYRADIUS", "5", "km"}, "*0\r\n"},
+		{"search nothing found", []string{"GEOSEARCH", "geo:sicily", "FROMLONLAT", "0", "0", "BYRADIUS", "5", "km"}, "*0\r\n"},
+
+		{"store", []string{"GEOSEARCHSTORE", "geo:dest", "geo:sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "COUNT", "3"}, ":3\r\n"},
+		{"stored positions", []string{"GEOPOS", "geo:dest", "Catania"}, "*1\r\n" + cataniaCoord},
+		{"store with options", []string{"GEOSEARCHSTORE", "geo:dest", "geo:sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "5", "km", "WITHDIST"},
+			"-ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options\r\n"},
+		{"store dist", []string{"GEORADIUS", "geo:sicily", "15", "37", "200", "km", "STOREDIST", "geo:dists"}, ":2\r\n"},
+		{"store nothing deletes", []string{"GEOSEARCHSTORE", "geo:dest", "geo:sicily", "FROMLONLAT", "0", "0", "BYRADIUS", "5", "km"}, ":0\r\n"},
+		{"deleted", []string{"GEOPOS", "geo:dest", "Catania"}, "*1\r\n*-1\r\n"},
+
+		{"plain string", []string{"SET", "geo:string", "foo"}, "+OK\r\n"},
+		{"wrong type", []string{"GEOADD", "geo:string", "13.361389", "38.115556", "Palermo"}, "-" + wrongTypeErr + "\r\n"},
+		{"zset is not a string", []string{"GET", "geo:sicily"}, "-" + wrongTypeErr + "\r\n"},
+	})
+}
+
+func TestSortedSetOrdering(t *testing.T) {
+	z := newSortedSet()
+	for i, member := range []string{"d", "b", "a", "c", "e"} {
+		z.add(member, float64(i%2))
+	}
+	if !z.add("f", 0) || z.add("f", 2) {
+		t.Fatal("add should only report new members")
+	}
+	if !z.remove("e") || z.remove("e") {
+		t.Fatal("remove should only report existing members")
+	}
+
+	var got []string
+	z.ascendFrom(0, func(member string, score float64) bool {
+		got = append(got, member)
+		return true
+	})
+	expected := []string{"a", "d", "b", "c", "f"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, but got %v", expected, got)
+		}
+	}
+	if z.Len() != 5 {
+		t.Errorf("expected 5 members, but got %d", z.Len())
+	}
+}
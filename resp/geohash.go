@@ -0,0 +1,339 @@
+package resp
+
+import "math"
+
+// Geo positions are stored as sorted set scores holding a 52 bit geohash: 26 bits of latitude
+// interleaved with 26 bits of longitude, using the Web Mercator latitude limits like Redis does.
+const (
+	geoStepMax   = 26
+	geoLatMin    = -85.05112878
+	geoLatMax    = 85.05112878
+	geoLongMin   = -180.0
+	geoLongMax   = 180.0
+	earthRadius  = 6372797.560856 // meters
+	mercatorMax  = 20037726.37
+	geoAlphabet  = "0123456789bcdefghjkmnpqrstuvwxyz"
+	geoHashChars = 11
+)
+
+type geoHashRange struct {
+	min, max float64
+}
+
+type geoHashBits struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+type geoHashArea struct {
+	hash                geoHashBits
+	longitude, latitude geoHashRange
+}
+
+type geoHashNeighbors struct {
+	north, east, west, south                   geoHashBits
+	northEast, southEast, northWest, southWest geoHashBits
+}
+
+var (
+	wgs84LongRange = geoHashRange{geoLongMin, geoLongMax}
+	wgs84LatRange  = geoHashRange{geoLatMin, geoLatMax}
+)
+
+// interleave64 spreads the bits of x over the even positions and those of y over the odd ones
+func interleave64(x, y uint32) uint64 {
+	spread := func(v uint64) uint64 {
+		v = (v | v<<16) & 0x0000FFFF0000FFFF
+		v = (v | v<<8) & 0x00FF00FF00FF00FF
+		v = (v | v<<4) & 0x0F0F0F0F0F0F0F0F
+		v = (v | v<<2) & 0x3333333333333333
+		v = (v | v<<1) & 0x5555555555555555
+		return v
+	}
+	return spread(uint64(x)) | spread(uint64(y))<<1
+}
+
+// deinterleave64 is the inverse of interleave64, returning x in the low and y in the high 32 bits
+func deinterleave64(interleaved uint64) uint64 {
+	squash := func(v uint64) uint64 {
+		v &= 0x5555555555555555
+		v = (v | v>>1) & 0x3333333333333333
+		v = (v | v>>2) & 0x0F0F0F0F0F0F0F0F
+		v = (v | v>>4) & 0x00FF00FF00FF00FF
+		v = (v | v>>8) & 0x0000FFFF0000FFFF
+		v = (v | v>>16) & 0x00000000FFFFFFFF
+		return v
+	}
+	return squash(interleaved) | squash(interleaved>>1)<<32
+}
+
+func geohashEncode(longRange, latRange geoHashRange, longitude, latitude float64, step uint) (geoHashBits, bool) {
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHashBits{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return geoHashBits{}, false
+	}
+
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geoHashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+func geohashEncodeWGS84(longitude, latitude float64, step uint) (geoHashBits, bool) {
+	return geohashEncode(wgs84LongRange, wgs84LatRange, longitude, latitude, step)
+}
+
+func geohashDecode(longRange, latRange geoHashRange, hash geoHashBits) geoHashArea {
+	sep := deinterleave64(hash.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	ilato := uint32(sep)
+	ilono := uint32(sep >> 32)
+	div := float64(uint64(1) << hash.step)
+
+	return geoHashArea{
+		hash: hash,
+		latitude: geoHashRange{
+			min: latRange.min + (float64(ilato)/div)*latScale,
+			max: latRange.min + (float64(ilato+1)/div)*latScale,
+		},
+		longitude: geoHashRange{
+			min: longRange.min + (float64(ilono)/div)*longScale,
+			max: longRange.min + (float64(ilono+1)/div)*longScale,
+		},
+	}
+}
+
+// decodeGeoScore turns a sorted set score back into the center of its geohash cell
+func decodeGeoScore(score float64) (longitude, latitude float64) {
+	area := geohashDecode(wgs84LongRange, wgs84LatRange, geoHashBits{bits: uint64(score), step: geoStepMax})
+	longitude = (area.longitude.min + area.longitude.max) / 2
+	longitude = max(geoLongMin, min(geoLongMax, longitude))
+	latitude = (area.latitude.min + area.latitude.max) / 2
+	latitude = max(geoLatMin, min(geoLatMax, latitude))
+	return longitude, latitude
+}
+
+// align52Bits scales a hash of any step to the 52 bit score space
+func align52Bits(hash geoHashBits) uint64 {
+	return hash.bits << (52 - hash.step*2)
+}
+
+func geohashMoveX(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashMoveY(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= 0x5555555555555555 >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashNeighborsOf(hash geoHashBits) geoHashNeighbors {
+	move := func(dx, dy int) geoHashBits {
+		h := hash
+		geohashMoveX(&h, dx)
+		geohashMoveY(&h, dy)
+		return h
+	}
+	return geoHashNeighbors{
+		east:      move(1, 0),
+		west:      move(-1, 0),
+		south:     move(0, -1),
+		north:     move(0, 1),
+		northWest: move(-1, 1),
+		southWest: move(-1, -1),
+		northEast: move(1, 1),
+		southEast: move(1, -1),
+	}
+}
+
+func degRad(ang float64) float64 { return ang * (math.Pi / 180) }
+func radDeg(ang float64) float64 { return ang / (math.Pi / 180) }
+
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return earthRadius * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// geoDistance is the haversine distance in meters between two points
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lon1r, lon2r := degRad(lon1), degRad(lon2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// geoShape is the area of a search: a circle of radius or a width by height box around a center,
+// with the dimensions in the user's unit and conversion turning them into meters
+type geoShape struct {
+	box           bool
+	longitude     float64
+	latitude      float64
+	radius        float64
+	width, height float64
+	conversion    float64
+}
+
+// distanceIfInside returns the distance in meters from the center when the point lies within the shape
+func (s geoShape) distanceIfInside(longitude, latitude float64) (float64, bool) {
+	if !s.box {
+		distance := geoDistance(s.longitude, s.latitude, longitude, latitude)
+		return distance, distance <= s.radius*s.conversion
+	}
+
+	// the latitude distance is cheaper so it is checked first
+	if geoLatDistance(latitude, s.latitude) > s.height*s.conversion/2 {
+		return 0, false
+	}
+	if geoDistance(longitude, latitude, s.longitude, latitude) > s.width*s.conversion/2 {
+		return 0, false
+	}
+	return geoDistance(s.longitude, s.latitude, longitude, latitude), true
+}
+
+// boundingBox returns the min longitude, min latitude, max longitude and max latitude around the shape
+func (s geoShape) boundingBox() (float64, float64, float64, float64) {
+	height, width := s.conversion*s.radius, s.conversion*s.radius
+	if s.box {
+		height, width = s.conversion*s.height/2, s.conversion*s.width/2
+	}
+
+	latDelta := radDeg(height / earthRadius)
+	longDeltaTop := radDeg(width / earthRadius / math.Cos(degRad(s.latitude+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadius / math.Cos(degRad(s.latitude-latDelta)))
+
+	// the hemispheres point in opposite directions, so the widest edge differs
+	if s.latitude < 0 {
+		return s.longitude - longDeltaBottom, s.latitude - latDelta, s.longitude + longDeltaBottom, s.latitude + latDelta
+	}
+	return s.longitude - longDeltaTop, s.latitude - latDelta, s.longitude + longDeltaTop, s.latitude + latDelta
+}
+
+// geohashEstimateSteps picks the precision of the nine boxes a search of the given radius scans
+func geohashEstimateSteps(rangeMeters, lat float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2 // make sure the range is included in most of the base cases
+
+	// wider range towards the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return uint(max(1, min(geoStepMax, step)))
+}
+
+// geoSearchAreas returns the box containing the center of the shape followed by its eight neighbours,
+// zeroing the neighbours that cannot contain any point of the shape
+func geoSearchAreas(s geoShape) [9]geoHashBits {
+	minLon, minLat, maxLon, maxLat := s.boundingBox()
+
+	radiusMeters := s.radius
+	if s.box {
+		radiusMeters = math.Sqrt((s.width/2)*(s.width/2) + (s.height/2)*(s.height/2))
+	}
+	radiusMeters *= s.conversion
+
+	steps := geohashEstimateSteps(radiusMeters, s.latitude)
+	hash, _ := geohashEncodeWGS84(s.longitude, s.latitude, steps)
+	neighbors := geohashNeighborsOf(hash)
+	area := geohashDecode(wgs84LongRange, wgs84LatRange, hash)
+
+	// the estimated step may be too coarse when the search area is near the edge of the center box
+	north := geohashDecode(wgs84LongRange, wgs84LatRange, neighbors.north)
+	south := geohashDecode(wgs84LongRange, wgs84LatRange, neighbors.south)
+	east := geohashDecode(wgs84LongRange, wgs84LatRange, neighbors.east)
+	west := geohashDecode(wgs84LongRange, wgs84LatRange, neighbors.west)
+	decreaseStep := north.latitude.max < maxLat || south.latitude.min > minLat ||
+		east.longitude.max < maxLon || west.longitude.min > minLon
+
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = geohashEncodeWGS84(s.longitude, s.latitude, steps)
+		neighbors = geohashNeighborsOf(hash)
+		area = geohashDecode(wgs84LongRange, wgs84LatRange, hash)
+	}
+
+	// exclude the boxes that are useless
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			neighbors.south, neighbors.southWest, neighbors.southEast = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.latitude.max > maxLat {
+			neighbors.north, neighbors.northEast, neighbors.northWest = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.min < minLon {
+			neighbors.west, neighbors.southWest, neighbors.northWest = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.max > maxLon {
+			neighbors.east, neighbors.southEast, neighbors.northEast = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+	}
+
+	return [9]geoHashBits{
+		hash,
+		neighbors.north, neighbors.south, neighbors.east, neighbors.west,
+		neighbors.northEast, neighbors.northWest, neighbors.southEast, neighbors.southWest,
+	}
+}
+
+// standardGeohash re-encodes a score with the standard -90..90 latitude range into the usual base32 string
+func standardGeohash(score float64) string {
+	longitude, latitude := decodeGeoScore(score)
+	hash, _ := geohashEncode(geoHashRange{-180, 180}, geoHashRange{-90, 90}, longitude, latitude, geoStepMax)
+
+	buf := make([]byte, geoHashChars)
+	for i := range buf {
+		idx := 0
+		// only 52 bits are available, the eleventh character is always zero
+		if i < geoHashChars-1 {
+			idx = int(hash.bits>>(52-(i+1)*5)) & 0x1f
+		}
+		buf[i] = geoAlphabet[idx]
+	}
+	return string(buf)
+}
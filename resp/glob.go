@@ -0,0 +1,111 @@
+package resp
+
+import "unicode"
+
+// stringMatch reports whether s matches the glob-style pattern, following Redis' stringmatchlen:
+// '*' and '?' wildcards, [...] classes with ranges and '^' negation, and '\' escapes
+func stringMatch(pattern, s string, nocase bool) bool {
+	return globMatch([]byte(pattern), []byte(s), nocase, 0)
+}
+
+func globMatch(pattern, s []byte, nocase bool, nesting int) bool {
+	// protect against abusive patterns with many stars
+	if nesting > 1000 {
+		return false
+	}
+
+	fold := func(b byte) rune {
+		if nocase {
+			return unicode.ToLower(rune(b))
+		}
+		return rune(b)
+	}
+
+	for len(pattern) > 0 && len(s) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for len(s) > 0 {
+				if globMatch(pattern[1:], s, nocase, nesting+1) {
+					return true
+				}
+				s = s[1:]
+			}
+			return false
+
+		case '?':
+			s = s[1:]
+
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for {
+				if len(pattern) == 0 {
+					break
+				}
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == s[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := fold(pattern[0]), fold(pattern[2])
+					if start > end {
+						start, end = end, start
+					}
+					c := fold(s[0])
+					pattern = pattern[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if fold(pattern[0]) == fold(s[0]) {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				// a class without its closing bracket ends the pattern
+				pattern = []byte{']'}
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s = s[1:]
+
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if fold(pattern[0]) != fold(s[0]) {
+				return false
+			}
+			s = s[1:]
+		}
+
+		pattern = pattern[1:]
+		if len(s) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			break
+		}
+	}
+	return len(pattern) == 0 && len(s) == 0
+}
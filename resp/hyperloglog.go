@@ -0,0 +1,798 @@
+package resp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strings"
+)
+
+// HyperLogLog values are plain strings in the exact layout Redis uses, so GET, DUMP and
+// RDB files are interchangeable with a real server:
+//
+//	+------+---+-----+----------+
+//	| HYLL | E | N/U | Cardin.  |
+//	+------+---+-----+----------+
+//
+// followed by 16384 6 bit registers, either densely packed or run length encoded (sparse).
+// The cached cardinality is little endian; the top bit of its last byte marks it stale.
+const (
+	hllP            = 14
+	hllQ            = 64 - hllP
+	hllRegisters    = 1 << hllP
+	hllPMask        = hllRegisters - 1
+	hllBits         = 6
+	hllRegisterMax  = 1<<hllBits - 1
+	hllHdrSize      = 16
+	hllDenseSize    = hllHdrSize + (hllRegisters*hllBits+7)/8
+	hllDense        = 0
+	hllSparse       = 1
+	hllMaxEncoding  = 1
+	hllAlphaInf     = 0.721347520444481703680 // 0.5/ln(2)
+	hllSparseMaxLen = 3000                    // hll-sparse-max-bytes
+
+	hllSparseXZeroBit     = 0x40
+	hllSparseValBit       = 0x80
+	hllSparseValMaxValue  = 32
+	hllSparseValMaxLen    = 4
+	hllSparseZeroMaxLen   = 64
+	hllSparseXZeroMaxLen  = 16384
+	hllCardOffset         = 8
+	hllEncodingOffset     = 4
+	hllInvalidCacheOffset = hllCardOffset + 7
+)
+
+var (
+	errInvalidHLLObject = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	errCorruptedHLL     = errors.New("INVALIDOBJ Corrupted HLL object detected")
+)
+
+func sparseIsZero(op byte) bool  { return op&0xc0 == 0 }
+func sparseIsXZero(op byte) bool { return op&0xc0 == hllSparseXZeroBit }
+func sparseIsVal(op byte) bool   { return op&hllSparseValBit != 0 }
+func sparseZeroLen(op byte) int  { return int(op&0x3f) + 1 }
+func sparseXZeroLen(op, next byte) int {
+	return (int(op&0x3f)<<8 | int(next)) + 1
+}
+func sparseValValue(op byte) int { return int(op>>2&0x1f) + 1 }
+func sparseValLen(op byte) int   { return int(op&0x3) + 1 }
+func sparseVal(value, length int) byte {
+	return byte((value-1)<<2|(length-1)) | hllSparseValBit
+}
+func sparseZero(length int) byte { return byte(length - 1) }
+func sparseXZero(length int) []byte {
+	l := length - 1
+	return []byte{byte(l>>8) | hllSparseXZeroBit, byte(l & 0xff)}
+}
+
+// newHLL returns an empty sparse HyperLogLog, a header followed by XZERO opcodes covering every register
+func newHLL() []byte {
+	hll := make([]byte, hllHdrSize, hllHdrSize+2)
+	copy(hll, "HYLL")
+	hll[hllEncodingOffset] = hllSparse
+	for remaining := hllRegisters; remaining > 0; remaining -= hllSparseXZeroMaxLen {
+		hll = append(hll, sparseXZero(min(remaining, hllSparseXZeroMaxLen))...)
+	}
+	return hll
+}
+
+// isValidHLL checks the magic, encoding and, for dense values, the exact length
+func isValidHLL(hll []byte) bool {
+	if len(hll) < hllHdrSize || string(hll[:4]) != "HYLL" {
+		return false
+	}
+	if hll[hllEncodingOffset] > hllMaxEncoding {
+		return false
+	}
+	return hll[hllEncodingOffset] != hllDense || len(hll) == hllDenseSize
+}
+
+func invalidateHLLCache(hll []byte) {
+	hll[hllInvalidCacheOffset] |= 1 << 7
+}
+
+// murmurHash64A is the 64 bit MurmurHash2 variant Redis uses to hash HyperLogLog elements
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(key))*m
+
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register an element maps to and the length of the 000..1 pattern that follows
+func hllPatLen(ele []byte) (int, int) {
+	hash := murmurHash64A(ele, 0xadc83b19)
+	index := int(hash & hllPMask)
+	hash >>= hllP
+	hash |= 1 << hllQ // make sure the count is at most Q+1
+	return index, bits.TrailingZeros64(hash) + 1
+}
+
+func denseGetRegister(regs []byte, index int) int {
+	b := index * hllBits / 8
+	fb := uint(index * hllBits & 7)
+	b0 := uint(regs[b])
+	b1 := uint(0)
+	if b+1 < len(regs) {
+		b1 = uint(regs[b+1])
+	}
+	return int((b0>>fb | b1<<(8-fb)) & hllRegisterMax)
+}
+
+func denseSetRegister(regs []byte, index, value int) {
+	b := index * hllBits / 8
+	fb := uint(index * hllBits & 7)
+	v := uint(value)
+	regs[b] &^= byte(hllRegisterMax << fb)
+	regs[b] |= byte(v << fb)
+	if b+1 < len(regs) {
+		regs[b+1] &^= byte(hllRegisterMax >> (8 - fb))
+		regs[b+1] |= byte(v >> (8 - fb))
+	}
+}
+
+// denseSet raises a register to count and reports whether it changed
+func denseSet(regs []byte, index, count int) bool {
+	if count > denseGetRegister(regs, index) {
+		denseSetRegister(regs, index, count)
+		return true
+	}
+	return false
+}
+
+// hllSparseToDense converts a sparse HyperLogLog, keeping its header and cached cardinality
+func hllSparseToDense(hll []byte) ([]byte, error) {
+	if hll[hllEncodingOffset] == hllDense {
+		return hll, nil
+	}
+
+	dense := make([]byte, hllDenseSize)
+	copy(dense, hll[:hllHdrSize])
+	dense[hllEncodingOffset] = hllDense
+	regs := dense[hllHdrSize:]
+
+	idx := 0
+	for p := hllHdrSize; p < len(hll); {
+		op := hll[p]
+		switch {
+		case sparseIsZero(op):
+			idx += sparseZeroLen(op)
+			p++
+		case sparseIsXZero(op):
+			if p+1 >= len(hll) {
+				return nil, errCorruptedHLL
+			}
+			idx += sparseXZeroLen(op, hll[p+1])
+			p += 2
+		default:
+			runLen, value := sparseValLen(op), sparseValValue(op)
+			if runLen+idx > hllRegisters {
+				return nil, errCorruptedHLL
+			}
+			for ; runLen > 0; runLen-- {
+				denseSetRegister(regs, idx, value)
+				idx++
+			}
+			p++
+		}
+	}
+	if idx != hllRegisters {
+		return nil, errCorruptedHLL
+	}
+	return dense, nil
+}
+
+// hllSparseSet raises register index to count in a sparse HyperLogLog, splitting and merging opcodes
+// in place the way Redis does, or promoting to dense when the value or the size no longer fit.
+// It returns the possibly reallocated value and 1 when a register changed, 0 when not.
+func hllSparseSet(hll []byte, index, count int) ([]byte, int, error) {
+	if count > hllSparseValMaxValue {
+		return hllPromoteAndSet(hll, index, count)
+	}
+
+	// step 1: locate the opcode covering the register
+	p, prev := hllHdrSize, -1
+	first, span := 0, 0
+	for p < len(hll) {
+		op := hll[p]
+		opLen := 1
+		switch {
+		case sparseIsZero(op):
+			span = sparseZeroLen(op)
+		case sparseIsVal(op):
+			span = sparseValLen(op)
+		default:
+			if p+1 >= len(hll) {
+				return hll, 0, errCorruptedHLL
+			}
+			span = sparseXZeroLen(op, hll[p+1])
+			opLen = 2
+		}
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += opLen
+		first += span
+	}
+	if span == 0 || p >= len(hll) {
+		return hll, 0, errCorruptedHLL
+	}
+
+	op := hll[p]
+	isZero, isXZero, isVal := sparseIsZero(op), sparseIsXZero(op), sparseIsVal(op)
+	runLen := 0
+	switch {
+	case isZero:
+		runLen = sparseZeroLen(op)
+	case isXZero:
+		runLen = sparseXZeroLen(op, hll[p+1])
+	default:
+		runLen = sparseValLen(op)
+	}
+
+	// step 2: the trivial in place updates
+	updated := false
+	if isVal {
+		if sparseValValue(op) >= count {
+			return hll, 0, nil
+		}
+		if runLen == 1 {
+			hll[p] = sparseVal(count, 1)
+			updated = true
+		}
+	}
+	if !updated && isZero && runLen == 1 {
+		hll[p] = sparseVal(count, 1)
+		updated = true
+	}
+
+	if !updated {
+		// general case: split the opcode into up to three new ones
+		seq := make([]byte, 0, 5)
+		last := first + span - 1
+		zeros := func(n int) {
+			if n > hllSparseZeroMaxLen {
+				seq = append(seq, sparseXZero(n)...)
+			} else {
+				seq = append(seq, sparseZero(n))
+			}
+		}
+
+		if isZero || isXZero {
+			if index != first {
+				zeros(index - first)
+			}
+			seq = append(seq, sparseVal(count, 1))
+			if index != last {
+				zeros(last - index)
+			}
+		} else {
+			current := sparseValValue(op)
+			if index != first {
+				seq = append(seq, sparseVal(current, index-first))
+			}
+			seq = append(seq, sparseVal(count, 1))
+			if index != last {
+				seq = append(seq, sparseVal(current, last-index))
+			}
+		}
+
+		// step 3: substitute the new sequence for the old opcode
+		oldLen := 1
+		if isXZero {
+			oldLen = 2
+		}
+		delta := len(seq) - oldLen
+		if delta > 0 && len(hll)+delta > hllSparseMaxLen {
+			return hllPromoteAndSet(hll, index, count)
+		}
+		replaced := make([]byte, 0, len(hll)+delta)
+		replaced = append(replaced, hll[:p]...)
+		replaced = append(replaced, seq...)
+		replaced = append(replaced, hll[p+oldLen:]...)
+		hll = replaced
+	}
+
+	// step 4: merge adjacent VAL opcodes holding the same value
+	p = hllHdrSize
+	if prev >= 0 {
+		p = prev
+	}
+	for scan := 5; p < len(hll) && scan > 0; scan-- {
+		op := hll[p]
+		if sparseIsXZero(op) {
+			p += 2
+			continue
+		}
+		if sparseIsZero(op) {
+			p++
+			continue
+		}
+		if p+1 < len(hll) && sparseIsVal(hll[p+1]) {
+			v1, v2 := sparseValValue(op), sparseValValue(hll[p+1])
+			if v1 == v2 {
+				if merged := sparseValLen(op) + sparseValLen(hll[p+1]); merged <= hllSparseValMaxLen {
+					hll[p+1] = sparseVal(v1, merged)
+					hll = append(hll[:p], hll[p+1:]...)
+					// retry from the same position to merge with the next opcode too
+					continue
+				}
+			}
+		}
+		p++
+	}
+
+	invalidateHLLCache(hll)
+	return hll, 1, nil
+}
+
+func hllPromoteAndSet(hll []byte, index, count int) ([]byte, int, error) {
+	dense, err := hllSparseToDense(hll)
+	if err != nil {
+		return hll, 0, err
+	}
+	denseSet(dense[hllHdrSize:], index, count)
+	return dense, 1, nil
+}
+
+// hllAdd adds an element, returning the possibly reallocated value and 1 when a register changed
+func hllAdd(hll []byte, ele []byte) ([]byte, int, error) {
+	index, count := hllPatLen(ele)
+	if hll[hllEncodingOffset] == hllDense {
+		if denseSet(hll[hllHdrSize:], index, count) {
+			return hll, 1, nil
+		}
+		return hll, 0, nil
+	}
+	return hllSparseSet(hll, index, count)
+}
+
+// hllRegisterHisto counts how many registers hold each value
+func hllRegisterHisto(hll []byte) ([64]int, error) {
+	var histo [64]int
+	if hll[hllEncodingOffset] == hllDense {
+		regs := hll[hllHdrSize:]
+		for i := 0; i < hllRegisters; i++ {
+			histo[denseGetRegister(regs, i)]++
+		}
+		return histo, nil
+	}
+
+	idx := 0
+	for p := hllHdrSize; p < len(hll); {
+		op := hll[p]
+		switch {
+		case sparseIsZero(op):
+			runLen := sparseZeroLen(op)
+			idx += runLen
+			histo[0] += runLen
+			p++
+		case sparseIsXZero(op):
+			if p+1 >= len(hll) {
+				return histo, errCorruptedHLL
+			}
+			runLen := sparseXZeroLen(op, hll[p+1])
+			idx += runLen
+			histo[0] += runLen
+			p += 2
+		default:
+			runLen := sparseValLen(op)
+			idx += runLen
+			histo[sparseValValue(op)] += runLen
+			p++
+		}
+	}
+	if idx != hllRegisters {
+		return histo, errCorruptedHLL
+	}
+	return histo, nil
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// hllEstimate turns a register histogram into a cardinality using Ertl's improved estimator
+func hllEstimate(histo [64]int) uint64 {
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllCount(hll []byte) (uint64, error) {
+	histo, err := hllRegisterHisto(hll)
+	if err != nil {
+		return 0, err
+	}
+	return hllEstimate(histo), nil
+}
+
+// hllMerge raises every register of maxRegs to at least the value it has in hll
+func hllMerge(maxRegs []uint8, hll []byte) error {
+	if hll[hllEncodingOffset] == hllDense {
+		regs := hll[hllHdrSize:]
+		for i := 0; i < hllRegisters; i++ {
+			maxRegs[i] = max(maxRegs[i], uint8(denseGetRegister(regs, i)))
+		}
+		return nil
+	}
+
+	idx := 0
+	for p := hllHdrSize; p < len(hll); {
+		op := hll[p]
+		switch {
+		case sparseIsZero(op):
+			idx += sparseZeroLen(op)
+			p++
+		case sparseIsXZero(op):
+			if p+1 >= len(hll) {
+				return errCorruptedHLL
+			}
+			idx += sparseXZeroLen(op, hll[p+1])
+			p += 2
+		default:
+			runLen, value := sparseValLen(op), uint8(sparseValValue(op))
+			if runLen+idx > hllRegisters {
+				return errCorruptedHLL
+			}
+			for ; runLen > 0; runLen-- {
+				maxRegs[idx] = max(maxRegs[idx], value)
+				idx++
+			}
+			p++
+		}
+	}
+	if idx != hllRegisters {
+		return errCorruptedHLL
+	}
+	return nil
+}
+
+// lookupHLL returns the HyperLogLog stored at key as a mutable copy, or nil when the key does not exist.
+// The caller must hold mu.
+func lookupHLL(key string) ([]byte, error) {
+	value, exists, err := lookupString(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	hll := []byte(value)
+	if !isValidHLL(hll) {
+		return nil, errInvalidHLLObject
+	}
+	return hll, nil
+}
+
+// handlePFAdd adds elements to a HyperLogLog and returns 1 if its registers changed
+func handlePFAdd(args ...BulkString) ([]byte, error) {
+	if len(args) < 2 {
+		return wrongArgsReply("pfadd")
+	}
+
+	key := *args[1].Value
+	hll, err := lookupHLL(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	updated := 0
+	if hll == nil {
+		hll = newHLL()
+		updated++
+	}
+	for _, arg := range args[2:] {
+		var changed int
+		if hll, changed, err = hllAdd(hll, []byte(*arg.Value)); err != nil {
+			return errorReply(errCorruptedHLL.Error())
+		}
+		updated += changed
+	}
+
+	if updated == 0 {
+		return SerializeInteger(Integer{Value: 0})
+	}
+	invalidateHLLCache(hll)
+	storeString(key, hll)
+	notifyKeyspaceEvent(notifyString, "pfadd", key, currentDB.id)
+	return SerializeInteger(Integer{Value: 1})
+}
+
+// handlePFCount estimates the cardinality of one HyperLogLog, caching it in the value,
+// or of the union of several without modifying them
+func handlePFCount(args ...BulkString) ([]byte, error) {
+	if len(args) < 2 {
+		return wrongArgsReply("pfcount")
+	}
+
+	if len(args) > 2 {
+		maxRegs := make([]uint8, hllRegisters)
+		for _, arg := range args[1:] {
+			hll, err := lookupHLL(*arg.Value)
+			if err != nil {
+				return errorReply(err.Error())
+			}
+			if hll == nil {
+				continue
+			}
+			if err := hllMerge(maxRegs, hll); err != nil {
+				return errorReply(err.Error())
+			}
+		}
+		var histo [64]int
+		for _, reg := range maxRegs {
+			histo[reg]++
+		}
+		return SerializeInteger(Integer{Value: int(hllEstimate(histo))})
+	}
+
+	key := *args[1].Value
+	hll, err := lookupHLL(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if hll == nil {
+		return SerializeInteger(Integer{Value: 0})
+	}
+
+	card := hll[hllCardOffset : hllCardOffset+8]
+	if card[7]&(1<<7) == 0 {
+		return SerializeInteger(Integer{Value: int(binary.LittleEndian.Uint64(card))})
+	}
+
+	count, err := hllCount(hll)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	binary.LittleEndian.PutUint64(card, count)
+	storeString(key, hll)
+	return SerializeInteger(Integer{Value: int(count)})
+}
+
+// handlePFMerge stores the union of the source HyperLogLogs and the destination into the destination
+func handlePFMerge(args ...BulkString) ([]byte, error) {
+	if len(args) < 2 {
+		return wrongArgsReply("pfmerge")
+	}
+
+	maxRegs := make([]uint8, hllRegisters)
+	useDense := false
+	for _, arg := range args[1:] {
+		hll, err := lookupHLL(*arg.Value)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		if hll == nil {
+			continue
+		}
+		if hll[hllEncodingOffset] == hllDense {
+			useDense = true
+		}
+		if err := hllMerge(maxRegs, hll); err != nil {
+			return errorReply(err.Error())
+		}
+	}
+
+	dest := *args[1].Value
+	hll, _ := lookupHLL(dest)
+	if hll == nil {
+		hll = newHLL()
+	}
+	var err error
+	if useDense {
+		if hll, err = hllSparseToDense(hll); err != nil {
+			return errorReply(err.Error())
+		}
+	}
+
+	for i, reg := range maxRegs {
+		if reg == 0 {
+			continue
+		}
+		if hll[hllEncodingOffset] == hllDense {
+			denseSet(hll[hllHdrSize:], i, int(reg))
+		} else if hll, _, err = hllSparseSet(hll, i, int(reg)); err != nil {
+			return errorReply(err.Error())
+		}
+	}
+	invalidateHLLCache(hll)
+	storeString(dest, hll)
+	notifyKeyspaceEvent(notifyString, "pfadd", dest, currentDB.id)
+	return []byte("+OK\r\n"), nil
+}
+
+// handlePFDebug exposes HyperLogLog internals: GETREG, DECODE, ENCODING and TODENSE
+func handlePFDebug(args ...BulkString) ([]byte, error) {
+	if len(args) < 3 {
+		return wrongArgsReply("pfdebug")
+	}
+	sub := *args[1].Value
+
+	key := *args[2].Value
+	hll, err := lookupHLL(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if hll == nil {
+		return errorReply("ERR The specified key does not exist")
+	}
+	if len(args) != 3 {
+		return errorReply(fmt.Sprintf("ERR Wrong number of arguments for the '%s' subcommand", sub))
+	}
+
+	switch strings.ToLower(sub) {
+	case "getreg":
+		if hll[hllEncodingOffset] == hllSparse {
+			if hll, err = hllSparseToDense(hll); err != nil {
+				return errorReply(err.Error())
+			}
+			storeString(key, hll)
+		}
+		regs := make([]RESPData, hllRegisters)
+		for i := range regs {
+			regs[i] = Integer{Value: denseGetRegister(hll[hllHdrSize:], i)}
+		}
+		return SerializeArray(Array{Elements: &regs})
+
+	case "decode":
+		if hll[hllEncodingOffset] != hllSparse {
+			return errorReply("ERR HLL encoding is not sparse")
+		}
+		var decoded []string
+		for p := hllHdrSize; p < len(hll); {
+			op := hll[p]
+			switch {
+			case sparseIsZero(op):
+				decoded = append(decoded, fmt.Sprintf("z:%d", sparseZeroLen(op)))
+				p++
+			case sparseIsXZero(op):
+				decoded = append(decoded, fmt.Sprintf("Z:%d", sparseXZeroLen(op, hll[p+1])))
+				p += 2
+			default:
+				decoded = append(decoded, fmt.Sprintf("v:%d,%d", sparseValValue(op), sparseValLen(op)))
+				p++
+			}
+		}
+		return bulkString(strings.Join(decoded, " ")).serialize()
+
+	case "encoding":
+		if hll[hllEncodingOffset] == hllDense {
+			return []byte("+dense\r\n"), nil
+		}
+		return []byte("+sparse\r\n"), nil
+
+	case "todense":
+		if hll[hllEncodingOffset] == hllDense {
+			return SerializeInteger(Integer{Value: 0})
+		}
+		if hll, err = hllSparseToDense(hll); err != nil {
+			return errorReply(err.Error())
+		}
+		storeString(key, hll)
+		return SerializeInteger(Integer{Value: 1})
+	}
+	return errorReply(fmt.Sprintf("ERR Unknown PFDEBUG subcommand '%s'", sub))
+}
+
+// handlePFSelfTest checks register access and the estimation error of the dense and sparse encodings
+func handlePFSelfTest(args ...BulkString) ([]byte, error) {
+	const testCycles = 1000
+
+	dense := make([]byte, hllDenseSize)
+	copy(dense, "HYLL")
+	regs := dense[hllHdrSize:]
+
+	// test 1: every register keeps its value without disturbing its neighbours
+	expected := make([]int, hllRegisters)
+	for cycle := 0; cycle < testCycles; cycle++ {
+		for i := range expected {
+			expected[i] = rand.Intn(hllRegisterMax + 1)
+			denseSetRegister(regs, i, expected[i])
+		}
+		for i, want := range expected {
+			if got := denseGetRegister(regs, i); got != want {
+				return errorReply(fmt.Sprintf("TESTFAILED Register %d should be %d but is %d", i, want, got))
+			}
+		}
+	}
+
+	// test 2: the estimate stays within bounds and both encodings agree
+	clear(regs)
+	sparse := newHLL()
+	relErr := 1.04 / math.Sqrt(hllRegisters)
+	checkpoint := int64(1)
+	seed := rand.Uint64()
+	ele := make([]byte, 8)
+	for j := int64(1); j <= 10000000; j++ {
+		binary.LittleEndian.PutUint64(ele, uint64(j)^seed)
+		index, count := hllPatLen(ele)
+		denseSet(regs, index, count)
+		sparse, _, _ = hllAdd(sparse, ele)
+
+		if j != checkpoint {
+			continue
+		}
+		if j < hllSparseMaxLen/2 && sparse[hllEncodingOffset] != hllSparse {
+			return errorReply("TESTFAILED sparse encoding not used")
+		}
+		denseCount, _ := hllCount(dense)
+		sparseCount, _ := hllCount(sparse)
+		if denseCount != sparseCount {
+			return errorReply("TESTFAILED dense/sparse disagree")
+		}
+
+		maxErr := int64(math.Ceil(relErr * 6 * float64(checkpoint)))
+		if j == 10 {
+			maxErr = 1
+		}
+		absErr := checkpoint - int64(denseCount)
+		if absErr < 0 {
+			absErr = -absErr
+		}
+		if absErr > maxErr {
+			return errorReply(fmt.Sprintf("TESTFAILED Too big error. card:%d abserr:%d", checkpoint, absErr))
+		}
+		checkpoint *= 10
+	}
+
+	return []byte("+OK\r\n"), nil
+}
@@ -0,0 +1,104 @@
+package resp
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLogCommands(t *testing.T) {
+	emptyHLL := "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x7f\xff"
+	runCommandCases(t, []commandCase{
+		{"create empty", []string{"PFADD", "hll:empty"}, ":1\r\n"},
+		{"create again", []string{"PFADD", "hll:empty"}, ":0\r\n"},
+		{"raw empty value", []string{"GET", "hll:empty"}, "$18\r\n" + emptyHLL + "\r\n"},
+		{"decode empty", []string{"PFDEBUG", "DECODE", "hll:empty"}, "$7\r\nZ:16384\r\n"},
+		{"count empty", []string{"PFCOUNT", "hll:empty"}, ":0\r\n"},
+
+		{"add", []string{"PFADD", "hll:a", "a", "b", "c", "d", "e", "f", "g"}, ":1\r\n"},
+		{"add existing", []string{"PFADD", "hll:a", "a", "b"}, ":0\r\n"},
+		{"count", []string{"PFCOUNT", "hll:a"}, ":7\r\n"},
+		{"add more", []string{"PFADD", "hll:b", "e", "f", "g", "h", "i"}, ":1\r\n"},
+		{"count union", []string{"PFCOUNT", "hll:a", "hll:b", "hll:missing"}, ":9\r\n"},
+		{"merge", []string{"PFMERGE", "hll:merged", "hll:a", "hll:b"}, "+OK\r\n"},
+		{"count merged", []string{"PFCOUNT", "hll:merged"}, ":9\r\n"},
+		{"encoding", []string{"PFDEBUG", "ENCODING", "hll:merged"}, "+sparse\r\n"},
+		{"todense", []string{"PFDEBUG", "TODENSE", "hll:merged"}, ":1\r\n"},
+		{"todense again", []string{"PFDEBUG", "TODENSE", "hll:merged"}, ":0\r\n"},
+		{"dense encoding", []string{"PFDEBUG", "ENCODING", "hll:merged"}, "+dense\r\n"},
+		{"count dense", []string{"PFCOUNT", "hll:merged"}, ":9\r\n"},
+		{"decode dense", []string{"PFDEBUG", "DECODE", "hll:merged"}, "-ERR HLL encoding is not sparse\r\n"},
+		{"debug missing key", []string{"PFDEBUG", "ENCODING", "hll:missing"}, "-ERR The specified key does not exist\r\n"},
+		{"debug unknown", []string{"PFDEBUG", "FOO", "hll:a"}, "-ERR Unknown PFDEBUG subcommand 'FOO'\r\n"},
+
+		{"plain string", []string{"SET", "hll:string", "foo"}, "+OK\r\n"},
+		{"add to plain string", []string{"PFADD", "hll:string", "a"}, "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{"count plain string", []string{"PFCOUNT", "hll:string"}, "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{"stream", []string{"XADD", "hll:stream", "1-0", "k", "v"}, "$3\r\n1-0\r\n"},
+		{"add to stream", []string{"PFADD", "hll:stream", "a"}, "-" + wrongTypeErr + "\r\n"},
+		{"corrupted", []string{"SET", "hll:corrupt", "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x7f"}, "+OK\r\n"},
+		{"count corrupted", []string{"PFCOUNT", "hll:corrupt"}, "-INVALIDOBJ Corrupted HLL object detected\r\n"},
+	})
+}
+
+func TestHyperLogLogPromotesToDense(t *testing.T) {
+	for i := 0; i < 5000; i++ {
+		if _, err := ExecuteRespData(respCommand("PFADD", "hll:big", "element:"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	result, _ := ExecuteRespData(respCommand("PFDEBUG", "ENCODING", "hll:big"))
+	if string(result) != "+dense\r\n" {
+		t.Errorf("expected dense encoding, but got %q", result)
+	}
+
+	result, _ = ExecuteRespData(respCommand("PFCOUNT", "hll:big"))
+	count, err := strconv.Atoi(string(result[1 : len(result)-2]))
+	if err != nil {
+		t.Fatalf("unexpected reply %q", result)
+	}
+	if count < 4900 || count > 5100 {
+		t.Errorf("expected a count close to 5000, but got %d", count)
+	}
+
+	mu.RLock()
+	cached := store["hll:big"].value.(string)
+	mu.RUnlock()
+	if cached[hllInvalidCacheOffset]&(1<<7) != 0 {
+		t.Error("expected PFCOUNT to cache the cardinality")
+	}
+}
+
+func TestHyperLogLogSparseMatchesDense(t *testing.T) {
+	sparse := newHLL()
+	dense, err := hllSparseToDense(newHLL())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		ele := []byte("member:" + strconv.Itoa(i))
+		sparse, _, _ = hllAdd(sparse, ele)
+		dense, _, _ = hllAdd(dense, ele)
+	}
+	if sparse[hllEncodingOffset] != hllSparse {
+		t.Fatal("expected the small HyperLogLog to stay sparse")
+	}
+
+	promoted, err := hllSparseToDense(sparse)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(promoted[hllHdrSize:]) != string(dense[hllHdrSize:]) {
+		t.Error("sparse and dense registers differ")
+	}
+}
+
+func TestPFSelfTest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping PFSELFTEST in short mode")
+	}
+	runCommandCases(t, []commandCase{
+		{"selftest", []string{"PFSELFTEST"}, "+OK\r\n"},
+	})
+}
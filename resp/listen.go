@@ -0,0 +1,225 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxBindAddresses is how many addresses bind takes
+const maxBindAddresses = 16
+
+const protectedModeError = "-DENIED Redis is running in protected mode because protected mode is enabled and no password is set for the default user. " +
+	"In this mode connections are only accepted from the loopback interface. If you want to connect from external computers to Redis you may adopt one of the following solutions: " +
+	"1) Just disable protected mode sending the command 'CONFIG SET protected-mode no' from the loopback interface by connecting to Redis from the same host the server is running, " +
+	"however MAKE SURE Redis is not publicly accessible from internet if you do so. Use CONFIG REWRITE to make this change permanent. " +
+	"2) Alternatively you can just disable the protected mode by editing the Redis configuration file, and setting the protected mode option to 'no', and then restarting the server. " +
+	"3) If you started the server manually just for testing, restart it with the '--protected-mode no' option. " +
+	"4) Set up an authentication password for the default user. " +
+	"NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside.\r\n"
+
+// setBind takes the addresses to listen on: IPv4 or IPv6 ones, * for every IPv4 address and ::* for every
+// IPv6 one, those starting with - being skipped when they are not available
+func setBind(value string) error {
+	addrs := strings.Fields(value)
+	if len(addrs) == 0 {
+		return errors.New("argument must not be empty")
+	}
+	if len(addrs) > maxBindAddresses {
+		return errors.New("Too many bind addresses specified.")
+	}
+	config.bind = addrs
+	return nil
+}
+
+// Listen opens a listener on port for every bind address, accepting TLS connections when useTLS is set
+func Listen(port int, useTLS bool) ([]net.Listener, error) {
+	mu.RLock()
+	addrs := config.bind
+	mu.RUnlock()
+
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		optional := strings.HasPrefix(addr, "-")
+		host, network := strings.TrimPrefix(addr, "-"), "tcp4"
+		switch {
+		case host == "*":
+			host = "0.0.0.0"
+		case host == "::*":
+			host, network = "::", "tcp6"
+		case strings.Contains(host, ":"):
+			network = "tcp6"
+		}
+		l, err := net.Listen(network, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			if optional {
+				fmt.Printf("Skipping optional bind address %s: %v\n", host, err)
+				continue
+			}
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("Could not create server TCP listening socket %s:%d: %v", host, port, err)
+		}
+		if useTLS {
+			l = tlsListener(l)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listening holds the listeners the server accepts connections on and handle, which serves the connections
+// they accept. The listeners are closed while a shutdown is in progress and opened again when it is
+// aborted. It has its own lock since opening the listeners takes mu.
+var listening struct {
+	sync.Mutex
+	listeners []net.Listener
+	handle    func(net.Conn)
+}
+
+// openListeners opens the listeners of port and tls-port on every bind address, a port of 0 disabling
+// them, and the Unix socket when one is configured
+func openListeners() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, p := range []struct {
+		port   int
+		useTLS bool
+	}{{Port(), false}, {TLSPort(), true}} {
+		if p.port == 0 {
+			continue
+		}
+		l, err := Listen(p.port, p.useTLS)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("%v\nFailed listening on port %d (tcp), aborting.", err, p.port)
+		}
+		listeners = append(listeners, l...)
+	}
+	if path := UnixSocket(); path != "" {
+		l, err := ListenUnix()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("Failed opening Unix socket %s: %v", path, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// Serve opens the listeners and serves the connections they accept with handle until the process exits.
+// It only returns when the listeners can't be opened.
+func Serve(handle func(net.Conn)) error {
+	listeners, err := openListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		return errors.New("Configured to not listen anywhere, exiting.")
+	}
+	listening.Lock()
+	listening.listeners, listening.handle = listeners, handle
+	listening.Unlock()
+	for _, l := range listeners {
+		go accept(l, handle)
+	}
+	select {}
+}
+
+// accept serves the connections of a listener until it is closed
+func accept(l net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if opErr, ok := err.(*net.OpError); ok && opErr.Temporary() {
+				fmt.Println("Error accepting connection: ", err.Error())
+				continue
+			}
+			fmt.Println("Error accepting connection: ", err.Error())
+			os.Exit(1)
+		}
+		go handle(conn)
+	}
+}
+
+// stopListening closes the listeners when a shutdown starts, so new connections are refused
+func stopListening() {
+	listening.Lock()
+	defer listening.Unlock()
+	closeListeners(listening.listeners)
+	listening.listeners = nil
+}
+
+// resumeListening opens the listeners again after a failed or aborted shutdown. The caller must not
+// hold mu.
+func resumeListening() {
+	listening.Lock()
+	defer listening.Unlock()
+	if listening.handle == nil || listening.listeners != nil {
+		return
+	}
+	listeners, err := openListeners()
+	if err != nil {
+		fmt.Println("Error listening again after the aborted shutdown:", err)
+		return
+	}
+	listening.listeners = listeners
+	for _, l := range listeners {
+		go accept(l, listening.handle)
+	}
+}
+
+// ProtectedModeRefuses reports whether protected mode refuses conn, which was then sent the reason and
+// should be closed: while the default user has no password only local connections are accepted
+func ProtectedModeRefuses(conn net.Conn) bool {
+	mu.RLock()
+	protected := config.protectedMode && defaultUser.nopass
+	mu.RUnlock()
+	if !protected || isLocalConn(conn) {
+		return false
+	}
+	conn.Write([]byte(protectedModeError))
+	return true
+}
+
+// isLocalConn reports whether conn comes from the loopback interface or a Unix socket
+func isLocalConn(conn net.Conn) bool {
+	if conn.LocalAddr().Network() == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && ip.IsLoopback()
+}
+
+// protectedActionSetter takes whether an action enable-protected-configs or enable-debug-command
+// protects is allowed: yes, no or local for local connections only
+func protectedActionSetter(p *string) func(string) error {
+	return func(value string) error {
+		switch v := strings.ToLower(value); v {
+		case "yes", "no", "local":
+			*p = v
+			return nil
+		}
+		return errors.New("argument(s) must be one of the following: no, yes, local")
+	}
+}
+
+// allowProtectedAction reports whether the setting protecting an action lets the client do it. Clients
+// without a connection are internal and always may. The caller must hold mu.
+func (c *Client) allowProtectedAction(setting string) bool {
+	return c.conn == nil || setting == "yes" || setting == "local" && isLocalConn(c.conn)
+}
@@ -0,0 +1,145 @@
+package resp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// remoteConn is a loopback connection that looks like it comes from another host
+type remoteConn struct {
+	net.Conn
+}
+
+func (remoteConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+}
+
+// useBind sets the bind addresses for the test
+func useBind(t *testing.T, addrs string) {
+	t.Helper()
+	mu.Lock()
+	defer mu.Unlock()
+	saved := config.bind
+	if err := setBind(addrs); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		config.bind = saved
+	})
+}
+
+// allowProtectedActions sets enable-protected-configs and enable-debug-command for the test
+func allowProtectedActions(t *testing.T, setting string) {
+	t.Helper()
+	mu.Lock()
+	defer mu.Unlock()
+	config.enableProtectedConfigs, config.enableDebugCommand = setting, setting
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		config.enableProtectedConfigs, config.enableDebugCommand = "no", "no"
+	})
+}
+
+func TestBind(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"default", []string{"CONFIG", "GET", "bind"}, string(respCommand("bind", "* -::*"))},
+		{"immutable", []string{"CONFIG", "SET", "bind", "127.0.0.1"}, "-ERR CONFIG SET failed (possibly related to argument 'bind') - can't set immutable config\r\n"},
+	})
+	if err := setBind(strings.Repeat("127.0.0.1 ", 17)); err == nil {
+		t.Error("expected too many addresses to be refused")
+	}
+
+	// an optional address that isn't available is skipped
+	useBind(t, "127.0.0.1 -203.0.113.7")
+	listeners, err := Listen(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || !strings.HasPrefix(listeners[0].Addr().String(), "127.0.0.1:") {
+		t.Fatalf("expected a listener on 127.0.0.1, got %v", listeners)
+	}
+	conn, err := net.Dial("tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	listeners[0].Close()
+
+	// a required one fails
+	useBind(t, "127.0.0.1 203.0.113.7")
+	if _, err := Listen(0, false); err == nil || !strings.Contains(err.Error(), "203.0.113.7") {
+		t.Errorf("expected the unavailable address to fail, got %v", err)
+	}
+}
+
+func TestProtectedMode(t *testing.T) {
+	local, r := subscriber(t)
+	if ProtectedModeRefuses(local.conn) {
+		t.Error("expected a loopback connection to be accepted")
+	}
+	remote := remoteConn{local.conn}
+	if !ProtectedModeRefuses(remote) {
+		t.Fatal("expected a connection from another host to be refused")
+	}
+	expectOutput(t, r, protectedModeError)
+
+	setConfig(t, "protected-mode", "no")
+	if ProtectedModeRefuses(remote) {
+		t.Error("expected connections to be accepted without protected mode")
+	}
+	setConfig(t, "protected-mode", "yes")
+	setConfig(t, "requirepass", "secret")
+	if ProtectedModeRefuses(remote) {
+		t.Error("expected connections to be accepted once a password is set")
+	}
+}
+
+func TestProtectedActions(t *testing.T) {
+	useTempDir(t)
+	mu.RLock()
+	dir := config.dir
+	mu.RUnlock()
+	local, _ := subscriber(t)
+	remoteSide, _ := subscriber(t)
+	remote := NewConnClient(remoteConn{remoteSide.conn})
+	t.Cleanup(remote.Close)
+
+	protectedConfig := "-ERR CONFIG SET failed (possibly related to argument 'dir') - can't set protected config\r\n"
+	debugDenied := "-" + debugNotAllowedError + "\r\n"
+	runClientCommandCases(t, local, []commandCase{
+		{"config", []string{"CONFIG", "SET", "dir", dir}, protectedConfig},
+		{"debug", []string{"DEBUG", "SLEEP", "0"}, debugDenied},
+		{"immutable", []string{"CONFIG", "SET", "enable-debug-command", "yes"}, "-ERR CONFIG SET failed (possibly related to argument 'enable-debug-command') - can't set immutable config\r\n"},
+		{"other config", []string{"CONFIG", "SET", "dbfilename", "other.rdb", "appendfsync", "always"}, "-ERR CONFIG SET failed (possibly related to argument 'dbfilename') - can't set protected config\r\n"},
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"queued debug", []string{"DEBUG", "SLEEP", "0"}, debugDenied},
+		{"exec", []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+	})
+	// clients without a connection are internal
+	runCommandCases(t, []commandCase{
+		{"internal config", []string{"CONFIG", "SET", "dir", dir}, "+OK\r\n"},
+		{"internal debug", []string{"DEBUG", "SLEEP", "0"}, "+OK\r\n"},
+	})
+
+	allowProtectedActions(t, "local")
+	runClientCommandCases(t, local, []commandCase{
+		{"local config", []string{"CONFIG", "SET", "dir", dir}, "+OK\r\n"},
+		{"local debug", []string{"DEBUG", "SLEEP", "0"}, "+OK\r\n"},
+		{"debug float", []string{"DEBUG", "SLEEP", "soon"}, "-ERR value is not a valid float\r\n"},
+		{"debug unknown", []string{"DEBUG", "NOPE"}, "-ERR unknown subcommand or wrong number of arguments for 'NOPE'. Try DEBUG HELP.\r\n"},
+	})
+	runClientCommandCases(t, remote, []commandCase{
+		{"remote config", []string{"CONFIG", "SET", "dir", dir}, protectedConfig},
+		{"remote debug", []string{"DEBUG", "SLEEP", "0"}, debugDenied},
+	})
+
+	allowProtectedActions(t, "yes")
+	runClientCommandCases(t, remote, []commandCase{
+		{"remote config", []string{"CONFIG", "SET", "dir", dir}, "+OK\r\n"},
+		{"remote debug", []string{"DEBUG", "SLEEP", "0"}, "+OK\r\n"},
+	})
+}
@@ -0,0 +1,211 @@
+package resp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Listpacks are the compact encoding Redis serializes stream nodes and small sorted sets with:
+// a 6 byte header (total bytes and element count), the elements and a 0xFF terminator.
+// Every element is an encoding byte with its data followed by the element length encoded backwards.
+const (
+	listpackHeaderSize = 6
+	listpackEOF        = 0xff
+)
+
+var errListpackCorrupt = errors.New("invalid listpack")
+
+type listpackBuilder struct {
+	buf   []byte
+	count int
+}
+
+func newListpackBuilder() *listpackBuilder {
+	return &listpackBuilder{buf: make([]byte, listpackHeaderSize, 64)}
+}
+
+// appendString adds s, stored as an integer when it is the canonical form of one like Redis does
+func (lp *listpackBuilder) appendString(s string) {
+	if len(s) <= 20 {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+			lp.appendInt(v)
+			return
+		}
+	}
+
+	start := len(lp.buf)
+	switch n := len(s); {
+	case n < 64:
+		lp.buf = append(lp.buf, 0x80|byte(n))
+	case n < 4096:
+		lp.buf = append(lp.buf, 0xe0|byte(n>>8), byte(n))
+	default:
+		lp.buf = append(lp.buf, 0xf0)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.finishElement(start)
+}
+
+func (lp *listpackBuilder) appendInt(v int64) {
+	start := len(lp.buf)
+	switch {
+	case v >= 0 && v <= 127:
+		lp.buf = append(lp.buf, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint16(v) & 0x1fff
+		lp.buf = append(lp.buf, 0xc0|byte(u>>8), byte(u))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		lp.buf = append(lp.buf, 0xf1)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(v))
+	case v >= -(1<<23) && v < 1<<23:
+		u := uint32(v)
+		lp.buf = append(lp.buf, 0xf2, byte(u), byte(u>>8), byte(u>>16))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		lp.buf = append(lp.buf, 0xf3)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(v))
+	default:
+		lp.buf = append(lp.buf, 0xf4)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(v))
+	}
+	lp.finishElement(start)
+}
+
+// finishElement appends the backlen of the element starting at start
+func (lp *listpackBuilder) finishElement(start int) {
+	l := len(lp.buf) - start
+	switch {
+	case l <= 127:
+		lp.buf = append(lp.buf, byte(l))
+	case l < 16383:
+		lp.buf = append(lp.buf, byte(l>>7), byte(l&127)|128)
+	case l < 2097151:
+		lp.buf = append(lp.buf, byte(l>>14), byte((l>>7)&127)|128, byte(l&127)|128)
+	case l < 268435455:
+		lp.buf = append(lp.buf, byte(l>>21), byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	default:
+		lp.buf = append(lp.buf, byte(l>>28), byte((l>>21)&127)|128, byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	}
+	lp.count++
+}
+
+// bytes terminates the listpack and fills in its header
+func (lp *listpackBuilder) bytes() []byte {
+	buf := append(lp.buf, listpackEOF)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)))
+	count := lp.count
+	if count > math.MaxUint16-1 {
+		count = math.MaxUint16 // unknown, readers have to walk the elements
+	}
+	binary.LittleEndian.PutUint16(buf[4:], uint16(count))
+	return buf
+}
+
+// listpackElements decodes every element of a listpack, integers in their decimal form
+func listpackElements(buf []byte) ([]string, error) {
+	if len(buf) < listpackHeaderSize+1 || int(binary.LittleEndian.Uint32(buf)) != len(buf) || buf[len(buf)-1] != listpackEOF {
+		return nil, errListpackCorrupt
+	}
+
+	var elements []string
+	p := listpackHeaderSize
+	for buf[p] != listpackEOF {
+		value, size, err := listpackElement(buf[p:])
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, value)
+		p += size + listpackBacklenSize(size)
+		if p >= len(buf) {
+			return nil, errListpackCorrupt
+		}
+	}
+	if count := int(binary.LittleEndian.Uint16(buf[4:])); count != math.MaxUint16 && count != len(elements) {
+		return nil, errListpackCorrupt
+	}
+	return elements, nil
+}
+
+// listpackElement decodes the element at the start of b, returning it and its size without the backlen
+func listpackElement(b []byte) (string, int, error) {
+	need := func(n int) error {
+		if len(b) < n {
+			return errListpackCorrupt
+		}
+		return nil
+	}
+	integer := func(size int, v int64) (string, int, error) {
+		return strconv.FormatInt(v, 10), size, nil
+	}
+	str := func(header, n int) (string, int, error) {
+		if err := need(header + n); err != nil {
+			return "", 0, err
+		}
+		return string(b[header : header+n]), header + n, nil
+	}
+
+	enc := b[0]
+	switch {
+	case enc&0x80 == 0:
+		return integer(1, int64(enc&0x7f))
+	case enc&0xc0 == 0x80:
+		return str(1, int(enc&0x3f))
+	case enc&0xe0 == 0xc0:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		u := uint16(enc&0x1f)<<8 | uint16(b[1])
+		return integer(2, int64(int16(u<<3)>>3))
+	case enc&0xf0 == 0xe0:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		return str(2, int(enc&0x0f)<<8|int(b[1]))
+	}
+
+	switch enc {
+	case 0xf0:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		return str(5, int(binary.LittleEndian.Uint32(b[1:])))
+	case 0xf1:
+		if err := need(3); err != nil {
+			return "", 0, err
+		}
+		return integer(3, int64(int16(binary.LittleEndian.Uint16(b[1:]))))
+	case 0xf2:
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		u := uint32(b[1]) | uint32(b[2])<<8 | uint32(b[3])<<16
+		return integer(4, int64(int32(u<<8)>>8))
+	case 0xf3:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		return integer(5, int64(int32(binary.LittleEndian.Uint32(b[1:]))))
+	case 0xf4:
+		if err := need(9); err != nil {
+			return "", 0, err
+		}
+		return integer(9, int64(binary.LittleEndian.Uint64(b[1:])))
+	}
+	return "", 0, errListpackCorrupt
+}
+
+func listpackBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
@@ -0,0 +1,166 @@
+package resp
+
+import "errors"
+
+// LZF as implemented by liblzf, which Redis uses to compress long strings in RDB files
+const (
+	lzfHashLog = 16
+	lzfMaxLit  = 1 << 5
+	lzfMaxOff  = 1 << 13
+	lzfMaxRef  = (1 << 8) + (1 << 3)
+)
+
+var errLZFCorrupt = errors.New("invalid LZF data")
+
+// lzfCompress compresses in, returning nil when the output would not fit in maxLen bytes
+func lzfCompress(in []byte, maxLen int) []byte {
+	if len(in) < 3 {
+		return nil
+	}
+	var htab [1 << lzfHashLog]int
+	out := make([]byte, 0, maxLen)
+
+	lit := 0
+	out = append(out, 0) // control byte of the first literal run
+	hval := uint32(in[0])<<8 | uint32(in[1])
+	ip := 0
+
+	for ip < len(in)-2 {
+		hval = hval<<8 | uint32(in[ip+2])
+		slot := ((hval >> (3*8 - lzfHashLog)) - hval*5) & (1<<lzfHashLog - 1)
+		ref := htab[slot] - 1 // positions are stored off by one so zero means empty
+		htab[slot] = ip + 1
+		off := ip - ref - 1
+
+		if ref >= 0 && off < lzfMaxOff && in[ref] == in[ip] && in[ref+1] == in[ip+1] && in[ref+2] == in[ip+2] {
+			length := 2
+			maxRef := min(len(in)-ip-length, lzfMaxRef)
+			if len(out)-boolToInt(lit == 0)+3+1 >= maxLen {
+				return nil
+			}
+
+			// close the pending literal run
+			out[len(out)-lit-1] = byte(lit - 1)
+			if lit == 0 {
+				out = out[:len(out)-1]
+			}
+
+			for length < maxRef && in[ref+length] == in[ip+length] {
+				length++
+			}
+			length -= 2
+			ip++
+
+			if length < 7 {
+				out = append(out, byte(off>>8)+byte(length<<5))
+			} else {
+				out = append(out, byte(off>>8)+7<<5, byte(length-7))
+			}
+			out = append(out, byte(off))
+
+			lit = 0
+			out = append(out, 0)
+			ip += length + 1
+			if ip >= len(in)-2 {
+				break
+			}
+
+			// hash the positions inside the match so later data can refer to them
+			ip--
+			hval = uint32(in[ip])<<8 | uint32(in[ip+1])
+			hval = hval<<8 | uint32(in[ip+2])
+			htab[((hval>>(3*8-lzfHashLog))-hval*5)&(1<<lzfHashLog-1)] = ip + 1
+			ip++
+			continue
+		}
+
+		if len(out) >= maxLen {
+			return nil
+		}
+		lit++
+		out = append(out, in[ip])
+		ip++
+		if lit == lzfMaxLit {
+			out[len(out)-lit-1] = byte(lit - 1)
+			lit = 0
+			out = append(out, 0)
+		}
+	}
+
+	for ip < len(in) {
+		if len(out) >= maxLen {
+			return nil
+		}
+		lit++
+		out = append(out, in[ip])
+		ip++
+		if lit == lzfMaxLit {
+			out[len(out)-lit-1] = byte(lit - 1)
+			lit = 0
+			out = append(out, 0)
+		}
+	}
+
+	out[len(out)-lit-1] = byte(lit - 1)
+	if lit == 0 {
+		out = out[:len(out)-1]
+	}
+	if len(out) > maxLen {
+		return nil
+	}
+	return out
+}
+
+// lzfDecompress expands in, which must produce exactly outLen bytes
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 1<<5 {
+			// literal run of ctrl+1 bytes
+			ctrl++
+			if ip+ctrl > len(in) || len(out)+ctrl > outLen {
+				return nil, errLZFCorrupt
+			}
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+			continue
+		}
+
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, errLZFCorrupt
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errLZFCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - 1 - int(in[ip])
+		ip++
+		length += 2
+		if ref < 0 || len(out)+length > outLen {
+			return nil, errLZFCorrupt
+		}
+		// the reference may overlap the bytes being written, so copy one at a time
+		for i := 0; i < length; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errLZFCorrupt
+	}
+	return out, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
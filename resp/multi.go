@@ -0,0 +1,237 @@
+package resp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// multiState is the transaction a client opened with MULTI
+type multiState struct {
+	commands []queuedCommand
+	// dirty is set when a command could not be queued, so EXEC must abort
+	dirty bool
+}
+
+type queuedCommand struct {
+	cmd  command
+	args []BulkString
+}
+
+// multiControlCommands run immediately even inside a transaction
+var multiControlCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"RESET":   true,
+	"QUIT":    true,
+}
+
+// noMultiCommands can not be queued in a transaction
+var noMultiCommands = map[string]bool{
+	"SHUTDOWN": true,
+	"PSYNC":    true,
+	"SYNC":     true,
+}
+
+// flagTransaction marks an open transaction as failed after a command was rejected at queue time
+func (c *Client) flagTransaction() {
+	if c.multi != nil {
+		c.multi.dirty = true
+	}
+}
+
+// handleMulti starts a transaction: the following commands are queued until EXEC or DISCARD
+func handleMulti(c *Client, args ...BulkString) ([]byte, error) {
+	if c.multi != nil {
+		return errorReply("ERR MULTI calls can not be nested")
+	}
+	c.multi = &multiState{}
+	return []byte("+OK\r\n"), nil
+}
+
+// handleDiscard drops the queued commands
+func handleDiscard(c *Client, args ...BulkString) ([]byte, error) {
+	if c.multi == nil {
+		return errorReply("ERR DISCARD without MULTI")
+	}
+	c.multi = nil
+	c.unwatchAllKeys()
+	return []byte("+OK\r\n"), nil
+}
+
+// handleExec runs the queued commands one after the other without any other client running in between.
+// Errors raised while running a command become its entry of the reply, nothing is rolled back.
+func handleExec(c *Client, args ...BulkString) ([]byte, error) {
+	if c.multi == nil {
+		return errorReply("ERR EXEC without MULTI")
+	}
+	multi := c.multi
+	c.multi = nil
+	defer c.unwatchAllKeys()
+	if multi.dirty {
+		return errorReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	if c.dirtyCAS || c.watchedKeyExpired() {
+		return []byte("*-1\r\n"), nil
+	}
+
+	denyBlocking = true
+	defer func() { denyBlocking = false }()
+
+	// EXEC itself is not logged, the writes it runs are, wrapped in MULTI ... EXEC
+	preventPropagation()
+	beginTransactionPropagation()
+	reply := []byte(fmt.Sprintf("*%d\r\n", len(multi.commands)))
+	for _, queued := range multi.commands {
+		// the user may have lost a permission since the command was queued
+		if denial := c.checkPermissions(strings.ToUpper(*queued.args[0].Value), queued.cmd, queued.args); denial != nil {
+			addACLLogEntry(c, denial, "multi")
+			result, _ := errorReply("NOPERM ACLs rules changed between the moment the transaction was accumulated and the EXEC call. This command is no longer allowed for the following reason: " + denial.message(false))
+			reply = append(reply, result...)
+			continue
+		}
+		result, err := c.call(queued.cmd, queued.args)
+		if err != nil {
+			result, _ = errorReply("ERR " + err.Error())
+		}
+		reply = append(reply, result...)
+	}
+	endTransactionPropagation()
+	return reply, nil
+}
+
+// watchedKey is a key a client watches for changes until its next EXEC, DISCARD or UNWATCH
+type watchedKey struct {
+	db  *database
+	key string
+	// expired is set when the key existed but had already expired at WATCH time, so deleting it is no change
+	expired bool
+}
+
+// handleWatch makes the next EXEC of the client fail if any of the keys is modified before it runs
+func handleWatch(c *Client, args ...BulkString) ([]byte, error) {
+	if c.multi != nil {
+		return errorReply("ERR WATCH inside MULTI is not allowed")
+	}
+	// nothing to watch anymore, the transaction fails anyway
+	if c.dirtyCAS {
+		return []byte("+OK\r\n"), nil
+	}
+	for _, arg := range args[1:] {
+		c.watchKey(*arg.Value)
+	}
+	return []byte("+OK\r\n"), nil
+}
+
+// handleUnwatch forgets every key the client watches
+func handleUnwatch(c *Client, args ...BulkString) ([]byte, error) {
+	c.unwatchAllKeys()
+	return []byte("+OK\r\n"), nil
+}
+
+// watchKey adds key of the selected database to the watched keys of the client. The caller must hold mu.
+func (c *Client) watchKey(key string) {
+	for _, wk := range c.watched {
+		if wk.db == c.db && wk.key == key {
+			return
+		}
+	}
+	entry, exists := c.db.entries[key]
+	c.db.watchedKeys[key] = append(c.db.watchedKeys[key], c)
+	c.watched = append(c.watched, watchedKey{db: c.db, key: key, expired: exists && entry.expired(time.Now())})
+}
+
+// unwatchAllKeys removes the client from the watched keys index, which also clears a failed check.
+// The caller must hold mu.
+func (c *Client) unwatchAllKeys() {
+	for _, wk := range c.watched {
+		clients := wk.db.watchedKeys[wk.key]
+		for i, other := range clients {
+			if other == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(wk.db.watchedKeys, wk.key)
+		} else {
+			wk.db.watchedKeys[wk.key] = clients
+		}
+	}
+	c.watched = nil
+	c.dirtyCAS = false
+}
+
+func (c *Client) watchedKeyFor(db *database, key string) *watchedKey {
+	for i := range c.watched {
+		if c.watched[i].db == db && c.watched[i].key == key {
+			return &c.watched[i]
+		}
+	}
+	return nil
+}
+
+// watchedKeyExpired reports whether a key that was alive at WATCH time has expired since, without
+// having been deleted yet. The caller must hold mu.
+func (c *Client) watchedKeyExpired() bool {
+	now := time.Now()
+	for _, wk := range c.watched {
+		if entry, exists := wk.db.entries[wk.key]; exists && !wk.expired && entry.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// touchWatchedKey fails the transactions of the clients watching key. The caller must hold mu.
+func (db *database) touchWatchedKey(key string) {
+	for _, c := range db.watchedKeys[key] {
+		wk := c.watchedKeyFor(db, key)
+		if wk.expired {
+			if _, exists := db.entries[key]; !exists {
+				// the key was already expired at WATCH time and is now deleted, logically nothing changed
+				wk.expired = false
+				continue
+			}
+		}
+		c.dirtyCAS = true
+	}
+}
+
+// touchAllWatchedKeys fails the transactions watching keys of db that are about to be emptied
+// or replaced with the contents of replacedWith, which is nil for FLUSHDB. The caller must hold mu.
+func (db *database) touchAllWatchedKeys(replacedWith *database) {
+	now := time.Now()
+	for key, clients := range db.watchedKeys {
+		_, existsInEmptied := db.entries[key]
+		var replacement StoreEntry
+		existsInReplacement := false
+		if replacedWith != nil {
+			replacement, existsInReplacement = replacedWith.entries[key]
+		}
+		if !existsInEmptied && !existsInReplacement {
+			continue
+		}
+
+		for _, c := range clients {
+			wk := c.watchedKeyFor(db, key)
+			if wk.expired {
+				if !existsInReplacement {
+					// the expired key is deleted, logically nothing changed
+					wk.expired = false
+					continue
+				}
+				if replacement.expired(now) {
+					continue
+				}
+			} else if !existsInEmptied && replacement.expired(now) {
+				// a missing key is replaced with an expired one, still logically missing
+				wk.expired = true
+				continue
+			}
+			c.dirtyCAS = true
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package resp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMultiExec(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"exec without multi", []string{"EXEC"}, "-ERR EXEC without MULTI\r\n"},
+		{"discard without multi", []string{"DISCARD"}, "-ERR DISCARD without MULTI\r\n"},
+
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"nested multi", []string{"MULTI"}, "-ERR MULTI calls can not be nested\r\n"},
+		{"queue set", []string{"SET", "tx:a", "1"}, "+QUEUED\r\n"},
+		{"queue get", []string{"GET", "tx:a"}, "+QUEUED\r\n"},
+		{"queue runtime error", []string{"XADD", "tx:a", "1-0", "f", "v"}, "+QUEUED\r\n"},
+		{"queue blocking read", []string{"XREAD", "BLOCK", "0", "STREAMS", "tx:stream", "$"}, "+QUEUED\r\n"},
+		{"exec", []string{"EXEC"}, "*4\r\n+OK\r\n$1\r\n1\r\n-" + wrongTypeErr + "\r\n*-1\r\n"},
+		{"no longer in multi", []string{"GET", "tx:a"}, "$1\r\n1\r\n"},
+
+		{"multi to discard", []string{"MULTI"}, "+OK\r\n"},
+		{"queue discarded set", []string{"SET", "tx:b", "1"}, "+QUEUED\r\n"},
+		{"discard", []string{"DISCARD"}, "+OK\r\n"},
+		{"discarded set did not run", []string{"GET", "tx:b"}, "$-1\r\n"},
+
+		{"multi to abort", []string{"MULTI"}, "+OK\r\n"},
+		{"queue before error", []string{"SET", "tx:c", "1"}, "+QUEUED\r\n"},
+		{"unknown command", []string{"NOSUCHCMD", "x"}, "-ERR unknown command 'NOSUCHCMD', with args beginning with: 'x' \r\n"},
+		{"wrong arity", []string{"GET", "tx:c", "extra"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"exec aborts", []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{"aborted set did not run", []string{"GET", "tx:c"}, "$-1\r\n"},
+
+		{"empty transaction", []string{"MULTI"}, "+OK\r\n"},
+		{"empty exec", []string{"EXEC"}, "*0\r\n"},
+	})
+}
+
+func TestMultiIsPerClient(t *testing.T) {
+	alice, bob := NewClient(), NewClient()
+	runClientCommandCases(t, alice, []commandCase{
+		{"alice multi", []string{"MULTI"}, "+OK\r\n"},
+		{"alice queues", []string{"SET", "tx:shared", "alice"}, "+QUEUED\r\n"},
+	})
+	runClientCommandCases(t, bob, []commandCase{
+		{"bob is not queued", []string{"SET", "tx:shared", "bob"}, "+OK\r\n"},
+		{"bob sees his write", []string{"GET", "tx:shared"}, "$3\r\nbob\r\n"},
+	})
+	runClientCommandCases(t, alice, []commandCase{
+		{"alice exec", []string{"EXEC"}, "*1\r\n+OK\r\n"},
+		{"alice wrote last", []string{"GET", "tx:shared"}, "$5\r\nalice\r\n"},
+	})
+}
+
+func TestWatch(t *testing.T) {
+	alice, bob := NewClient(), NewClient()
+	runClientCommandCases(t, alice, []commandCase{
+		{"watch", []string{"WATCH", "cas:stock"}, "+OK\r\n"},
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"watch inside multi", []string{"WATCH", "cas:other"}, "-ERR WATCH inside MULTI is not allowed\r\n"},
+		{"queue", []string{"SET", "cas:stock", "9"}, "+QUEUED\r\n"},
+		{"exec untouched", []string{"EXEC"}, "*1\r\n+OK\r\n"},
+
+		{"watch again", []string{"WATCH", "cas:stock"}, "+OK\r\n"},
+	})
+	runClientCommandCases(t, bob, []commandCase{
+		{"bob writes", []string{"SET", "cas:stock", "8"}, "+OK\r\n"},
+	})
+	runClientCommandCases(t, alice, []commandCase{
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"queue", []string{"SET", "cas:stock", "7"}, "+QUEUED\r\n"},
+		{"exec fails", []string{"EXEC"}, "*-1\r\n"},
+		{"write was dropped", []string{"GET", "cas:stock"}, "$1\r\n8\r\n"},
+		{"exec unwatched", []string{"MULTI"}, "+OK\r\n"},
+		{"exec runs", []string{"EXEC"}, "*0\r\n"},
+
+		{"watch before unwatch", []string{"WATCH", "cas:stock"}, "+OK\r\n"},
+		{"unwatch", []string{"UNWATCH"}, "+OK\r\n"},
+	})
+	runClientCommandCases(t, bob, []commandCase{
+		{"bob deletes", []string{"DEL", "cas:stock"}, ":1\r\n"},
+	})
+	runClientCommandCases(t, alice, []commandCase{
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"exec after unwatch", []string{"EXEC"}, "*0\r\n"},
+	})
+}
+
+func TestWatchModifications(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  [][]string
+		modify [][]string
+		fails  bool
+	}{
+		{"delete", [][]string{{"SET", "cas:k", "v"}}, [][]string{{"DEL", "cas:k"}}, true},
+		{"deleting a missing key", nil, [][]string{{"DEL", "cas:k"}}, false},
+		{"stream write", nil, [][]string{{"XADD", "cas:k", "*", "f", "v"}}, true},
+		{"bitmap write", nil, [][]string{{"SETBIT", "cas:k", "7", "1"}}, true},
+		{"other key", [][]string{{"SET", "cas:k", "v"}}, [][]string{{"SET", "cas:other", "v"}}, false},
+		{"same key in another db", [][]string{{"SET", "cas:k", "v"}}, [][]string{{"SELECT", "1"}, {"SET", "cas:k", "v"}}, false},
+		{"flushdb", [][]string{{"SET", "cas:k", "v"}}, [][]string{{"FLUSHDB"}}, true},
+		{"flushdb without the key", nil, [][]string{{"SET", "cas:other", "v"}, {"FLUSHDB"}}, false},
+		{"flushall", [][]string{{"SET", "cas:k", "v"}}, [][]string{{"FLUSHALL"}}, true},
+		{"swapdb", nil, [][]string{{"SELECT", "1"}, {"SET", "cas:k", "v"}, {"SWAPDB", "0", "1"}}, true},
+		{"swapdb of empty keys", nil, [][]string{{"SWAPDB", "0", "1"}}, false},
+		{"expiration", [][]string{{"SET", "cas:k", "v", "PX", "20"}}, [][]string{{"SLEEP"}}, true},
+		{"already expired at watch", [][]string{{"SET", "cas:k", "v", "PX", "1"}, {"SLEEP"}}, [][]string{{"GET", "cas:k"}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			watcher, writer := NewClient(), NewClient()
+			run := func(client *Client, steps [][]string) {
+				t.Helper()
+				for _, step := range steps {
+					if step[0] == "SLEEP" {
+						time.Sleep(30 * time.Millisecond)
+						continue
+					}
+					if _, err := client.Execute(respCommand(step...)); err != nil {
+						t.Fatalf("%v: unexpected error: %v", step, err)
+					}
+				}
+			}
+			run(writer, [][]string{{"FLUSHALL"}})
+			run(writer, test.setup)
+			run(watcher, [][]string{{"WATCH", "cas:k"}, {"MULTI"}, {"PING"}})
+			run(writer, test.modify)
+
+			expected := "*1\r\n+PONG\r\n"
+			if test.fails {
+				expected = "*-1\r\n"
+			}
+			result, err := watcher.Execute(respCommand("EXEC"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(result) != expected {
+				t.Errorf("expected %q, but got %q", expected, string(result))
+			}
+			watcher.Close()
+		})
+	}
+	runCommandCases(t, []commandCase{{"clean up", []string{"FLUSHALL"}, "+OK\r\n"}})
+}
@@ -0,0 +1,94 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Keyspace event classes, selected by the notify-keyspace-events characters. Keyspace and keyevent pick
+// the channels events are published to, the others which events are.
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyKeyMiss              // m
+	notifyNew                  // n
+
+	// notifyAll is the A alias, which leaves out key misses and new keys
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted | notifyStream
+)
+
+// notifyClassChars maps the characters of notify-keyspace-events to their classes, in the order they are
+// written back
+var notifyClassChars = []struct {
+	char  byte
+	class int
+}{
+	{'g', notifyGeneric}, {'$', notifyString}, {'l', notifyList}, {'s', notifySet}, {'h', notifyHash},
+	{'z', notifyZset}, {'x', notifyExpired}, {'e', notifyEvicted}, {'t', notifyStream},
+	{'K', notifyKeyspace}, {'E', notifyKeyevent}, {'m', notifyKeyMiss}, {'n', notifyNew},
+}
+
+func setNotifyKeyspaceEvents(value string) error {
+	flags := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+		known := false
+		for _, c := range notifyClassChars {
+			if c.char == value[i] {
+				flags |= c.class
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmn'.")
+		}
+	}
+	config.notifyKeyspaceEvents = flags
+	return nil
+}
+
+func formatNotifyKeyspaceEvents() string {
+	flags := config.notifyKeyspaceEvents
+	var b strings.Builder
+	for _, c := range notifyClassChars {
+		if c.class&notifyAll != 0 && flags&notifyAll == notifyAll {
+			continue
+		}
+		if flags&c.class != 0 {
+			b.WriteByte(c.char)
+		}
+	}
+	if flags&notifyAll == notifyAll {
+		return "A" + b.String()
+	}
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes event about key of database dbid when its class is enabled: the event to
+// __keyspace@<db>__:<key> and the key to __keyevent@<db>__:<event>. The caller must hold mu.
+func notifyKeyspaceEvent(class int, event, key string, dbid int) {
+	flags := config.notifyKeyspaceEvents
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		publishMessage(fmt.Sprintf("__keyspace@%d__:%s", dbid, key), event)
+	}
+	if flags&notifyKeyevent != 0 {
+		publishMessage(fmt.Sprintf("__keyevent@%d__:%s", dbid, event), key)
+	}
+}
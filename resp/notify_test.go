@@ -0,0 +1,56 @@
+package resp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// messageFrame is what a RESP2 subscriber of channel receives when payload is published to it
+func messageFrame(channel, payload string) string {
+	return fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(payload), payload)
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	setConfig(t, "notify-keyspace-events", "KEAmn")
+	runCommandCases(t, []commandCase{
+		{"get flags", []string{"CONFIG", "GET", "notify-keyspace-events"}, "*2\r\n$22\r\nnotify-keyspace-events\r\n$5\r\nAKEmn\r\n"},
+		{"bad class", []string{"CONFIG", "SET", "notify-keyspace-events", "KQ"}, "-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKEtmn'.\r\n"},
+	})
+
+	t.Cleanup(func() { ExecuteRespData(respCommand("DEL", "notify:stream")) })
+	keyspace, stream := "__keyspace@0__:notify:key", "__keyspace@0__:notify:stream"
+	sub, r := subscriber(t)
+	runClientCommandCases(t, sub, []commandCase{
+		{"subscribe", []string{"SUBSCRIBE", keyspace, stream, "__keyevent@0__:del", "__keyevent@0__:expired"}, ""},
+	})
+	for i, channel := range []string{keyspace, stream, "__keyevent@0__:del", "__keyevent@0__:expired"} {
+		expectOutput(t, r, fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(channel), channel, i+1))
+	}
+
+	runCommandCases(t, []commandCase{
+		{"set", []string{"SET", "notify:key", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+		{"del", []string{"DEL", "notify:key", "notify:missing"}, ":1\r\n"},
+		{"set expiring", []string{"SET", "notify:key", "v", "PX", "1"}, "+OK\r\n"},
+	})
+	expectOutput(t, r, messageFrame(keyspace, "new")+messageFrame(keyspace, "set")+messageFrame(keyspace, "expire"))
+	expectOutput(t, r, messageFrame(keyspace, "del")+messageFrame("__keyevent@0__:del", "notify:key"))
+	expectOutput(t, r, messageFrame(keyspace, "new")+messageFrame(keyspace, "set")+messageFrame(keyspace, "expire"))
+
+	time.Sleep(5 * time.Millisecond)
+	runCommandCases(t, []commandCase{
+		{"get expired", []string{"GET", "notify:key"}, "$-1\r\n"},
+	})
+	expectOutput(t, r, messageFrame(keyspace, "expired")+messageFrame("__keyevent@0__:expired", "notify:key")+messageFrame(keyspace, "keymiss"))
+
+	// the IDs XADD generates are not known in advance
+	for i := 0; i < 2; i++ {
+		ExecuteRespData(respCommand("XADD", "notify:stream", "MAXLEN", "1", "*", "f", "v"))
+	}
+	runCommandCases(t, []commandCase{
+		{"xgroup", []string{"XGROUP", "CREATE", "notify:stream", "group", "$"}, "+OK\r\n"},
+	})
+	expectOutput(t, r, messageFrame(stream, "new")+messageFrame(stream, "xadd"))
+	expectOutput(t, r, messageFrame(stream, "xadd")+messageFrame(stream, "xtrim"))
+	expectOutput(t, r, messageFrame(stream, "xgroup-create"))
+}
@@ -0,0 +1,209 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientClass selects the output buffer limit of a client
+type clientClass int
+
+const (
+	classNormal clientClass = iota
+	classReplica
+	classPubSub
+)
+
+var clientClassNames = []string{"normal", "slave", "pubsub"}
+
+// outputLimit closes a client whose pending output reaches hard bytes, or stays at soft bytes or more for
+// longer than softSeconds. A zero limit is disabled.
+type outputLimit struct {
+	hard        int64
+	soft        int64
+	softSeconds int64
+}
+
+// exceeded reports whether size bytes of pending output break the limit. since tracks when the output
+// went over the soft limit, zero while under it.
+func (l outputLimit) exceeded(size int64, since *time.Time, now time.Time) bool {
+	if l.hard > 0 && size >= l.hard {
+		return true
+	}
+	if l.soft == 0 || size < l.soft {
+		*since = time.Time{}
+		return false
+	}
+	if since.IsZero() {
+		*since = now
+		return false
+	}
+	return now.Sub(*since) > time.Duration(l.softSeconds)*time.Second
+}
+
+func formatOutputLimits() string {
+	parts := make([]string, 0, len(config.clientOutputBufferLimit))
+	for class, l := range config.clientOutputBufferLimit {
+		parts = append(parts, fmt.Sprintf("%s %d %d %d", clientClassNames[class], l.hard, l.soft, l.softSeconds))
+	}
+	return strings.Join(parts, " ")
+}
+
+// setOutputLimits applies "<class> <hard> <soft> <soft seconds>" groups, the classes not given keeping their limit
+func setOutputLimits(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return errors.New("Wrong number of arguments in buffer limit configuration.")
+	}
+	limits := config.clientOutputBufferLimit
+	for i := 0; i < len(fields); i += 4 {
+		var class clientClass
+		switch strings.ToLower(fields[i]) {
+		case "normal":
+			class = classNormal
+		case "replica", "slave":
+			class = classReplica
+		case "pubsub":
+			class = classPubSub
+		default:
+			return errors.New("Invalid client class specified in buffer limit configuration.")
+		}
+		hard, err1 := parseMemory(fields[i+1])
+		soft, err2 := parseMemory(fields[i+2])
+		softSeconds, err3 := strconv.ParseInt(fields[i+3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || softSeconds < 0 {
+			return errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		limits[class] = outputLimit{hard: hard, soft: soft, softSeconds: softSeconds}
+	}
+	config.clientOutputBufferLimit = limits
+	return nil
+}
+
+// clientOutput is what a connection is sent, written by a goroutine of its own so publishing a message
+// never waits on a slow subscriber. It has its own lock, replies being queued without mu.
+type clientOutput struct {
+	mu      sync.Mutex
+	pending []byte
+	wake    chan struct{}
+	closed  bool
+	// flushed are closed once what was pending when they were added is written, see flush
+	flushed []chan struct{}
+	// softSince is when pending went over the soft limit of the client
+	softSince time.Time
+}
+
+// startOutput hands the writes to the connection over to a writer goroutine, which runs until the
+// client is closed. Only the goroutine reading the connection starts it.
+func (c *Client) startOutput() {
+	if c.out != nil || c.conn == nil {
+		return
+	}
+	c.out = &clientOutput{wake: make(chan struct{}, 1)}
+	go c.writeLoop()
+}
+
+// writeLoop writes the queued output of the client until it is closed
+func (c *Client) writeLoop() {
+	o := c.out
+	for {
+		o.mu.Lock()
+		buf, flushed, closed := o.pending, o.flushed, o.closed
+		o.pending, o.flushed = nil, nil
+		o.mu.Unlock()
+		if closed {
+			return
+		}
+		if len(buf) == 0 && len(flushed) == 0 {
+			<-o.wake
+			continue
+		}
+		if len(buf) > 0 {
+			if _, err := c.writeConn(buf); err != nil {
+				// the connection loop sees the closed connection and frees the client
+				c.conn.Close()
+				o.close()
+				closeAll(flushed)
+				return
+			}
+		}
+		closeAll(flushed)
+	}
+}
+
+// flush waits until the writer goroutine wrote what is queued, or gave up on the connection
+func (o *clientOutput) flush() {
+	done := make(chan struct{})
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+	o.flushed = append(o.flushed, done)
+	o.signal()
+	o.mu.Unlock()
+	<-done
+}
+
+func closeAll(chans []chan struct{}) {
+	for _, ch := range chans {
+		close(ch)
+	}
+}
+
+// queue appends p to the output, returning false when that breaks limit, in which case the output is
+// dropped and closed
+func (o *clientOutput) queue(p []byte, limit outputLimit) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return true
+	}
+	o.pending = append(o.pending, p...)
+	ok := !limit.exceeded(int64(len(o.pending)), &o.softSince, time.Now())
+	if !ok {
+		o.closed = true
+		o.pending = nil
+		closeAll(o.flushed)
+		o.flushed = nil
+	}
+	o.signal()
+	return ok
+}
+
+func (o *clientOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.pending = nil
+	closeAll(o.flushed)
+	o.flushed = nil
+	o.signal()
+}
+
+func (o *clientOutput) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sendMessage queues a message the client did not ask for, such as a published one, closing the
+// connection when the client does not keep up with its output. The caller must hold mu.
+func (c *Client) sendMessage(p []byte) {
+	if c.out == nil {
+		return
+	}
+	class := classNormal
+	if c.subscribed() {
+		class = classPubSub
+	}
+	if !c.out.queue(p, config.clientOutputBufferLimit[class]) {
+		fmt.Printf("Client id=%d scheduled to be closed ASAP for overcoming of output buffer limits.\n", c.id)
+		c.conn.Close()
+	}
+}
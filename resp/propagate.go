@@ -0,0 +1,123 @@
+package resp
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// propagationState is what the running command asked for about how it is logged, guarded by mu.
+// Client.call starts every command with a fresh state and propagates its arguments afterwards
+// when it changed the dataset.
+type propagationState struct {
+	// rewritten replaces the arguments of the command, see rewriteCommand
+	rewritten []string
+	prevented bool
+	// dirtyStart is the dirty counter when the command started
+	dirtyStart int
+}
+
+var propagation propagationState
+
+// transactionPropagation wraps what EXEC propagates in MULTI ... EXEC.
+// The MULTI is only written before the first write so read only transactions leave no trace.
+var transactionPropagation struct {
+	active  bool
+	started bool
+}
+
+// rewriteCommand makes the running command propagate as args, for commands whose replay would
+// not give the same result, like relative expirations or generated IDs. The caller must hold mu.
+func rewriteCommand(args ...string) {
+	propagation.rewritten = args
+}
+
+// preventPropagation keeps the running command out of the log, for commands that propagate
+// their effects one by one through propagateCommand instead. The caller must hold mu.
+func preventPropagation() {
+	propagation.prevented = true
+}
+
+// propagateCommand logs a write executed against db and sends it to the replicas, so replaying it
+// rebuilds the dataset. The caller must hold mu.
+func propagateCommand(db *database, args []string) {
+	if transactionPropagation.active && !transactionPropagation.started {
+		transactionPropagation.started = true
+		propagateNow(db, []string{"MULTI"})
+	}
+	propagateNow(db, args)
+}
+
+func propagateNow(db *database, args []string) {
+	feedAppendOnlyFile(db, args)
+	feedReplicationStream(db, args)
+	// WAIT of the client waits for the replicas to get this far
+	if currentClient != nil {
+		currentClient.woff = replicationState.offset
+	}
+}
+
+// propagateDeletion logs the deletion of an expired key as a DEL. The caller must hold mu.
+func propagateDeletion(db *database, key string) {
+	propagateCommand(db, []string{"DEL", key})
+}
+
+// beginTransactionPropagation and endTransactionPropagation surround the commands EXEC runs.
+// The caller must hold mu.
+func beginTransactionPropagation() {
+	transactionPropagation.active = true
+	transactionPropagation.started = false
+}
+
+func endTransactionPropagation() {
+	if transactionPropagation.started {
+		propagateNow(nil, []string{"EXEC"})
+	}
+	transactionPropagation.active = false
+	transactionPropagation.started = false
+}
+
+// commandArgs returns the values of a command's arguments
+func commandArgs(args []BulkString) []string {
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		argv[i] = *arg.Value
+	}
+	return argv
+}
+
+// propagateXClaim logs the state of a pending entry after it was delivered or claimed as an XCLAIM
+// that sets it exactly, or removes it when the entry is gone. The caller must hold mu.
+func propagateXClaim(key, group, consumer string, id streamID, p *pendingEntry, g *consumerGroup) {
+	dirty++
+	propagateCommand(currentDB, []string{
+		"XCLAIM", key, group, consumer, "0", id.String(),
+		"TIME", strconv.FormatInt(p.deliveryTime, 10),
+		"RETRYCOUNT", strconv.FormatUint(p.deliveryCount, 10),
+		"FORCE", "JUSTID", "LASTID", g.lastID.String(),
+	})
+}
+
+// propagateGroupID logs the position of a group that moved forward. The caller must hold mu.
+func propagateGroupID(key, group string, g *consumerGroup) {
+	dirty++
+	propagateCommand(currentDB, []string{
+		"XGROUP", "SETID", key, group, g.lastID.String(),
+		"ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10),
+	})
+}
+
+// propagateConsumerCreation logs a consumer created implicitly by a read. The caller must hold mu.
+func propagateConsumerCreation(key, group, consumer string) {
+	dirty++
+	propagateCommand(currentDB, []string{"XGROUP", "CREATECONSUMER", key, group, consumer})
+}
+
+// appendCommand serializes args as the RESP array a client would have sent
+func appendCommand(buf []byte, args []string) []byte {
+	buf = append(buf, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		b, _ := SerializeBulkString(bulkString(arg))
+		buf = append(buf, b...)
+	}
+	return buf
+}
@@ -0,0 +1,293 @@
+package resp
+
+import (
+	"sort"
+	"strings"
+)
+
+// pubsubChannels, pubsubPatterns and pubsubShardChannels map each channel and pattern to the clients
+// subscribed to it, guarded by mu. Shard channels belong to the hash slot of their name, their messages
+// staying within the node serving it.
+var (
+	pubsubChannels      = make(map[string]map[*Client]struct{})
+	pubsubPatterns      = make(map[string]map[*Client]struct{})
+	pubsubShardChannels = make(map[string]map[*Client]struct{})
+)
+
+// subscriberCommands are the only commands a RESP2 client can send while it has subscriptions
+var subscriberCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SSUBSCRIBE":   true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+	"RESET":        true,
+	"QUIT":         true,
+}
+
+// subscriptionCount is the number of channels and patterns the client is subscribed to, shard channels
+// being counted apart
+func (c *Client) subscriptionCount() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func (c *Client) shardSubscriptionCount() int {
+	return len(c.shardChannels)
+}
+
+// subscribed reports whether the client has any subscription
+func (c *Client) subscribed() bool {
+	return c.subscriptionCount()+c.shardSubscriptionCount() > 0
+}
+
+// pubsubFrame serializes a message of the subscriptions of c, a push in RESP3 and an array in RESP2
+func (c *Client) pubsubFrame(elements ...RESPData) []byte {
+	var frame []byte
+	if c.resp == 3 {
+		frame, _ = SerializePush(Push{Elements: &elements})
+	} else {
+		frame, _ = SerializeArray(Array{Elements: &elements})
+	}
+	return frame
+}
+
+// subscribe adds c to the subscribers of name in registry, returning false if it already was one.
+// The caller must hold mu.
+func subscribe(registry map[string]map[*Client]struct{}, own *map[string]struct{}, c *Client, name string) bool {
+	if _, ok := (*own)[name]; ok {
+		return false
+	}
+	if *own == nil {
+		*own = make(map[string]struct{})
+	}
+	(*own)[name] = struct{}{}
+	if registry[name] == nil {
+		registry[name] = make(map[*Client]struct{})
+	}
+	registry[name][c] = struct{}{}
+	return true
+}
+
+// unsubscribe removes c from the subscribers of name in registry, returning false if it was not one.
+// The caller must hold mu.
+func unsubscribe(registry map[string]map[*Client]struct{}, own map[string]struct{}, c *Client, name string) bool {
+	if _, ok := own[name]; !ok {
+		return false
+	}
+	delete(own, name)
+	delete(registry[name], c)
+	if len(registry[name]) == 0 {
+		delete(registry, name)
+	}
+	return true
+}
+
+// unsubscribeAll drops every subscription of the client. The caller must hold mu.
+func (c *Client) unsubscribeAll() {
+	for channel := range c.channels {
+		unsubscribe(pubsubChannels, c.channels, c, channel)
+	}
+	for pattern := range c.patterns {
+		unsubscribe(pubsubPatterns, c.patterns, c, pattern)
+	}
+	for channel := range c.shardChannels {
+		unsubscribe(pubsubShardChannels, c.shardChannels, c, channel)
+	}
+}
+
+// handleSubscribe subscribes the client to the channels, confirming each with a subscribe message
+// holding its number of subscriptions
+func handleSubscribe(c *Client, args ...BulkString) ([]byte, error) {
+	c.startOutput()
+	var reply []byte
+	for _, arg := range args[1:] {
+		subscribe(pubsubChannels, &c.channels, c, *arg.Value)
+		reply = append(reply, c.pubsubFrame(bulkString("subscribe"), arg, Integer{Value: c.subscriptionCount()})...)
+	}
+	return reply, nil
+}
+
+// handlePSubscribe subscribes the client to the channels matching the glob-style patterns
+func handlePSubscribe(c *Client, args ...BulkString) ([]byte, error) {
+	c.startOutput()
+	var reply []byte
+	for _, arg := range args[1:] {
+		subscribe(pubsubPatterns, &c.patterns, c, *arg.Value)
+		reply = append(reply, c.pubsubFrame(bulkString("psubscribe"), arg, Integer{Value: c.subscriptionCount()})...)
+	}
+	return reply, nil
+}
+
+// handleSSubscribe subscribes the client to the shard channels, counting its shard subscriptions only
+func handleSSubscribe(c *Client, args ...BulkString) ([]byte, error) {
+	c.startOutput()
+	var reply []byte
+	for _, arg := range args[1:] {
+		subscribe(pubsubShardChannels, &c.shardChannels, c, *arg.Value)
+		reply = append(reply, c.pubsubFrame(bulkString("ssubscribe"), arg, Integer{Value: c.shardSubscriptionCount()})...)
+	}
+	return reply, nil
+}
+
+// handleUnsubscribe unsubscribes the client from the channels, or all of them without arguments
+func handleUnsubscribe(c *Client, args ...BulkString) ([]byte, error) {
+	return c.unsubscribeReply("unsubscribe", pubsubChannels, c.channels, args[1:], c.subscriptionCount), nil
+}
+
+// handlePUnsubscribe unsubscribes the client from the patterns, or all of them without arguments
+func handlePUnsubscribe(c *Client, args ...BulkString) ([]byte, error) {
+	return c.unsubscribeReply("punsubscribe", pubsubPatterns, c.patterns, args[1:], c.subscriptionCount), nil
+}
+
+// handleSUnsubscribe unsubscribes the client from the shard channels, or all of them without arguments
+func handleSUnsubscribe(c *Client, args ...BulkString) ([]byte, error) {
+	return c.unsubscribeReply("sunsubscribe", pubsubShardChannels, c.shardChannels, args[1:], c.shardSubscriptionCount), nil
+}
+
+// unsubscribeReply drops the subscriptions in names, every one in own when names is empty, confirming
+// each with a kind message holding what count returns. Without any subscription to drop the confirmation
+// has a null name.
+func (c *Client) unsubscribeReply(kind string, registry map[string]map[*Client]struct{}, own map[string]struct{}, names []BulkString, count func() int) []byte {
+	if len(names) == 0 {
+		if len(own) == 0 {
+			return c.pubsubFrame(bulkString(kind), BulkString{}, Integer{Value: count()})
+		}
+		for _, name := range sortedNames(own) {
+			names = append(names, bulkString(name))
+		}
+	}
+	var reply []byte
+	for _, name := range names {
+		unsubscribe(registry, own, c, *name.Value)
+		reply = append(reply, c.pubsubFrame(bulkString(kind), name, Integer{Value: count()})...)
+	}
+	return reply
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handlePublish sends the message to the subscribers of the channel and of the patterns matching it,
+// returning how many clients received it. Replicas get the command to deliver it to their own subscribers.
+func handlePublish(args ...BulkString) ([]byte, error) {
+	receivers := publishMessage(*args[1].Value, *args[2].Value)
+	feedReplicationStream(nil, commandArgs(args))
+	return SerializeInteger(Integer{Value: receivers})
+}
+
+// publishMessage delivers message to the subscribers of channel. The caller must hold mu.
+func publishMessage(channel, message string) int {
+	receivers := 0
+	for c := range pubsubChannels[channel] {
+		c.sendMessage(c.pubsubFrame(bulkString("message"), bulkString(channel), bulkString(message)))
+		receivers++
+	}
+	for pattern, clients := range pubsubPatterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		for c := range clients {
+			c.sendMessage(c.pubsubFrame(bulkString("pmessage"), bulkString(pattern), bulkString(channel), bulkString(message)))
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// handleSPublish sends the message to the subscribers of the shard channel, returning how many there are
+func handleSPublish(args ...BulkString) ([]byte, error) {
+	channel := *args[1].Value
+	receivers := 0
+	for c := range pubsubShardChannels[channel] {
+		c.sendMessage(c.pubsubFrame(bulkString("smessage"), args[1], args[2]))
+		receivers++
+	}
+	feedReplicationStream(nil, commandArgs(args))
+	return SerializeInteger(Integer{Value: receivers})
+}
+
+// removeShardChannelsInSlot unsubscribes the clients from the shard channels of slot once this node no
+// longer serves it, telling each of them with a sunsubscribe message. The caller must hold mu.
+func removeShardChannelsInSlot(slot int) {
+	for _, channel := range sortedNames(pubsubShardChannels) {
+		if keyHashSlot(channel) != slot {
+			continue
+		}
+		for c := range pubsubShardChannels[channel] {
+			unsubscribe(pubsubShardChannels, c.shardChannels, c, channel)
+			c.sendMessage(c.pubsubFrame(bulkString("sunsubscribe"), bulkString(channel), Integer{Value: c.shardSubscriptionCount()}))
+		}
+	}
+}
+
+// activeChannels lists the channels of registry matching pattern, sorted
+func activeChannels(registry map[string]map[*Client]struct{}, pattern string) []RESPData {
+	elements := []RESPData{}
+	for _, channel := range sortedNames(registry) {
+		if stringMatch(pattern, channel, false) {
+			elements = append(elements, bulkString(channel))
+		}
+	}
+	return elements
+}
+
+// subscriberCounts pairs every channel with its number of subscribers in registry
+func subscriberCounts(registry map[string]map[*Client]struct{}, channels []BulkString) []RESPData {
+	elements := make([]RESPData, 0, len(channels)*2)
+	for _, channel := range channels {
+		elements = append(elements, channel, Integer{Value: len(registry[*channel.Value])})
+	}
+	return elements
+}
+
+// handlePubSub implements PUBSUB CHANNELS, NUMSUB, NUMPAT, SHARDCHANNELS and SHARDNUMSUB
+func handlePubSub(args ...BulkString) ([]byte, error) {
+	sub := strings.ToUpper(*args[1].Value)
+	switch {
+	case (sub == "CHANNELS" || sub == "SHARDCHANNELS") && len(args) <= 3:
+		registry := pubsubChannels
+		if sub == "SHARDCHANNELS" {
+			registry = pubsubShardChannels
+		}
+		pattern := "*"
+		if len(args) == 3 {
+			pattern = *args[2].Value
+		}
+		elements := activeChannels(registry, pattern)
+		return SerializeArray(Array{Elements: &elements})
+	case sub == "NUMSUB":
+		elements := subscriberCounts(pubsubChannels, args[2:])
+		return SerializeArray(Array{Elements: &elements})
+	case sub == "SHARDNUMSUB":
+		elements := subscriberCounts(pubsubShardChannels, args[2:])
+		return SerializeArray(Array{Elements: &elements})
+	case sub == "NUMPAT" && len(args) == 2:
+		return SerializeInteger(Integer{Value: len(pubsubPatterns)})
+	case sub == "HELP" && len(args) == 2:
+		return helpReply(
+			"PUBSUB <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CHANNELS [<pattern>]",
+			"    Return the currently active channels matching a <pattern> (default: '*').",
+			"NUMPAT",
+			"    Return number of subscriptions to patterns.",
+			"NUMSUB [<channel> ...]",
+			"    Return the number of subscribers for the specified channels, excluding",
+			"    pattern subscriptions(default: no channels).",
+			"SHARDCHANNELS [<pattern>]",
+			"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+			"SHARDNUMSUB [<shardchannel> ...]",
+			"    Return the number of subscribers for the specified shard level channel(s)",
+			"HELP",
+			"    Print this help.",
+		)
+	}
+	return subcommandSyntaxReply("pubsub", *args[1].Value)
+}
@@ -0,0 +1,216 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscriber connects a client whose replies and messages, once it subscribed, are read from r
+func subscriber(t *testing.T) (*Client, *bufio.Reader) {
+	t.Helper()
+	clientConn, serverConn := connPair(t)
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	client := NewConnClient(serverConn)
+	t.Cleanup(client.Close)
+	return client, bufio.NewReader(clientConn)
+}
+
+// expectOutput reads what the connection of a subscriber was sent, which must be expected
+func expectOutput(t *testing.T, r *bufio.Reader, expected string) {
+	t.Helper()
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("expected %q, but reading failed: %v", expected, err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("expected %q, but got %q", expected, buf)
+	}
+}
+
+// helloResp3 switches a subscriber to RESP3, its connection being written asynchronously from then on
+func helloResp3(t *testing.T, c *Client, r *bufio.Reader, options ...string) {
+	t.Helper()
+	runClientCommandCases(t, c, []commandCase{
+		{"hello", append([]string{"HELLO", "3"}, options...), ""},
+	})
+	id := strconv.FormatInt(c.id, 10)
+	expectOutput(t, r, "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$5\r\n7.2.0\r\n$5\r\nproto\r\n:3\r\n"+
+		"$2\r\nid\r\n:"+id+"\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n")
+}
+
+func TestPubSub(t *testing.T) {
+	sub, r := subscriber(t)
+	runClientCommandCases(t, sub, []commandCase{
+		{"subscribe", []string{"SUBSCRIBE", "news", "weather"}, ""},
+	})
+	expectOutput(t, r, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$7\r\nweather\r\n:2\r\n")
+
+	runCommandCases(t, []commandCase{
+		{"publish", []string{"PUBLISH", "news", "hello"}, ":1\r\n"},
+		{"no subscriber", []string{"PUBLISH", "sports", "goal"}, ":0\r\n"},
+	})
+	expectOutput(t, r, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+
+	runClientCommandCases(t, sub, []commandCase{
+		{"psubscribe", []string{"PSUBSCRIBE", "news.*"}, ""},
+		{"subscriber mode", []string{"GET", "key"}, "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n"},
+		{"ping", []string{"PING"}, ""},
+	})
+	expectOutput(t, r, "*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:3\r\n")
+	expectOutput(t, r, "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+
+	runCommandCases(t, []commandCase{
+		{"publish to pattern", []string{"PUBLISH", "news.tech", "go"}, ":1\r\n"},
+		{"channels", []string{"PUBSUB", "CHANNELS"}, "*2\r\n$4\r\nnews\r\n$7\r\nweather\r\n"},
+		{"channels matching", []string{"PUBSUB", "CHANNELS", "w*"}, "*1\r\n$7\r\nweather\r\n"},
+		{"numsub", []string{"PUBSUB", "NUMSUB", "news", "sports"}, "*4\r\n$4\r\nnews\r\n:1\r\n$6\r\nsports\r\n:0\r\n"},
+		{"numpat", []string{"PUBSUB", "NUMPAT"}, ":1\r\n"},
+		{"bad subcommand", []string{"PUBSUB", "NUMPAT", "x"}, "-ERR unknown subcommand or wrong number of arguments for 'NUMPAT'. Try PUBSUB HELP.\r\n"},
+	})
+	expectOutput(t, r, "*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$9\r\nnews.tech\r\n$2\r\ngo\r\n")
+
+	runClientCommandCases(t, sub, []commandCase{
+		{"unsubscribe all", []string{"UNSUBSCRIBE"}, ""},
+		{"punsubscribe", []string{"PUNSUBSCRIBE", "news.*"}, ""},
+		{"nothing left", []string{"UNSUBSCRIBE"}, ""},
+		{"back to normal", []string{"PING", "x"}, ""},
+	})
+	expectOutput(t, r, "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:2\r\n*3\r\n$11\r\nunsubscribe\r\n$7\r\nweather\r\n:1\r\n")
+	expectOutput(t, r, "*3\r\n$12\r\npunsubscribe\r\n$6\r\nnews.*\r\n:0\r\n")
+	expectOutput(t, r, "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n")
+	expectOutput(t, r, "$1\r\nx\r\n")
+
+	runCommandCases(t, []commandCase{
+		{"no channels", []string{"PUBSUB", "CHANNELS"}, "*0\r\n"},
+		{"no patterns", []string{"PUBSUB", "NUMPAT"}, ":0\r\n"},
+	})
+}
+
+func TestPubSubReset(t *testing.T) {
+	sub, r := subscriber(t)
+	runClientCommandCases(t, sub, []commandCase{
+		{"subscribe", []string{"SUBSCRIBE", "reset:channel"}, ""},
+		{"reset", []string{"RESET"}, ""},
+		{"get", []string{"GET", "reset:key"}, ""},
+	})
+	expectOutput(t, r, "*3\r\n$9\r\nsubscribe\r\n$13\r\nreset:channel\r\n:1\r\n+RESET\r\n$-1\r\n")
+	runCommandCases(t, []commandCase{
+		{"unsubscribed", []string{"PUBLISH", "reset:channel", "m"}, ":0\r\n"},
+	})
+}
+
+func TestPubSubResp3(t *testing.T) {
+	sub, r := subscriber(t)
+	runClientCommandCases(t, sub, []commandCase{
+		{"bad version", []string{"HELLO", "4"}, "-NOPROTO unsupported protocol version\r\n"},
+		{"not a version", []string{"HELLO", "three"}, "-ERR Protocol version is not an integer or out of range\r\n"},
+		{"bad option", []string{"HELLO", "3", "AUTH"}, "-ERR Syntax error in HELLO option 'AUTH'\r\n"},
+	})
+	helloResp3(t, sub, r, "SETNAME", "listener")
+
+	runClientCommandCases(t, sub, []commandCase{
+		{"subscribe", []string{"SUBSCRIBE", "resp3:channel"}, ""},
+		// RESP3 clients can run any command, messages being told apart as push frames
+		{"get", []string{"GET", "resp3:key"}, ""},
+	})
+	expectOutput(t, r, ">3\r\n$9\r\nsubscribe\r\n$13\r\nresp3:channel\r\n:1\r\n$-1\r\n")
+	runCommandCases(t, []commandCase{
+		{"publish", []string{"PUBLISH", "resp3:channel", "m"}, ":1\r\n"},
+	})
+	expectOutput(t, r, ">3\r\n$7\r\nmessage\r\n$13\r\nresp3:channel\r\n$1\r\nm\r\n")
+}
+
+func TestPubSubOutputLimit(t *testing.T) {
+	setConfig(t, "client-output-buffer-limit", "pubsub 1kb 0 0")
+	runCommandCases(t, []commandCase{
+		{"get limits", []string{"CONFIG", "GET", "client-output-buffer-limit"}, "*2\r\n$26\r\nclient-output-buffer-limit\r\n$56\r\nnormal 0 0 0 slave 268435456 67108864 60 pubsub 1024 0 0\r\n"},
+		{"bad class", []string{"CONFIG", "SET", "client-output-buffer-limit", "master 1 1 1"}, "-ERR CONFIG SET failed (possibly related to argument 'client-output-buffer-limit') - Invalid client class specified in buffer limit configuration.\r\n"},
+	})
+
+	// nothing is read from the pipe, so the messages queue up
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	sub := NewConnClient(serverConn)
+	defer sub.Close()
+	runClientCommandCases(t, sub, []commandCase{
+		{"subscribe", []string{"SUBSCRIBE", "slow"}, ""},
+	})
+	message := strings.Repeat("x", 100)
+	for i := 0; i < 20; i++ {
+		runCommandCases(t, []commandCase{{"publish", []string{"PUBLISH", "slow", message}, ":1\r\n"}})
+	}
+
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(clientConn)
+	if err != nil {
+		t.Fatalf("expected the connection to be closed, but got %v", err)
+	}
+	if strings.Count(string(received), message) >= 20 {
+		t.Errorf("expected messages over the limit to be dropped, but all of them arrived")
+	}
+}
+
+func TestPubSubReplication(t *testing.T) {
+	useTempDir(t)
+	replicaClient, r, _, _ := connectReplica(t)
+	defer replicaClient.Close()
+	runCommandCases(t, []commandCase{
+		{"publish", []string{"PUBLISH", "replicated", "m"}, ":0\r\n"},
+	})
+	expectCommand(t, r, "PUBLISH", "replicated", "m")
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	if got := crc16("123456789"); got != 0x31c3 {
+		t.Errorf("expected the XModem check value 0x31c3, but got %#x", got)
+	}
+	for key, slot := range map[string]int{"foo": 12182, "bar": 5061, "{user1000}.following": 3443, "{}foo": 9500, "foo{}{bar}": 8363} {
+		if got := keyHashSlot(key); got != slot {
+			t.Errorf("%s: expected slot %d, but got %d", key, slot, got)
+		}
+	}
+}
+
+func TestShardedPubSub(t *testing.T) {
+	sub, r := subscriber(t)
+	runClientCommandCases(t, sub, []commandCase{
+		{"ssubscribe", []string{"SSUBSCRIBE", "orders", "{user1}.feed"}, ""},
+		{"subscribe", []string{"SUBSCRIBE", "orders"}, ""},
+		{"subscriber mode", []string{"GET", "key"}, "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n"},
+	})
+	// shard subscriptions are counted apart
+	expectOutput(t, r, "*3\r\n$10\r\nssubscribe\r\n$6\r\norders\r\n:1\r\n*3\r\n$10\r\nssubscribe\r\n$12\r\n{user1}.feed\r\n:2\r\n")
+	expectOutput(t, r, "*3\r\n$9\r\nsubscribe\r\n$6\r\norders\r\n:1\r\n")
+
+	runCommandCases(t, []commandCase{
+		{"spublish", []string{"SPUBLISH", "orders", "new"}, ":1\r\n"},
+		{"publish", []string{"PUBLISH", "orders", "old"}, ":1\r\n"},
+		{"shardchannels", []string{"PUBSUB", "SHARDCHANNELS"}, "*2\r\n$6\r\norders\r\n$12\r\n{user1}.feed\r\n"},
+		{"shardchannels matching", []string{"PUBSUB", "SHARDCHANNELS", "{*"}, "*1\r\n$12\r\n{user1}.feed\r\n"},
+		{"shardnumsub", []string{"PUBSUB", "SHARDNUMSUB", "orders", "none"}, "*4\r\n$6\r\norders\r\n:1\r\n$4\r\nnone\r\n:0\r\n"},
+	})
+	expectOutput(t, r, "*3\r\n$8\r\nsmessage\r\n$6\r\norders\r\n$3\r\nnew\r\n")
+	expectOutput(t, r, "*3\r\n$7\r\nmessage\r\n$6\r\norders\r\n$3\r\nold\r\n")
+
+	// the slot of a channel moving to another node ends its subscriptions
+	mu.Lock()
+	removeShardChannelsInSlot(keyHashSlot("{user1}.feed"))
+	mu.Unlock()
+	expectOutput(t, r, "*3\r\n$12\r\nsunsubscribe\r\n$12\r\n{user1}.feed\r\n:1\r\n")
+
+	runClientCommandCases(t, sub, []commandCase{
+		{"sunsubscribe", []string{"SUNSUBSCRIBE"}, ""},
+		{"nothing left", []string{"SUNSUBSCRIBE", "orders"}, ""},
+	})
+	expectOutput(t, r, "*3\r\n$12\r\nsunsubscribe\r\n$6\r\norders\r\n:0\r\n")
+	expectOutput(t, r, "*3\r\n$12\r\nsunsubscribe\r\n$6\r\norders\r\n:0\r\n")
+	runCommandCases(t, []commandCase{
+		{"no shard channels", []string{"PUBSUB", "SHARDCHANNELS"}, "*0\r\n"},
+		{"channel still subscribed", []string{"PUBSUB", "NUMSUB", "orders"}, "*2\r\n$6\r\norders\r\n:1\r\n"},
+	})
+}
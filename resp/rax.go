@@ -0,0 +1,270 @@
+package resp
+
+import (
+	"bytes"
+	"sort"
+)
+
+// rax is a compressed radix tree keyed by byte strings and kept in lexicographic order.
+// Streams use it with 16 byte big endian IDs so that walking the tree yields entries in ID order.
+type rax[V any] struct {
+	root raxNode[V]
+	size int
+}
+
+type raxNode[V any] struct {
+	prefix   []byte // edge label leading from the parent to this node
+	children []*raxNode[V]
+	value    V
+	isKey    bool
+}
+
+func newRax[V any]() *rax[V] {
+	return &rax[V]{}
+}
+
+// Len returns the number of keys stored in the tree
+func (r *rax[V]) Len() int {
+	return r.size
+}
+
+// nodeCount returns the number of internal nodes, including the root
+func (r *rax[V]) nodeCount() int {
+	var count func(n *raxNode[V]) int
+	count = func(n *raxNode[V]) int {
+		total := 1
+		for _, child := range n.children {
+			total += count(child)
+		}
+		return total
+	}
+	return count(&r.root)
+}
+
+// Insert stores value under key and reports whether the key was newly added
+func (r *rax[V]) Insert(key []byte, value V) bool {
+	n := &r.root
+	for {
+		if len(key) == 0 {
+			added := !n.isKey
+			n.value = value
+			n.isKey = true
+			if added {
+				r.size++
+			}
+			return added
+		}
+
+		i, child := n.childFor(key[0])
+		if child == nil {
+			leaf := &raxNode[V]{prefix: append([]byte(nil), key...), value: value, isKey: true}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = leaf
+			r.size++
+			return true
+		}
+
+		common := commonPrefixLen(child.prefix, key)
+		if common < len(child.prefix) {
+			// split the edge so the shared part becomes its own node
+			split := &raxNode[V]{prefix: child.prefix[:common:common], children: []*raxNode[V]{child}}
+			child.prefix = child.prefix[common:]
+			n.children[i] = split
+			child = split
+		}
+
+		n = child
+		key = key[common:]
+	}
+}
+
+// Find returns the value stored under key
+func (r *rax[V]) Find(key []byte) (V, bool) {
+	n := &r.root
+	for len(key) > 0 {
+		_, child := n.childFor(key[0])
+		if child == nil || !bytes.HasPrefix(key, child.prefix) {
+			var zero V
+			return zero, false
+		}
+		key = key[len(child.prefix):]
+		n = child
+	}
+	return n.value, n.isKey
+}
+
+// Remove deletes key from the tree and reports whether it was present
+func (r *rax[V]) Remove(key []byte) bool {
+	path := []*raxNode[V]{&r.root}
+	n := &r.root
+	for len(key) > 0 {
+		_, child := n.childFor(key[0])
+		if child == nil || !bytes.HasPrefix(key, child.prefix) {
+			return false
+		}
+		key = key[len(child.prefix):]
+		n = child
+		path = append(path, n)
+	}
+	if !n.isKey {
+		return false
+	}
+
+	var zero V
+	n.value = zero
+	n.isKey = false
+	r.size--
+
+	// prune empty leaves and merge nodes left with a single child
+	for i := len(path) - 1; i > 0; i-- {
+		node, parent := path[i], path[i-1]
+		switch {
+		case !node.isKey && len(node.children) == 0:
+			idx, _ := parent.childFor(node.prefix[0])
+			parent.children = append(parent.children[:idx], parent.children[idx+1:]...)
+			continue
+		case !node.isKey && len(node.children) == 1:
+			only := node.children[0]
+			node.prefix = append(append([]byte(nil), node.prefix...), only.prefix...)
+			node.children = only.children
+			node.value = only.value
+			node.isKey = only.isKey
+		}
+		break
+	}
+	return true
+}
+
+// Ascend calls fn for every key >= from in ascending order until fn returns false
+func (r *rax[V]) Ascend(from []byte, fn func(key []byte, value V) bool) {
+	r.root.ascend(nil, from, true, fn)
+}
+
+// Descend calls fn for every key <= from in descending order until fn returns false.
+// A nil from starts at the largest key.
+func (r *rax[V]) Descend(from []byte, fn func(key []byte, value V) bool) {
+	r.root.descend(nil, from, from != nil, fn)
+}
+
+// Floor returns the largest key <= key
+func (r *rax[V]) Floor(key []byte) ([]byte, V, bool) {
+	var (
+		foundKey []byte
+		foundVal V
+		found    bool
+	)
+	r.Descend(key, func(k []byte, v V) bool {
+		foundKey, foundVal, found = k, v, true
+		return false
+	})
+	return foundKey, foundVal, found
+}
+
+// First returns the smallest key in the tree
+func (r *rax[V]) First() ([]byte, V, bool) {
+	var (
+		foundKey []byte
+		foundVal V
+		found    bool
+	)
+	r.Ascend(nil, func(k []byte, v V) bool {
+		foundKey, foundVal, found = k, v, true
+		return false
+	})
+	return foundKey, foundVal, found
+}
+
+// Last returns the largest key in the tree
+func (r *rax[V]) Last() ([]byte, V, bool) {
+	return r.Floor(nil)
+}
+
+// ascend walks the subtree rooted at n, whose full key is key.
+// While bounded is true, subtrees that sort entirely below from are skipped.
+func (n *raxNode[V]) ascend(key, from []byte, bounded bool, fn func([]byte, V) bool) bool {
+	if bounded {
+		switch cmp := comparePrefix(key, from); {
+		case cmp < 0:
+			return true
+		case cmp > 0:
+			bounded = false
+		}
+	}
+
+	if n.isKey && (!bounded || len(key) >= len(from)) {
+		if !fn(append([]byte(nil), key...), n.value) {
+			return false
+		}
+	}
+
+	for _, child := range n.children {
+		if !child.ascend(concat(key, child.prefix), from, bounded, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// descend is the mirror of ascend, skipping subtrees that sort entirely above from
+func (n *raxNode[V]) descend(key, from []byte, bounded bool, fn func([]byte, V) bool) bool {
+	if bounded {
+		switch cmp := comparePrefix(key, from); {
+		case cmp > 0:
+			return true
+		case cmp < 0:
+			bounded = false
+		}
+	}
+
+	for i := len(n.children) - 1; i >= 0; i-- {
+		child := n.children[i]
+		if !child.descend(concat(key, child.prefix), from, bounded, fn) {
+			return false
+		}
+	}
+
+	// a node's own key is a prefix of its children's keys so it always sorts before them
+	if n.isKey && (!bounded || len(key) <= len(from)) {
+		if !fn(append([]byte(nil), key...), n.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// childFor returns the child whose edge starts with b, or the insertion index if there is none
+func (n *raxNode[V]) childFor(b byte) (int, *raxNode[V]) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].prefix[0] >= b
+	})
+	if i < len(n.children) && n.children[i].prefix[0] == b {
+		return i, n.children[i]
+	}
+	return i, nil
+}
+
+// comparePrefix compares key against bound over their common length.
+// When key is longer than bound and shares it as a prefix every key below it sorts after bound, so 1 is returned.
+func comparePrefix(key, bound []byte) int {
+	if len(key) <= len(bound) {
+		return bytes.Compare(key, bound[:len(key)])
+	}
+	if cmp := bytes.Compare(key[:len(bound)], bound); cmp != 0 {
+		return cmp
+	}
+	return 1
+}
+
+func commonPrefixLen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func concat(a, b []byte) []byte {
+	out := make([]byte, 0, len(a)+len(b))
+	return append(append(out, a...), b...)
+}
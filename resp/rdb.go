@@ -0,0 +1,1143 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RDB file layout: "REDIS" and a 4 digit version, AUX fields, then per database a SELECTDB opcode
+// followed by the keys, each an optional expire opcode, a type byte, the key and its value.
+// The file ends with the EOF opcode and a CRC64 of everything before it.
+const (
+	rdbVersion = 11
+	// rdbMaxLoadVersion is the newest format we read, as long as it only holds types we know
+	rdbMaxLoadVersion = 12
+	redisVersion      = "7.2.0"
+
+	rdbTypeString           = 0
+	rdbTypeZSet             = 3
+	rdbTypeZSet2            = 5
+	rdbTypeStreamListpacks  = 15
+	rdbTypeZSetListpack     = 17
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeStreamListpacks3 = 21
+
+	rdbOpcodeSlotInfo     = 244
+	rdbOpcodeFunction2    = 245
+	rdbOpcodeFunction     = 246
+	rdbOpcodeModuleAux    = 247
+	rdbOpcodeIdle         = 248
+	rdbOpcodeFreq         = 249
+	rdbOpcodeAux          = 250
+	rdbOpcodeResizeDB     = 251
+	rdbOpcodeExpireTimeMS = 252
+	rdbOpcodeExpireTime   = 253
+	rdbOpcodeSelectDB     = 254
+	rdbOpcodeEOF          = 255
+
+	// lengths starting with the bits 11 are special string encodings
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	// flags of the entries inside a stream listpack node
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+var errRDBCorrupt = errors.New("corrupt RDB data")
+
+// rdbWriter serializes RDB data while keeping the running checksum. The first error sticks and
+// later writes are dropped, so callers only check err at the end.
+type rdbWriter struct {
+	w        io.Writer
+	crc      uint64
+	err      error
+	compress bool
+}
+
+func (w *rdbWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = crc64Update(w.crc, p)
+	_, w.err = w.w.Write(p)
+}
+
+func (w *rdbWriter) writeByte(b byte) {
+	w.write([]byte{b})
+}
+
+func (w *rdbWriter) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.writeByte(byte(n))
+	case n < 1<<14:
+		w.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		w.write(binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n)))
+	default:
+		w.write(binary.BigEndian.AppendUint64([]byte{0x81}, n))
+	}
+}
+
+// writeString stores s as a small integer when it is the canonical form of one,
+// LZF compressed when that pays off, or as is
+func (w *rdbWriter) writeString(s string) {
+	if len(s) <= 11 {
+		if v, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(v, 10) == s {
+			switch {
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				w.write([]byte{0xc0 | rdbEncInt8, byte(v)})
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				w.write(binary.LittleEndian.AppendUint16([]byte{0xc0 | rdbEncInt16}, uint16(v)))
+			default:
+				w.write(binary.LittleEndian.AppendUint32([]byte{0xc0 | rdbEncInt32}, uint32(v)))
+			}
+			return
+		}
+	}
+
+	if w.compress && len(s) > 20 {
+		if compressed := lzfCompress([]byte(s), len(s)-4); compressed != nil {
+			w.writeByte(0xc0 | rdbEncLZF)
+			w.writeLen(uint64(len(compressed)))
+			w.writeLen(uint64(len(s)))
+			w.write(compressed)
+			return
+		}
+	}
+
+	w.writeLen(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+func (w *rdbWriter) writeMillis(ms int64) {
+	w.write(binary.LittleEndian.AppendUint64(nil, uint64(ms)))
+}
+
+func (w *rdbWriter) writeDouble(f float64) {
+	w.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(f)))
+}
+
+func rdbObjectType(value any) byte {
+	switch value.(type) {
+	case *sortedSet:
+		return rdbTypeZSet2
+	case *stream:
+		return rdbTypeStreamListpacks3
+	}
+	return rdbTypeString
+}
+
+func (w *rdbWriter) writeObjectType(value any) {
+	w.writeByte(rdbObjectType(value))
+}
+
+// writeObject serializes a value in the encoding announced by writeObjectType
+func (w *rdbWriter) writeObject(value any) {
+	switch v := value.(type) {
+	case string:
+		w.writeString(v)
+	case *sortedSet:
+		w.writeLen(uint64(v.Len()))
+		v.ascendFrom(math.Inf(-1), func(member string, score float64) bool {
+			w.writeString(member)
+			w.writeDouble(score)
+			return true
+		})
+	case *stream:
+		w.writeStream(v)
+	default:
+		w.err = fmt.Errorf("can't serialize values of type %T", value)
+	}
+}
+
+func (w *rdbWriter) writeStream(s *stream) {
+	w.writeLen(uint64(s.nodes.Len()))
+	s.nodes.Ascend(nil, func(key []byte, node *streamNode) bool {
+		w.writeString(string(key))
+		w.writeString(string(encodeStreamNode(node)))
+		return w.err == nil
+	})
+
+	w.writeLen(s.length)
+	w.writeLen(s.lastID.ms)
+	w.writeLen(s.lastID.seq)
+	w.writeLen(s.firstID.ms)
+	w.writeLen(s.firstID.seq)
+	w.writeLen(s.maxDeletedID.ms)
+	w.writeLen(s.maxDeletedID.seq)
+	w.writeLen(s.entriesAdded)
+
+	if s.groups == nil {
+		w.writeLen(0)
+		return
+	}
+	w.writeLen(uint64(s.groups.Len()))
+	s.groups.Ascend(nil, func(name []byte, g *consumerGroup) bool {
+		w.writeString(string(name))
+		w.writeLen(g.lastID.ms)
+		w.writeLen(g.lastID.seq)
+		w.writeLen(uint64(g.entriesRead))
+
+		w.writeLen(uint64(g.pending.Len()))
+		g.pending.Ascend(nil, func(id []byte, p *pendingEntry) bool {
+			w.write(id)
+			w.writeMillis(p.deliveryTime)
+			w.writeLen(p.deliveryCount)
+			return true
+		})
+
+		w.writeLen(uint64(g.consumers.Len()))
+		g.consumers.Ascend(nil, func(name []byte, c *streamConsumer) bool {
+			w.writeString(string(name))
+			w.writeMillis(c.seenTime)
+			w.writeMillis(c.activeTime)
+			w.writeLen(uint64(c.pending.Len()))
+			c.pending.Ascend(nil, func(id []byte, _ *pendingEntry) bool {
+				w.write(id)
+				return true
+			})
+			return true
+		})
+		return w.err == nil
+	})
+}
+
+// encodeStreamNode lays a node out as Redis does: a master entry with the live and deleted counts and
+// the field names of the first entry, then every entry with its ID relative to the master ID.
+// Entries repeating the master fields only store their values.
+func encodeStreamNode(node *streamNode) []byte {
+	master := node.entries[0]
+	masterFields := make([]string, 0, len(master.fields)/2)
+	for i := 0; i < len(master.fields); i += 2 {
+		masterFields = append(masterFields, master.fields[i])
+	}
+
+	lp := newListpackBuilder()
+	lp.appendInt(int64(node.live))
+	lp.appendInt(int64(len(node.entries) - node.live))
+	lp.appendInt(int64(len(masterFields)))
+	for _, field := range masterFields {
+		lp.appendString(field)
+	}
+	lp.appendInt(0)
+
+	for _, entry := range node.entries {
+		numFields := len(entry.fields) / 2
+		sameFields := numFields == len(masterFields)
+		for i := 0; sameFields && i < numFields; i++ {
+			sameFields = entry.fields[2*i] == masterFields[i]
+		}
+
+		flags := int64(0)
+		if entry.deleted {
+			flags |= streamItemFlagDeleted
+		}
+		if sameFields {
+			flags |= streamItemFlagSameFields
+		}
+		lp.appendInt(flags)
+		lp.appendInt(int64(entry.id.ms - master.id.ms))
+		lp.appendInt(int64(entry.id.seq - master.id.seq))
+
+		lpCount := int64(numFields) + 3
+		if sameFields {
+			for i := 1; i < len(entry.fields); i += 2 {
+				lp.appendString(entry.fields[i])
+			}
+		} else {
+			lp.appendInt(int64(numFields))
+			for _, field := range entry.fields {
+				lp.appendString(field)
+			}
+			lpCount += int64(numFields) + 1
+		}
+		lp.appendInt(lpCount)
+	}
+	return lp.bytes()
+}
+
+// rdbReader parses RDB data while keeping the running checksum
+type rdbReader struct {
+	r   io.Reader
+	crc uint64
+}
+
+func (r *rdbReader) read(n uint64) ([]byte, error) {
+	var buf []byte
+	if n <= 1<<20 {
+		buf = make([]byte, n)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			return nil, rdbReadError(err)
+		}
+	} else {
+		// grow with the data actually read rather than trusting a corrupt length
+		var b bytes.Buffer
+		if _, err := io.CopyN(&b, r.r, int64(n)); err != nil {
+			return nil, rdbReadError(err)
+		}
+		buf = b.Bytes()
+	}
+	r.crc = crc64Update(r.crc, buf)
+	return buf, nil
+}
+
+func rdbReadError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("unexpected EOF reading RDB file")
+	}
+	return err
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	b, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readLen decodes a length, reporting whether it is actually the tag of a special string encoding
+func (r *rdbReader) readLen() (uint64, bool, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			buf, err := r.read(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := r.read(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		}
+		return 0, false, fmt.Errorf("unknown length encoding %d", b)
+	}
+	return uint64(b & 0x3f), true, nil
+}
+
+// readLength is readLen for places where a special encoding is not allowed
+func (r *rdbReader) readLength() (uint64, error) {
+	n, encoded, err := r.readLen()
+	if err == nil && encoded {
+		err = errRDBCorrupt
+	}
+	return n, err
+}
+
+func (r *rdbReader) readString() (string, error) {
+	n, encoded, err := r.readLen()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		buf, err := r.read(n)
+		return string(buf), err
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := r.readByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		buf, err := r.read(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case rdbEncInt32:
+		buf, err := r.read(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case rdbEncLZF:
+		compressedLen, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		length, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := r.read(compressedLen)
+		if err != nil {
+			return "", err
+		}
+		if length > 512<<20 {
+			return "", errRDBCorrupt
+		}
+		out, err := lzfDecompress(compressed, int(length))
+		return string(out), err
+	}
+	return "", fmt.Errorf("unknown RDB string encoding type %d", n)
+}
+
+func (r *rdbReader) readMillis() (int64, error) {
+	buf, err := r.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func (r *rdbReader) readDouble() (float64, error) {
+	buf, err := r.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readStringDouble reads the textual doubles of the old ZSET encoding, where lengths 253 to 255 mean NaN and infinities
+func (r *rdbReader) readStringDouble() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := r.read(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// readObject decodes a value of the given RDB type
+func (r *rdbReader) readObject(typ byte) (any, error) {
+	switch typ {
+	case rdbTypeString:
+		return r.readString()
+	case rdbTypeZSet, rdbTypeZSet2:
+		return r.readSortedSet(typ)
+	case rdbTypeZSetListpack:
+		lp, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		return sortedSetFromListpack([]byte(lp))
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return r.readStream(typ)
+	}
+	return nil, fmt.Errorf("unsupported RDB object type %d", typ)
+}
+
+func (r *rdbReader) readSortedSet(typ byte) (*sortedSet, error) {
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	z := newSortedSet()
+	for i := uint64(0); i < n; i++ {
+		member, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if typ == rdbTypeZSet2 {
+			score, err = r.readDouble()
+		} else {
+			score, err = r.readStringDouble()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(score) || !z.add(member, score) {
+			return nil, errors.New("duplicate or invalid sorted set member in RDB")
+		}
+	}
+	return z, nil
+}
+
+func sortedSetFromListpack(lp []byte) (*sortedSet, error) {
+	elements, err := listpackElements(lp)
+	if err != nil {
+		return nil, err
+	}
+	if len(elements)%2 != 0 {
+		return nil, errListpackCorrupt
+	}
+	z := newSortedSet()
+	for i := 0; i < len(elements); i += 2 {
+		score, err := strconv.ParseFloat(elements[i+1], 64)
+		if err != nil || math.IsNaN(score) || !z.add(elements[i], score) {
+			return nil, errListpackCorrupt
+		}
+	}
+	return z, nil
+}
+
+func (r *rdbReader) readStreamID() (streamID, error) {
+	ms, err := r.readLength()
+	if err != nil {
+		return streamID{}, err
+	}
+	seq, err := r.readLength()
+	return streamID{ms, seq}, err
+}
+
+func (r *rdbReader) readStream(typ byte) (*stream, error) {
+	s := newStream()
+	nodes, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, errors.New("stream node key entry is not the size of a stream ID")
+		}
+		lp, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		node, err := decodeStreamNode(streamIDFromKey([]byte(key)), []byte(lp))
+		if err != nil {
+			return nil, err
+		}
+		s.nodes.Insert([]byte(key), node)
+	}
+
+	if s.length, err = r.readLength(); err != nil {
+		return nil, err
+	}
+	if s.lastID, err = r.readStreamID(); err != nil {
+		return nil, err
+	}
+	if typ >= rdbTypeStreamListpacks2 {
+		if s.firstID, err = r.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.maxDeletedID, err = r.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.entriesAdded, err = r.readLength(); err != nil {
+			return nil, err
+		}
+	} else {
+		// older files lack these, so make the best of what the entries tell
+		s.entriesAdded = s.length
+		s.refreshFirstID()
+	}
+
+	groups, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		if err := r.readConsumerGroup(s, typ); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (r *rdbReader) readConsumerGroup(s *stream, typ byte) error {
+	name, err := r.readString()
+	if err != nil {
+		return err
+	}
+	lastID, err := r.readStreamID()
+	if err != nil {
+		return err
+	}
+	entriesRead := int64(invalidEntriesRead)
+	if typ >= rdbTypeStreamListpacks2 {
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		entriesRead = int64(n)
+	} else {
+		entriesRead = s.estimateDistance(lastID)
+	}
+	g := s.createGroup(name, lastID, entriesRead)
+	if g == nil {
+		return errors.New("duplicated consumer group name in RDB")
+	}
+
+	pending, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < pending; i++ {
+		id, err := r.read(16)
+		if err != nil {
+			return err
+		}
+		p := &pendingEntry{}
+		if p.deliveryTime, err = r.readMillis(); err != nil {
+			return err
+		}
+		if p.deliveryCount, err = r.readLength(); err != nil {
+			return err
+		}
+		if !g.pending.Insert(id, p) {
+			return errors.New("duplicated global PEL entry loading stream consumer group")
+		}
+	}
+
+	consumers, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < consumers; i++ {
+		name, err := r.readString()
+		if err != nil {
+			return err
+		}
+		c := g.createConsumer(name)
+		if c == nil {
+			return errors.New("duplicate stream consumer detected")
+		}
+		if c.seenTime, err = r.readMillis(); err != nil {
+			return err
+		}
+		c.activeTime = c.seenTime
+		if typ >= rdbTypeStreamListpacks3 {
+			if c.activeTime, err = r.readMillis(); err != nil {
+				return err
+			}
+		}
+
+		owned, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < owned; j++ {
+			id, err := r.read(16)
+			if err != nil {
+				return err
+			}
+			p, ok := g.pending.Find(id)
+			if !ok || p.consumer != nil {
+				return errors.New("consumer PEL entry not found in group global PEL")
+			}
+			p.consumer = c
+			c.pending.Insert(id, p)
+		}
+	}
+
+	orphan := false
+	g.pending.Ascend(nil, func(_ []byte, p *pendingEntry) bool {
+		orphan = p.consumer == nil
+		return !orphan
+	})
+	if orphan {
+		return errors.New("stream PEL entry without a consumer")
+	}
+	return nil
+}
+
+// decodeStreamNode is the inverse of encodeStreamNode
+func decodeStreamNode(master streamID, lp []byte) (*streamNode, error) {
+	elements, err := listpackElements(lp)
+	if err != nil {
+		return nil, err
+	}
+	next := func() (string, error) {
+		if len(elements) == 0 {
+			return "", errListpackCorrupt
+		}
+		e := elements[0]
+		elements = elements[1:]
+		return e, nil
+	}
+	nextInt := func() (int64, error) {
+		e, err := next()
+		if err != nil {
+			return 0, err
+		}
+		v, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return 0, errListpackCorrupt
+		}
+		return v, nil
+	}
+
+	live, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	masterFieldCount, err := nextInt()
+	if err != nil || masterFieldCount < 0 || int(masterFieldCount) > len(elements) {
+		return nil, errListpackCorrupt
+	}
+	masterFields := make([]string, masterFieldCount)
+	for i := range masterFields {
+		masterFields[i], _ = next()
+	}
+	if terminator, err := nextInt(); err != nil || terminator != 0 {
+		return nil, errListpackCorrupt
+	}
+
+	node := &streamNode{live: int(live)}
+	for len(elements) > 0 {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		entry := streamEntry{
+			id:      streamID{master.ms + uint64(msDiff), master.seq + uint64(seqDiff)},
+			deleted: flags&streamItemFlagDeleted != 0,
+		}
+
+		if flags&streamItemFlagSameFields != 0 {
+			entry.fields = make([]string, 0, 2*len(masterFields))
+			for _, field := range masterFields {
+				value, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.fields = append(entry.fields, field, value)
+			}
+		} else {
+			numFields, err := nextInt()
+			if err != nil || numFields < 0 || 2*int(numFields) > len(elements) {
+				return nil, errListpackCorrupt
+			}
+			entry.fields = make([]string, 2*numFields)
+			for i := range entry.fields {
+				entry.fields[i], _ = next()
+			}
+		}
+		if _, err := nextInt(); err != nil { // lp-count, only needed to walk backwards
+			return nil, err
+		}
+		node.entries = append(node.entries, entry)
+	}
+
+	if len(node.entries) == 0 || live < 1 || int(live+deleted) != len(node.entries) || node.entries[0].id != master {
+		return nil, errors.New("invalid stream node in RDB")
+	}
+	return node, nil
+}
+
+// writeRDB serializes the databases as an RDB file, with the AUX fields Redis writes.
+// aofBase marks the file as the base of a multi part AOF.
+func writeRDB(out io.Writer, dbs []map[string]StoreEntry, compress, checksum, aofBase bool) error {
+	w := &rdbWriter{w: out, compress: compress}
+	w.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	aux := [][2]string{
+		{"redis-ver", redisVersion},
+		{"redis-bits", strconv.Itoa(strconv.IntSize)},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"used-mem", strconv.FormatUint(mem.HeapAlloc, 10)},
+		{"aof-base", strconv.Itoa(boolToInt(aofBase))},
+	}
+	for _, field := range aux {
+		w.writeByte(rdbOpcodeAux)
+		w.writeString(field[0])
+		w.writeString(field[1])
+	}
+
+	for id, entries := range dbs {
+		if len(entries) == 0 {
+			continue
+		}
+		expires := 0
+		for _, entry := range entries {
+			if !entry.expiration.IsZero() {
+				expires++
+			}
+		}
+		w.writeByte(rdbOpcodeSelectDB)
+		w.writeLen(uint64(id))
+		w.writeByte(rdbOpcodeResizeDB)
+		w.writeLen(uint64(len(entries)))
+		w.writeLen(uint64(expires))
+
+		for key, entry := range entries {
+			if !entry.expiration.IsZero() {
+				w.writeByte(rdbOpcodeExpireTimeMS)
+				w.writeMillis(entry.expiration.UnixMilli())
+			}
+			w.writeObjectType(entry.value)
+			w.writeString(key)
+			w.writeObject(entry.value)
+			if w.err != nil {
+				return w.err
+			}
+		}
+	}
+
+	w.writeByte(rdbOpcodeEOF)
+	sum := uint64(0)
+	if checksum {
+		sum = w.crc
+	}
+	w.write(binary.LittleEndian.AppendUint64(nil, sum))
+	return w.err
+}
+
+// readRDB parses an RDB file into one keyspace per database, dropping keys that already expired
+func readRDB(in io.Reader, verifyChecksum bool) ([]map[string]StoreEntry, error) {
+	r := &rdbReader{r: in}
+	header, err := r.read(9)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:5]) != "REDIS" {
+		return nil, errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbMaxLoadVersion {
+		return nil, fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+
+	dbs := make([]map[string]StoreEntry, databaseCount)
+	for i := range dbs {
+		dbs[i] = make(map[string]StoreEntry)
+	}
+	db := dbs[0]
+	var expiration time.Time
+	now := time.Now()
+
+	for {
+		typ, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case rdbOpcodeExpireTime:
+			buf, err := r.read(4)
+			if err != nil {
+				return nil, err
+			}
+			expiration = time.Unix(int64(int32(binary.LittleEndian.Uint32(buf))), 0)
+			continue
+		case rdbOpcodeExpireTimeMS:
+			ms, err := r.readMillis()
+			if err != nil {
+				return nil, err
+			}
+			expiration = time.UnixMilli(ms)
+			continue
+		case rdbOpcodeFreq:
+			if _, err := r.readByte(); err != nil {
+				return nil, err
+			}
+			continue
+		case rdbOpcodeIdle:
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+			continue
+		case rdbOpcodeEOF:
+			computed := r.crc
+			if version >= 5 {
+				buf, err := r.read(8)
+				if err != nil {
+					return nil, err
+				}
+				expected := binary.LittleEndian.Uint64(buf)
+				if verifyChecksum && expected != 0 && expected != computed {
+					return nil, fmt.Errorf("wrong RDB checksum expected: (%x) got (%x)", computed, expected)
+				}
+			}
+			return dbs, nil
+		case rdbOpcodeSelectDB:
+			id, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+			if id >= databaseCount {
+				return nil, fmt.Errorf("data file was created with a Redis server configured to handle more than %d databases", databaseCount)
+			}
+			db = dbs[id]
+			continue
+		case rdbOpcodeResizeDB:
+			for i := 0; i < 2; i++ {
+				if _, err := r.readLength(); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case rdbOpcodeSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.readLength(); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case rdbOpcodeAux:
+			for i := 0; i < 2; i++ {
+				if _, err := r.readString(); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case rdbOpcodeModuleAux:
+			return nil, errors.New("the RDB file contains module AUX data, but modules are not supported")
+		case rdbOpcodeFunction, rdbOpcodeFunction2:
+			return nil, errors.New("the RDB file contains functions, but functions are not supported")
+		}
+
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.readObject(typ)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := db[key]; exists {
+			return nil, fmt.Errorf("duplicate key '%s' found in RDB file", key)
+		}
+		if expiration.IsZero() || !expiration.Before(now) {
+			db[key] = StoreEntry{value: value, expiration: expiration}
+		}
+		expiration = time.Time{}
+	}
+}
+
+// rdbState tracks snapshots, guarded by mu
+var rdbState = struct {
+	lastSave         time.Time
+	lastBgsaveOK     bool
+	lastBgsaveTry    time.Time
+	bgsaveInProgress bool
+	// bgsaveToSocket is set while the running save streams to replicas rather than writing the file
+	bgsaveToSocket bool
+	// dirtyAtBgsave is the dirty counter when the running BGSAVE took its snapshot
+	dirtyAtBgsave int
+}{lastSave: time.Now(), lastBgsaveOK: true}
+
+func rdbPath() string {
+	return filepath.Join(config.dir, config.dbFilename)
+}
+
+// snapshotKeyspace copies every database so it can be written out after mu is released.
+// Strings are immutable and shared, the richer types are cloned. The caller must hold mu.
+func snapshotKeyspace() []map[string]StoreEntry {
+	dbs := make([]map[string]StoreEntry, len(databases))
+	for i, db := range databases {
+		entries := make(map[string]StoreEntry, len(db.entries))
+		for key, entry := range db.entries {
+			switch v := entry.value.(type) {
+			case *sortedSet:
+				entry.value = v.clone()
+			case *stream:
+				entry.value = v.clone()
+			}
+			entries[key] = entry
+		}
+		dbs[i] = entries
+	}
+	return dbs
+}
+
+// saveRDBFile writes the databases to a temporary file which then atomically replaces path
+func saveRDBFile(path string, dbs []map[string]StoreEntry, compress, checksum bool) error {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed opening the temp RDB file %s for saving: %v", filepath.Base(tmp), err)
+	}
+
+	buffered := bufio.NewWriterSize(f, 64<<10)
+	err = writeRDB(buffered, dbs, compress, checksum, false)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write error saving DB on disk: %v", err)
+	}
+	return nil
+}
+
+// rdbSave writes the dataset synchronously. The caller must hold mu.
+func rdbSave() error {
+	err := saveRDBFile(rdbPath(), snapshotKeyspace(), config.rdbCompression, config.rdbChecksum)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	fmt.Println("DB saved on disk")
+	dirty = 0
+	rdbState.lastSave = time.Now()
+	rdbState.lastBgsaveOK = true
+	return nil
+}
+
+var errBgsaveInProgress = errors.New("ERR Background save already in progress")
+
+// rdbSaveBackground snapshots the dataset under mu and writes it from another goroutine,
+// so clients keep being served while the file is written. The caller must hold mu.
+func rdbSaveBackground() error {
+	if rdbState.bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+	dbs := snapshotKeyspace()
+	path, compress, checksum := rdbPath(), config.rdbCompression, config.rdbChecksum
+	rdbState.bgsaveInProgress = true
+	rdbState.dirtyAtBgsave = dirty
+	rdbState.lastBgsaveTry = time.Now()
+	fmt.Println("Background saving started")
+
+	go func() {
+		err := saveRDBFile(path, dbs, compress, checksum)
+
+		mu.Lock()
+		defer mu.Unlock()
+		rdbState.bgsaveInProgress = false
+		rdbState.lastBgsaveOK = err == nil
+		// replicas waiting for a snapshot get this one or start the next save
+		defer updateReplicasWaitingBgsave(path, err)
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Background saving error")
+			return
+		}
+		fmt.Println("Background saving terminated with success")
+		dirty -= rdbState.dirtyAtBgsave
+		rdbState.lastSave = time.Now()
+	}()
+	return nil
+}
+
+// handleSave writes the dataset to disk, blocking every client until it is done
+func handleSave(args ...BulkString) ([]byte, error) {
+	if rdbState.bgsaveInProgress {
+		return errorReply(errBgsaveInProgress.Error())
+	}
+	if err := rdbSave(); err != nil {
+		return errorReply("ERR")
+	}
+	return []byte("+OK\r\n"), nil
+}
+
+// handleBgsave starts writing the dataset to disk in the background
+func handleBgsave(args ...BulkString) ([]byte, error) {
+	if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(*args[1].Value, "SCHEDULE")) {
+		return errorReply(errSyntax.Error())
+	}
+	if err := rdbSaveBackground(); err != nil {
+		return errorReply(err.Error())
+	}
+	return []byte("+Background saving started\r\n"), nil
+}
+
+// handleLastSave returns the unix time of the last successful save
+func handleLastSave(args ...BulkString) ([]byte, error) {
+	return SerializeInteger(Integer{Value: int(rdbState.lastSave.Unix())})
+}
+
+// StartSaveRoutine starts a background save whenever one of the save rules is met
+func StartSaveRoutine() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for range ticker.C {
+		mu.Lock()
+		now := time.Now()
+		for _, rule := range config.saveParams {
+			// after a failed attempt only retry every few seconds
+			if dirty >= rule.changes && now.Sub(rdbState.lastSave) > time.Duration(rule.seconds)*time.Second &&
+				(rdbState.lastBgsaveOK || now.Sub(rdbState.lastBgsaveTry) > 5*time.Second) {
+				if !rdbState.bgsaveInProgress {
+					fmt.Printf("%d changes in %d seconds. Saving...\n", rule.changes, rule.seconds)
+					rdbSaveBackground()
+				}
+				break
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// LoadRDB replaces the keyspace with the RDB file in the configured directory, if there is one
+func LoadRDB() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	start := time.Now()
+	f, err := os.Open(rdbPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dbs, err := readRDB(bufio.NewReaderSize(f, 64<<10), config.rdbChecksum)
+	if err != nil {
+		return fmt.Errorf("short read or OOM loading DB. %v", err)
+	}
+	loadDatabases(dbs)
+	fmt.Printf("DB loaded from disk: %.3f seconds\n", time.Since(start).Seconds())
+	return nil
+}
+
+// loadDatabases replaces the keyspace of every database with what was read from disk. The caller must hold mu.
+func loadDatabases(dbs []map[string]StoreEntry) {
+	for i, entries := range dbs {
+		databases[i].entries = entries
+	}
+	selectDB(currentDB)
+}
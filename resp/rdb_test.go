@@ -0,0 +1,248 @@
+package resp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC64(t *testing.T) {
+	if got := crc64Update(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("expected e9c6d914c4b8d9ca, but got %x", got)
+	}
+}
+
+func TestLZFRoundTrip(t *testing.T) {
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		[]byte(strings.Repeat("abcdefgh", 1000)),
+		[]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		[]byte("the quick brown fox jumps over the lazy dog, the quick brown fox jumps over the lazy dog"),
+		append([]byte(strings.Repeat("x", 300)), random[:200]...),
+	}
+	for _, in := range inputs {
+		compressed := lzfCompress(in, len(in)-4)
+		if compressed == nil {
+			t.Fatalf("expected %q... to compress", in[:10])
+		}
+		out, err := lzfDecompress(compressed, len(in))
+		if err != nil || !bytes.Equal(out, in) {
+			t.Fatalf("round trip of %q... failed: %v", in[:10], err)
+		}
+	}
+	if lzfCompress(random, len(random)-4) != nil {
+		t.Error("random data should not compress")
+	}
+	if _, err := lzfDecompress([]byte{0xe0, 0x10, 0x00}, 20); err == nil {
+		t.Error("a back reference before the start should be rejected")
+	}
+}
+
+func TestListpackRoundTrip(t *testing.T) {
+	values := []string{"0", "127", "128", "-1", "4095", "-4096", "32767", "-32768", "8388607", "-8388608",
+		"2147483647", "-2147483648", "9223372036854775807", "-9223372036854775808", "007", "1.5", "",
+		strings.Repeat("s", 63), strings.Repeat("m", 4000), strings.Repeat("l", 70000)}
+	lp := newListpackBuilder()
+	for _, v := range values {
+		lp.appendString(v)
+	}
+	got, err := listpackElements(lp.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(values) {
+		t.Fatalf("expected %d elements, but got %d", len(values), len(got))
+	}
+	for i := range values {
+		if got[i] != values[i] {
+			t.Errorf("element %d: expected %.20q, but got %.20q", i, values[i], got[i])
+		}
+	}
+}
+
+func TestReadRedisRDB(t *testing.T) {
+	// laid out the way Redis 7.2 writes it: AUX fields, a key without and one with a millisecond expiry in the future
+	data, _ := hex.DecodeString("524544495330303131" +
+		"fa0972656469732d76657205372e322e30" +
+		"fa0a72656469732d62697473c040" +
+		"fe00fb0201" +
+		"00056170706c650362616e" +
+		"fc0060954595020000" + "0003666f6fc07b" +
+		"ff0000000000000000")
+	dbs, err := readRDB(bytes.NewReader(data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := dbs[0]["apple"].value; v != "ban" {
+		t.Errorf("expected apple to be ban, but got %v", v)
+	}
+	foo := dbs[0]["foo"]
+	if foo.value != "123" || foo.expiration.UnixMilli() != 2840140800000 {
+		t.Errorf("expected foo to be 123 expiring at 2840140800000, but got %v at %d", foo.value, foo.expiration.UnixMilli())
+	}
+}
+
+func TestRDBChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	dbs := make([]map[string]StoreEntry, databaseCount)
+	dbs[3] = map[string]StoreEntry{"key": {value: strings.Repeat("value", 10)}}
+	if err := writeRDB(&buf, dbs, true, true, false); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if loaded, err := readRDB(bytes.NewReader(data), true); err != nil || loaded[3]["key"].value != strings.Repeat("value", 10) {
+		t.Fatalf("expected the file to load, got %v", err)
+	}
+
+	data[bytes.Index(data, []byte("key"))] = 'K'
+	if _, err := readRDB(bytes.NewReader(data), true); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected a checksum error, but got %v", err)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	mu.Lock()
+	oldDir := config.dir
+	config.dir = t.TempDir()
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		config.dir = oldDir
+		mu.Unlock()
+	}()
+
+	runCommandCases(t, []commandCase{
+		{"flush", []string{"FLUSHALL"}, "+OK\r\n"},
+		{"string", []string{"SET", "rdb:string", "hello"}, "+OK\r\n"},
+		{"compressible", []string{"SET", "rdb:long", strings.Repeat("abc", 100)}, "+OK\r\n"},
+		{"integer", []string{"SET", "rdb:int", "-12345"}, "+OK\r\n"},
+		{"bitmap", []string{"SETBIT", "rdb:bits", "100", "1"}, ":0\r\n"},
+		{"geo", []string{"GEOADD", "rdb:geo", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"}, ":2\r\n"},
+		{"stream", []string{"XADD", "rdb:stream", "1-1", "f", "v"}, "$3\r\n1-1\r\n"},
+		{"stream other fields", []string{"XADD", "rdb:stream", "1-2", "a", "1", "b", "2"}, "$3\r\n1-2\r\n"},
+		{"stream same fields", []string{"XADD", "rdb:stream", "2-0", "f", "w"}, "$3\r\n2-0\r\n"},
+		{"stream delete", []string{"XDEL", "rdb:stream", "1-2"}, ":1\r\n"},
+		{"group", []string{"XGROUP", "CREATE", "rdb:stream", "g", "0"}, "+OK\r\n"},
+		{"deliver", []string{"XREADGROUP", "GROUP", "g", "alice", "COUNT", "1", "STREAMS", "rdb:stream", ">"},
+			"*1\r\n*2\r\n$10\r\nrdb:stream\r\n*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{"select", []string{"SELECT", "5"}, "+OK\r\n"},
+		{"other db", []string{"SET", "rdb:db5", "five", "PX", "100000"}, "+OK\r\n"},
+		{"back", []string{"SELECT", "0"}, "+OK\r\n"},
+	})
+
+	reads := [][]string{
+		{"GET", "rdb:string"},
+		{"GET", "rdb:long"},
+		{"GET", "rdb:int"},
+		{"GETBIT", "rdb:bits", "100"},
+		{"GEOPOS", "rdb:geo", "Palermo", "Catania"},
+		{"XRANGE", "rdb:stream", "-", "+"},
+		{"XINFO", "STREAM", "rdb:stream", "FULL"},
+		{"XPENDING", "rdb:stream", "g"},
+		{"DBSIZE"},
+	}
+	client := NewClient()
+	before := make([]string, len(reads))
+	for i, args := range reads {
+		result, _ := client.Execute(respCommand(args...))
+		before[i] = string(result)
+	}
+
+	runCommandCases(t, []commandCase{
+		{"save", []string{"SAVE"}, "+OK\r\n"},
+		{"flush after save", []string{"FLUSHALL"}, "+OK\r\n"},
+	})
+	if err := LoadRDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, args := range reads {
+		result, _ := client.Execute(respCommand(args...))
+		if string(result) != before[i] {
+			t.Errorf("%v: expected %q after loading, but got %q", args, before[i], string(result))
+		}
+	}
+	runCommandCases(t, []commandCase{
+		{"select loaded", []string{"SELECT", "5"}, "+OK\r\n"},
+		{"other db loaded", []string{"GET", "rdb:db5"}, "$4\r\nfive\r\n"},
+		{"back", []string{"SELECT", "0"}, "+OK\r\n"},
+	})
+
+	// a background save writes the same file while clients keep running
+	path := filepath.Join(config.dir, config.dbFilename)
+	os.Remove(path)
+	runCommandCases(t, []commandCase{
+		{"bgsave", []string{"BGSAVE"}, "+Background saving started\r\n"},
+		{"bgsave syntax", []string{"BGSAVE", "NOW"}, "-ERR syntax error\r\n"},
+		{"served during bgsave", []string{"PING"}, "+PONG\r\n"},
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.RLock()
+		done := !rdbState.bgsaveInProgress
+		mu.RUnlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("BGSAVE did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected BGSAVE to write %s: %v", path, err)
+	}
+	result, _ := client.Execute(respCommand("LASTSAVE"))
+	if !strings.HasPrefix(string(result), ":") || string(result) == ":0\r\n" {
+		t.Errorf("expected LASTSAVE to be a timestamp, but got %q", result)
+	}
+
+	runCommandCases(t, []commandCase{{"clean up", []string{"FLUSHALL"}, "+OK\r\n"}})
+}
+
+func TestConfig(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"get", []string{"CONFIG", "GET", "dbfilename"}, "*2\r\n$10\r\ndbfilename\r\n$8\r\ndump.rdb\r\n"},
+		{"get pattern", []string{"CONFIG", "GET", "rdb*"}, "*4\r\n$11\r\nrdbchecksum\r\n$3\r\nyes\r\n$14\r\nrdbcompression\r\n$3\r\nyes\r\n"},
+		{"set save", []string{"CONFIG", "SET", "save", "900 1 300 10"}, "+OK\r\n"},
+		{"get save", []string{"CONFIG", "GET", "save"}, "*2\r\n$4\r\nsave\r\n$12\r\n900 1 300 10\r\n"},
+		{"bad save", []string{"CONFIG", "SET", "save", "900"},
+			"-ERR CONFIG SET failed (possibly related to argument 'save') - Invalid save parameters\r\n"},
+		{"rolled back", []string{"CONFIG", "SET", "save", "60 1", "rdbcompression", "maybe"},
+			"-ERR CONFIG SET failed (possibly related to argument 'rdbcompression') - argument must be 'yes' or 'no'\r\n"},
+		{"save unchanged", []string{"CONFIG", "GET", "save"}, "*2\r\n$4\r\nsave\r\n$12\r\n900 1 300 10\r\n"},
+		{"unknown", []string{"CONFIG", "SET", "nosuch", "1"}, "-ERR Unknown option or number of arguments for CONFIG SET - 'nosuch'\r\n"},
+		{"restore save", []string{"CONFIG", "SET", "save", "3600 1 300 100 60 10000"}, "+OK\r\n"},
+	})
+}
+
+func TestLoadConfig(t *testing.T) {
+	mu.Lock()
+	defer mu.Unlock()
+	oldDir, oldFile, oldSave := config.dir, config.dbFilename, config.saveParams
+	defer func() {
+		config.dir, config.dbFilename, config.saveParams = oldDir, oldFile, oldSave
+	}()
+
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "redis.conf")
+	os.WriteFile(confPath, []byte("# comment\ndbfilename \"from file.rdb\"\nsave 900 1\n"), 0o644)
+	if err := LoadConfig([]string{confPath, "--dir", dir, "--save", "60", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	if config.dir != dir || config.dbFilename != "from file.rdb" || formatSaveParams() != "900 1 60 5" {
+		t.Errorf("unexpected config %q %q %q", config.dir, config.dbFilename, formatSaveParams())
+	}
+	if err := LoadConfig([]string{"--save", ""}); err != nil || len(config.saveParams) != 0 {
+		t.Errorf("expected an empty save to disable snapshots, got %v %v", config.saveParams, err)
+	}
+	if err := LoadConfig([]string{"--nosuch", "1"}); err == nil {
+		t.Error("expected an unknown option to fail")
+	}
+}
@@ -0,0 +1,1313 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Replication: a replica connects to its master, does the PING/REPLCONF/PSYNC handshake and receives
+// an RDB snapshot, written by a background save, followed by the stream of the commands that changed
+// the dataset since the snapshot. The stream is the same RESP the AOF holds, applied by the replica
+// through the dispatcher as if its master was a client. The offset counts the bytes of the stream.
+// The end of the stream is kept in the backlog, so a replica that reconnects with the replication ID
+// and offset it reached gets the part it missed with +CONTINUE instead of a new snapshot.
+// With repl-diskless-sync the snapshot is streamed to the replicas instead of a file, delimited by
+// "$EOF:<40 random characters>\r\n" and the same 40 characters since its size is not known upfront.
+
+const (
+	// replPingPeriod is how often the master pings its replicas so they can tell the link is alive
+	replPingPeriod = 10 * time.Second
+	// replTimeout is how long a replica waits for data from its master before dropping the link
+	replTimeout = 60 * time.Second
+)
+
+// replicaState is where a replica connected to us is in its synchronization
+type replicaState int
+
+const (
+	// replicaWaitBgsaveStart replicas wait for the running save to end to get one of their own
+	replicaWaitBgsaveStart replicaState = iota
+	// replicaWaitBgsaveEnd replicas wait for the save of their snapshot, buffering the stream meanwhile
+	replicaWaitBgsaveEnd
+	replicaSendingRDB
+	replicaOnline
+)
+
+// replica is the master side of a replica connection
+type replica struct {
+	client        *Client
+	state         replicaState
+	listeningPort int
+	// ipAddress is the address the replica announced, its connection's one by default
+	ipAddress string
+	// oldSync replicas sent SYNC and get the RDB file without the +FULLRESYNC line
+	oldSync bool
+	// initialOffset is the offset of the stream at the time of the snapshot
+	initialOffset int64
+	// psync2 replicas understand +CONTINUE with a new replication ID, capaEOF ones a snapshot
+	// delimited by an EOF mark
+	psync2  bool
+	capaEOF bool
+	// waitingSince is when the replica started waiting for a save
+	waitingSince time.Time
+	// rdbSocket is set while the snapshot is streamed to the replica, startOnAck once it was streamed:
+	// the stream follows the first REPLCONF ACK, so it can't be mistaken for the end of the snapshot
+	rdbSocket  bool
+	startOnAck bool
+	// ackOffset is the offset the replica acknowledged with REPLCONF ACK, at ackTime, and aofAckOffset
+	// the one its AOF is synced up to
+	ackOffset    int64
+	aofAckOffset int64
+	ackTime      time.Time
+	// pending is the stream not written to the replica yet, sent by writeLoop, over its soft output
+	// buffer limit since softSince
+	pending   []byte
+	softSince time.Time
+	wake      chan struct{}
+	closed    bool
+}
+
+// replLinkState is where a replica is in its connection to the master
+type replLinkState int
+
+const (
+	replNone replLinkState = iota
+	replConnect
+	replConnecting
+	replTransfer
+	replConnected
+)
+
+// masterLink is the replica side of the connection to the master. It is dropped by setting another one.
+type masterLink struct {
+	host   string
+	port   int
+	conn   net.Conn
+	reader *bufio.Reader
+	// client applies the stream once the snapshot is loaded
+	client *Client
+}
+
+// replicationState is the replication role and its progress, guarded by mu
+var replicationState = struct {
+	replid string
+	// offset is the position in the replication stream, which replicas continue from their master's
+	offset int64
+	// replid2 is the ID of the history we followed as a replica before being promoted, valid up to
+	// secondReplidOffset so our former fellow replicas can continue from us
+	replid2            string
+	secondReplidOffset int64
+	backlog            *replBacklog
+	replicas           []*replica
+	// selectedDB is the database the last command sent to the replicas was for
+	selectedDB int
+	lastPing   time.Time
+
+	// masterHost is empty unless this server is a replica
+	masterHost string
+	masterPort int
+	linkState  replLinkState
+	link       *masterLink
+	// cachedMaster is set when the dataset matches replid up to offset, so a partial resync can be
+	// asked for, cachedClient being the client that applied the stream with its selected database
+	cachedMaster bool
+	cachedClient *Client
+}{replid: newReplicationID(), replid2: strings.Repeat("0", 40), secondReplidOffset: -1, selectedDB: -1}
+
+var errLinkClosed = errors.New("replication link closed")
+
+// REPLICAOF is added to the command table in init, since the link it starts runs commands through the table
+func init() {
+	commands["REPLICAOF"] = command{handler: handleReplicaOf, arity: 3, flags: cmdAdmin}
+	commands["SLAVEOF"] = command{handler: handleReplicaOf, arity: 3, flags: cmdAdmin}
+}
+
+// newReplicationID returns a random ID of 40 hex characters naming a replication history
+func newReplicationID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// shiftReplicationID starts a new history when a replica is promoted, the one it followed staying valid
+// as the secondary ID up to the current offset. The caller must hold mu.
+func shiftReplicationID() {
+	replicationState.replid2 = replicationState.replid
+	replicationState.secondReplidOffset = replicationState.offset + 1
+	replicationState.replid = newReplicationID()
+	fmt.Printf("Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s\n",
+		replicationState.replid2, replicationState.secondReplidOffset, replicationState.replid)
+}
+
+func clearReplicationID2() {
+	replicationState.replid2 = strings.Repeat("0", 40)
+	replicationState.secondReplidOffset = -1
+}
+
+// createReplicationBacklog starts keeping the stream from the current offset. The caller must hold mu.
+func createReplicationBacklog() {
+	replicationState.backlog = newReplBacklog(backlogSize(config.replBacklogSize), replicationState.offset+1)
+}
+
+// backlogSize is the size the backlog gets for the configured one, which has a minimum
+func backlogSize(configured int64) int {
+	return int(max(configured, 16*1024))
+}
+
+// replicaReadOnly reports whether writes from clients are refused. The caller must hold mu.
+func replicaReadOnly() bool {
+	return replicationState.masterHost != "" && config.replicaReadOnly
+}
+
+// feedReplicationStream sends a command executed against db to the replicas, selecting db first when
+// the previous command was for another one. A nil db is for commands such as EXEC that apply to none.
+// A replica does not feed its own commands, it proxies the stream of its master. The caller must hold mu.
+func feedReplicationStream(db *database, args []string) {
+	if replicationState.masterHost != "" {
+		return
+	}
+	if replicationState.backlog == nil {
+		if len(replicationState.replicas) == 0 && aofState.status == aofOff {
+			return
+		}
+		// WAITAOF follows the AOF with the offset, which moves with the backlog
+		createReplicationBacklog()
+	}
+	var buf []byte
+	if db != nil && db.id != replicationState.selectedDB {
+		buf = appendCommand(buf, []string{"SELECT", strconv.Itoa(db.id)})
+		replicationState.selectedDB = db.id
+	}
+	feedReplicationBuffer(appendCommand(buf, args))
+}
+
+// feedReplicationBuffer advances the offset by buf, keeps it in the backlog and queues it for the
+// replicas that are past their snapshot. The caller must hold mu.
+func feedReplicationBuffer(buf []byte) {
+	replicationState.offset += int64(len(buf))
+	if replicationState.backlog != nil {
+		replicationState.backlog.feed(buf)
+	}
+	var overLimit []*replica
+	now := time.Now()
+	for _, r := range replicationState.replicas {
+		if r.state == replicaWaitBgsaveStart {
+			continue
+		}
+		r.pending = append(r.pending, buf...)
+		if config.clientOutputBufferLimit[classReplica].exceeded(int64(len(r.pending)), &r.softSince, now) {
+			overLimit = append(overLimit, r)
+		}
+		r.signal()
+	}
+	// a replica that can't keep up resyncs once it reconnects
+	for _, r := range overLimit {
+		fmt.Printf("Client %s scheduled to be closed ASAP for overcoming of output buffer limits.\n", r.name())
+		freeReplica(r)
+		r.client.conn.Close()
+	}
+}
+
+func (r *replica) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// name is how the replica shows in the logs, with the port it listens on
+func (r *replica) name() string {
+	return net.JoinHostPort(r.ipAddress, strconv.Itoa(r.listeningPort))
+}
+
+// replicaOf returns the replica state of c, created when it first uses REPLCONF or PSYNC
+func (c *Client) replicaOf() *replica {
+	if c.replica == nil {
+		c.replica = &replica{client: c, wake: make(chan struct{}, 1), aofAckOffset: -1}
+		if c.conn != nil {
+			c.replica.ipAddress, _, _ = net.SplitHostPort(c.conn.RemoteAddr().String())
+		}
+	}
+	return c.replica
+}
+
+// freeReplica forgets a replica whose connection is gone. The caller must hold mu.
+func freeReplica(r *replica) {
+	for i, other := range replicationState.replicas {
+		if other == r {
+			replicationState.replicas = append(replicationState.replicas[:i], replicationState.replicas[i+1:]...)
+			fmt.Printf("Connection with replica %s lost.\n", r.name())
+			break
+		}
+	}
+	r.closed = true
+	r.pending = nil
+	r.signal()
+}
+
+// disconnectReplicas closes the connections of every replica, which then resync. The caller must hold mu.
+func disconnectReplicas() {
+	for _, r := range append([]*replica(nil), replicationState.replicas...) {
+		freeReplica(r)
+		r.client.conn.Close()
+	}
+}
+
+// handleReplconf records what a replica tells about itself before it syncs, and the offsets it
+// acknowledges afterwards. GETACK asks a replica to acknowledge its offset at once.
+func handleReplconf(c *Client, args ...BulkString) ([]byte, error) {
+	if len(args)%2 == 0 {
+		return errorReply(errSyntax.Error())
+	}
+	r := c.replicaOf()
+	acked := false
+	for i := 1; i < len(args); i += 2 {
+		option, value := strings.ToLower(*args[i].Value), *args[i+1].Value
+		switch option {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return errorReply(errNotInteger.Error())
+			}
+			r.listeningPort = port
+		case "ip-address":
+			r.ipAddress = value
+		case "capa":
+			switch strings.ToLower(value) {
+			case "psync2":
+				r.psync2 = true
+			case "eof":
+				r.capaEOF = true
+			}
+		case "ack":
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && offset > r.ackOffset {
+				r.ackOffset = offset
+			}
+			r.ackTime = time.Now()
+			acked = true
+			if r.startOnAck {
+				r.startOnAck = false
+				fmt.Printf("Streaming enabled for replica %s\n", r.name())
+				go r.writeLoop()
+			}
+		case "fack":
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && offset > r.aofAckOffset {
+				r.aofAckOffset = offset
+			}
+			acked = true
+		case "getack":
+			// asked by our master on the stream, the answer is a command of its own
+			if c.master && replicationState.link != nil && replicationState.link.client == c {
+				replicationState.link.sendAck()
+			}
+			return []byte(""), nil
+		default:
+			return errorReply(fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", *args[i].Value))
+		}
+	}
+	if acked {
+		// acknowledgements are not replied to, they arrive on the stream connection
+		signalReplicationWaiters()
+		return []byte(""), nil
+	}
+	return []byte("+OK\r\n"), nil
+}
+
+// handlePsync turns the client into a replica. When the backlog still holds the stream from the
+// replication ID and offset it asks for, the reply is +CONTINUE and the missing part follows.
+// Otherwise it gets a full resynchronization: the reply is the replication ID and offset of the
+// snapshot, then the RDB file and the stream follow. Both are written by the replica's own
+// goroutine, so the command itself replies nothing.
+func handlePsync(c *Client, args ...BulkString) ([]byte, error) {
+	if c.conn != nil && (c.replica == nil || (!c.replica.closed && !containsReplica(c.replica))) &&
+		(replicationState.masterHost == "" || replicationState.linkState == replConnected) &&
+		tryPartialResync(c, *args[1].Value, *args[2].Value) {
+		return []byte(""), nil
+	}
+	return syncReplica(c, false)
+}
+
+// tryPartialResync continues the replica from the backlog if possible. The caller must hold mu.
+func tryPartialResync(c *Client, replid, offsetArg string) bool {
+	offset, err := strconv.ParseInt(offsetArg, 10, 64)
+	if err != nil || replid == "?" {
+		return false
+	}
+	r := c.replicaOf()
+	state := &replicationState
+	if !strings.EqualFold(replid, state.replid) &&
+		(!strings.EqualFold(replid, state.replid2) || offset > state.secondReplidOffset) {
+		if !strings.EqualFold(replid, state.replid) && !strings.EqualFold(replid, state.replid2) {
+			fmt.Printf("Partial resynchronization not accepted: Replication ID mismatch (Replica asked for '%s', my replication IDs are '%s' and '%s')\n",
+				replid, state.replid, state.replid2)
+		} else {
+			fmt.Printf("Partial resynchronization not accepted: Requested offset for second ID was %d, but I can reply up to %d\n",
+				offset, state.secondReplidOffset)
+		}
+		return false
+	}
+	if state.backlog == nil {
+		return false
+	}
+	missing, ok := state.backlog.since(offset)
+	if !ok {
+		fmt.Printf("Unable to partial resync with replica %s for lack of backlog (Replica request was: %d).\n", r.name(), offset)
+		return false
+	}
+
+	if r.psync2 {
+		c.Write([]byte(fmt.Sprintf("+CONTINUE %s\r\n", state.replid)))
+	} else {
+		c.Write([]byte("+CONTINUE\r\n"))
+	}
+	r.state = replicaOnline
+	r.ackTime = time.Now()
+	r.pending = missing
+	state.replicas = append(state.replicas, r)
+	fmt.Printf("Partial resynchronization request from %s accepted. Sending %d bytes of backlog starting from offset %d.\n",
+		r.name(), len(missing), offset)
+	go r.writeLoop()
+	return true
+}
+
+// handleSync is the synchronization of old replicas, which is PSYNC without the reply line
+func handleSync(c *Client, args ...BulkString) ([]byte, error) {
+	return syncReplica(c, true)
+}
+
+func syncReplica(c *Client, oldSync bool) ([]byte, error) {
+	if c.conn == nil || (c.replica != nil && c.replica.closed) {
+		return errorReply("ERR Replica can't be synchronized on this connection")
+	}
+	if c.replica != nil && containsReplica(c.replica) {
+		// already syncing, the request is ignored
+		return []byte(""), nil
+	}
+	if replicationState.masterHost != "" && replicationState.linkState != replConnected {
+		return errorReply("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+
+	r := c.replicaOf()
+	r.oldSync = oldSync
+	fmt.Printf("Replica %s asks for synchronization\n", r.name())
+	fmt.Printf("Full resync requested by replica %s\n", r.name())
+	replicationState.replicas = append(replicationState.replicas, r)
+	// the first replica of a master starts a new history kept in the backlog
+	if len(replicationState.replicas) == 1 && replicationState.backlog == nil {
+		replicationState.replid = newReplicationID()
+		clearReplicationID2()
+		createReplicationBacklog()
+		fmt.Printf("Replication backlog created, my new replication IDs are '%s' and '%s'\n",
+			replicationState.replid, replicationState.replid2)
+	}
+
+	r.waitingSince = time.Now()
+	if rdbState.bgsaveInProgress {
+		// a save to disk for other replicas took its snapshot at the right point of the stream for us too
+		for _, other := range replicationState.replicas {
+			if other != r && other.state == replicaWaitBgsaveEnd && !rdbState.bgsaveToSocket {
+				r.pending = append([]byte(nil), other.pending...)
+				setupReplicaForFullResync(r, other.initialOffset)
+				fmt.Println("Waiting for end of BGSAVE for SYNC")
+				return []byte(""), nil
+			}
+		}
+		r.state = replicaWaitBgsaveStart
+		fmt.Println("Can't attach the replica to the current BGSAVE. Waiting for next BGSAVE for SYNC")
+		return []byte(""), nil
+	}
+	r.state = replicaWaitBgsaveStart
+	if config.replDisklessSync && r.capaEOF && config.replDisklessSyncDelay > 0 {
+		// the replication routine starts it once other replicas had a chance to share it
+		fmt.Println("Delay next BGSAVE for diskless SYNC")
+		return []byte(""), nil
+	}
+	startBgsaveForReplication()
+	return []byte(""), nil
+}
+
+func containsReplica(r *replica) bool {
+	for _, other := range replicationState.replicas {
+		if other == r {
+			return true
+		}
+	}
+	return false
+}
+
+// setupReplicaForFullResync makes r wait for the snapshot taken at offset, telling it the replication
+// ID and offset it continues from. The caller must hold mu.
+func setupReplicaForFullResync(r *replica, offset int64) {
+	r.state = replicaWaitBgsaveEnd
+	r.initialOffset = offset
+	if !r.oldSync {
+		r.client.Write([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", replicationState.replid, offset)))
+	}
+}
+
+// startBgsaveForReplication starts a background save for the replicas waiting for one, streamed to
+// them with repl-diskless-sync when they all support it. The stream they get after the snapshot
+// starts with a SELECT. The caller must hold mu.
+func startBgsaveForReplication() {
+	socket := config.replDisklessSync
+	for _, r := range replicationState.replicas {
+		if r.state == replicaWaitBgsaveStart && !r.capaEOF {
+			socket = false
+		}
+	}
+	if socket {
+		fmt.Println("Starting BGSAVE for SYNC with target: replicas sockets")
+		rdbSaveToReplicasSockets()
+		return
+	}
+
+	fmt.Println("Starting BGSAVE for SYNC with target: disk")
+	if err := rdbSaveBackground(); err != nil {
+		fmt.Printf("BGSAVE for replication failed: %v\n", err)
+		for _, r := range append([]*replica(nil), replicationState.replicas...) {
+			if r.state == replicaWaitBgsaveStart {
+				r.client.Write([]byte("-ERR BGSAVE failed, replication can't continue\r\n"))
+				freeReplica(r)
+				r.client.conn.Close()
+			}
+		}
+		return
+	}
+	replicationState.selectedDB = -1
+	for _, r := range replicationState.replicas {
+		if r.state == replicaWaitBgsaveStart {
+			setupReplicaForFullResync(r, replicationState.offset)
+		}
+	}
+}
+
+// rdbSaveToReplicasSockets streams a snapshot to the replicas waiting for one from another goroutine.
+// They are online once it is written, the stream following their first acknowledgement.
+// The caller must hold mu.
+func rdbSaveToReplicasSockets() {
+	dbs := snapshotKeyspace()
+	compress, checksum := config.rdbCompression, config.rdbChecksum
+	rdbState.bgsaveInProgress = true
+	rdbState.bgsaveToSocket = true
+	replicationState.selectedDB = -1
+
+	var targets []*replica
+	for _, r := range replicationState.replicas {
+		if r.state == replicaWaitBgsaveStart {
+			setupReplicaForFullResync(r, replicationState.offset)
+			r.rdbSocket = true
+			targets = append(targets, r)
+		}
+	}
+
+	go func() {
+		mark := newReplicationID()
+		w := &replicasWriter{replicas: targets, failed: make(map[*replica]bool)}
+		buffered := bufio.NewWriterSize(w, 64<<10)
+		buffered.WriteString("$EOF:" + mark + "\r\n")
+		err := writeRDB(buffered, dbs, compress, checksum, false)
+		if err == nil {
+			err = buffered.Flush()
+		}
+
+		// the replicas are online before they get the mark, so their acknowledgement finds them so
+		mu.Lock()
+		rdbState.bgsaveInProgress = false
+		rdbState.bgsaveToSocket = false
+		var done []*replica
+		for _, r := range targets {
+			r.rdbSocket = false
+			if r.closed {
+				continue
+			}
+			if err != nil || w.failed[r] {
+				fmt.Printf("Diskless rdb transfer to replica %s failed\n", r.name())
+				freeReplica(r)
+				r.client.conn.Close()
+				continue
+			}
+			r.state = replicaOnline
+			r.ackTime = time.Now()
+			r.startOnAck = true
+			done = append(done, r)
+		}
+		mu.Unlock()
+
+		for _, r := range done {
+			if _, err := r.client.Write([]byte(mark)); err != nil {
+				r.client.conn.Close()
+				continue
+			}
+			fmt.Printf("Streamed RDB transfer with replica %s succeeded (socket). Waiting for REPLCONF ACK from replica to enable streaming\n", r.name())
+		}
+		if err == nil {
+			fmt.Println("Background RDB transfer terminated with success")
+		}
+	}()
+}
+
+// replicasWriter writes a snapshot to several replicas, giving up on the ones that fail. It only
+// fails when no replica is left.
+type replicasWriter struct {
+	replicas []*replica
+	failed   map[*replica]bool
+}
+
+func (w *replicasWriter) Write(p []byte) (int, error) {
+	left := 0
+	for _, r := range w.replicas {
+		if w.failed[r] {
+			continue
+		}
+		r.client.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		if _, err := r.client.Write(p); err != nil {
+			fmt.Printf("Diskless rdb transfer, write error sending DB to replica: %v\n", err)
+			w.failed[r] = true
+			continue
+		}
+		left++
+	}
+	if left == 0 {
+		return 0, errors.New("no replica left to transfer the snapshot to")
+	}
+	return len(p), nil
+}
+
+// updateReplicasWaitingBgsave sends the file of a finished background save to the replicas waiting
+// for it, and starts another save for the ones that could not use it. The caller must hold mu.
+func updateReplicasWaitingBgsave(path string, saveErr error) {
+	startNeeded := false
+	for _, r := range append([]*replica(nil), replicationState.replicas...) {
+		switch r.state {
+		case replicaWaitBgsaveStart:
+			startNeeded = true
+		case replicaWaitBgsaveEnd:
+			f, err := os.Open(path)
+			if saveErr != nil || err != nil {
+				fmt.Printf("SYNC failed. BGSAVE returned an error for replica %s\n", r.name())
+				freeReplica(r)
+				r.client.conn.Close()
+				if f != nil {
+					f.Close()
+				}
+				continue
+			}
+			r.state = replicaSendingRDB
+			go r.sendRDB(f)
+		}
+	}
+	if startNeeded {
+		startBgsaveForReplication()
+	}
+}
+
+// sendRDB writes the RDB file as a bulk string without the final CRLF, then the stream
+func (r *replica) sendRDB(f *os.File) {
+	defer f.Close()
+	info, err := f.Stat()
+	if err == nil {
+		_, err = r.client.Write([]byte(fmt.Sprintf("$%d\r\n", info.Size())))
+	}
+	if err == nil {
+		_, err = io.Copy(r.client, f)
+	}
+	if err != nil {
+		fmt.Printf("Write error sending DB to replica: %v\n", err)
+		r.client.conn.Close()
+		return
+	}
+
+	mu.Lock()
+	r.state = replicaOnline
+	r.ackTime = time.Now()
+	mu.Unlock()
+	fmt.Printf("Synchronization with replica %s succeeded\n", r.name())
+	r.writeLoop()
+}
+
+// writeLoop writes the stream queued for the replica until it is freed
+func (r *replica) writeLoop() {
+	for {
+		mu.Lock()
+		buf, closed := r.pending, r.closed
+		r.pending = nil
+		mu.Unlock()
+		if closed {
+			return
+		}
+		if len(buf) == 0 {
+			<-r.wake
+			continue
+		}
+		if _, err := r.client.Write(buf); err != nil {
+			fmt.Printf("Error writing to replica %s: %v\n", r.name(), err)
+			// the connection loop sees the closed connection and frees the replica
+			r.client.conn.Close()
+			return
+		}
+	}
+}
+
+// handleReplicaOf makes this server a replica of the given master, or a master again with NO ONE.
+// The dataset is kept until the master sends its snapshot.
+func handleReplicaOf(args ...BulkString) ([]byte, error) {
+	host, portArg := *args[1].Value, *args[2].Value
+	if strings.EqualFold(host, "no") && strings.EqualFold(portArg, "one") {
+		if replicationState.masterHost != "" {
+			replicationUnsetMaster()
+			fmt.Println("MASTER MODE enabled (user request)")
+		}
+		return []byte("+OK\r\n"), nil
+	}
+
+	port, err := strconv.Atoi(portArg)
+	if err != nil || port < 0 || port > 65535 {
+		return errorReply("ERR Invalid master port")
+	}
+	if replicationState.masterHost == host && replicationState.masterPort == port {
+		return []byte("+OK Already connected to specified master\r\n"), nil
+	}
+	replicationSetMaster(host, port)
+	connectToMaster()
+	fmt.Printf("REPLICAOF %s:%d enabled (user request)\n", host, port)
+	return []byte("+OK\r\n"), nil
+}
+
+// replicationSetMaster makes this server a replica of host:port, connecting from the replication
+// routine. The caller must hold mu.
+func replicationSetMaster(host string, port int) {
+	if replicationState.masterHost == "" {
+		// our own history is where a partial resync with the new master can start from
+		replicationState.cachedMaster = true
+		replicationState.cachedClient = nil
+	}
+	cancelMasterLink()
+	replicationState.masterHost = host
+	replicationState.masterPort = port
+	replicationState.linkState = replConnect
+	fmt.Printf("Connecting to MASTER %s:%d\n", host, port)
+}
+
+// replicationUnsetMaster makes this server a master again. The caller must hold mu.
+func replicationUnsetMaster() {
+	cancelMasterLink()
+	replicationState.masterHost = ""
+	replicationState.masterPort = 0
+	replicationState.linkState = replNone
+	replicationState.cachedMaster = false
+	replicationState.cachedClient = nil
+	// our history goes on under a new ID, the replicas reconnect and continue with the previous one
+	shiftReplicationID()
+	disconnectReplicas()
+	replicationState.selectedDB = -1
+}
+
+// cancelMasterLink drops the connection to the master, its goroutine stopping once it notices.
+// The caller must hold mu.
+func cancelMasterLink() {
+	link := replicationState.link
+	if link == nil {
+		return
+	}
+	replicationState.link = nil
+	link.cache()
+	if link.conn != nil {
+		link.conn.Close()
+	}
+}
+
+// cache keeps the client that applied the stream of a link that was connected, so a partial
+// resync continues with the database it selected. The caller must hold mu.
+func (link *masterLink) cache() {
+	if link.client == nil {
+		return
+	}
+	// a transaction cut by the link is dropped, the master sends it again
+	link.client.multi = nil
+	replicationState.cachedClient = link.client
+	link.client = nil
+}
+
+// sendAck tells the master the offset we processed. The caller must hold mu.
+func (link *masterLink) sendAck() {
+	if link.conn == nil || link.client == nil {
+		return
+	}
+	link.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+	link.conn.Write(appendCommand(nil, []string{
+		"REPLCONF", "ACK", strconv.FormatInt(replicationState.offset, 10),
+		"FACK", strconv.FormatInt(aofState.fsyncedOffset, 10),
+	}))
+}
+
+// connectToMaster starts synchronizing with the master from a goroutine. The caller must hold mu.
+func connectToMaster() {
+	link := &masterLink{host: replicationState.masterHost, port: replicationState.masterPort}
+	replicationState.link = link
+	replicationState.linkState = replConnecting
+	go link.run()
+}
+
+// run synchronizes with the master and applies its stream until the link breaks or is dropped,
+// the replication routine reconnecting afterwards
+func (link *masterLink) run() {
+	err := link.sync()
+	if err == nil {
+		fmt.Println("MASTER <-> REPLICA sync: Finished with success")
+		err = link.stream()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if link.conn != nil {
+		link.conn.Close()
+	}
+	if replicationState.link != link {
+		return
+	}
+	replicationState.link = nil
+	link.cache()
+	replicationState.linkState = replConnect
+	fmt.Printf("Connection with master lost: %v\n", err)
+}
+
+// current reports whether link is still the connection to the master. The caller must hold mu.
+func (link *masterLink) current() bool {
+	return replicationState.link == link
+}
+
+// sync connects to the master, does the handshake and loads the snapshot it sends
+func (link *masterLink) sync() error {
+	conn, err := dialMaster(link.host, link.port)
+	if err != nil {
+		return fmt.Errorf("error condition on socket for SYNC: %v", err)
+	}
+	mu.Lock()
+	if !link.current() {
+		mu.Unlock()
+		conn.Close()
+		return errLinkClosed
+	}
+	link.conn = conn
+	port, dir, masteruser, masterauth := config.port, config.dir, config.masteruser, config.masterauth
+	psyncReplid, psyncOffset := "?", "-1"
+	if replicationState.cachedMaster {
+		psyncReplid = replicationState.replid
+		psyncOffset = strconv.FormatInt(replicationState.offset+1, 10)
+	}
+	mu.Unlock()
+	fmt.Println("MASTER <-> REPLICA sync started")
+
+	conn.SetDeadline(time.Now().Add(replTimeout))
+	r := bufio.NewReader(conn)
+	send := func(args ...string) (string, error) {
+		if _, err := conn.Write(appendCommand(nil, args)); err != nil {
+			return "", err
+		}
+		return readReplyLine(r)
+	}
+
+	reply, err := send("PING")
+	if err != nil {
+		return err
+	}
+	// a master requiring authentication still proves it is alive
+	if strings.HasPrefix(reply, "-") && !strings.HasPrefix(reply, "-NOAUTH") &&
+		!strings.HasPrefix(reply, "-NOPERM") && !strings.HasPrefix(reply, "-ERR operation not permitted") {
+		return fmt.Errorf("error reply to PING from master: '%s'", reply)
+	}
+	if masterauth != "" {
+		credentials := []string{"AUTH", masterauth}
+		if masteruser != "" {
+			credentials = []string{"AUTH", masteruser, masterauth}
+		}
+		if reply, err = send(credentials...); err != nil {
+			return err
+		}
+		if strings.HasPrefix(reply, "-") {
+			return fmt.Errorf("unable to AUTH to MASTER: %s", reply)
+		}
+	}
+	if reply, err = send("REPLCONF", "listening-port", strconv.Itoa(port)); err != nil {
+		return err
+	}
+	if strings.HasPrefix(reply, "-") {
+		fmt.Printf("(Non critical) Master does not understand REPLCONF listening-port: %s\n", reply)
+	}
+	if reply, err = send("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return err
+	}
+	if strings.HasPrefix(reply, "-") {
+		fmt.Printf("(Non critical) Master does not understand REPLCONF capa: %s\n", reply)
+	}
+
+	if psyncReplid == "?" {
+		fmt.Println("Partial resynchronization not possible (no cached master)")
+	} else {
+		fmt.Printf("Trying a partial resynchronization (request %s:%s).\n", psyncReplid, psyncOffset)
+	}
+	reply, err = send("PSYNC", psyncReplid, psyncOffset)
+	// the master keeps the link alive with newlines until it replies
+	for err == nil && reply == "" {
+		reply, err = readReplyLine(r)
+	}
+	if err != nil {
+		return err
+	}
+	if reply == "+CONTINUE" || strings.HasPrefix(reply, "+CONTINUE ") {
+		return link.continueSync(r, strings.TrimSpace(strings.TrimPrefix(reply, "+CONTINUE")))
+	}
+	fields := strings.Fields(reply)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" || len(fields[1]) != 40 {
+		return fmt.Errorf("unexpected reply to PSYNC from master: %s", reply)
+	}
+	replid := fields[1]
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected reply to PSYNC from master: %s", reply)
+	}
+	fmt.Printf("Full resync from master: %s:%d\n", replid, offset)
+
+	mu.Lock()
+	if !link.current() {
+		mu.Unlock()
+		return errLinkClosed
+	}
+	replicationState.linkState = replTransfer
+	// the dataset is replaced, there is nothing left to continue
+	replicationState.cachedMaster = false
+	replicationState.cachedClient = nil
+	diskless := useDisklessLoad()
+	checksum := config.rdbChecksum
+	mu.Unlock()
+
+	payload, err := readPayloadHeader(conn, r)
+	if err != nil {
+		return err
+	}
+	if diskless {
+		// the old dataset keeps being served while the new one is parsed aside
+		fmt.Println("MASTER <-> REPLICA sync: Loading DB in memory")
+		dbs, err := readRDB(bufio.NewReaderSize(payload, 64<<10), checksum)
+		if err == nil {
+			_, err = io.Copy(io.Discard, payload)
+		}
+		if err != nil {
+			fmt.Println("MASTER <-> REPLICA sync: Discarding the half-loaded data")
+			return fmt.Errorf("failed trying to load the MASTER synchronization DB from socket: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !link.current() {
+			return errLinkClosed
+		}
+		fmt.Println("MASTER <-> REPLICA sync: Swapping active DB with loaded DB")
+		installMasterDataset(dbs)
+	} else {
+		tmp, err := receiveRDB(payload, dir)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !link.current() {
+			return errLinkClosed
+		}
+		if err := loadMasterRDB(tmp); err != nil {
+			return fmt.Errorf("failed trying to load the MASTER synchronization DB from disk: %v", err)
+		}
+	}
+	replicationState.replid = replid
+	replicationState.offset = offset
+	clearReplicationID2()
+	createReplicationBacklog()
+	replicationState.cachedMaster = true
+	link.client = NewClient()
+	link.client.master = true
+	link.reader = r
+	replicationState.linkState = replConnected
+	conn.SetDeadline(time.Time{})
+	// a master streaming its snapshot starts the stream once it knows the snapshot was received
+	link.sendAck()
+	return nil
+}
+
+// useDisklessLoad reports whether the snapshot of the master is loaded as it is received rather than
+// saved to a file first. The caller must hold mu.
+func useDisklessLoad() bool {
+	switch config.replDisklessLoad {
+	case "swapdb":
+		return true
+	case "on-empty-db":
+		for _, db := range databases {
+			if len(db.entries) > 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// continueSync goes on with the stream after the master accepted a partial resynchronization,
+// switching to the new replication ID it may send
+func (link *masterLink) continueSync(r *bufio.Reader, newReplid string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if !link.current() {
+		return errLinkClosed
+	}
+	fmt.Println("Successful partial resynchronization with master.")
+	if newReplid != "" && newReplid != replicationState.replid {
+		shiftReplicationID()
+		replicationState.replid = newReplid
+		fmt.Printf("Master replication ID changed to %s\n", newReplid)
+		// our replicas have to know about the new ID
+		disconnectReplicas()
+	}
+	if replicationState.backlog == nil {
+		createReplicationBacklog()
+	}
+	link.client = replicationState.cachedClient
+	replicationState.cachedClient = nil
+	if link.client == nil {
+		link.client = NewClient()
+		link.client.master = true
+	}
+	link.reader = r
+	replicationState.linkState = replConnected
+	link.conn.SetDeadline(time.Time{})
+	fmt.Println("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+	return nil
+}
+
+// readReplyLine reads a one line reply of the master during the handshake
+func readReplyLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readPayloadHeader reads the header of the snapshot the master sends, returning a reader that ends
+// with it: it has the size of the snapshot, or the EOF mark that follows it when streamed. The master
+// sends newlines to keep the link alive while the snapshot is being saved.
+func readPayloadHeader(conn net.Conn, r *bufio.Reader) (io.Reader, error) {
+	var header string
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("I/O error reading bulk count from MASTER: %v", err)
+		}
+		if line == "\n" {
+			continue
+		}
+		header = strings.TrimRight(line, "\r\n")
+		break
+	}
+	if strings.HasPrefix(header, "-") {
+		return nil, fmt.Errorf("MASTER aborted replication with an error: %s", header[1:])
+	}
+	// the transfer may take a while, only a stalled one times out
+	conn.SetReadDeadline(time.Time{})
+	body := &deadlineReader{conn: conn, r: r}
+	if mark, ok := strings.CutPrefix(header, "$EOF:"); ok && len(mark) == eofMarkLen {
+		fmt.Println("MASTER <-> REPLICA sync: receiving streamed RDB from master with EOF")
+		return &eofReader{r: body, mark: []byte(mark)}, nil
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(header, "$"), 10, 64)
+	if !strings.HasPrefix(header, "$") || err != nil || size < 0 {
+		return nil, fmt.Errorf("bad protocol from MASTER, the first byte is not '$' (we received '%s'), are you sure the host and port are right?", header)
+	}
+	fmt.Printf("MASTER <-> REPLICA sync: receiving %d bytes from master\n", size)
+	return &exactReader{r: io.LimitReader(body, size), left: size}, nil
+}
+
+// receiveRDB writes the snapshot of the master to a temporary file of dir
+func receiveRDB(payload io.Reader, dir string) (string, error) {
+	tmp := filepath.Join(dir, fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", fmt.Errorf("opening the temp file needed for MASTER <-> REPLICA synchronization: %v", err)
+	}
+	_, err = io.Copy(f, payload)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("I/O error trying to sync with MASTER: %v", err)
+	}
+	return tmp, nil
+}
+
+// eofMarkLen is the length of the mark delimiting a streamed snapshot
+const eofMarkLen = 40
+
+// eofReader reads a streamed snapshot up to the mark that ends it, holding the last bytes read back
+// until it knows whether they are the mark. Nothing follows the mark until the replica acknowledges it.
+type eofReader struct {
+	r    io.Reader
+	mark []byte
+	// out is what was read and can be returned, held what may be the start of the mark
+	out  []byte
+	held []byte
+	done bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		buf := make([]byte, 32<<10)
+		n, err := e.r.Read(buf)
+		data := append(e.held, buf[:n]...)
+		if bytes.HasSuffix(data, e.mark) {
+			e.done = true
+			e.out, e.held = data[:len(data)-eofMarkLen], nil
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		keep := min(len(data), eofMarkLen)
+		e.out = data[:len(data)-keep]
+		e.held = append([]byte(nil), data[len(data)-keep:]...)
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// exactReader fails when the reader ends before the size it was given
+type exactReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.left -= int64(n)
+	if err == io.EOF && e.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// deadlineReader extends the read deadline of the connection before every read
+type deadlineReader struct {
+	conn net.Conn
+	r    io.Reader
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(replTimeout))
+	return d.r.Read(p)
+}
+
+// loadMasterRDB replaces the dataset with the snapshot received from the master, which becomes our
+// RDB file. The caller must hold mu.
+func loadMasterRDB(tmp string) error {
+	fmt.Println("MASTER <-> REPLICA sync: Flushing old data")
+	path := rdbPath()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fmt.Println("MASTER <-> REPLICA sync: Loading DB in memory")
+	dbs, err := readRDB(bufio.NewReaderSize(f, 64<<10), config.rdbChecksum)
+	if err != nil {
+		return err
+	}
+	installMasterDataset(dbs)
+	return nil
+}
+
+// installMasterDataset swaps the databases loaded from the snapshot of the master in.
+// The caller must hold mu.
+func installMasterDataset(dbs []map[string]StoreEntry) {
+	for i, db := range databases {
+		db.touchAllWatchedKeys(&database{entries: dbs[i]})
+	}
+	loadDatabases(dbs)
+	trackingInvalidateKeysOnFlush()
+	for _, db := range databases {
+		db.signalReadyKeys()
+	}
+
+	// our replicas followed the previous history, they resync from the new one
+	disconnectReplicas()
+	replicationState.selectedDB = -1
+	// the AOF is rebuilt from the new dataset
+	if aofState.status != aofOff {
+		stopAppendOnly()
+		if err := startAppendOnly(); err != nil {
+			fmt.Printf("Failed enabling the AOF after successful master synchronization: %v\n", err)
+		}
+	}
+}
+
+// stream applies the commands the master sends, proxying them to our own replicas. A transaction only
+// counts in the offset once it is executed, so a link lost in the middle resumes before its MULTI.
+func (link *masterLink) stream() error {
+	var applied []byte
+	for {
+		link.conn.SetReadDeadline(time.Now().Add(replTimeout))
+		frame, _, err := readCommand(link.reader)
+		if err != nil {
+			return err
+		}
+		if _, err := link.client.Execute(frame); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		if !link.current() {
+			mu.Unlock()
+			return errLinkClosed
+		}
+		applied = append(applied, frame...)
+		if link.client.multi == nil {
+			feedReplicationBuffer(applied)
+			applied = applied[:0]
+			// the commands were synced before the offset moved past them
+			if config.appendFsync == "always" && len(aofState.buf) == 0 {
+				updateFsyncedOffset(replicationState.offset)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// handleRole returns the replication role of the server with its replicas or its master
+func handleRole(args ...BulkString) ([]byte, error) {
+	var elements []RESPData
+	if replicationState.masterHost == "" {
+		replicas := make([]RESPData, 0, len(replicationState.replicas))
+		for _, r := range replicationState.replicas {
+			if r.state != replicaOnline {
+				continue
+			}
+			entry := []RESPData{
+				bulkString(r.ipAddress),
+				bulkString(strconv.Itoa(r.listeningPort)),
+				bulkString(strconv.FormatInt(r.ackOffset, 10)),
+			}
+			replicas = append(replicas, Array{Elements: &entry})
+		}
+		elements = []RESPData{
+			bulkString("master"),
+			Integer{Value: int(replicationState.offset)},
+			Array{Elements: &replicas},
+		}
+	} else {
+		offset := -1
+		if replicationState.linkState == replConnected {
+			offset = int(replicationState.offset)
+		}
+		elements = []RESPData{
+			bulkString("slave"),
+			bulkString(replicationState.masterHost),
+			Integer{Value: replicationState.masterPort},
+			bulkString(replicationState.linkState.String()),
+			Integer{Value: offset},
+		}
+	}
+	return SerializeArray(Array{Elements: &elements})
+}
+
+func (s replLinkState) String() string {
+	switch s {
+	case replConnect:
+		return "connect"
+	case replConnecting:
+		return "connecting"
+	case replTransfer:
+		return "sync"
+	case replConnected:
+		return "connected"
+	}
+	return "none"
+}
+
+// StartReplicationRoutine runs replicationCron every second
+func StartReplicationRoutine() {
+	ticker := time.NewTicker(1 * time.Second)
+	for range ticker.C {
+		mu.Lock()
+		replicationCron()
+		mu.Unlock()
+	}
+}
+
+// replicationCron connects replicas to their master and acknowledges its stream, pings the replicas,
+// drops the ones that stopped acknowledging and keeps the ones waiting for their snapshot alive.
+// The caller must hold mu.
+func replicationCron() {
+	if replicationState.masterHost != "" && replicationState.linkState == replConnect {
+		connectToMaster()
+	}
+	if replicationState.linkState == replConnected && replicationState.link != nil {
+		replicationState.link.sendAck()
+	}
+
+	for _, r := range append([]*replica(nil), replicationState.replicas...) {
+		// replicas using SYNC don't acknowledge anything
+		if r.state == replicaOnline && !r.oldSync && time.Since(r.ackTime) > replTimeout {
+			fmt.Printf("Disconnecting timedout replica: %s\n", r.name())
+			freeReplica(r)
+			r.client.conn.Close()
+		}
+	}
+
+	if replicationState.masterHost == "" && len(replicationState.replicas) > 0 &&
+		time.Since(replicationState.lastPing) >= replPingPeriod {
+		feedReplicationStream(nil, []string{"PING"})
+		replicationState.lastPing = time.Now()
+	}
+
+	// with diskless sync the save waits for other replicas to join, up to the delay
+	waiting, longest := false, time.Duration(0)
+	for _, r := range replicationState.replicas {
+		if r.state == replicaWaitBgsaveStart || (r.state == replicaWaitBgsaveEnd && !r.rdbSocket) {
+			r.client.Write([]byte("\n"))
+		}
+		if r.state == replicaWaitBgsaveStart {
+			waiting = true
+			longest = max(longest, time.Since(r.waitingSince))
+		}
+	}
+	if waiting && !rdbState.bgsaveInProgress &&
+		(!config.replDisklessSync || longest >= time.Duration(config.replDisklessSyncDelay)*time.Second) {
+		startBgsaveForReplication()
+	}
+}
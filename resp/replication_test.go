@@ -0,0 +1,683 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTempDir points the RDB files of the test to a temporary directory
+func useTempDir(t *testing.T) {
+	t.Helper()
+	mu.Lock()
+	oldDir := config.dir
+	config.dir = t.TempDir()
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		config.dir = oldDir
+		mu.Unlock()
+	})
+}
+
+// connPair returns both ends of a loopback TCP connection
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// expectCommand reads the next command of a replication stream and compares its arguments
+func expectCommand(t *testing.T, r *bufio.Reader, args ...string) {
+	t.Helper()
+	frame, _, err := readCommand(r)
+	if err != nil {
+		t.Fatalf("expected %v, but reading failed: %v", args, err)
+	}
+	if expected := appendCommand(nil, args); !bytes.Equal(frame, expected) {
+		t.Fatalf("expected %q, but got %q", expected, frame)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicationMaster(t *testing.T) {
+	useTempDir(t)
+	runCommandCases(t, []commandCase{{"set", []string{"SET", "repl:before", "v", "PXAT", "99999999999999"}, "+OK\r\n"}})
+
+	replicaConn, serverConn := connPair(t)
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(replicaConn)
+	client := NewConnClient(serverConn)
+	runClientCommandCases(t, client, []commandCase{
+		{"listening port", []string{"REPLCONF", "listening-port", "7777"}, "+OK\r\n"},
+		{"capabilities", []string{"REPLCONF", "capa", "eof", "capa", "psync2"}, "+OK\r\n"},
+		{"unknown option", []string{"REPLCONF", "speed", "fast"}, "-ERR Unrecognized REPLCONF option: speed\r\n"},
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"psync in multi", []string{"PSYNC", "?", "-1"}, "-ERR Command not allowed inside a transaction\r\n"},
+		{"discard", []string{"DISCARD"}, "+OK\r\n"},
+		{"psync", []string{"PSYNC", "?", "-1"}, ""},
+	})
+
+	line, err := r.ReadString('\n')
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 3 || fields[0] != "+FULLRESYNC" || len(fields[1]) != 40 {
+		t.Fatalf("expected +FULLRESYNC <replid> <offset>, but got %q (%v)", line, err)
+	}
+	line, err = r.ReadString('\n')
+	size, convErr := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+	if err != nil || !strings.HasPrefix(line, "$") || convErr != nil {
+		t.Fatalf("expected the RDB bulk length, but got %q (%v)", line, err)
+	}
+	dbs, err := readRDB(io.LimitReader(r, int64(size)), true)
+	if err != nil {
+		t.Fatalf("reading the RDB sent to the replica: %v", err)
+	}
+	if dbs[0]["repl:before"].value != "v" {
+		t.Error("expected the snapshot to hold the key set before the sync")
+	}
+
+	// the commands after the snapshot follow, starting with the database they are for
+	runCommandCases(t, []commandCase{
+		{"set", []string{"SET", "repl:after", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+		{"select", []string{"SELECT", "1"}, "+OK\r\n"},
+	})
+	expectCommand(t, r, "SELECT", "0")
+	expectCommand(t, r, "SET", "repl:after", "v", "PXAT", "99999999999999")
+	other := NewClient()
+	runClientCommandCases(t, other, []commandCase{
+		{"select", []string{"SELECT", "1"}, "+OK\r\n"},
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"queue", []string{"DEL", "repl:after"}, "+QUEUED\r\n"},
+		{"queue", []string{"RESTORE", "repl:restored", "0", "\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb"}, "+QUEUED\r\n"},
+		{"exec", []string{"EXEC"}, "*2\r\n:0\r\n+OK\r\n"},
+	})
+	expectCommand(t, r, "SELECT", "1")
+	expectCommand(t, r, "MULTI")
+	expectCommand(t, r, "RESTORE", "repl:restored", "0", "\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb")
+	expectCommand(t, r, "EXEC")
+
+	waitFor(t, "the replica to be online", func() bool {
+		result, _ := ExecuteRespData(respCommand("ROLE"))
+		return strings.Contains(string(result), "$4\r\n7777\r\n")
+	})
+
+	// a replica that goes away is forgotten
+	client.Close()
+	mu.RLock()
+	replicas := len(replicationState.replicas)
+	mu.RUnlock()
+	if replicas != 0 {
+		t.Errorf("expected no replica after its client closed, but got %d", replicas)
+	}
+}
+
+func TestReplBacklog(t *testing.T) {
+	b := newReplBacklog(8, 1)
+	b.feed([]byte("abcde"))
+	if data, ok := b.since(3); !ok || string(data) != "cde" {
+		t.Errorf("expected cde from offset 3, but got %q (%v)", data, ok)
+	}
+	if data, ok := b.since(6); !ok || len(data) != 0 {
+		t.Errorf("expected nothing missing at the end of the stream, but got %q (%v)", data, ok)
+	}
+	if _, ok := b.since(7); ok {
+		t.Error("expected an offset past the stream not to be in the backlog")
+	}
+
+	// the oldest bytes are dropped once it wraps around
+	b.feed([]byte("fghijk"))
+	if _, ok := b.since(3); ok {
+		t.Error("expected offset 3 to be dropped")
+	}
+	if data, ok := b.since(4); !ok || string(data) != "defghijk" {
+		t.Errorf("expected defghijk from offset 4, but got %q (%v)", data, ok)
+	}
+	b.feed([]byte("0123456789"))
+	if data, ok := b.since(14); !ok || string(data) != "23456789" {
+		t.Errorf("expected 23456789 from offset 14, but got %q (%v)", data, ok)
+	}
+
+	b.resize(4)
+	if data, ok := b.since(18); !ok || string(data) != "6789" {
+		t.Errorf("expected 6789 from offset 18 after shrinking, but got %q (%v)", data, ok)
+	}
+	b.resize(16)
+	b.feed([]byte("xy"))
+	if data, ok := b.since(18); !ok || string(data) != "6789xy" {
+		t.Errorf("expected 6789xy from offset 18 after growing, but got %q (%v)", data, ok)
+	}
+}
+
+// connectReplica connects a replica that gets a full resynchronization, returning the replication ID
+// and offset of the snapshot
+func connectReplica(t *testing.T) (*Client, *bufio.Reader, string, int64) {
+	t.Helper()
+	replicaConn, serverConn := connPair(t)
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(replicaConn)
+	client := NewConnClient(serverConn)
+	runClientCommandCases(t, client, []commandCase{
+		{"capabilities", []string{"REPLCONF", "capa", "psync2"}, "+OK\r\n"},
+		{"psync", []string{"PSYNC", "?", "-1"}, ""},
+	})
+	line, err := r.ReadString('\n')
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("expected +FULLRESYNC <replid> <offset>, but got %q (%v)", line, err)
+	}
+	offset, _ := strconv.ParseInt(fields[2], 10, 64)
+	line, err = r.ReadString('\n')
+	size, convErr := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+	if err != nil || convErr != nil {
+		t.Fatalf("expected the RDB bulk length, but got %q (%v)", line, err)
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	return client, r, fields[1], offset
+}
+
+func TestReplicationPartialResync(t *testing.T) {
+	useTempDir(t)
+	client, r, replid, offset := connectReplica(t)
+	runCommandCases(t, []commandCase{{"set", []string{"SET", "psync:first", "v", "PXAT", "99999999999999"}, "+OK\r\n"}})
+	expectCommand(t, r, "SELECT", "0")
+	expectCommand(t, r, "SET", "psync:first", "v", "PXAT", "99999999999999")
+	offset += int64(len(appendCommand(nil, []string{"SELECT", "0"})) + len(appendCommand(nil, []string{"SET", "psync:first", "v", "PXAT", "99999999999999"})))
+
+	// acknowledgements show in ROLE and are not replied to
+	runClientCommandCases(t, client, []commandCase{{"ack", []string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}, ""}})
+	waitFor(t, "the acknowledged offset", func() bool {
+		result, _ := ExecuteRespData(respCommand("ROLE"))
+		return strings.HasSuffix(string(result), "\r\n"+strconv.FormatInt(offset, 10)+"\r\n")
+	})
+
+	// the replica goes away and misses a write, which it gets from the backlog when it comes back
+	client.Close()
+	runCommandCases(t, []commandCase{{"missed", []string{"SET", "psync:missed", "v", "PXAT", "99999999999999"}, "+OK\r\n"}})
+	replicaConn, serverConn := connPair(t)
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r = bufio.NewReader(replicaConn)
+	client = NewConnClient(serverConn)
+	defer client.Close()
+	runClientCommandCases(t, client, []commandCase{
+		{"capabilities", []string{"REPLCONF", "capa", "psync2"}, "+OK\r\n"},
+		{"psync", []string{"PSYNC", replid, strconv.FormatInt(offset+1, 10)}, ""},
+	})
+	if line, err := r.ReadString('\n'); err != nil || line != "+CONTINUE "+replid+"\r\n" {
+		t.Fatalf("expected +CONTINUE %s, but got %q (%v)", replid, line, err)
+	}
+	expectCommand(t, r, "SET", "psync:missed", "v", "PXAT", "99999999999999")
+	runCommandCases(t, []commandCase{{"after", []string{"SET", "psync:after", "v", "PXAT", "99999999999999"}, "+OK\r\n"}})
+	expectCommand(t, r, "SET", "psync:after", "v", "PXAT", "99999999999999")
+
+	// resizing keeps the end of the stream
+	runCommandCases(t, []commandCase{
+		{"backlog size", []string{"CONFIG", "SET", "repl-backlog-size", "2mb"}, "+OK\r\n"},
+		{"get backlog size", []string{"CONFIG", "GET", "repl-backlog-size"}, "*2\r\n$17\r\nrepl-backlog-size\r\n$7\r\n2097152\r\n"},
+		{"bad backlog size", []string{"CONFIG", "SET", "repl-backlog-size", "lots"},
+			"-ERR CONFIG SET failed (possibly related to argument 'repl-backlog-size') - argument must be a memory value\r\n"},
+		{"default backlog size", []string{"CONFIG", "SET", "repl-backlog-size", "1mb"}, "+OK\r\n"},
+	})
+	mu.RLock()
+	_, kept := replicationState.backlog.since(offset + 1)
+	mu.RUnlock()
+	if !kept {
+		t.Error("expected the backlog to keep the stream when resized")
+	}
+
+	// a replica with another history gets a snapshot
+	other, otherServer := connPair(t)
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	otherClient := NewConnClient(otherServer)
+	runClientCommandCases(t, otherClient, []commandCase{
+		{"psync", []string{"PSYNC", strings.Repeat("f", 40), strconv.FormatInt(offset+1, 10)}, ""},
+	})
+	if line, err := bufio.NewReader(other).ReadString('\n'); err != nil || !strings.HasPrefix(line, "+FULLRESYNC "+replid) {
+		t.Errorf("expected a full resync, but got %q (%v)", line, err)
+	}
+	otherClient.Close()
+	waitFor(t, "the snapshot to be saved", func() bool {
+		mu.RLock()
+		defer mu.RUnlock()
+		return !rdbState.bgsaveInProgress
+	})
+}
+
+// fakeMaster accepts replicas and checks their handshake, then sends a snapshot or continues their
+// stream, and streams what it reads from commands to the last one
+type fakeMaster struct {
+	listener net.Listener
+	commands chan []string
+	// psyncs has the arguments of every PSYNC, acks the offsets acknowledged and closed fires when a
+	// replica closes its connection
+	psyncs chan []string
+	acks   chan string
+	closed chan struct{}
+
+	mu sync.Mutex
+	// continueReplid makes the next PSYNC continue with this ID rather than get a snapshot, which is
+	// streamed with an EOF mark when eof is set
+	continueReplid string
+	eof            bool
+	conn           net.Conn
+}
+
+func startFakeMaster(t *testing.T, snapshot []map[string]StoreEntry, offset int64) *fakeMaster {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMaster{
+		listener: l,
+		commands: make(chan []string, 16),
+		psyncs:   make(chan []string, 4),
+		acks:     make(chan string, 16),
+		closed:   make(chan struct{}, 4),
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var rdb bytes.Buffer
+	if err := writeRDB(&rdb, snapshot, false, true, false); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			m.serve(conn, rdb.Bytes(), offset)
+		}
+	}()
+	return m
+}
+
+// serve runs the replication of one connection until the replica closes it or drop is called
+func (m *fakeMaster) serve(conn net.Conn, rdb []byte, offset int64) {
+	r := bufio.NewReader(conn)
+	for _, reply := range []string{"+PONG\r\n", "+OK\r\n", "+OK\r\n"} {
+		if _, _, err := readCommand(r); err != nil {
+			conn.Close()
+			return
+		}
+		conn.Write([]byte(reply))
+	}
+	frame, name, err := readCommand(r)
+	if err != nil || name != "PSYNC" {
+		conn.Close()
+		return
+	}
+	m.psyncs <- frameArgs(frame)
+
+	m.mu.Lock()
+	m.conn = conn
+	if m.continueReplid != "" {
+		conn.Write([]byte("+CONTINUE " + m.continueReplid + "\r\n"))
+		m.continueReplid = ""
+	} else if m.eof {
+		mark := strings.Repeat("e", eofMarkLen)
+		conn.Write([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n$EOF:%s\r\n", strings.Repeat("a", 40), offset, mark)))
+		conn.Write(append(append([]byte(nil), rdb...), mark...))
+	} else {
+		conn.Write([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n\n$%d\r\n", strings.Repeat("a", 40), offset, len(rdb))))
+		conn.Write(rdb)
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			frame, _, err := readCommand(r)
+			if err != nil {
+				break
+			}
+			if args := frameArgs(frame); len(args) >= 3 && strings.EqualFold(args[1], "ACK") {
+				m.acks <- args[2]
+			}
+		}
+		conn.Close()
+		close(done)
+		m.closed <- struct{}{}
+	}()
+	go func() {
+		for {
+			select {
+			case args, ok := <-m.commands:
+				if !ok {
+					return
+				}
+				conn.Write(appendCommand(nil, args))
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// drop closes the connection of the last replica, as if the link broke
+func (m *fakeMaster) drop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conn.Close()
+}
+
+// streamSnapshot makes the snapshots streamed with an EOF mark
+func (m *fakeMaster) streamSnapshot() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.eof = true
+}
+
+// continueNext makes the next PSYNC continue with replid
+func (m *fakeMaster) continueNext(replid string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.continueReplid = replid
+}
+
+func (m *fakeMaster) port() string {
+	return strconv.Itoa(m.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestReplicationReplica(t *testing.T) {
+	useTempDir(t)
+	snapshot := []map[string]StoreEntry{{"repl:loaded": {value: "snapshot"}}}
+	master := startFakeMaster(t, snapshot, 100)
+	defer close(master.commands)
+
+	client := NewClient()
+	runClientCommandCases(t, client, []commandCase{
+		{"before", []string{"SET", "repl:local", "v"}, "+OK\r\n"},
+		{"bad port", []string{"REPLICAOF", "127.0.0.1", "port"}, "-ERR Invalid master port\r\n"},
+		{"replicaof", []string{"REPLICAOF", "127.0.0.1", master.port()}, "+OK\r\n"},
+		{"again", []string{"REPLICAOF", "127.0.0.1", master.port()}, "+OK Already connected to specified master\r\n"},
+	})
+	defer ExecuteRespData(respCommand("REPLICAOF", "NO", "ONE"))
+
+	waitFor(t, "the snapshot to be loaded", func() bool {
+		result, _ := client.Execute(respCommand("GET", "repl:loaded"))
+		return string(result) == "$8\r\nsnapshot\r\n"
+	})
+	// the snapshot is acknowledged as soon as it is loaded
+	select {
+	case ack := <-master.acks:
+		if ack != "100" {
+			t.Errorf("expected the snapshot's offset 100 to be acknowledged, but got %s", ack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for REPLCONF ACK")
+	}
+
+	// the stream is applied as the master's client, writes from other clients are refused
+	soon := strconv.FormatInt(time.Now().Add(200*time.Millisecond).UnixMilli(), 10)
+	stream := [][]string{{"SELECT", "0"}, {"SET", "repl:streamed", "v"}, {"SET", "repl:expiring", "v", "PXAT", soon}}
+	for _, args := range stream {
+		master.commands <- args
+	}
+	waitFor(t, "the stream to be applied", func() bool {
+		result, _ := client.Execute(respCommand("GET", "repl:expiring"))
+		return string(result) == "$1\r\nv\r\n"
+	})
+	offset := 100
+	for _, args := range stream {
+		offset += len(appendCommand(nil, args))
+	}
+	runClientCommandCases(t, client, []commandCase{
+		{"dropped by the sync", []string{"GET", "repl:local"}, "$-1\r\n"},
+		{"streamed", []string{"GET", "repl:streamed"}, "$1\r\nv\r\n"},
+		{"read only", []string{"SET", "repl:local", "v"}, "-READONLY You can't write against a read only replica.\r\n"},
+		{"role", []string{"ROLE"}, fmt.Sprintf("*5\r\n$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:%s\r\n$9\r\nconnected\r\n:%d\r\n", master.port(), offset)},
+		{"writable", []string{"CONFIG", "SET", "replica-read-only", "no"}, "+OK\r\n"},
+		{"local write", []string{"SET", "repl:local", "v"}, "+OK\r\n"},
+		{"read only again", []string{"CONFIG", "SET", "replica-read-only", "yes"}, "+OK\r\n"},
+	})
+
+	// an expired key looks missing but stays until the master deletes it
+	time.Sleep(250 * time.Millisecond)
+	runClientCommandCases(t, client, []commandCase{{"expired", []string{"GET", "repl:expiring"}, "$-1\r\n"}})
+	mu.RLock()
+	_, kept := databases[0].entries["repl:expiring"]
+	mu.RUnlock()
+	if !kept {
+		t.Error("expected the replica to keep the expired key until the master deletes it")
+	}
+	master.commands <- []string{"DEL", "repl:expiring"}
+	offset += len(appendCommand(nil, []string{"DEL", "repl:expiring"}))
+	waitFor(t, "the master's deletion", func() bool {
+		mu.RLock()
+		defer mu.RUnlock()
+		_, exists := databases[0].entries["repl:expiring"]
+		return !exists
+	})
+
+	// GETACK is answered with the offset before it, on the stream connection
+	getack := []string{"REPLCONF", "GETACK", "*"}
+	master.commands <- getack
+	select {
+	case ack := <-master.acks:
+		if ack != strconv.Itoa(offset) {
+			t.Errorf("expected the acknowledged offset to be %d, but got %s", offset, ack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for REPLCONF ACK")
+	}
+	offset += len(appendCommand(nil, getack))
+
+	// a broken link continues with the database selected and without the transaction it cut
+	stream = [][]string{{"SELECT", "1"}, {"SET", "repl:db1", "v"}}
+	for _, args := range stream {
+		master.commands <- args
+		offset += len(appendCommand(nil, args))
+	}
+	master.commands <- []string{"MULTI"}
+	master.commands <- []string{"SET", "repl:cut", "v"}
+	waitFor(t, "the transaction to start", func() bool {
+		mu.RLock()
+		defer mu.RUnlock()
+		link := replicationState.link
+		return link != nil && link.client != nil && link.client.multi != nil && len(link.client.multi.commands) == 1
+	})
+	<-master.psyncs
+	master.continueNext(strings.Repeat("b", 40))
+	master.drop()
+	<-master.closed
+	waitFor(t, "the link to be lost", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if replicationState.linkState != replConnect {
+			return false
+		}
+		replicationCron()
+		return true
+	})
+	select {
+	case args := <-master.psyncs:
+		if expected := []string{"PSYNC", strings.Repeat("a", 40), strconv.Itoa(offset + 1)}; fmt.Sprint(args) != fmt.Sprint(expected) {
+			t.Errorf("expected %v, but got %v", expected, args)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for PSYNC")
+	}
+	master.commands <- []string{"SET", "repl:continued", "v"}
+	offset += len(appendCommand(nil, []string{"SET", "repl:continued", "v"}))
+	waitFor(t, "the continued stream", func() bool {
+		mu.RLock()
+		defer mu.RUnlock()
+		_, exists := databases[1].entries["repl:continued"]
+		return exists
+	})
+	mu.RLock()
+	_, cut := databases[1].entries["repl:cut"]
+	replid, replid2, secondOffset := replicationState.replid, replicationState.replid2, replicationState.secondReplidOffset
+	mu.RUnlock()
+	if cut {
+		t.Error("expected the cut transaction not to be applied")
+	}
+	if replid != strings.Repeat("b", 40) || replid2 != strings.Repeat("a", 40) || secondOffset != int64(offset-len(appendCommand(nil, []string{"SET", "repl:continued", "v"}))+1) {
+		t.Errorf("expected the new replication ID with the previous one as secondary, but got %s, %s up to %d", replid, replid2, secondOffset)
+	}
+
+	// turning back into a master drops the link and accepts writes
+	runClientCommandCases(t, client, []commandCase{
+		{"no one", []string{"REPLICAOF", "NO", "ONE"}, "+OK\r\n"},
+		{"role", []string{"ROLE"}, "*3\r\n$6\r\nmaster\r\n:" + strconv.Itoa(offset) + "\r\n*0\r\n"},
+		{"writes", []string{"SET", "repl:local", "v"}, "+OK\r\n"},
+	})
+	select {
+	case <-master.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the link to the master to be closed")
+	}
+}
+
+// setConfig changes a parameter for the duration of the test
+func setConfig(t *testing.T, name, value string) {
+	t.Helper()
+	old, _ := ExecuteRespData(respCommand("CONFIG", "GET", name))
+	previous := strings.Split(string(old), "\r\n")[4]
+	runCommandCases(t, []commandCase{{"set " + name, []string{"CONFIG", "SET", name, value}, "+OK\r\n"}})
+	t.Cleanup(func() { ExecuteRespData(respCommand("CONFIG", "SET", name, previous)) })
+}
+
+func TestReplicationDisklessSync(t *testing.T) {
+	useTempDir(t)
+	setConfig(t, "repl-diskless-sync", "yes")
+	runCommandCases(t, []commandCase{{"set", []string{"SET", "diskless:before", "v", "PXAT", "99999999999999"}, "+OK\r\n"}})
+
+	replicaConn, serverConn := connPair(t)
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(replicaConn)
+	client := NewConnClient(serverConn)
+	defer client.Close()
+	runClientCommandCases(t, client, []commandCase{
+		{"capabilities", []string{"REPLCONF", "capa", "eof", "capa", "psync2"}, "+OK\r\n"},
+		{"psync", []string{"PSYNC", "?", "-1"}, ""},
+	})
+
+	// the transfer waits for other replicas to join
+	mu.Lock()
+	replicationCron()
+	started := rdbState.bgsaveInProgress
+	mu.Unlock()
+	if started {
+		t.Fatal("expected the transfer to wait for repl-diskless-sync-delay")
+	}
+	setConfig(t, "repl-diskless-sync-delay", "0")
+	mu.Lock()
+	replicationCron()
+	mu.Unlock()
+
+	// the replica was kept alive with newlines while it waited
+	line, err := r.ReadString('\n')
+	for err == nil && line == "\n" {
+		line, err = r.ReadString('\n')
+	}
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("expected +FULLRESYNC <replid> <offset>, but got %q (%v)", line, err)
+	}
+	line, err = r.ReadString('\n')
+	mark, found := strings.CutPrefix(strings.TrimSuffix(line, "\r\n"), "$EOF:")
+	if err != nil || !found || len(mark) != eofMarkLen {
+		t.Fatalf("expected $EOF:<mark>, but got %q (%v)", line, err)
+	}
+	payload := &eofReader{r: r, mark: []byte(mark)}
+	dbs, err := readRDB(payload, true)
+	if err != nil {
+		t.Fatalf("reading the streamed RDB: %v", err)
+	}
+	if rest, err := io.ReadAll(payload); err != nil || len(rest) != 0 {
+		t.Fatalf("expected the snapshot to end with the mark, but got %q after it (%v)", rest, err)
+	}
+	if dbs[0]["diskless:before"].value != "v" {
+		t.Error("expected the snapshot to hold the key set before the sync")
+	}
+
+	// the stream starts with the first acknowledgement
+	runCommandCases(t, []commandCase{{"set", []string{"SET", "diskless:after", "v", "PXAT", "99999999999999"}, "+OK\r\n"}})
+	replicaConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := r.Peek(1); err == nil {
+		t.Fatal("expected nothing to be streamed before the replica acknowledges the snapshot")
+	}
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	runClientCommandCases(t, client, []commandCase{{"ack", []string{"REPLCONF", "ACK", fields[2]}, ""}})
+	expectCommand(t, r, "SELECT", "0")
+	expectCommand(t, r, "SET", "diskless:after", "v", "PXAT", "99999999999999")
+}
+
+func TestReplicationDisklessLoad(t *testing.T) {
+	useTempDir(t)
+	setConfig(t, "repl-diskless-load", "swapdb")
+	snapshot := []map[string]StoreEntry{{"diskless:loaded": {value: "snapshot"}}}
+	master := startFakeMaster(t, snapshot, 10)
+	master.streamSnapshot()
+	defer close(master.commands)
+
+	client := NewClient()
+	runClientCommandCases(t, client, []commandCase{
+		{"before", []string{"SET", "diskless:local", "v"}, "+OK\r\n"},
+		{"replicaof", []string{"REPLICAOF", "127.0.0.1", master.port()}, "+OK\r\n"},
+	})
+	defer ExecuteRespData(respCommand("REPLICAOF", "NO", "ONE"))
+
+	select {
+	case ack := <-master.acks:
+		if ack != "10" {
+			t.Errorf("expected the snapshot's offset 10 to be acknowledged, but got %s", ack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for REPLCONF ACK")
+	}
+	master.commands <- []string{"SET", "diskless:streamed", "v"}
+	waitFor(t, "the stream to be applied", func() bool {
+		result, _ := client.Execute(respCommand("GET", "diskless:streamed"))
+		return string(result) == "$1\r\nv\r\n"
+	})
+	runClientCommandCases(t, client, []commandCase{
+		{"loaded", []string{"GET", "diskless:loaded"}, "$8\r\nsnapshot\r\n"},
+		{"swapped out", []string{"GET", "diskless:local"}, "$-1\r\n"},
+	})
+	mu.RLock()
+	dir := config.dir
+	mu.RUnlock()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the snapshot to be loaded without files, but found %v", entries)
+	}
+}
@@ -8,49 +8,164 @@ import (
 	"time"
 )
 
+// StoreEntry holds a key's value, which is a string or one of the richer types such as *stream.
+// A zero expiration means the key never expires.
 type StoreEntry struct {
-	value      string
+	value      any
 	expiration time.Time
 }
 
-var store = make(map[string]StoreEntry)
+func (e StoreEntry) expired(now time.Time) bool {
+	return !e.expiration.IsZero() && now.After(e.expiration)
+}
+
+const wrongTypeErr = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+// store is the keyspace of the selected database, see selectDB
+var store = databases[0].entries
 var mu sync.RWMutex
 
-var commands = map[string]func(...BulkString) ([]byte, error){
-	"ECHO": handleEcho,
-	"PING": handlePing,
-	"SET":  handleSet,
-	"GET":  handleGet,
+// commands maps a command name to its handler and arity. A positive arity is the exact number of
+// arguments including the command name, a negative one the minimum. The flags, categories and key specs
+// drive the ACL checks.
+var commands = map[string]command{
+	"ECHO": {handler: handleEcho, arity: 2, flags: cmdFast, categories: aclConnection},
+	"PING": {clientHandler: handlePing, arity: -1, flags: cmdFast, categories: aclConnection},
+	"SET":  {handler: handleSet, arity: -3, flags: cmdWrite, categories: aclString, keys: []keySpec{keyAt(1, keyRead|keyWrite)}},
+	"GET":  {handler: handleGet, arity: 2, flags: cmdReadOnly | cmdFast, categories: aclString, keys: []keySpec{keyAt(1, keyRead)}},
+	"DEL":  {handler: handleDel, arity: -2, flags: cmdWrite, categories: aclKeyspace, keys: []keySpec{keysFrom(1, 1, keyWrite)}},
+
+	"SELECT":   {clientHandler: handleSelect, arity: 2, flags: cmdFast, categories: aclConnection},
+	"SWAPDB":   {handler: handleSwapDB, arity: 3, flags: cmdWrite | cmdFast, categories: aclKeyspace | aclDangerous},
+	"FLUSHDB":  {handler: handleFlushDB, arity: -1, flags: cmdWrite, categories: aclKeyspace | aclDangerous},
+	"FLUSHALL": {handler: handleFlushAll, arity: -1, flags: cmdWrite, categories: aclKeyspace | aclDangerous},
+	"DBSIZE":   {handler: handleDBSize, arity: 1, flags: cmdReadOnly | cmdFast, categories: aclKeyspace},
+
+	"MULTI":   {clientHandler: handleMulti, arity: 1, flags: cmdFast, categories: aclTransaction},
+	"EXEC":    {clientHandler: handleExec, arity: 1, categories: aclTransaction},
+	"DISCARD": {clientHandler: handleDiscard, arity: 1, flags: cmdFast, categories: aclTransaction},
+	"WATCH":   {clientHandler: handleWatch, arity: -2, flags: cmdFast, categories: aclTransaction, keys: []keySpec{keysFrom(1, 1, 0)}},
+	"UNWATCH": {clientHandler: handleUnwatch, arity: 1, flags: cmdFast, categories: aclTransaction},
+
+	"XADD":      {handler: handleXAdd, arity: -5, flags: cmdWrite | cmdFast, categories: aclStream, keys: []keySpec{keyAt(1, keyWrite)}},
+	"XRANGE":    {handler: handleXRange, arity: -4, flags: cmdReadOnly, categories: aclStream, keys: []keySpec{keyAt(1, keyRead)}},
+	"XREVRANGE": {handler: handleXRevRange, arity: -4, flags: cmdReadOnly, categories: aclStream, keys: []keySpec{keyAt(1, keyRead)}},
+	"XLEN":      {handler: handleXLen, arity: 2, flags: cmdReadOnly | cmdFast, categories: aclStream, keys: []keySpec{keyAt(1, 0)}},
+	"XDEL":      {handler: handleXDel, arity: -3, flags: cmdWrite | cmdFast, categories: aclStream, keys: []keySpec{keyAt(1, keyWrite)}},
+	"XTRIM":     {handler: handleXTrim, arity: -4, flags: cmdWrite, categories: aclStream, keys: []keySpec{keyAt(1, keyWrite)}},
+	"XSETID":    {handler: handleXSetID, arity: -3, flags: cmdWrite | cmdFast, categories: aclStream, keys: []keySpec{keyAt(1, keyWrite)}},
+
+	"XREAD":      {handler: handleXRead, arity: -4, flags: cmdReadOnly | cmdBlocking, categories: aclStream, keys: []keySpec{streamsKeys(keyRead)}},
+	"XREADGROUP": {handler: handleXReadGroup, arity: -7, flags: cmdWrite | cmdBlocking, categories: aclStream, keys: []keySpec{streamsKeys(keyRead | keyWrite)}},
+	"XGROUP":     {handler: handleXGroup, arity: -2, flags: cmdWrite, categories: aclStream, keys: []keySpec{keyAt(2, keyWrite)}},
+	"XACK":       {handler: handleXAck, arity: -4, flags: cmdWrite | cmdFast, categories: aclStream, keys: []keySpec{keyAt(1, keyWrite)}},
+	"XPENDING":   {handler: handleXPending, arity: -3, flags: cmdReadOnly, categories: aclStream, keys: []keySpec{keyAt(1, keyRead)}},
+	"XCLAIM":     {handler: handleXClaim, arity: -6, flags: cmdWrite | cmdFast, categories: aclStream, keys: []keySpec{keyAt(1, keyRead|keyWrite)}},
+	"XAUTOCLAIM": {handler: handleXAutoClaim, arity: -6, flags: cmdWrite | cmdFast, categories: aclStream, keys: []keySpec{keyAt(1, keyRead|keyWrite)}},
+	"XINFO":      {handler: handleXInfo, arity: -2, flags: cmdReadOnly, categories: aclStream, keys: []keySpec{keyAt(2, keyRead)}},
+
+	"SETBIT":      {handler: handleSetBit, arity: 4, flags: cmdWrite, categories: aclBitmap, keys: []keySpec{keyAt(1, keyRead|keyWrite)}},
+	"GETBIT":      {handler: handleGetBit, arity: 3, flags: cmdReadOnly | cmdFast, categories: aclBitmap, keys: []keySpec{keyAt(1, keyRead)}},
+	"BITCOUNT":    {handler: handleBitCount, arity: -2, flags: cmdReadOnly, categories: aclBitmap, keys: []keySpec{keyAt(1, keyRead)}},
+	"BITPOS":      {handler: handleBitPos, arity: -3, flags: cmdReadOnly, categories: aclBitmap, keys: []keySpec{keyAt(1, keyRead)}},
+	"BITOP":       {handler: handleBitOp, arity: -4, flags: cmdWrite, categories: aclBitmap, keys: []keySpec{keyAt(2, keyWrite), keysFrom(3, 1, keyRead)}},
+	"BITFIELD":    {handler: handleBitField, arity: -2, flags: cmdWrite, categories: aclBitmap, keys: []keySpec{keyAt(1, keyRead|keyWrite)}},
+	"BITFIELD_RO": {handler: handleBitFieldRO, arity: -2, flags: cmdReadOnly | cmdFast, categories: aclBitmap, keys: []keySpec{keyAt(1, keyRead)}},
+
+	"PFADD":      {handler: handlePFAdd, arity: -2, flags: cmdWrite | cmdFast, categories: aclHyperLogLog, keys: []keySpec{keyAt(1, keyWrite)}},
+	"PFCOUNT":    {handler: handlePFCount, arity: -2, flags: cmdReadOnly, categories: aclHyperLogLog, keys: []keySpec{keysFrom(1, 1, keyRead)}},
+	"PFMERGE":    {handler: handlePFMerge, arity: -2, flags: cmdWrite, categories: aclHyperLogLog, keys: []keySpec{keyAt(1, keyRead|keyWrite), keysFrom(2, 1, keyRead)}},
+	"PFDEBUG":    {handler: handlePFDebug, arity: -3, flags: cmdWrite | cmdAdmin, categories: aclHyperLogLog, keys: []keySpec{keyAt(2, keyRead)}},
+	"PFSELFTEST": {handler: handlePFSelfTest, arity: 1, flags: cmdAdmin, categories: aclHyperLogLog},
+
+	"GEOADD":               {handler: handleGeoAdd, arity: -5, flags: cmdWrite, categories: aclGeo, keys: []keySpec{keyAt(1, keyWrite)}},
+	"GEODIST":              {handler: handleGeoDist, arity: -4, flags: cmdReadOnly, categories: aclGeo, keys: []keySpec{keyAt(1, keyRead)}},
+	"GEOHASH":              {handler: handleGeoHash, arity: -2, flags: cmdReadOnly, categories: aclGeo, keys: []keySpec{keyAt(1, keyRead)}},
+	"GEOPOS":               {handler: handleGeoPos, arity: -2, flags: cmdReadOnly, categories: aclGeo, keys: []keySpec{keyAt(1, keyRead)}},
+	"GEOSEARCH":            {handler: handleGeoSearch, arity: -7, flags: cmdReadOnly, categories: aclGeo, keys: []keySpec{keyAt(1, keyRead)}},
+	"GEOSEARCHSTORE":       {handler: handleGeoSearchStore, arity: -8, flags: cmdWrite, categories: aclGeo, keys: []keySpec{keyAt(1, keyWrite), keyAt(2, keyRead)}},
+	"GEORADIUS":            {handler: handleGeoRadius, arity: -6, flags: cmdWrite, categories: aclGeo, keys: []keySpec{keyAt(1, keyRead), keyAfter("STORE", 6, keyWrite), keyAfter("STOREDIST", 6, keyWrite)}},
+	"GEORADIUS_RO":         {handler: handleGeoRadiusRO, arity: -6, flags: cmdReadOnly, categories: aclGeo, keys: []keySpec{keyAt(1, keyRead)}},
+	"GEORADIUSBYMEMBER":    {handler: handleGeoRadiusByMember, arity: -5, flags: cmdWrite, categories: aclGeo, keys: []keySpec{keyAt(1, keyRead), keyAfter("STORE", 5, keyWrite), keyAfter("STOREDIST", 5, keyWrite)}},
+	"GEORADIUSBYMEMBER_RO": {handler: handleGeoRadiusByMemberRO, arity: -5, flags: cmdReadOnly, categories: aclGeo, keys: []keySpec{keyAt(1, keyRead)}},
+
+	"SAVE":     {handler: handleSave, arity: 1, flags: cmdAdmin},
+	"BGSAVE":   {handler: handleBgsave, arity: -1, flags: cmdAdmin},
+	"LASTSAVE": {handler: handleLastSave, arity: 1, flags: cmdAdmin | cmdFast},
+	"CONFIG":   {clientHandler: handleConfig, arity: -2, flags: cmdAdmin},
+
+	"BGREWRITEAOF": {handler: handleBgrewriteAOF, arity: 1, flags: cmdAdmin},
+	"SHUTDOWN":     {handler: handleShutdown, arity: -1, flags: cmdAdmin},
+	"DEBUG":        {handler: handleDebug, arity: -2, flags: cmdAdmin},
+
+	"DUMP":    {handler: handleDump, arity: 2, flags: cmdReadOnly, categories: aclKeyspace, keys: []keySpec{keyAt(1, keyRead)}},
+	"RESTORE": {handler: handleRestore, arity: -4, flags: cmdWrite, categories: aclKeyspace | aclDangerous, keys: []keySpec{keyAt(1, keyWrite)}},
+
+	"REPLCONF": {clientHandler: handleReplconf, arity: -1, flags: cmdAdmin},
+	"PSYNC":    {clientHandler: handlePsync, arity: -3, flags: cmdAdmin},
+	"SYNC":     {clientHandler: handleSync, arity: 1, flags: cmdAdmin},
+	"ROLE":     {handler: handleRole, arity: 1, flags: cmdAdmin | cmdFast},
+	"WAIT":     {clientHandler: handleWait, arity: 3, flags: cmdBlocking, categories: aclConnection},
+	"WAITAOF":  {clientHandler: handleWaitAOF, arity: 4, flags: cmdBlocking, categories: aclConnection},
+
+	"SUBSCRIBE":    {clientHandler: handleSubscribe, arity: -2, flags: cmdPubSub},
+	"UNSUBSCRIBE":  {clientHandler: handleUnsubscribe, arity: -1, flags: cmdPubSub},
+	"PSUBSCRIBE":   {clientHandler: handlePSubscribe, arity: -2, flags: cmdPubSub},
+	"PUNSUBSCRIBE": {clientHandler: handlePUnsubscribe, arity: -1, flags: cmdPubSub},
+	"PUBLISH":      {handler: handlePublish, arity: 3, flags: cmdPubSub | cmdFast},
+	"PUBSUB":       {handler: handlePubSub, arity: -2, flags: cmdPubSub},
+	"SSUBSCRIBE":   {clientHandler: handleSSubscribe, arity: -2, flags: cmdPubSub, keys: []keySpec{keysFrom(1, 1, keyNotKey)}},
+	"SUNSUBSCRIBE": {clientHandler: handleSUnsubscribe, arity: -1, flags: cmdPubSub, keys: []keySpec{keysFrom(1, 1, keyNotKey)}},
+	"SPUBLISH":     {handler: handleSPublish, arity: 3, flags: cmdPubSub | cmdFast, keys: []keySpec{keyAt(1, keyNotKey)}},
+
+	"HELLO":  {clientHandler: handleHello, arity: -1, flags: cmdFast, categories: aclConnection},
+	"CLIENT": {clientHandler: handleClient, arity: -2, categories: aclConnection},
+	"RESET":  {clientHandler: handleReset, arity: 1, flags: cmdFast, categories: aclConnection},
+	"AUTH":   {clientHandler: handleAuth, arity: -2, flags: cmdFast, categories: aclConnection},
+	"QUIT":   {clientHandler: handleQuit, arity: -1, flags: cmdFast, categories: aclConnection},
+
+	"CLUSTER": {clientHandler: handleCluster, arity: -2},
+	"ASKING":  {clientHandler: handleAsking, arity: 1, flags: cmdFast, categories: aclConnection},
+
+	"ACL": {clientHandler: handleACL, arity: -2, flags: cmdAdmin, subcommands: aclSubcommands},
 }
 
 func StartCleanupRoutine() {
 	ticker := time.NewTicker(1 * time.Second)
 	for range ticker.C {
-		var keysToDelete []string
+		keysToDelete := make(map[*database][]string)
 
 		mu.RLock()
+		// replicas wait for the deletions of their master
+		if replicationState.masterHost != "" {
+			mu.RUnlock()
+			continue
+		}
 		now := time.Now()
-		for key, entry := range store {
-			if now.After(entry.expiration) {
-				keysToDelete = append(keysToDelete, key)
+		for _, db := range databases {
+			for key, entry := range db.entries {
+				if entry.expired(now) {
+					keysToDelete[db] = append(keysToDelete[db], key)
+				}
 			}
 		}
 		mu.RUnlock()
 
 		if len(keysToDelete) > 0 {
 			mu.Lock()
-			for _, key := range keysToDelete {
-				if entry, exists := store[key]; exists && now.After(entry.expiration) {
-					delete(store, key)
+			for db, keys := range keysToDelete {
+				for _, key := range keys {
+					expireIfNeeded(db, key)
 				}
 			}
+			flushAppendOnlyFile()
 			mu.Unlock()
 		}
 	}
 }
 
-// handleSet sets the value of the key in a map with an optional expiration time in milliseconds and returns OK
-// if no time is provided the key will expire in 24 hours
+// handleSet sets the value of the key in a map with an optional expiration time in milliseconds, relative (PX)
+// or as a unix time (PXAT), and returns OK. If no time is provided the key will expire in 24 hours
 func handleSet(params ...BulkString) ([]byte, error) {
 	len := len(params)
 	if len < 3 {
@@ -61,27 +176,34 @@ func handleSet(params ...BulkString) ([]byte, error) {
 	key := params[1]
 	value := params[2]
 
+	expiration := time.Now().Add(24 * time.Hour)
+	expireGiven := false
 	if len > 3 {
-		flagOne := *params[3].Value
-		if strings.ToUpper(flagOne) == "PX" && len > 4 {
+		flagOne := strings.ToUpper(*params[3].Value)
+		if (flagOne == "PX" || flagOne == "PXAT") && len > 4 {
 			// check if the value is an integer because PX expects time in milliseconds
 			pxValue, err := strconv.Atoi(*params[4].Value)
 			if err != nil {
 				return []byte(""), fmt.Errorf("invalid argument for SET")
 			}
 
-			mu.Lock()
-			store[*key.Value] = StoreEntry{value: *value.Value, expiration: time.Now().Add(time.Duration(pxValue) * time.Millisecond)}
-
-			mu.Unlock()
-			return []byte("+OK\r\n"), nil
+			if flagOne == "PX" {
+				expiration = time.Now().Add(time.Duration(pxValue) * time.Millisecond)
+			} else {
+				expiration = time.UnixMilli(int64(pxValue))
+			}
+			expireGiven = true
 		}
 
 	}
 
-	mu.Lock()
-	store[*key.Value] = StoreEntry{value: *value.Value, expiration: time.Now().Add(24 * time.Hour)}
-	mu.Unlock()
+	setKey(*key.Value, StoreEntry{value: *value.Value, expiration: expiration})
+	notifyKeyspaceEvent(notifyString, "set", *key.Value, currentDB.id)
+	if expireGiven {
+		notifyKeyspaceEvent(notifyGeneric, "expire", *key.Value, currentDB.id)
+	}
+	// the expiration is relative to now, which is a different time when the log is replayed
+	rewriteCommand("SET", *key.Value, *value.Value, "PXAT", strconv.FormatInt(expiration.UnixMilli(), 10))
 	return []byte("+OK\r\n"), nil
 }
 
@@ -89,36 +211,35 @@ func handleSet(params ...BulkString) ([]byte, error) {
 func handleGet(args ...BulkString) ([]byte, error) {
 	key := *args[1].Value
 
-	// Step 1: Acquire read lock to check the existence and expiration of the key
-	mu.RLock()
-	storeEntry, exists := store[key]
-	mu.RUnlock() // Release read lock as we may need to acquire a write lock
-
-	// Step 2: Handle key existence and expiration
-	if exists {
-		// If the entry has expired, we need to delete it
-		if time.Now().After(storeEntry.expiration) {
-			// Step 3: Acquire write lock to delete the expired key
-			mu.Lock()
-			// Double-check the condition to ensure it hasn't been modified
-			if storeEntry, exists := store[key]; exists && time.Now().After(storeEntry.expiration) {
-				delete(store, key)
-				mu.Unlock() // Release write lock after deletion
-				return []byte("$-1\r\n"), nil
-			}
-			mu.Unlock() // Release write lock if no deletion occurred
-		} else {
-			// Key is valid, return its value
-			return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(storeEntry.value), storeEntry.value)), nil
-		}
+	// an expired entry is deleted by the lookup
+	storeEntry, exists := lookupEntry(key)
+	if !exists {
+		return []byte("$-1\r\n"), nil
 	}
 
-	// Key does not exist or has been deleted, return null bulk string
-	return []byte("$-1\r\n"), nil
+	value, ok := storeEntry.value.(string)
+	if !ok {
+		return errorReply(wrongTypeErr)
+	}
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)), nil
 }
 
-// handlePing returns PONG
-func handlePing(args ...BulkString) ([]byte, error) {
+// handlePing returns PONG, or its argument. A RESP2 client with subscriptions gets a pong message
+// instead, like the messages of its channels.
+func handlePing(c *Client, args ...BulkString) ([]byte, error) {
+	if len(args) > 2 {
+		return wrongArgsReply("PING")
+	}
+	if c.resp == 2 && c.subscribed() {
+		payload := bulkString("")
+		if len(args) == 2 {
+			payload = args[1]
+		}
+		return c.pubsubFrame(bulkString("pong"), payload), nil
+	}
+	if len(args) == 2 {
+		return args[1].serialize()
+	}
 	return []byte("+PONG\r\n"), nil
 }
 
@@ -131,59 +252,36 @@ func handleEcho(args ...BulkString) ([]byte, error) {
 	return args[1].serialize()
 }
 
-// parses the RESP data checks for commands and returns serialized response string and error if any
-func ExecuteRespData(data []byte) ([]byte, error) {
-	respData, _, err := ParseByteDataToResp(data)
-	if err != nil {
-		return []byte(""), err
-	}
-
-	val, ok := respData.(Array)
-	if !ok {
-		return []byte(""), fmt.Errorf("invalid command")
-	}
-
-	// TODO : see if we can use more than 2 elements
-	if len(*val.Elements) < 1 {
-		return []byte(""), fmt.Errorf("invalid command")
-	}
-
-	cmd, ok := (*val.Elements)[0].(BulkString)
-
-	if !ok {
-		return []byte(""), fmt.Errorf("invalid command")
-	}
-
-	cmdStr := strings.ToUpper(*cmd.Value)
-
-	commandFunc, ok := commands[cmdStr]
-
-	if !ok {
-		return []byte(""), fmt.Errorf("invalid command")
-	}
-
-	if len(*val.Elements) < 2 {
-		return commandFunc()
-	}
-
-	args := make([]BulkString, len(*val.Elements))
+// errorReply serializes msg as a RESP simple error so the client sees it instead of the connection closing
+func errorReply(msg string) ([]byte, error) {
+	return SerializeSimpleError(SimpleError{Message: msg})
+}
 
-	for i, elem := range *val.Elements {
-		arg, ok := elem.(BulkString)
+// wrongArgsReply is the standard arity error for the named command
+func wrongArgsReply(name string) ([]byte, error) {
+	return errorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
 
-		if !ok {
-			return []byte(""), fmt.Errorf("invalid command")
-		}
+func bulkString(s string) BulkString {
+	return BulkString{Value: &s}
+}
 
-		args[i] = arg
+// lookupEntry returns the live entry stored at key, deleting it first when it has expired.
+// A miss of a read only command is a keymiss event. The caller must hold mu.
+func lookupEntry(key string) (StoreEntry, bool) {
+	var entry StoreEntry
+	exists := false
+	if !expireIfNeeded(currentDB, key) {
+		entry, exists = store[key]
 	}
-
-	// arg, ok := (*val.Elements)[1].(BulkString)
-
-	if !ok {
-		return []byte(""), fmt.Errorf("invalid command")
+	if !exists && currentCommandFlags&cmdWrite == 0 {
+		notifyKeyspaceEvent(notifyKeyMiss, "keymiss", key, currentDB.id)
 	}
+	trackKeyRead(key)
+	return entry, exists
+}
 
-	return commandFunc(args...)
-
+// ExecuteRespData runs a single command on behalf of a client without connection state
+func ExecuteRespData(data []byte) ([]byte, error) {
+	return NewClient().Execute(data)
 }
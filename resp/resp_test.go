@@ -35,3 +35,39 @@ func TestExecuteRespData(t *testing.T) {
 		})
 	}
 }
+
+// respCommand encodes args as the RESP array a client sends for a command
+func respCommand(args ...string) []byte {
+	elements := make([]RESPData, len(args))
+	for i, arg := range args {
+		elements[i] = BulkString{Value: stringPtr(arg)}
+	}
+	data, _ := SerializeArray(Array{Elements: &elements})
+	return data
+}
+
+// commandCase is one step of a scripted session against a client
+type commandCase struct {
+	name     string
+	args     []string
+	expected string
+}
+
+// runCommandCases runs the steps in order as a single client
+func runCommandCases(t *testing.T, tests []commandCase) {
+	t.Helper()
+	runClientCommandCases(t, NewClient(), tests)
+}
+
+func runClientCommandCases(t *testing.T, client *Client, tests []commandCase) {
+	t.Helper()
+	for _, test := range tests {
+		result, err := client.Execute(respCommand(test.args...))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if string(result) != test.expected {
+			t.Errorf("%s: expected %q, but got %q", test.name, test.expected, string(result))
+		}
+	}
+}
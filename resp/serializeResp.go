@@ -16,6 +16,10 @@ func SerializeRESPDataToBytes(data RESPData) ([]byte, error) {
 		return SerializeBulkString(v)
 	case Array:
 		return SerializeArray(v)
+	case Push:
+		return SerializePush(v)
+	case Map:
+		return SerializeMap(v)
 	default:
 		return nil, fmt.Errorf("unknown RESP type")
 	}
@@ -58,4 +62,26 @@ func SerializeArray(a Array) ([]byte, error) {
     }
     fmt.Println("result is ", string(result))
     return result, nil
-}
\ No newline at end of file
+}
+
+// SerializePush writes the elements of a push message after its '>' header
+func SerializePush(p Push) ([]byte, error) {
+	return serializeAggregate('>', len(*p.Elements), *p.Elements)
+}
+
+// SerializeMap writes the key and value pairs of a map after its '%' header
+func SerializeMap(m Map) ([]byte, error) {
+	return serializeAggregate('%', len(*m.Elements)/2, *m.Elements)
+}
+
+func serializeAggregate(prefix byte, n int, elements []RESPData) ([]byte, error) {
+	result := []byte(fmt.Sprintf("%c%d\r\n", prefix, n))
+	for _, elem := range elements {
+		b, err := SerializeRESPDataToBytes(elem)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, b...)
+	}
+	return result, nil
+}
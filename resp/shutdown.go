@@ -0,0 +1,366 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownFlags are the options of SHUTDOWN, which the signals get from shutdown-on-sigint and shutdown-on-sigterm
+type shutdownFlags int
+
+const (
+	shutdownNoSave shutdownFlags = 1 << iota
+	shutdownSave
+	shutdownNow
+	shutdownForce
+)
+
+var shutdownFlagNames = []struct {
+	name string
+	flag shutdownFlags
+}{
+	{"save", shutdownSave},
+	{"nosave", shutdownNoSave},
+	{"now", shutdownNow},
+	{"force", shutdownForce},
+}
+
+var (
+	errShutdownFailed     = errors.New("ERR Errors trying to SHUTDOWN. Check logs.")
+	errNoShutdown         = errors.New("ERR No shutdown in progress.")
+	errShutdownAborted    = errors.New("shutdown aborted")
+	errShutdownInProgress = errors.New("shutdown already in progress")
+)
+
+// exit ends the process once the server is ready to, replaced in tests
+var exit = os.Exit
+
+// lifecycle counts the commands being executed so a shutdown can let them finish before saving.
+// It has its own lock since commands wait on it before taking mu.
+var lifecycle = struct {
+	sync.Mutex
+	cond *sync.Cond
+	// executing is the number of commands past the shutdown gate, not counting blocked clients
+	executing    int
+	shuttingDown bool
+	aborted      bool
+}{}
+
+func init() {
+	lifecycle.cond = sync.NewCond(&lifecycle.Mutex)
+}
+
+// beginCommand waits while a shutdown is in progress, then counts the command as executing
+func beginCommand() {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	for lifecycle.shuttingDown {
+		lifecycle.cond.Wait()
+	}
+	lifecycle.executing++
+}
+
+// resumeCommand counts a command as executing again after it waited without the lock, even during a
+// shutdown since it already started
+func resumeCommand() {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	lifecycle.executing++
+}
+
+func endCommand() {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	lifecycle.executing--
+	lifecycle.cond.Broadcast()
+}
+
+// shutdownInProgress reports whether the server is shutting down
+func shutdownInProgress() bool {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	return lifecycle.shuttingDown
+}
+
+// shutdown stops accepting connections and serving commands, waits for the running ones and the background saves, then for the
+// replicas to catch up unless NOW is given, syncs the AOF, writes a final RDB file when save points are
+// configured or SAVE is given, and exits, with 1 when FORCE overrode an error.
+// It returns when the shutdown failed or was aborted, commands being served again.
+// The caller must not hold mu.
+func shutdown(flags shutdownFlags) error {
+	lifecycle.Lock()
+	if lifecycle.shuttingDown {
+		lifecycle.Unlock()
+		return errShutdownInProgress
+	}
+	lifecycle.shuttingDown = true
+	lifecycle.aborted = false
+	lifecycle.Unlock()
+	stopListening()
+	defer resumeAfterShutdown()
+
+	// the commands that were already running complete, the ones that come next wait in beginCommand
+	for {
+		lifecycle.Lock()
+		for lifecycle.executing > 0 && !lifecycle.aborted {
+			lifecycle.cond.Wait()
+		}
+		aborted := lifecycle.aborted
+		lifecycle.Unlock()
+		if aborted {
+			fmt.Println("Shutdown manually aborted.")
+			return errShutdownAborted
+		}
+
+		mu.Lock()
+		if !rdbState.bgsaveInProgress && !aofState.rewriteInProgress {
+			break
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer mu.Unlock()
+
+	if flags&shutdownNow == 0 && config.shutdownTimeout > 0 {
+		if err := waitForReplicasOnShutdown(time.Duration(config.shutdownTimeout) * time.Second); err != nil {
+			return err
+		}
+	}
+
+	code := 0
+	if err := prepareForShutdown(flags); err != nil {
+		if flags&shutdownForce == 0 {
+			fmt.Println("Errors trying to shut down the server. Check the logs for more information.")
+			return err
+		}
+		fmt.Println("Errors trying to shut down the server, exiting anyway since FORCE was given.")
+		code = 1
+	}
+	removeUnixSocket()
+	fmt.Println("Redis is now ready to exit, bye bye...")
+	exit(code)
+	return nil
+}
+
+// laggingReplicas returns the online replicas that did not acknowledge offset yet
+func laggingReplicas(offset int64) []*replica {
+	var lagging []*replica
+	for _, r := range replicationState.replicas {
+		if r.state == replicaOnline && r.ackOffset < offset {
+			lagging = append(lagging, r)
+		}
+	}
+	return lagging
+}
+
+// waitForReplicasOnShutdown asks the replicas to acknowledge their offset and waits until they all
+// reached the current one or timeout passes, so they don't miss the last writes. The replicas that
+// still lag then are logged and the shutdown goes on. The caller must hold mu, released while waiting.
+func waitForReplicasOnShutdown(timeout time.Duration) error {
+	if len(laggingReplicas(replicationState.offset)) == 0 {
+		return nil
+	}
+	feedReplicationStream(nil, []string{"REPLCONF", "GETACK", "*"})
+	target := replicationState.offset
+	fmt.Println("Waiting for replicas before shutting down.")
+
+	deadline := time.Now().Add(timeout)
+	for {
+		lagging := laggingReplicas(target)
+		if len(lagging) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			for _, r := range lagging {
+				fmt.Printf("Lagging replica %s reported offset %d behind master, shutting down anyway.\n", r.name(), target-r.ackOffset)
+			}
+			return nil
+		}
+
+		lifecycle.Lock()
+		aborted := lifecycle.aborted
+		lifecycle.Unlock()
+		if aborted {
+			fmt.Println("Shutdown manually aborted.")
+			return errShutdownAborted
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+	}
+}
+
+// prepareForShutdown persists the dataset before the process exits. The caller must hold mu.
+func prepareForShutdown(flags shutdownFlags) error {
+	fmt.Println("User requested shutdown...")
+
+	if aofState.status != aofOff {
+		fmt.Println("Calling fsync() on the AOF file.")
+		flushAppendOnlyFile()
+		err := aofState.lastWriteErr
+		if err == nil && aofState.file != nil {
+			err = aofState.file.Sync()
+		}
+		if err != nil {
+			fmt.Printf("Error writing the AOF file on shutdown: %v\n", err)
+			if flags&shutdownForce == 0 {
+				return err
+			}
+		}
+	}
+
+	if (len(config.saveParams) > 0 && flags&shutdownNoSave == 0) || flags&shutdownSave != 0 {
+		fmt.Println("Saving the final RDB snapshot before exiting.")
+		if err := rdbSave(); err != nil {
+			fmt.Println("Error trying to save the DB, can't exit.")
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeAfterShutdown accepts connections again and lets the waiting commands run after a failed or
+// aborted shutdown
+func resumeAfterShutdown() {
+	resumeListening()
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	lifecycle.shuttingDown = false
+	lifecycle.aborted = false
+	lifecycle.cond.Broadcast()
+}
+
+// abortShutdown cancels a shutdown that is still waiting for commands or background saves to finish
+func abortShutdown() error {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	if !lifecycle.shuttingDown || lifecycle.aborted {
+		return errNoShutdown
+	}
+	lifecycle.aborted = true
+	lifecycle.cond.Broadcast()
+	return nil
+}
+
+// parseShutdownFlags parses the options of SHUTDOWN
+func parseShutdownFlags(args []BulkString) (flags shutdownFlags, abort bool, err error) {
+	for _, arg := range args {
+		switch strings.ToUpper(*arg.Value) {
+		case "NOSAVE":
+			flags |= shutdownNoSave
+		case "SAVE":
+			flags |= shutdownSave
+		case "NOW":
+			// skips waiting for the replicas to catch up
+			flags |= shutdownNow
+		case "FORCE":
+			flags |= shutdownForce
+		case "ABORT":
+			abort = true
+		default:
+			return 0, false, errSyntax
+		}
+	}
+	if (abort && flags != 0) || (flags&shutdownNoSave != 0 && flags&shutdownSave != 0) {
+		return 0, false, errSyntax
+	}
+	return flags, abort, nil
+}
+
+// handleShutdown saves and stops the server, or cancels a shutdown in progress with ABORT.
+// On success the connection is closed without a reply.
+func handleShutdown(args ...BulkString) ([]byte, error) {
+	flags, abort, err := parseShutdownFlags(args[1:])
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if abort {
+		if err := abortShutdown(); err != nil {
+			return errorReply(err.Error())
+		}
+		return []byte("+OK\r\n"), nil
+	}
+
+	withoutLock(func() { err = shutdown(flags) })
+	if err != nil {
+		return errorReply(errShutdownFailed.Error())
+	}
+	return []byte(""), errors.New("server is shutting down")
+}
+
+// HandleShutdownSignal starts the shutdown for SIGINT or SIGTERM with the flags configured for it.
+// A second signal while the shutdown is in progress exits at once.
+func HandleShutdownSignal(sig os.Signal) {
+	name, flags := "SIGTERM", config.shutdownOnSigterm
+	if sig == syscall.SIGINT {
+		name, flags = "SIGINT", config.shutdownOnSigint
+	}
+
+	if shutdownInProgress() {
+		fmt.Println("You insist... exiting now.")
+		exit(1)
+		return
+	}
+	fmt.Printf("Received %s scheduling shutdown...\n", name)
+	go func() {
+		if err := shutdown(flags); err != nil && err != errShutdownAborted {
+			fmt.Printf("%s received but errors trying to shut down the server, check the logs for more information\n", name)
+		}
+	}()
+}
+
+// formatShutdownFlags renders the flags of shutdown-on-sigint and shutdown-on-sigterm
+func formatShutdownFlags(flags shutdownFlags) string {
+	var names []string
+	for _, f := range shutdownFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "default"
+	}
+	return strings.Join(names, " ")
+}
+
+func setShutdownTimeout(value string) error {
+	timeout, err := strconv.Atoi(value)
+	if err != nil || timeout < 0 {
+		return errors.New("argument must be between 0 and 2147483647 inclusive")
+	}
+	config.shutdownTimeout = timeout
+	return nil
+}
+
+func shutdownFlagsSetter(p *shutdownFlags) func(string) error {
+	return func(value string) error {
+		var flags shutdownFlags
+		fields := strings.Fields(strings.ToLower(value))
+		for _, field := range fields {
+			if field == "default" && len(fields) == 1 {
+				continue
+			}
+			found := false
+			for _, f := range shutdownFlagNames {
+				if f.name == field {
+					flags |= f.flag
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("invalid enum value '%s'", field)
+			}
+		}
+		if flags&shutdownSave != 0 && flags&shutdownNoSave != 0 {
+			return errors.New("can't set both 'save' and 'nosave'")
+		}
+		*p = flags
+		return nil
+	}
+}
@@ -0,0 +1,259 @@
+package resp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// stubExit records the exit codes of the shutdowns run by the test instead of ending the process
+func stubExit(t *testing.T) *[]int {
+	t.Helper()
+	var codes []int
+	exit = func(code int) { codes = append(codes, code) }
+	t.Cleanup(func() { exit = os.Exit })
+	return &codes
+}
+
+func TestShutdownArguments(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"abort with flags", []string{"SHUTDOWN", "ABORT", "NOW"}, "-ERR syntax error\r\n"},
+		{"save and nosave", []string{"SHUTDOWN", "SAVE", "NOSAVE"}, "-ERR syntax error\r\n"},
+		{"unknown flag", []string{"SHUTDOWN", "LATER"}, "-ERR syntax error\r\n"},
+		{"nothing to abort", []string{"SHUTDOWN", "ABORT"}, "-ERR No shutdown in progress.\r\n"},
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"not in multi", []string{"SHUTDOWN"}, "-ERR Command not allowed inside a transaction\r\n"},
+		{"aborted exec", []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{"signal config", []string{"CONFIG", "SET", "shutdown-on-sigterm", "nosave force"}, "+OK\r\n"},
+		{"get signal config", []string{"CONFIG", "GET", "shutdown-on-sig*"},
+			"*4\r\n$18\r\nshutdown-on-sigint\r\n$7\r\ndefault\r\n$19\r\nshutdown-on-sigterm\r\n$12\r\nnosave force\r\n"},
+		{"bad signal config", []string{"CONFIG", "SET", "shutdown-on-sigterm", "save nosave"},
+			"-ERR CONFIG SET failed (possibly related to argument 'shutdown-on-sigterm') - can't set both 'save' and 'nosave'\r\n"},
+		{"reset signal config", []string{"CONFIG", "SET", "shutdown-on-sigterm", "default"}, "+OK\r\n"},
+		{"get timeout", []string{"CONFIG", "GET", "shutdown-timeout"}, "*2\r\n$16\r\nshutdown-timeout\r\n$2\r\n10\r\n"},
+		{"bad timeout", []string{"CONFIG", "SET", "shutdown-timeout", "-1"},
+			"-ERR CONFIG SET failed (possibly related to argument 'shutdown-timeout') - argument must be between 0 and 2147483647 inclusive\r\n"},
+	})
+}
+
+func TestShutdownSaves(t *testing.T) {
+	codes := stubExit(t)
+	mu.Lock()
+	oldDir := config.dir
+	config.dir = t.TempDir()
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		config.dir = oldDir
+		mu.Unlock()
+	}()
+	path := filepath.Join(config.dir, config.dbFilename)
+
+	runCommandCases(t, []commandCase{{"set", []string{"SET", "shutdown:key", "v"}, "+OK\r\n"}})
+
+	// the connection is closed instead of getting a reply
+	client := NewClient()
+	if _, err := client.Execute(respCommand("SHUTDOWN", "NOSAVE")); err == nil {
+		t.Error("expected SHUTDOWN to close the connection")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expected SHUTDOWN NOSAVE not to write the RDB file")
+	}
+	if _, err := client.Execute(respCommand("SHUTDOWN")); err == nil {
+		t.Error("expected SHUTDOWN to close the connection")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected SHUTDOWN to save with save points configured: %v", err)
+	}
+	if len(*codes) != 2 || (*codes)[0] != 0 || (*codes)[1] != 0 {
+		t.Errorf("expected two exits with code 0, but got %v", *codes)
+	}
+
+	// a failed save keeps the server running unless FORCE is given
+	mu.Lock()
+	config.dir = filepath.Join(t.TempDir(), "gone")
+	mu.Unlock()
+	runCommandCases(t, []commandCase{
+		{"save fails", []string{"SHUTDOWN", "SAVE"}, "-ERR Errors trying to SHUTDOWN. Check logs.\r\n"},
+		{"still serving", []string{"GET", "shutdown:key"}, "$1\r\nv\r\n"},
+	})
+	if len(*codes) != 2 {
+		t.Errorf("expected no exit after a failed save, but got %v", *codes)
+	}
+	if _, err := NewClient().Execute(respCommand("SHUTDOWN", "SAVE", "FORCE")); err == nil {
+		t.Error("expected SHUTDOWN FORCE to close the connection")
+	}
+	if len(*codes) != 3 || (*codes)[2] != 1 {
+		t.Errorf("expected SHUTDOWN FORCE to exit with code 1 despite the failed save, but got %v", *codes)
+	}
+}
+
+func TestShutdownWaitsAndAborts(t *testing.T) {
+	codes := stubExit(t)
+
+	// a client blocked on a key does not hold the shutdown back
+	blocked := make(chan string, 1)
+	go func() {
+		result, _ := ExecuteRespData(respCommand("XREAD", "BLOCK", "0", "STREAMS", "shutdown:stream", "$"))
+		blocked <- string(result)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := ExecuteRespData(respCommand("SHUTDOWN", "NOSAVE")); err == nil {
+		t.Error("expected SHUTDOWN to close the connection")
+	}
+	if len(*codes) != 1 {
+		t.Fatalf("expected the shutdown to complete with a blocked client, but got %v", *codes)
+	}
+	runCommandCases(t, []commandCase{{"wake", []string{"XADD", "shutdown:stream", "1-1", "f", "v"}, "$3\r\n1-1\r\n"}})
+	<-blocked
+
+	// a background save in progress holds the shutdown, commands waiting meanwhile until it is aborted
+	mu.Lock()
+	rdbState.bgsaveInProgress = true
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		rdbState.bgsaveInProgress = false
+		mu.Unlock()
+	}()
+
+	shutdownReply := make(chan string, 1)
+	go func() {
+		result, _ := ExecuteRespData(respCommand("SHUTDOWN", "NOSAVE"))
+		shutdownReply <- string(result)
+	}()
+	for !shutdownInProgress() {
+		time.Sleep(time.Millisecond)
+	}
+
+	pong := make(chan string, 1)
+	go func() {
+		result, _ := ExecuteRespData(respCommand("PING"))
+		pong <- string(result)
+	}()
+	select {
+	case result := <-pong:
+		t.Fatalf("expected PING to wait during the shutdown, but got %q", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	runCommandCases(t, []commandCase{{"abort", []string{"SHUTDOWN", "ABORT"}, "+OK\r\n"}})
+	if result := <-shutdownReply; result != "-ERR Errors trying to SHUTDOWN. Check logs.\r\n" {
+		t.Errorf("expected the aborted SHUTDOWN to fail, but got %q", result)
+	}
+	if result := <-pong; result != "+PONG\r\n" {
+		t.Errorf("expected PING to be served after the abort, but got %q", result)
+	}
+	if len(*codes) != 1 {
+		t.Errorf("expected no exit after the abort, but got %v", *codes)
+	}
+}
+
+func TestShutdownWaitsForReplicas(t *testing.T) {
+	useTempDir(t)
+	codes := stubExit(t)
+	client, r, _, _ := connectReplica(t)
+	defer client.Close()
+	runCommandCases(t, []commandCase{{"set", []string{"SET", "shutdown:replicated", "v", "PXAT", "99999999999999"}, "+OK\r\n"}})
+	expectCommand(t, r, "SELECT", "0")
+	expectCommand(t, r, "SET", "shutdown:replicated", "v", "PXAT", "99999999999999")
+
+	// NOW skips the wait for the lagging replica
+	if _, err := ExecuteRespData(respCommand("SHUTDOWN", "NOSAVE", "NOW")); err == nil {
+		t.Error("expected SHUTDOWN NOW to close the connection")
+	}
+	if len(*codes) != 1 {
+		t.Fatalf("expected SHUTDOWN NOW to exit at once, but got %v", *codes)
+	}
+
+	// otherwise the shutdown asks the replica for its offset and exits once it acknowledged it
+	shutdownDone := make(chan struct{})
+	go func() {
+		ExecuteRespData(respCommand("SHUTDOWN", "NOSAVE"))
+		close(shutdownDone)
+	}()
+	expectCommand(t, r, "REPLCONF", "GETACK", "*")
+	select {
+	case <-shutdownDone:
+		t.Fatal("expected the shutdown to wait for the replica")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	offset := replicationState.offset
+	mu.Unlock()
+	runClientCommandCases(t, client, []commandCase{{"ack", []string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}, ""}})
+	<-shutdownDone
+	if len(*codes) != 2 || (*codes)[1] != 0 {
+		t.Fatalf("expected the shutdown to complete once the replica acknowledged, but got %v", *codes)
+	}
+
+	// a replica that never catches up holds the shutdown until shutdown-timeout
+	setConfig(t, "shutdown-timeout", "1")
+	runCommandCases(t, []commandCase{{"set", []string{"SET", "shutdown:lagging", "v"}, "+OK\r\n"}})
+	start := time.Now()
+	if _, err := ExecuteRespData(respCommand("SHUTDOWN", "NOSAVE")); err == nil {
+		t.Error("expected SHUTDOWN to close the connection")
+	}
+	if elapsed := time.Since(start); len(*codes) != 3 || elapsed < time.Second {
+		t.Errorf("expected the shutdown to exit after the timeout, but got %v after %v", *codes, elapsed)
+	}
+}
+
+// the listeners are closed while a shutdown is in progress, so connections are refused, and opened again
+// when it is aborted
+func TestShutdownClosesListeners(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.sock")
+	mu.Lock()
+	oldPort := config.port
+	config.port, config.unixSocket = 0, path
+	mu.Unlock()
+	t.Cleanup(func() {
+		stopListening()
+		listening.Lock()
+		listening.handle = nil
+		listening.Unlock()
+		mu.Lock()
+		defer mu.Unlock()
+		config.port, config.unixSocket, unixSocketPath = oldPort, "", ""
+	})
+	go Serve(func(conn net.Conn) { conn.Close() })
+	waitFor(t, "the listener", func() bool {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+
+	mu.Lock()
+	rdbState.bgsaveInProgress = true
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		rdbState.bgsaveInProgress = false
+		mu.Unlock()
+	}()
+	shutdownReply := make(chan string, 1)
+	go func() {
+		result, _ := ExecuteRespData(respCommand("SHUTDOWN", "NOSAVE"))
+		shutdownReply <- string(result)
+	}()
+	for !shutdownInProgress() {
+		time.Sleep(time.Millisecond)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		t.Error("expected connections to be refused during the shutdown")
+	}
+
+	runCommandCases(t, []commandCase{{"abort", []string{"SHUTDOWN", "ABORT"}, "+OK\r\n"}})
+	<-shutdownReply
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("expected connections to be accepted again after the abort: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,202 @@
+package resp
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Sorted sets use the same layout as Redis: a map from member to score for O(1) lookups
+// and a skiplist ordered by (score, member) for range queries.
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	forward  []*skiplistNode
+}
+
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{forward: make([]*skiplistNode, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomSkiplistLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// nodeLess reports whether node sorts before (score, member)
+func nodeLess(node *skiplistNode, score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+// insert adds a new node; the caller makes sure the member is not already present
+func (zsl *skiplist) insert(score float64, member string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.forward[i] != nil && nodeLess(x.forward[i], score, member) {
+			x = x.forward[i]
+		}
+		update[i] = x
+	}
+
+	level := randomSkiplistLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			update[i] = zsl.header
+		}
+		zsl.level = level
+	}
+
+	node := &skiplistNode{member: member, score: score, forward: make([]*skiplistNode, level)}
+	for i := 0; i < level; i++ {
+		node.forward[i] = update[i].forward[i]
+		update[i].forward[i] = node
+	}
+
+	if update[0] != zsl.header {
+		node.backward = update[0]
+	}
+	if node.forward[0] != nil {
+		node.forward[0].backward = node
+	} else {
+		zsl.tail = node
+	}
+	zsl.length++
+}
+
+// delete removes the node matching both score and member, reporting whether it was found
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.forward[i] != nil && nodeLess(x.forward[i], score, member) {
+			x = x.forward[i]
+		}
+		update[i] = x
+	}
+
+	x = x.forward[0]
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].forward[i] == x {
+			update[i].forward[i] = x.forward[i]
+		}
+	}
+	if x.forward[0] != nil {
+		x.forward[0].backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.forward[zsl.level-1] == nil {
+		zsl.level--
+	}
+	zsl.length--
+	return true
+}
+
+// firstFrom returns the first node with a score of at least min
+func (zsl *skiplist) firstFrom(min float64) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.forward[i] != nil && x.forward[i].score < min {
+			x = x.forward[i]
+		}
+	}
+	return x.forward[0]
+}
+
+type sortedSet struct {
+	scores map[string]float64
+	zsl    *skiplist
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{scores: map[string]float64{}, zsl: newSkiplist()}
+}
+
+func (z *sortedSet) Len() int {
+	return z.zsl.length
+}
+
+func (z *sortedSet) score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// add inserts member or moves it to a new score, reporting whether it was newly added
+func (z *sortedSet) add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.zsl.delete(old, member)
+	}
+	z.zsl.insert(score, member)
+	z.scores[member] = score
+	return !exists
+}
+
+func (z *sortedSet) remove(member string) bool {
+	score, exists := z.scores[member]
+	if !exists {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.scores, member)
+	return true
+}
+
+// ascendFrom calls fn in (score, member) order for every element scoring at least min until fn returns false
+func (z *sortedSet) ascendFrom(min float64, fn func(member string, score float64) bool) {
+	for x := z.zsl.firstFrom(min); x != nil; x = x.forward[0] {
+		if !fn(x.member, x.score) {
+			return
+		}
+	}
+}
+
+// clone returns an independent copy, for snapshots that outlive the lock
+func (z *sortedSet) clone() *sortedSet {
+	c := newSortedSet()
+	z.ascendFrom(math.Inf(-1), func(member string, score float64) bool {
+		c.add(member, score)
+		return true
+	})
+	return c
+}
+
+// lookupSortedSet returns the sorted set stored at key, or nil when the key does not exist.
+// The caller must hold mu.
+func lookupSortedSet(key string) (*sortedSet, error) {
+	entry, ok := lookupEntry(key)
+	if !ok {
+		return nil, nil
+	}
+	z, ok := entry.value.(*sortedSet)
+	if !ok {
+		return nil, errWrongType
+	}
+	return z, nil
+}
@@ -0,0 +1,377 @@
+package resp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamNodeMaxEntries caps how many entries (live or deleted) share one compact node,
+// the same default as Redis' stream-node-max-entries
+const streamNodeMaxEntries = 100
+
+var errInvalidStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+// streamID is the <ms>-<seq> identifier of a stream entry
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var (
+	minStreamID = streamID{0, 0}
+	maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+)
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) compare(other streamID) int {
+	switch {
+	case id.ms < other.ms:
+		return -1
+	case id.ms > other.ms:
+		return 1
+	case id.seq < other.seq:
+		return -1
+	case id.seq > other.seq:
+		return 1
+	}
+	return 0
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.compare(other) < 0
+}
+
+// incr returns the smallest ID greater than id, failing when id is already the maximum
+func (id streamID) incr() (streamID, error) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, nil
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, nil
+	}
+	return id, fmt.Errorf("stream ID overflow")
+}
+
+// decr returns the largest ID smaller than id, failing when id is 0-0
+func (id streamID) decr() (streamID, error) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, nil
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, nil
+	}
+	return id, fmt.Errorf("stream ID underflow")
+}
+
+// key encodes the ID big endian so that the radix tree orders IDs numerically
+func (id streamID) key() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, id.ms)
+	binary.BigEndian.PutUint64(b[8:], id.seq)
+	return b
+}
+
+func streamIDFromKey(b []byte) streamID {
+	return streamID{binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:])}
+}
+
+// parseStreamID parses "<ms>-<seq>" or "<ms>", using missingSeq when the sequence part is omitted
+func parseStreamID(s string, missingSeq uint64) (streamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	if !hasSeq {
+		return streamID{ms, missingSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	return streamID{ms, seq}, nil
+}
+
+// parseRangeID parses an XRANGE style boundary, accepting "-" and "+" for the smallest and largest IDs
+func parseRangeID(s string, missingSeq uint64) (streamID, error) {
+	switch s {
+	case "-":
+		return minStreamID, nil
+	case "+":
+		return maxStreamID, nil
+	}
+	return parseStreamID(s, missingSeq)
+}
+
+type streamEntry struct {
+	id      streamID
+	fields  []string // flattened field value pairs
+	deleted bool
+}
+
+// streamNode is the compact node stored in the radix tree, keyed by the ID of its first (master) entry.
+// Deleted entries stay in place and are only flagged, like the listpack nodes of Redis.
+type streamNode struct {
+	entries []streamEntry
+	live    int
+}
+
+type stream struct {
+	nodes        *rax[*streamNode]
+	length       uint64
+	lastID       streamID
+	firstID      streamID
+	maxDeletedID streamID
+	entriesAdded uint64
+	groups       *rax[*consumerGroup] // created with the first group
+}
+
+func newStream() *stream {
+	return &stream{nodes: newRax[*streamNode]()}
+}
+
+// clone returns an independent copy, for snapshots that outlive the lock
+func (s *stream) clone() *stream {
+	c := *s
+	c.nodes = newRax[*streamNode]()
+	s.nodes.Ascend(nil, func(key []byte, node *streamNode) bool {
+		c.nodes.Insert(key, &streamNode{entries: append([]streamEntry(nil), node.entries...), live: node.live})
+		return true
+	})
+	if s.groups != nil {
+		c.groups = newRax[*consumerGroup]()
+		s.groups.Ascend(nil, func(name []byte, g *consumerGroup) bool {
+			c.groups.Insert(name, g.clone())
+			return true
+		})
+	}
+	return &c
+}
+
+// nextID resolves the ID of a new entry. With auto set the ID comes from the clock,
+// otherwise requested is used as is, or only its milliseconds when seqGiven is false ("<ms>-*").
+func (s *stream) nextID(requested streamID, auto, seqGiven bool) (streamID, error) {
+	if auto {
+		now := uint64(time.Now().UnixMilli())
+		if now > s.lastID.ms {
+			return streamID{now, 0}, nil
+		}
+		return s.lastID.incr()
+	}
+
+	id := requested
+	if !seqGiven {
+		id.seq = 0
+		if id.ms == s.lastID.ms {
+			if s.lastID.seq == math.MaxUint64 {
+				return id, errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+			}
+			id.seq = s.lastID.seq + 1
+		}
+	}
+	return id, s.validateNewID(id)
+}
+
+func (s *stream) validateNewID(id streamID) error {
+	if id == minStreamID {
+		return errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	}
+	if id.compare(s.lastID) <= 0 {
+		return errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	return nil
+}
+
+// add appends a new entry; the caller has already checked that id is greater than lastID
+func (s *stream) add(id streamID, fields []string) {
+	_, last, ok := s.nodes.Last()
+	if !ok || len(last.entries) >= streamNodeMaxEntries {
+		last = &streamNode{}
+		s.nodes.Insert(id.key(), last)
+	}
+	last.entries = append(last.entries, streamEntry{id: id, fields: fields})
+	last.live++
+
+	if s.length == 0 {
+		s.firstID = id
+	}
+	s.length++
+	s.entriesAdded++
+	s.lastID = id
+}
+
+// delete flags the entry with the given ID as deleted and drops its node once nothing live remains
+func (s *stream) delete(id streamID) bool {
+	nodeKey, node, ok := s.nodes.Floor(id.key())
+	if !ok {
+		return false
+	}
+	for i := range node.entries {
+		entry := &node.entries[i]
+		if entry.id != id || entry.deleted {
+			continue
+		}
+		entry.deleted = true
+		node.live--
+		if node.live == 0 {
+			s.nodes.Remove(nodeKey)
+		}
+		s.length--
+		if s.maxDeletedID.less(id) {
+			s.maxDeletedID = id
+		}
+		if id == s.firstID {
+			s.refreshFirstID()
+		}
+		return true
+	}
+	return false
+}
+
+// lastValidID returns the ID of the newest live entry, which can be lower than lastID after deletions
+func (s *stream) lastValidID() streamID {
+	last := minStreamID
+	s.forRange(minStreamID, maxStreamID, true, func(e *streamEntry) bool {
+		last = e.id
+		return false
+	})
+	return last
+}
+
+func (s *stream) refreshFirstID() {
+	s.firstID = minStreamID
+	s.forRange(minStreamID, maxStreamID, false, func(e *streamEntry) bool {
+		s.firstID = e.id
+		return false
+	})
+}
+
+// forRange calls fn for every live entry with start <= id <= end, in reverse order when rev is set
+func (s *stream) forRange(start, end streamID, rev bool, fn func(*streamEntry) bool) {
+	if start.compare(end) > 0 {
+		return
+	}
+
+	visit := func(node *streamNode) bool {
+		for i := range node.entries {
+			idx := i
+			if rev {
+				idx = len(node.entries) - 1 - i
+			}
+			entry := &node.entries[idx]
+			if entry.deleted || entry.id.less(start) || end.less(entry.id) {
+				continue
+			}
+			if !fn(entry) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if rev {
+		s.nodes.Descend(end.key(), func(key []byte, node *streamNode) bool {
+			// once a node starts at or below start every earlier node is out of range
+			return visit(node) && start.less(streamIDFromKey(key))
+		})
+		return
+	}
+
+	// the entries at start may live in the node whose master ID is just below it
+	from := start.key()
+	if floor, _, ok := s.nodes.Floor(from); ok {
+		from = floor
+	}
+	s.nodes.Ascend(from, func(key []byte, node *streamNode) bool {
+		if end.less(streamIDFromKey(key)) {
+			return false
+		}
+		return visit(node)
+	})
+}
+
+// trimStrategy describes a MAXLEN or MINID clause of XADD and XTRIM
+type trimStrategy struct {
+	byMinID   bool
+	maxLen    int64
+	minID     streamID
+	approx    bool
+	limit     int64 // 0 means unlimited
+	specified bool
+}
+
+// trim removes entries according to strategy and returns how many were deleted.
+// Approximate trimming only drops whole nodes, exact trimming also flags entries inside the boundary node.
+func (s *stream) trim(strategy trimStrategy) int64 {
+	var removed int64
+
+	for {
+		if strategy.limit > 0 && removed >= strategy.limit {
+			break
+		}
+		nodeKey, node, ok := s.nodes.First()
+		if !ok {
+			break
+		}
+		if !strategy.byMinID && s.length <= uint64(strategy.maxLen) {
+			break
+		}
+
+		lastID := node.entries[len(node.entries)-1].id
+		wholeNode := false
+		if strategy.byMinID {
+			wholeNode = lastID.less(strategy.minID)
+		} else {
+			wholeNode = s.length-uint64(node.live) >= uint64(strategy.maxLen)
+		}
+		if strategy.limit > 0 && removed+int64(node.live) > strategy.limit {
+			wholeNode = false
+		}
+
+		if wholeNode {
+			s.nodes.Remove(nodeKey)
+			s.length -= uint64(node.live)
+			removed += int64(node.live)
+			continue
+		}
+
+		if strategy.approx {
+			break
+		}
+
+		// exact trimming: flag entries of the boundary node one by one
+		for i := range node.entries {
+			entry := &node.entries[i]
+			if entry.deleted {
+				continue
+			}
+			if strategy.byMinID && !entry.id.less(strategy.minID) {
+				break
+			}
+			if !strategy.byMinID && s.length <= uint64(strategy.maxLen) {
+				break
+			}
+			entry.deleted = true
+			node.live--
+			s.length--
+			removed++
+		}
+		if node.live == 0 {
+			s.nodes.Remove(nodeKey)
+		}
+		break
+	}
+
+	if removed > 0 {
+		s.refreshFirstID()
+	}
+	return removed
+}
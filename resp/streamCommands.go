@@ -0,0 +1,471 @@
+package resp
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	errWrongType  = errors.New(wrongTypeErr)
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+	errSyntax     = errors.New("ERR syntax error")
+)
+
+// lookupStream returns the stream stored at key, or nil when the key does not exist.
+// The caller must hold mu.
+func lookupStream(key string) (*stream, error) {
+	entry, ok := lookupEntry(key)
+	if !ok {
+		return nil, nil
+	}
+	s, ok := entry.value.(*stream)
+	if !ok {
+		return nil, errWrongType
+	}
+	return s, nil
+}
+
+func parseInt(arg BulkString) (int64, error) {
+	n, err := strconv.ParseInt(*arg.Value, 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	return n, nil
+}
+
+// streamAddArgs holds what XADD and XTRIM parse before touching the keyspace
+type streamAddArgs struct {
+	trim       trimStrategy
+	noMkStream bool
+	id         streamID
+	autoID     bool
+	seqGiven   bool
+	fieldPos   int
+}
+
+// parseStreamAddArgs parses the options shared by XADD and XTRIM starting after the key.
+// For XADD parsing stops at the entry ID, which is stored together with the position of the first field.
+func parseStreamAddArgs(args []BulkString, xadd bool) (streamAddArgs, error) {
+	parsed := streamAddArgs{}
+	limitGiven := false
+
+	i := 2
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(*args[i].Value)
+		moreArgs := len(args) - 1 - i
+
+		switch {
+		case xadd && opt == "NOMKSTREAM":
+			parsed.noMkStream = true
+
+		case (opt == "MAXLEN" || opt == "MINID") && moreArgs >= 1:
+			if parsed.trim.specified && parsed.trim.byMinID != (opt == "MINID") {
+				return parsed, errors.New("ERR syntax error, MAXLEN and MINID options at the same time are not compatible")
+			}
+			parsed.trim.specified = true
+			parsed.trim.byMinID = opt == "MINID"
+
+			next := *args[i+1].Value
+			if (next == "~" || next == "=") && moreArgs >= 2 {
+				parsed.trim.approx = next == "~"
+				i++
+			}
+			i++
+
+			if parsed.trim.byMinID {
+				id, err := parseStreamID(*args[i].Value, 0)
+				if err != nil {
+					return parsed, err
+				}
+				parsed.trim.minID = id
+			} else {
+				maxLen, err := parseInt(args[i])
+				if err != nil {
+					return parsed, err
+				}
+				if maxLen < 0 {
+					return parsed, errors.New("ERR The MAXLEN argument must be >= 0.")
+				}
+				parsed.trim.maxLen = maxLen
+			}
+
+		case opt == "LIMIT" && moreArgs >= 1:
+			limit, err := parseInt(args[i+1])
+			if err != nil {
+				return parsed, err
+			}
+			if limit < 0 {
+				return parsed, errors.New("ERR The LIMIT argument must be >= 0.")
+			}
+			parsed.trim.limit = limit
+			limitGiven = true
+			i++
+
+		case xadd:
+			// the first unknown token is the entry ID
+			raw := *args[i].Value
+			if raw == "*" {
+				parsed.autoID = true
+			} else {
+				msPart, seqPart, hasSeq := strings.Cut(raw, "-")
+				if hasSeq && seqPart == "*" {
+					ms, err := strconv.ParseUint(msPart, 10, 64)
+					if err != nil {
+						return parsed, errInvalidStreamID
+					}
+					parsed.id = streamID{ms: ms}
+				} else {
+					id, err := parseStreamID(raw, 0)
+					if err != nil {
+						return parsed, err
+					}
+					parsed.id = id
+					parsed.seqGiven = true
+				}
+			}
+			parsed.fieldPos = i + 1
+			return parsed, validateTrimLimit(&parsed.trim, limitGiven)
+
+		default:
+			return parsed, errSyntax
+		}
+	}
+
+	if xadd {
+		parsed.fieldPos = i
+	}
+	return parsed, validateTrimLimit(&parsed.trim, limitGiven)
+}
+
+// validateTrimLimit applies the LIMIT rules: it needs "~", and approximate trimming defaults to 100 nodes of work
+func validateTrimLimit(trim *trimStrategy, limitGiven bool) error {
+	if limitGiven && !trim.approx {
+		return errors.New("ERR syntax error, LIMIT cannot be used without the special ~ option")
+	}
+	if trim.approx && !limitGiven {
+		trim.limit = 100 * streamNodeMaxEntries
+	}
+	return nil
+}
+
+// handleXAdd appends an entry to a stream, creating it unless NOMKSTREAM is given, and returns the entry ID
+func handleXAdd(args ...BulkString) ([]byte, error) {
+	if len(args) < 5 {
+		return wrongArgsReply("xadd")
+	}
+
+	parsed, err := parseStreamAddArgs(args, true)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	fieldCount := len(args) - parsed.fieldPos
+	if fieldCount < 2 || fieldCount%2 == 1 {
+		return wrongArgsReply("xadd")
+	}
+	if parsed.seqGiven && parsed.id == minStreamID {
+		return errorReply("ERR The ID specified in XADD must be greater than 0-0")
+	}
+
+	key := *args[1].Value
+	s, err := lookupStream(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if s == nil {
+		if parsed.noMkStream {
+			return SerializeBulkString(BulkString{})
+		}
+		s = newStream()
+	}
+
+	if s.lastID == maxStreamID {
+		return errorReply("ERR The stream has exhausted the last possible ID, unable to add more items")
+	}
+	id, err := s.nextID(parsed.id, parsed.autoID, parsed.seqGiven)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	fields := make([]string, 0, fieldCount)
+	for _, arg := range args[parsed.fieldPos:] {
+		fields = append(fields, *arg.Value)
+	}
+	s.add(id, fields)
+	if _, exists := store[key]; !exists {
+		store[key] = StoreEntry{value: s}
+		notifyKeyspaceEvent(notifyNew, "new", key, currentDB.id)
+	}
+	notifyKeyspaceEvent(notifyStream, "xadd", key, currentDB.id)
+
+	if parsed.trim.specified && s.trim(parsed.trim) > 0 {
+		notifyKeyspaceEvent(notifyStream, "xtrim", key, currentDB.id)
+	}
+	signalModifiedKey(currentDB, key)
+	signalKeyAsReady(key)
+
+	// the log gets the ID that was generated and a trim that does not depend on the node layout
+	if parsed.autoID || !parsed.seqGiven || parsed.trim.approx {
+		argv := []string{"XADD", key}
+		if parsed.noMkStream {
+			argv = append(argv, "NOMKSTREAM")
+		}
+		if parsed.trim.specified {
+			argv = append(argv, s.exactTrimArgs(parsed.trim)...)
+		}
+		argv = append(argv, id.String())
+		rewriteCommand(append(argv, fields...)...)
+	}
+
+	return bulkString(id.String()).serialize()
+}
+
+// handleXTrim trims a stream by MAXLEN or MINID and returns the number of deleted entries
+func handleXTrim(args ...BulkString) ([]byte, error) {
+	if len(args) < 4 {
+		return wrongArgsReply("xtrim")
+	}
+
+	parsed, err := parseStreamAddArgs(args, false)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if !parsed.trim.specified {
+		return errorReply(errSyntax.Error())
+	}
+
+	s, err := lookupStream(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if s == nil {
+		return SerializeInteger(Integer{Value: 0})
+	}
+
+	trimmed := int(s.trim(parsed.trim))
+	if trimmed > 0 {
+		signalModifiedKey(currentDB, *args[1].Value)
+		notifyKeyspaceEvent(notifyStream, "xtrim", *args[1].Value, currentDB.id)
+		if parsed.trim.approx {
+			rewriteCommand(append([]string{"XTRIM", *args[1].Value}, s.exactTrimArgs(parsed.trim)...)...)
+		}
+	}
+	return SerializeInteger(Integer{Value: trimmed})
+}
+
+// exactTrimArgs renders a trim that was just applied as the exact trim giving the same stream,
+// since what an approximate trim removes depends on how the entries are split into nodes
+func (s *stream) exactTrimArgs(trim trimStrategy) []string {
+	if !trim.byMinID {
+		return []string{"MAXLEN", "=", strconv.FormatUint(s.length, 10)}
+	}
+	minID := trim.minID
+	if s.length > 0 {
+		minID = s.firstID
+	}
+	return []string{"MINID", "=", minID.String()}
+}
+
+// parseIntervalID parses an XRANGE boundary, where a leading "(" makes it exclusive
+func parseIntervalID(raw string, missingSeq uint64) (id streamID, exclusive bool, err error) {
+	if len(raw) > 1 && raw[0] == '(' {
+		id, err = parseStreamID(raw[1:], missingSeq)
+		return id, true, err
+	}
+	id, err = parseRangeID(raw, missingSeq)
+	return id, false, err
+}
+
+// streamRange serves XRANGE and XREVRANGE; args are already in start, end order
+func streamRange(key, rawStart, rawEnd string, countArgs []BulkString, rev bool) ([]byte, error) {
+	start, startEx, err := parseIntervalID(rawStart, 0)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	end, endEx, err := parseIntervalID(rawEnd, math.MaxUint64)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if startEx {
+		if start, err = start.incr(); err != nil {
+			return errorReply("ERR invalid start ID for the interval")
+		}
+	}
+	if endEx {
+		if end, err = end.decr(); err != nil {
+			return errorReply("ERR invalid end ID for the interval")
+		}
+	}
+
+	count := int64(-1)
+	for i := 0; i < len(countArgs); i++ {
+		if strings.ToUpper(*countArgs[i].Value) == "COUNT" && i+1 < len(countArgs) {
+			if count, err = parseInt(countArgs[i+1]); err != nil {
+				return errorReply(err.Error())
+			}
+			if count < 0 {
+				count = 0
+			}
+			i++
+		} else {
+			return errorReply(errSyntax.Error())
+		}
+	}
+
+	s, err := lookupStream(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	entries := []RESPData{}
+	if s != nil && count != 0 {
+		s.forRange(start, end, rev, func(e *streamEntry) bool {
+			entries = append(entries, streamEntryReply(e))
+			return count < 0 || int64(len(entries)) < count
+		})
+	}
+	return SerializeArray(Array{Elements: &entries})
+}
+
+// streamEntryReply renders an entry as the [id, [field, value, ...]] pair used by the range commands
+func streamEntryReply(e *streamEntry) RESPData {
+	fields := make([]RESPData, len(e.fields))
+	for i, f := range e.fields {
+		fields[i] = bulkString(f)
+	}
+	return Array{Elements: &[]RESPData{bulkString(e.id.String()), Array{Elements: &fields}}}
+}
+
+// handleXRange returns the entries between start and end, both inclusive unless prefixed with "("
+func handleXRange(args ...BulkString) ([]byte, error) {
+	if len(args) < 4 {
+		return wrongArgsReply("xrange")
+	}
+	return streamRange(*args[1].Value, *args[2].Value, *args[3].Value, args[4:], false)
+}
+
+// handleXRevRange is XRANGE in reverse order, taking the end boundary first
+func handleXRevRange(args ...BulkString) ([]byte, error) {
+	if len(args) < 4 {
+		return wrongArgsReply("xrevrange")
+	}
+	return streamRange(*args[1].Value, *args[3].Value, *args[2].Value, args[4:], true)
+}
+
+// handleXLen returns the number of entries in a stream, 0 when it does not exist
+func handleXLen(args ...BulkString) ([]byte, error) {
+	if len(args) != 2 {
+		return wrongArgsReply("xlen")
+	}
+
+	s, err := lookupStream(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if s == nil {
+		return SerializeInteger(Integer{Value: 0})
+	}
+	return SerializeInteger(Integer{Value: int(s.length)})
+}
+
+// handleXDel removes entries by ID and returns how many existed
+func handleXDel(args ...BulkString) ([]byte, error) {
+	if len(args) < 3 {
+		return wrongArgsReply("xdel")
+	}
+
+	ids := make([]streamID, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		id, err := parseStreamID(*arg.Value, 0)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		ids = append(ids, id)
+	}
+
+	s, err := lookupStream(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if s == nil {
+		return SerializeInteger(Integer{Value: 0})
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		if s.delete(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		signalModifiedKey(currentDB, *args[1].Value)
+		notifyKeyspaceEvent(notifyStream, "xdel", *args[1].Value, currentDB.id)
+	}
+	return SerializeInteger(Integer{Value: deleted})
+}
+
+// handleXSetID moves the last ID of a stream forward and optionally overrides its counters
+func handleXSetID(args ...BulkString) ([]byte, error) {
+	if len(args) < 3 {
+		return wrongArgsReply("xsetid")
+	}
+
+	id, err := parseStreamID(*args[2].Value, 0)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	entriesAdded := int64(-1)
+	maxDeletedID := minStreamID
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(*args[i].Value)
+		switch {
+		case opt == "ENTRIESADDED" && i+1 < len(args):
+			if entriesAdded, err = parseInt(args[i+1]); err != nil {
+				return errorReply(err.Error())
+			}
+			if entriesAdded < 0 {
+				return errorReply("ERR entries_added must be positive")
+			}
+		case opt == "MAXDELETEDID" && i+1 < len(args):
+			if maxDeletedID, err = parseStreamID(*args[i+1].Value, 0); err != nil {
+				return errorReply(err.Error())
+			}
+			if id.less(maxDeletedID) {
+				return errorReply("ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+			}
+		default:
+			return errorReply(errSyntax.Error())
+		}
+		i++
+	}
+
+	s, err := lookupStream(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if s == nil {
+		return errorReply("ERR no such key")
+	}
+
+	if s.length > 0 {
+		if id.less(s.lastValidID()) {
+			return errorReply("ERR The ID specified in XSETID is smaller than the target stream top item")
+		}
+		if entriesAdded != -1 && s.length > uint64(entriesAdded) {
+			return errorReply("ERR The entries_added specified in XSETID is smaller than the target stream length")
+		}
+	}
+
+	s.lastID = id
+	if entriesAdded != -1 {
+		s.entriesAdded = uint64(entriesAdded)
+	}
+	if maxDeletedID != minStreamID {
+		s.maxDeletedID = maxDeletedID
+	}
+	signalModifiedKey(currentDB, *args[1].Value)
+	notifyKeyspaceEvent(notifyStream, "xsetid", *args[1].Value, currentDB.id)
+	return []byte("+OK\r\n"), nil
+}
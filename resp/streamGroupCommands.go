@@ -0,0 +1,816 @@
+package resp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const xgroupMissingKeyErr = "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."
+
+func noGroupError(key, group string) error {
+	return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+}
+
+// subcommandSyntaxReply is the error for an unknown subcommand or one called with the wrong arity
+func subcommandSyntaxReply(cmd, sub string) ([]byte, error) {
+	return errorReply(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try %s HELP.", sub, strings.ToUpper(cmd)))
+}
+
+// helpReply renders HELP output as an array of simple strings
+func helpReply(lines ...string) ([]byte, error) {
+	elements := make([]RESPData, len(lines))
+	for i, line := range lines {
+		elements[i] = SimpleString{Value: line}
+	}
+	return SerializeArray(Array{Elements: &elements})
+}
+
+// lookupStreamGroup fetches the stream and group named by args[1] and args[2] for the group commands
+func lookupStreamGroup(args []BulkString) (*stream, *consumerGroup, error) {
+	key, group := *args[1].Value, *args[2].Value
+	s, err := lookupStream(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s == nil {
+		return nil, nil, noGroupError(key, group)
+	}
+	g := s.lookupGroup(group)
+	if g == nil {
+		return nil, nil, noGroupError(key, group)
+	}
+	return s, g, nil
+}
+
+// handleXGroup manages consumer groups: CREATE, SETID, DESTROY, CREATECONSUMER and DELCONSUMER
+func handleXGroup(args ...BulkString) ([]byte, error) {
+	if len(args) < 2 {
+		return wrongArgsReply("xgroup")
+	}
+	sub := strings.ToUpper(*args[1].Value)
+
+	if sub == "HELP" {
+		return helpReply(
+			"XGROUP <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CREATE <key> <groupname> <id|$> [option]",
+			"    Create a new consumer group. Options are:",
+			"    * MKSTREAM",
+			"      Create the empty stream if it does not exist.",
+			"    * ENTRIESREAD entries_read",
+			"      Set the group's entries_read counter (internal use).",
+			"CREATECONSUMER <key> <groupname> <consumer>",
+			"    Create a new consumer in the specified group.",
+			"DELCONSUMER <key> <groupname> <consumer>",
+			"    Remove the specified consumer.",
+			"DESTROY <key> <groupname>",
+			"    Remove the specified group.",
+			"SETID <key> <groupname> <id|$> [ENTRIESREAD entries_read]",
+			"    Set the current group ID and entries_read counter.",
+			"HELP",
+			"    Print this help.",
+		)
+	}
+
+	arityOK := map[string]func(int) bool{
+		"CREATE":         func(n int) bool { return n >= 5 && n <= 8 },
+		"SETID":          func(n int) bool { return n == 5 || n == 7 },
+		"DESTROY":        func(n int) bool { return n == 4 },
+		"CREATECONSUMER": func(n int) bool { return n == 5 },
+		"DELCONSUMER":    func(n int) bool { return n == 5 },
+	}
+	check, known := arityOK[sub]
+	if !known || !check(len(args)) {
+		return subcommandSyntaxReply("xgroup", *args[1].Value)
+	}
+
+	mkStream := false
+	entriesRead := int64(invalidEntriesRead)
+	if sub == "CREATE" || sub == "SETID" {
+		for i := 5; i < len(args); i++ {
+			opt := strings.ToUpper(*args[i].Value)
+			switch {
+			case sub == "CREATE" && opt == "MKSTREAM":
+				mkStream = true
+			case opt == "ENTRIESREAD" && i+1 < len(args):
+				i++
+				n, err := parseInt(args[i])
+				if err != nil {
+					return errorReply(err.Error())
+				}
+				if n < 0 && n != invalidEntriesRead {
+					return errorReply("ERR value for ENTRIESREAD must be positive or -1")
+				}
+				entriesRead = n
+			default:
+				return subcommandSyntaxReply("xgroup", *args[1].Value)
+			}
+		}
+	}
+
+	key, groupName := *args[2].Value, *args[3].Value
+	s, err := lookupStream(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	var g *consumerGroup
+	if !mkStream {
+		if s == nil {
+			return errorReply(xgroupMissingKeyErr)
+		}
+		g = s.lookupGroup(groupName)
+		if g == nil && sub != "CREATE" && sub != "DESTROY" {
+			return errorReply(fmt.Sprintf("NOGROUP No such consumer group '%s' for key name '%s'", groupName, key))
+		}
+	}
+
+	switch sub {
+	case "CREATE":
+		id := minStreamID
+		if raw := *args[4].Value; raw == "$" {
+			if s != nil {
+				id = s.lastID
+			}
+		} else if id, err = parseStreamID(raw, 0); err != nil {
+			return errorReply(err.Error())
+		}
+
+		if s == nil {
+			s = newStream()
+			store[key] = StoreEntry{value: s}
+			notifyKeyspaceEvent(notifyNew, "new", key, currentDB.id)
+		}
+		if s.createGroup(groupName, id, entriesRead) == nil {
+			return errorReply("BUSYGROUP Consumer Group name already exists")
+		}
+		signalModifiedKey(currentDB, key)
+		notifyKeyspaceEvent(notifyStream, "xgroup-create", key, currentDB.id)
+		return []byte("+OK\r\n"), nil
+
+	case "SETID":
+		id := s.lastID
+		if raw := *args[4].Value; raw != "$" {
+			if id, err = parseRangeID(raw, 0); err != nil {
+				return errorReply(err.Error())
+			}
+		}
+		g.lastID = id
+		g.entriesRead = entriesRead
+		signalModifiedKey(currentDB, key)
+		notifyKeyspaceEvent(notifyStream, "xgroup-setid", key, currentDB.id)
+		return []byte("+OK\r\n"), nil
+
+	case "DESTROY":
+		if s.destroyGroup(groupName) {
+			signalModifiedKey(currentDB, key)
+			notifyKeyspaceEvent(notifyStream, "xgroup-destroy", key, currentDB.id)
+			return SerializeInteger(Integer{Value: 1})
+		}
+		return SerializeInteger(Integer{Value: 0})
+
+	case "CREATECONSUMER":
+		if g.createConsumer(*args[4].Value) == nil {
+			return SerializeInteger(Integer{Value: 0})
+		}
+		signalModifiedKey(currentDB, key)
+		notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key, currentDB.id)
+		return SerializeInteger(Integer{Value: 1})
+
+	default: // DELCONSUMER
+		pending := 0
+		if c := g.lookupConsumer(*args[4].Value); c != nil {
+			pending = g.deleteConsumer(c)
+		}
+		signalModifiedKey(currentDB, key)
+		notifyKeyspaceEvent(notifyStream, "xgroup-delconsumer", key, currentDB.id)
+		return SerializeInteger(Integer{Value: pending})
+	}
+}
+
+// handleXAck removes entries from a group's pending list and returns how many were pending
+func handleXAck(args ...BulkString) ([]byte, error) {
+	if len(args) < 4 {
+		return wrongArgsReply("xack")
+	}
+
+	ids := make([]streamID, 0, len(args)-3)
+	for _, arg := range args[3:] {
+		id, err := parseStreamID(*arg.Value, 0)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		ids = append(ids, id)
+	}
+
+	s, err := lookupStream(*args[1].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if s == nil {
+		return SerializeInteger(Integer{Value: 0})
+	}
+	g := s.lookupGroup(*args[2].Value)
+	if g == nil {
+		return SerializeInteger(Integer{Value: 0})
+	}
+
+	acked := 0
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+			dirty++
+		}
+	}
+	return SerializeInteger(Integer{Value: acked})
+}
+
+// handleXPending reports a group's pending entries, as a summary or as an extended listing of a range
+func handleXPending(args ...BulkString) ([]byte, error) {
+	if len(args) < 3 {
+		return wrongArgsReply("xpending")
+	}
+	justInfo := len(args) == 3
+	if !justInfo && (len(args) < 6 || len(args) > 9) {
+		return errorReply(errSyntax.Error())
+	}
+
+	var (
+		minIdle  int64
+		start    = minStreamID
+		end      = maxStreamID
+		count    int64
+		consumer string
+		err      error
+	)
+	if !justInfo {
+		startIdx := 3
+		if strings.ToUpper(*args[3].Value) == "IDLE" {
+			if minIdle, err = parseInt(args[4]); err != nil {
+				return errorReply(err.Error())
+			}
+			if len(args) < 8 {
+				return errorReply(errSyntax.Error())
+			}
+			startIdx += 2
+		}
+
+		if count, err = parseInt(args[startIdx+2]); err != nil {
+			return errorReply(err.Error())
+		}
+		if count < 0 {
+			count = 0
+		}
+
+		var startEx, endEx bool
+		if start, startEx, err = parseIntervalID(*args[startIdx].Value, 0); err != nil {
+			return errorReply(err.Error())
+		}
+		if startEx {
+			if start, err = start.incr(); err != nil {
+				return errorReply("ERR invalid start ID for the interval")
+			}
+		}
+		if end, endEx, err = parseIntervalID(*args[startIdx+1].Value, math.MaxUint64); err != nil {
+			return errorReply(err.Error())
+		}
+		if endEx {
+			if end, err = end.decr(); err != nil {
+				return errorReply("ERR invalid end ID for the interval")
+			}
+		}
+		if len(args) == startIdx+4 {
+			consumer = *args[startIdx+3].Value
+		}
+	}
+
+	_, g, err := lookupStreamGroup(args)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	if justInfo {
+		if g.pending.Len() == 0 {
+			return SerializeArray(Array{Elements: &[]RESPData{Integer{Value: 0}, BulkString{}, BulkString{}, Array{}}})
+		}
+		first, _, _ := g.pending.First()
+		last, _, _ := g.pending.Last()
+
+		consumers := []RESPData{}
+		g.consumers.Ascend(nil, func(_ []byte, c *streamConsumer) bool {
+			if n := c.pending.Len(); n > 0 {
+				consumers = append(consumers, Array{Elements: &[]RESPData{bulkString(c.name), bulkString(strconv.Itoa(n))}})
+			}
+			return true
+		})
+		return SerializeArray(Array{Elements: &[]RESPData{
+			Integer{Value: g.pending.Len()},
+			bulkString(streamIDFromKey(first).String()),
+			bulkString(streamIDFromKey(last).String()),
+			Array{Elements: &consumers},
+		}})
+	}
+
+	pel := g.pending
+	if consumer != "" {
+		c := g.lookupConsumer(consumer)
+		if c == nil {
+			return SerializeArray(Array{Elements: &[]RESPData{}})
+		}
+		pel = c.pending
+	}
+
+	now := nowMillis()
+	entries := []RESPData{}
+	if count > 0 {
+		pel.Ascend(start.key(), func(key []byte, p *pendingEntry) bool {
+			id := streamIDFromKey(key)
+			if end.less(id) {
+				return false
+			}
+			idle := now - p.deliveryTime
+			if minIdle > 0 && idle < minIdle {
+				return true
+			}
+			entries = append(entries, Array{Elements: &[]RESPData{
+				bulkString(id.String()),
+				bulkString(p.consumer.name),
+				Integer{Value: int(idle)},
+				Integer{Value: int(p.deliveryCount)},
+			}})
+			return int64(len(entries)) < count
+		})
+	}
+	return SerializeArray(Array{Elements: &entries})
+}
+
+// claimEntry transfers a pending entry to c and renders the reply for it
+func claimEntry(s *stream, g *consumerGroup, c *streamConsumer, id streamID, p *pendingEntry, justID bool) RESPData {
+	g.assign(id.key(), p, c)
+	c.activeTime = nowMillis()
+	if justID {
+		return bulkString(id.String())
+	}
+	return streamEntryReply(s.entry(id))
+}
+
+// dropPending removes a pending entry whose stream entry no longer exists
+func (g *consumerGroup) dropPending(id streamID, p *pendingEntry) {
+	key := id.key()
+	g.pending.Remove(key)
+	if p.consumer != nil {
+		p.consumer.pending.Remove(key)
+	}
+}
+
+// handleXClaim changes the owner of pending entries that have been idle for at least min-idle-time
+func handleXClaim(args ...BulkString) ([]byte, error) {
+	if len(args) < 6 {
+		return wrongArgsReply("xclaim")
+	}
+
+	minIdle, err := strconv.ParseInt(*args[4].Value, 10, 64)
+	if err != nil {
+		return errorReply("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+
+	// IDs come first, the first argument that is not an ID starts the options
+	var ids []streamID
+	j := 5
+	for ; j < len(args); j++ {
+		id, err := parseStreamID(*args[j].Value, 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := nowMillis()
+	deliveryTime := int64(-1)
+	retryCount := int64(-1)
+	force, justID := false, false
+	lastID := minStreamID
+	for ; j < len(args); j++ {
+		opt := strings.ToUpper(*args[j].Value)
+		moreArgs := j+1 < len(args)
+		switch {
+		case opt == "FORCE":
+			force = true
+		case opt == "JUSTID":
+			justID = true
+		case opt == "IDLE" && moreArgs:
+			j++
+			idle, err := strconv.ParseInt(*args[j].Value, 10, 64)
+			if err != nil {
+				return errorReply("ERR Invalid IDLE option argument for XCLAIM")
+			}
+			deliveryTime = now - idle
+		case opt == "TIME" && moreArgs:
+			j++
+			if deliveryTime, err = strconv.ParseInt(*args[j].Value, 10, 64); err != nil {
+				return errorReply("ERR Invalid TIME option argument for XCLAIM")
+			}
+		case opt == "RETRYCOUNT" && moreArgs:
+			j++
+			if retryCount, err = strconv.ParseInt(*args[j].Value, 10, 64); err != nil {
+				return errorReply("ERR Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+		case opt == "LASTID" && moreArgs:
+			j++
+			if lastID, err = parseStreamID(*args[j].Value, 0); err != nil {
+				return errorReply(err.Error())
+			}
+		default:
+			return errorReply(fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", *args[j].Value))
+		}
+	}
+	// a bogus delivery time is clamped rather than rejected since clients compute it from their own clocks
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	s, g, err := lookupStreamGroup(args)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	// every claimed entry is logged with its resulting state, since IDLE and the retry counter are relative
+	key, group, consumer := *args[1].Value, *args[2].Value, *args[3].Value
+	preventPropagation()
+	if g.lastID.less(lastID) {
+		g.lastID = lastID
+		defer propagateGroupID(key, group, g)
+	}
+
+	var c *streamConsumer
+	claimed := []RESPData{}
+	for _, id := range ids {
+		p, pending := g.pending.Find(id.key())
+
+		if !s.entryExists(id) {
+			if pending {
+				g.dropPending(id, p)
+				propagateXClaim(key, group, consumer, id, p, g)
+			}
+			continue
+		}
+
+		if force && !pending {
+			p = &pendingEntry{deliveryTime: now, deliveryCount: 1}
+			g.pending.Insert(id.key(), p)
+			pending = true
+		}
+		if !pending {
+			continue
+		}
+		if p.consumer != nil && minIdle > 0 && now-p.deliveryTime < minIdle {
+			continue
+		}
+
+		if c == nil {
+			c = g.consumer(*args[1].Value, consumer)
+		}
+		p.deliveryTime = deliveryTime
+		if retryCount >= 0 {
+			p.deliveryCount = uint64(retryCount)
+		} else if !justID {
+			p.deliveryCount++
+		}
+		claimed = append(claimed, claimEntry(s, g, c, id, p, justID))
+		propagateXClaim(key, group, consumer, id, p, g)
+	}
+	return SerializeArray(Array{Elements: &claimed})
+}
+
+// handleXAutoClaim scans a group's PEL from start and claims idle entries, returning a cursor for the next call
+func handleXAutoClaim(args ...BulkString) ([]byte, error) {
+	if len(args) < 6 {
+		return wrongArgsReply("xautoclaim")
+	}
+
+	minIdle, err := strconv.ParseInt(*args[4].Value, 10, 64)
+	if err != nil {
+		return errorReply("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+
+	start, startEx, err := parseIntervalID(*args[5].Value, 0)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if startEx {
+		if start, err = start.incr(); err != nil {
+			return errorReply("ERR invalid start ID for the interval")
+		}
+	}
+
+	const attemptsFactor = 10
+	count := int64(100)
+	justID := false
+	for j := 6; j < len(args); j++ {
+		opt := strings.ToUpper(*args[j].Value)
+		switch {
+		case opt == "COUNT" && j+1 < len(args):
+			j++
+			n, err := strconv.ParseInt(*args[j].Value, 10, 64)
+			if err != nil || n < 1 || n > math.MaxInt64/16 {
+				return errorReply("ERR COUNT must be > 0")
+			}
+			count = n
+		case opt == "JUSTID":
+			justID = true
+		default:
+			return errorReply(errSyntax.Error())
+		}
+	}
+
+	s, g, err := lookupStreamGroup(args)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	key, group, consumer := *args[1].Value, *args[2].Value, *args[3].Value
+	preventPropagation()
+
+	// collect the candidates first since claiming and dropping entries mutates the PEL being walked
+	type candidate struct {
+		id streamID
+		p  *pendingEntry
+	}
+	attempts := count * attemptsFactor
+	var candidates []candidate
+	next := minStreamID
+	g.pending.Ascend(start.key(), func(key []byte, p *pendingEntry) bool {
+		if int64(len(candidates)) == attempts {
+			next = streamIDFromKey(key)
+			return false
+		}
+		candidates = append(candidates, candidate{streamIDFromKey(key), p})
+		return true
+	})
+
+	now := nowMillis()
+	var c *streamConsumer
+	claimed := []RESPData{}
+	deleted := []RESPData{}
+	for _, cand := range candidates {
+		// once enough entries were handled the cursor points at the first one left unexamined
+		if count == 0 {
+			next = cand.id
+			break
+		}
+		if !s.entryExists(cand.id) {
+			g.dropPending(cand.id, cand.p)
+			propagateXClaim(key, group, consumer, cand.id, cand.p, g)
+			deleted = append(deleted, bulkString(cand.id.String()))
+			count--
+			continue
+		}
+		if minIdle > 0 && now-cand.p.deliveryTime < minIdle {
+			continue
+		}
+
+		if c == nil {
+			c = g.consumer(*args[1].Value, consumer)
+		}
+		cand.p.deliveryTime = now
+		if !justID {
+			cand.p.deliveryCount++
+		}
+		claimed = append(claimed, claimEntry(s, g, c, cand.id, cand.p, justID))
+		propagateXClaim(key, group, consumer, cand.id, cand.p, g)
+		count--
+	}
+
+	return SerializeArray(Array{Elements: &[]RESPData{
+		bulkString(next.String()),
+		Array{Elements: &claimed},
+		Array{Elements: &deleted},
+	}})
+}
+
+// streamInfoFields renders alternating names and values as the flat arrays XINFO replies with
+func streamInfoFields(pairs ...RESPData) RESPData {
+	return Array{Elements: &pairs}
+}
+
+func nullableInt(n int64, ok bool) RESPData {
+	if !ok {
+		return BulkString{}
+	}
+	return Integer{Value: int(n)}
+}
+
+// handleXInfo introspects streams: XINFO STREAM [FULL [COUNT n]], XINFO GROUPS and XINFO CONSUMERS
+func handleXInfo(args ...BulkString) ([]byte, error) {
+	if len(args) < 2 {
+		return wrongArgsReply("xinfo")
+	}
+	sub := strings.ToUpper(*args[1].Value)
+
+	switch {
+	case sub == "HELP":
+		return helpReply(
+			"XINFO <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CONSUMERS <key> <groupname>",
+			"    Show consumers of <groupname>.",
+			"GROUPS <key>",
+			"    Show the stream consumer groups.",
+			"STREAM <key> [FULL [COUNT <count>]",
+			"    Show information about the stream.",
+			"HELP",
+			"    Print this help.",
+		)
+	case sub == "CONSUMERS" && len(args) == 4,
+		sub == "GROUPS" && len(args) == 3,
+		sub == "STREAM" && len(args) >= 3:
+	default:
+		return subcommandSyntaxReply("xinfo", *args[1].Value)
+	}
+
+	key := *args[2].Value
+	s, err := lookupStream(key)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if s == nil {
+		return errorReply("ERR no such key")
+	}
+
+	switch sub {
+	case "CONSUMERS":
+		g := s.lookupGroup(*args[3].Value)
+		if g == nil {
+			return errorReply(fmt.Sprintf("NOGROUP No such consumer group '%s' for key name '%s'", *args[3].Value, key))
+		}
+		now := nowMillis()
+		consumers := []RESPData{}
+		g.consumers.Ascend(nil, func(_ []byte, c *streamConsumer) bool {
+			inactive := int64(-1)
+			if c.activeTime != -1 {
+				inactive = now - c.activeTime
+			}
+			consumers = append(consumers, streamInfoFields(
+				bulkString("name"), bulkString(c.name),
+				bulkString("pending"), Integer{Value: c.pending.Len()},
+				bulkString("idle"), Integer{Value: int(now - c.seenTime)},
+				bulkString("inactive"), Integer{Value: int(inactive)},
+			))
+			return true
+		})
+		return SerializeArray(Array{Elements: &consumers})
+
+	case "GROUPS":
+		groups := []RESPData{}
+		s.forEachGroup(func(name string, g *consumerGroup) {
+			lag, ok := s.lag(g)
+			groups = append(groups, streamInfoFields(
+				bulkString("name"), bulkString(name),
+				bulkString("consumers"), Integer{Value: g.consumers.Len()},
+				bulkString("pending"), Integer{Value: g.pending.Len()},
+				bulkString("last-delivered-id"), bulkString(g.lastID.String()),
+				bulkString("entries-read"), nullableInt(g.entriesRead, g.entriesRead != invalidEntriesRead),
+				bulkString("lag"), nullableInt(lag, ok),
+			))
+		})
+		return SerializeArray(Array{Elements: &groups})
+	}
+
+	full := false
+	count := int64(10)
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(*args[i].Value)
+		switch {
+		case opt == "FULL" && i == 3:
+			full = true
+		case opt == "COUNT" && full && i+1 < len(args):
+			i++
+			if count, err = parseInt(args[i]); err != nil {
+				return errorReply(err.Error())
+			}
+			if count < 0 {
+				count = 10
+			}
+		default:
+			return errorReply(errSyntax.Error())
+		}
+	}
+
+	header := []RESPData{
+		bulkString("length"), Integer{Value: int(s.length)},
+		bulkString("radix-tree-keys"), Integer{Value: s.nodes.Len()},
+		bulkString("radix-tree-nodes"), Integer{Value: s.nodes.nodeCount()},
+		bulkString("last-generated-id"), bulkString(s.lastID.String()),
+		bulkString("max-deleted-entry-id"), bulkString(s.maxDeletedID.String()),
+		bulkString("entries-added"), Integer{Value: int(s.entriesAdded)},
+		bulkString("recorded-first-entry-id"), bulkString(s.firstID.String()),
+	}
+
+	if !full {
+		groupCount := 0
+		if s.groups != nil {
+			groupCount = s.groups.Len()
+		}
+		first, last := RESPData(BulkString{}), RESPData(BulkString{})
+		s.forRange(minStreamID, maxStreamID, false, func(e *streamEntry) bool {
+			first = streamEntryReply(e)
+			return false
+		})
+		s.forRange(minStreamID, maxStreamID, true, func(e *streamEntry) bool {
+			last = streamEntryReply(e)
+			return false
+		})
+		header = append(header,
+			bulkString("groups"), Integer{Value: groupCount},
+			bulkString("first-entry"), first,
+			bulkString("last-entry"), last,
+		)
+		return SerializeArray(Array{Elements: &header})
+	}
+
+	withinCount := func(n int) bool {
+		return count == 0 || int64(n) < count
+	}
+
+	entries := []RESPData{}
+	s.forRange(minStreamID, maxStreamID, false, func(e *streamEntry) bool {
+		if !withinCount(len(entries)) {
+			return false
+		}
+		entries = append(entries, streamEntryReply(e))
+		return true
+	})
+
+	groups := []RESPData{}
+	s.forEachGroup(func(name string, g *consumerGroup) {
+		pel := []RESPData{}
+		g.pending.Ascend(nil, func(key []byte, p *pendingEntry) bool {
+			if !withinCount(len(pel)) {
+				return false
+			}
+			pel = append(pel, Array{Elements: &[]RESPData{
+				bulkString(streamIDFromKey(key).String()),
+				bulkString(p.consumer.name),
+				Integer{Value: int(p.deliveryTime)},
+				Integer{Value: int(p.deliveryCount)},
+			}})
+			return true
+		})
+
+		consumers := []RESPData{}
+		g.consumers.Ascend(nil, func(_ []byte, c *streamConsumer) bool {
+			consumerPEL := []RESPData{}
+			c.pending.Ascend(nil, func(key []byte, p *pendingEntry) bool {
+				if !withinCount(len(consumerPEL)) {
+					return false
+				}
+				consumerPEL = append(consumerPEL, Array{Elements: &[]RESPData{
+					bulkString(streamIDFromKey(key).String()),
+					Integer{Value: int(p.deliveryTime)},
+					Integer{Value: int(p.deliveryCount)},
+				}})
+				return true
+			})
+			consumers = append(consumers, streamInfoFields(
+				bulkString("name"), bulkString(c.name),
+				bulkString("seen-time"), Integer{Value: int(c.seenTime)},
+				bulkString("active-time"), Integer{Value: int(c.activeTime)},
+				bulkString("pel-count"), Integer{Value: c.pending.Len()},
+				bulkString("pending"), Array{Elements: &consumerPEL},
+			))
+			return true
+		})
+
+		lag, ok := s.lag(g)
+		groups = append(groups, streamInfoFields(
+			bulkString("name"), bulkString(name),
+			bulkString("last-delivered-id"), bulkString(g.lastID.String()),
+			bulkString("entries-read"), nullableInt(g.entriesRead, g.entriesRead != invalidEntriesRead),
+			bulkString("lag"), nullableInt(lag, ok),
+			bulkString("pel-count"), Integer{Value: g.pending.Len()},
+			bulkString("pending"), Array{Elements: &pel},
+			bulkString("consumers"), Array{Elements: &consumers},
+		))
+	})
+
+	header = append(header,
+		bulkString("entries"), Array{Elements: &entries},
+		bulkString("groups"), Array{Elements: &groups},
+	)
+	return SerializeArray(Array{Elements: &header})
+}
+
+// forEachGroup visits the consumer groups in name order
+func (s *stream) forEachGroup(fn func(name string, g *consumerGroup)) {
+	if s.groups == nil {
+		return
+	}
+	s.groups.Ascend(nil, func(key []byte, g *consumerGroup) bool {
+		fn(string(key), g)
+		return true
+	})
+}
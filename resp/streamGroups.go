@@ -0,0 +1,282 @@
+package resp
+
+import "time"
+
+// invalidEntriesRead marks a consumer group whose logical read counter is unknown
+const invalidEntriesRead = -1
+
+// pendingEntry tracks a delivered but not yet acknowledged entry, shared by the group and consumer PELs
+type pendingEntry struct {
+	deliveryTime  int64 // unix time in milliseconds
+	deliveryCount uint64
+	consumer      *streamConsumer
+}
+
+type streamConsumer struct {
+	name       string
+	seenTime   int64
+	activeTime int64 // -1 until the consumer reads or claims something
+	pending    *rax[*pendingEntry]
+}
+
+type consumerGroup struct {
+	lastID      streamID
+	entriesRead int64
+	pending     *rax[*pendingEntry]
+	consumers   *rax[*streamConsumer]
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
+
+func (s *stream) lookupGroup(name string) *consumerGroup {
+	if s.groups == nil {
+		return nil
+	}
+	g, _ := s.groups.Find([]byte(name))
+	return g
+}
+
+// createGroup adds a consumer group, returning nil when the name is taken
+func (s *stream) createGroup(name string, lastID streamID, entriesRead int64) *consumerGroup {
+	if s.groups == nil {
+		s.groups = newRax[*consumerGroup]()
+	}
+	if s.lookupGroup(name) != nil {
+		return nil
+	}
+	g := &consumerGroup{
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pending:     newRax[*pendingEntry](),
+		consumers:   newRax[*streamConsumer](),
+	}
+	s.groups.Insert([]byte(name), g)
+	return g
+}
+
+func (s *stream) destroyGroup(name string) bool {
+	return s.groups != nil && s.groups.Remove([]byte(name))
+}
+
+// entryExists reports whether a live entry with the given ID is in the stream
+func (s *stream) entryExists(id streamID) bool {
+	found := false
+	s.forRange(id, id, false, func(*streamEntry) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+func (s *stream) entry(id streamID) *streamEntry {
+	var found *streamEntry
+	s.forRange(id, id, false, func(e *streamEntry) bool {
+		found = e
+		return false
+	})
+	return found
+}
+
+// rangeHasTombstones reports whether a deleted entry may lie between start and end
+func (s *stream) rangeHasTombstones(start, end streamID) bool {
+	if s.length == 0 || s.maxDeletedID == minStreamID {
+		return false
+	}
+	if s.maxDeletedID.less(s.firstID) {
+		return false
+	}
+	return !s.maxDeletedID.less(start) && !end.less(s.maxDeletedID)
+}
+
+// estimateDistance returns the logical position of id counted from the first entry ever added,
+// or invalidEntriesRead when fragmentation makes it impossible to tell
+func (s *stream) estimateDistance(id streamID) int64 {
+	if s.entriesAdded == 0 {
+		return 0
+	}
+	if s.length == 0 && id.compare(s.lastID) < 1 {
+		return int64(s.entriesAdded)
+	}
+
+	switch id.compare(s.lastID) {
+	case 0:
+		return int64(s.entriesAdded)
+	case 1:
+		return invalidEntriesRead
+	}
+
+	if s.maxDeletedID == minStreamID || s.maxDeletedID.less(s.firstID) {
+		switch id.compare(s.firstID) {
+		case -1:
+			return int64(s.entriesAdded - s.length)
+		case 0:
+			return int64(s.entriesAdded - s.length + 1)
+		}
+	}
+	return invalidEntriesRead
+}
+
+// lag returns how many entries the group has yet to read, ok is false when it cannot be computed
+func (s *stream) lag(g *consumerGroup) (lag int64, ok bool) {
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+	if g.entriesRead != invalidEntriesRead && !s.rangeHasTombstones(g.lastID, maxStreamID) {
+		return int64(s.entriesAdded) - g.entriesRead, true
+	}
+	if read := s.estimateDistance(g.lastID); read != invalidEntriesRead {
+		return int64(s.entriesAdded) - read, true
+	}
+	return 0, false
+}
+
+// clone copies the group with its consumers and PELs, keeping pending entries shared between them
+func (g *consumerGroup) clone() *consumerGroup {
+	c := &consumerGroup{
+		lastID:      g.lastID,
+		entriesRead: g.entriesRead,
+		pending:     newRax[*pendingEntry](),
+		consumers:   newRax[*streamConsumer](),
+	}
+	consumers := make(map[*streamConsumer]*streamConsumer)
+	g.consumers.Ascend(nil, func(name []byte, consumer *streamConsumer) bool {
+		copied := *consumer
+		copied.pending = newRax[*pendingEntry]()
+		consumers[consumer] = &copied
+		c.consumers.Insert(name, &copied)
+		return true
+	})
+	g.pending.Ascend(nil, func(key []byte, p *pendingEntry) bool {
+		copied := *p
+		copied.consumer = consumers[p.consumer]
+		c.pending.Insert(key, &copied)
+		copied.consumer.pending.Insert(key, &copied)
+		return true
+	})
+	return c
+}
+
+func (g *consumerGroup) lookupConsumer(name string) *streamConsumer {
+	c, _ := g.consumers.Find([]byte(name))
+	return c
+}
+
+// createConsumer adds a consumer, returning nil when it already exists
+func (g *consumerGroup) createConsumer(name string) *streamConsumer {
+	if g.lookupConsumer(name) != nil {
+		return nil
+	}
+	c := &streamConsumer{name: name, seenTime: nowMillis(), activeTime: -1, pending: newRax[*pendingEntry]()}
+	g.consumers.Insert([]byte(name), c)
+	return c
+}
+
+// consumer returns the named consumer, creating it if needed, and marks it as seen. key is the stream
+// of the group, for the keyspace event of the creation. The caller must hold mu.
+func (g *consumerGroup) consumer(key, name string) *streamConsumer {
+	c := g.lookupConsumer(name)
+	if c == nil {
+		c = g.createConsumer(name)
+		notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key, currentDB.id)
+	}
+	c.seenTime = nowMillis()
+	return c
+}
+
+// deleteConsumer removes a consumer together with its pending entries and returns how many it had
+func (g *consumerGroup) deleteConsumer(c *streamConsumer) int {
+	pending := c.pending.Len()
+	c.pending.Ascend(nil, func(key []byte, _ *pendingEntry) bool {
+		g.pending.Remove(key)
+		return true
+	})
+	g.consumers.Remove([]byte(c.name))
+	return pending
+}
+
+// assign records that the entry with the given key is now pending for c
+func (g *consumerGroup) assign(key []byte, p *pendingEntry, c *streamConsumer) {
+	if p.consumer != c {
+		if p.consumer != nil {
+			p.consumer.pending.Remove(key)
+		}
+		c.pending.Insert(key, p)
+		p.consumer = c
+	}
+}
+
+// ack removes id from the PELs and reports whether it was pending
+func (g *consumerGroup) ack(id streamID) bool {
+	key := id.key()
+	p, ok := g.pending.Find(key)
+	if !ok {
+		return false
+	}
+	g.pending.Remove(key)
+	p.consumer.pending.Remove(key)
+	return true
+}
+
+// deliverNew serves the entries after the group's last ID to c, as XREADGROUP with ">" does,
+// moving the group forward and adding each entry to the PELs unless noAck is set
+func (s *stream) deliverNew(g *consumerGroup, c *streamConsumer, count int64, noAck bool) []*streamEntry {
+	start, err := g.lastID.incr()
+	if err != nil {
+		return nil
+	}
+
+	now := nowMillis()
+	var delivered []*streamEntry
+	s.forRange(start, maxStreamID, false, func(e *streamEntry) bool {
+		if g.entriesRead != invalidEntriesRead && !s.rangeHasTombstones(e.id, maxStreamID) {
+			g.entriesRead++
+		} else if s.entriesAdded > 0 {
+			g.entriesRead = s.estimateDistance(e.id)
+		}
+		g.lastID = e.id
+
+		if !noAck {
+			key := e.id.key()
+			p, exists := g.pending.Find(key)
+			if !exists {
+				p = &pendingEntry{}
+				g.pending.Insert(key, p)
+			}
+			p.deliveryTime = now
+			p.deliveryCount = 1
+			g.assign(key, p, c)
+		}
+		c.activeTime = now
+
+		delivered = append(delivered, e)
+		return count <= 0 || int64(len(delivered)) < count
+	})
+	return delivered
+}
+
+// deliverHistory re-serves entries already pending for c with an ID greater than after.
+// Entries deleted from the stream come back as a nil *streamEntry next to their ID.
+func (s *stream) deliverHistory(c *streamConsumer, after streamID, count int64) ([]streamID, []*streamEntry) {
+	start, err := after.incr()
+	if err != nil {
+		return nil, nil
+	}
+
+	now := nowMillis()
+	var ids []streamID
+	var entries []*streamEntry
+	c.pending.Ascend(start.key(), func(key []byte, p *pendingEntry) bool {
+		id := streamIDFromKey(key)
+		e := s.entry(id)
+		if e != nil {
+			p.deliveryTime = now
+			p.deliveryCount++
+		}
+		ids = append(ids, id)
+		entries = append(entries, e)
+		return count <= 0 || int64(len(ids)) < count
+	})
+	return ids, entries
+}
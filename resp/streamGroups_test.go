@@ -0,0 +1,77 @@
+package resp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamConsumerGroups(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"create without stream", []string{"XGROUP", "CREATE", "cg:jobs", "workers", "$"}, "-" + xgroupMissingKeyErr + "\r\n"},
+		{"create with mkstream", []string{"XGROUP", "CREATE", "cg:jobs", "workers", "$", "MKSTREAM"}, "+OK\r\n"},
+		{"create twice", []string{"XGROUP", "CREATE", "cg:jobs", "workers", "$"}, "-BUSYGROUP Consumer Group name already exists\r\n"},
+		{"add 1", []string{"XADD", "cg:jobs", "1-0", "job", "a"}, "$3\r\n1-0\r\n"},
+		{"add 2", []string{"XADD", "cg:jobs", "2-0", "job", "b"}, "$3\r\n2-0\r\n"},
+		{"add 3", []string{"XADD", "cg:jobs", "3-0", "job", "c"}, "$3\r\n3-0\r\n"},
+		{"read new as alice", []string{"XREADGROUP", "GROUP", "workers", "alice", "COUNT", "2", "STREAMS", "cg:jobs", ">"},
+			"*1\r\n*2\r\n$7\r\ncg:jobs\r\n*2\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$3\r\njob\r\n$1\r\na\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$3\r\njob\r\n$1\r\nb\r\n"},
+		{"read new as bob", []string{"XREADGROUP", "GROUP", "workers", "bob", "STREAMS", "cg:jobs", ">"},
+			"*1\r\n*2\r\n$7\r\ncg:jobs\r\n*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$3\r\njob\r\n$1\r\nc\r\n"},
+		{"nothing new", []string{"XREADGROUP", "GROUP", "workers", "bob", "STREAMS", "cg:jobs", ">"}, "*-1\r\n"},
+		{"history of alice", []string{"XREADGROUP", "GROUP", "workers", "alice", "STREAMS", "cg:jobs", "1-0"},
+			"*1\r\n*2\r\n$7\r\ncg:jobs\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$3\r\njob\r\n$1\r\nb\r\n"},
+		{"dollar in xreadgroup", []string{"XREADGROUP", "GROUP", "workers", "bob", "STREAMS", "cg:jobs", "$"},
+			"-ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.\r\n"},
+		{"missing group", []string{"XREADGROUP", "GROUP", "nobody", "bob", "STREAMS", "cg:jobs", ">"},
+			"-NOGROUP No such key 'cg:jobs' or consumer group 'nobody' in XREADGROUP with GROUP option\r\n"},
+		{"pending summary", []string{"XPENDING", "cg:jobs", "workers"},
+			"*4\r\n:3\r\n$3\r\n1-0\r\n$3\r\n3-0\r\n*2\r\n*2\r\n$5\r\nalice\r\n$1\r\n2\r\n*2\r\n$3\r\nbob\r\n$1\r\n1\r\n"},
+		{"ack", []string{"XACK", "cg:jobs", "workers", "1-0", "9-0"}, ":1\r\n"},
+		{"claim to bob", []string{"XCLAIM", "cg:jobs", "workers", "bob", "0", "2-0", "JUSTID"}, "*1\r\n$3\r\n2-0\r\n"},
+		{"claim bad option", []string{"XCLAIM", "cg:jobs", "workers", "bob", "0", "2-0", "BOGUS"}, "-ERR Unrecognized XCLAIM option 'BOGUS'\r\n"},
+		{"delete claimed entry", []string{"XDEL", "cg:jobs", "3-0"}, ":1\r\n"},
+		{"autoclaim to carol", []string{"XAUTOCLAIM", "cg:jobs", "workers", "carol", "0", "0", "JUSTID"},
+			"*3\r\n$3\r\n0-0\r\n*1\r\n$3\r\n2-0\r\n*1\r\n$3\r\n3-0\r\n"},
+		{"groups info", []string{"XINFO", "GROUPS", "cg:jobs"},
+			"*1\r\n*12\r\n$4\r\nname\r\n$7\r\nworkers\r\n$9\r\nconsumers\r\n:3\r\n$7\r\npending\r\n:1\r\n$17\r\nlast-delivered-id\r\n$3\r\n3-0\r\n$12\r\nentries-read\r\n:3\r\n$3\r\nlag\r\n:0\r\n"},
+		{"delete consumer", []string{"XGROUP", "DELCONSUMER", "cg:jobs", "workers", "carol"}, ":1\r\n"},
+		{"create consumer", []string{"XGROUP", "CREATECONSUMER", "cg:jobs", "workers", "dave"}, ":1\r\n"},
+		{"setid", []string{"XGROUP", "SETID", "cg:jobs", "workers", "0"}, "+OK\r\n"},
+		{"reread after setid", []string{"XREADGROUP", "GROUP", "workers", "dave", "NOACK", "STREAMS", "cg:jobs", ">"},
+			"*1\r\n*2\r\n$7\r\ncg:jobs\r\n*2\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$3\r\njob\r\n$1\r\na\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$3\r\njob\r\n$1\r\nb\r\n"},
+		{"pending after noack", []string{"XPENDING", "cg:jobs", "workers"}, "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n"},
+		{"destroy", []string{"XGROUP", "DESTROY", "cg:jobs", "workers"}, ":1\r\n"},
+		{"unknown subcommand", []string{"XGROUP", "FOO", "cg:jobs"}, "-ERR unknown subcommand or wrong number of arguments for 'FOO'. Try XGROUP HELP.\r\n"},
+	})
+}
+
+func TestXReadBlocksUntilAdd(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"seed", []string{"XADD", "blk:events", "1-0", "k", "v"}, "$3\r\n1-0\r\n"},
+		{"unbalanced", []string{"XREAD", "STREAMS", "blk:events", "blk:other", "$"},
+			"-ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.\r\n"},
+		{"non blocking read", []string{"XREAD", "STREAMS", "blk:events", "$"}, "*-1\r\n"},
+		{"timeout", []string{"XREAD", "BLOCK", "20", "STREAMS", "blk:events", "$"}, "*-1\r\n"},
+	})
+
+	done := make(chan string)
+	go func() {
+		result, _ := ExecuteRespData(respCommand("XREAD", "BLOCK", "0", "STREAMS", "blk:events", "$"))
+		done <- string(result)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := ExecuteRespData(respCommand("XADD", "blk:events", "2-0", "k", "w")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "*1\r\n*2\r\n$10\r\nblk:events\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nk\r\n$1\r\nw\r\n"
+	select {
+	case result := <-done:
+		if result != expected {
+			t.Errorf("expected %q, but got %q", expected, result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("XREAD BLOCK was not woken by XADD")
+	}
+}
@@ -0,0 +1,263 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamReadArgs holds the parsed options of XREAD and XREADGROUP
+type streamReadArgs struct {
+	count    int64 // 0 means no limit
+	block    time.Duration
+	blocking bool
+	noAck    bool
+	group    string
+	consumer string
+	keys     []string
+	ids      []string
+}
+
+func parseStreamReadArgs(args []BulkString, xreadgroup bool) (streamReadArgs, error) {
+	parsed := streamReadArgs{}
+	name := strings.ToLower(*args[0].Value)
+	hasGroup := false
+
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(*args[i].Value)
+		moreArgs := len(args) - 1 - i
+
+		switch {
+		case opt == "BLOCK" && moreArgs >= 1:
+			i++
+			ms, err := strconv.ParseInt(*args[i].Value, 10, 64)
+			if err != nil {
+				return parsed, errors.New("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return parsed, errors.New("ERR timeout is negative")
+			}
+			parsed.blocking = true
+			parsed.block = time.Duration(ms) * time.Millisecond
+
+		case opt == "COUNT" && moreArgs >= 1:
+			i++
+			count, err := parseInt(args[i])
+			if err != nil {
+				return parsed, err
+			}
+			if count < 0 {
+				count = 0
+			}
+			parsed.count = count
+
+		case opt == "STREAMS" && moreArgs >= 1:
+			rest := args[i+1:]
+			if len(rest)%2 != 0 {
+				wanted := "$"
+				if xreadgroup {
+					wanted = ">"
+				}
+				return parsed, fmt.Errorf("ERR Unbalanced '%s' list of streams: for each stream key an ID or '%s' must be specified.", name, wanted)
+			}
+			half := len(rest) / 2
+			for j := 0; j < half; j++ {
+				parsed.keys = append(parsed.keys, *rest[j].Value)
+				parsed.ids = append(parsed.ids, *rest[half+j].Value)
+			}
+			i = len(args)
+
+		case opt == "GROUP" && moreArgs >= 2:
+			if !xreadgroup {
+				return parsed, errors.New("ERR The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			parsed.group = *args[i+1].Value
+			parsed.consumer = *args[i+2].Value
+			hasGroup = true
+			i += 2
+
+		case opt == "NOACK" && xreadgroup:
+			parsed.noAck = true
+
+		default:
+			return parsed, errSyntax
+		}
+	}
+
+	if len(parsed.keys) == 0 {
+		return parsed, errSyntax
+	}
+	if xreadgroup && !hasGroup {
+		return parsed, errors.New("ERR Missing GROUP option for XREADGROUP")
+	}
+	return parsed, nil
+}
+
+// streamReadTarget is one key of an XREAD or XREADGROUP call with its resolved starting ID
+type streamReadTarget struct {
+	key     string
+	after   streamID
+	newOnly bool // ">" in XREADGROUP
+}
+
+// resolveReadTargets checks the keys and turns "$", ">" and explicit IDs into targets. The caller must hold mu.
+func resolveReadTargets(parsed streamReadArgs, xreadgroup bool) ([]streamReadTarget, error) {
+	targets := make([]streamReadTarget, len(parsed.keys))
+	for i, key := range parsed.keys {
+		targets[i].key = key
+		s, err := lookupStream(key)
+		if err != nil {
+			return nil, err
+		}
+		if xreadgroup && (s == nil || s.lookupGroup(parsed.group) == nil) {
+			return nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, parsed.group)
+		}
+
+		switch raw := parsed.ids[i]; raw {
+		case "$":
+			if xreadgroup {
+				return nil, errors.New("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+			}
+			if s != nil {
+				targets[i].after = s.lastID
+			}
+		case ">":
+			if !xreadgroup {
+				return nil, errors.New("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+			}
+			targets[i].newOnly = true
+		default:
+			id, err := parseStreamID(raw, 0)
+			if err != nil {
+				return nil, err
+			}
+			targets[i].after = id
+		}
+	}
+	return targets, nil
+}
+
+// serveStreamReads builds the per key replies that can be served right now. The caller must hold mu.
+func serveStreamReads(parsed streamReadArgs, targets []streamReadTarget, xreadgroup bool) ([]RESPData, error) {
+	var replies []RESPData
+	for _, target := range targets {
+		s, err := lookupStream(target.key)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			if xreadgroup {
+				return nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", target.key, parsed.group)
+			}
+			continue
+		}
+
+		var entries []RESPData
+		if xreadgroup {
+			g := s.lookupGroup(parsed.group)
+			if g == nil {
+				return nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", target.key, parsed.group)
+			}
+			if g.lookupConsumer(parsed.consumer) == nil {
+				propagateConsumerCreation(target.key, parsed.group, parsed.consumer)
+			}
+			c := g.consumer(target.key, parsed.consumer)
+
+			if !target.newOnly {
+				ids, history := s.deliverHistory(c, target.after, parsed.count)
+				entries = []RESPData{}
+				for i, e := range history {
+					if e == nil {
+						entries = append(entries, Array{Elements: &[]RESPData{bulkString(ids[i].String()), Array{}}})
+					} else {
+						entries = append(entries, streamEntryReply(e))
+					}
+				}
+			} else if g.lastID.less(s.lastValidID()) {
+				delivered := s.deliverNew(g, c, parsed.count, parsed.noAck)
+				for _, e := range delivered {
+					entries = append(entries, streamEntryReply(e))
+					if !parsed.noAck {
+						p, _ := g.pending.Find(e.id.key())
+						propagateXClaim(target.key, parsed.group, parsed.consumer, e.id, p, g)
+					}
+				}
+				if len(delivered) > 0 {
+					propagateGroupID(target.key, parsed.group, g)
+				}
+			}
+		} else if start, err := target.after.incr(); err == nil {
+			s.forRange(start, maxStreamID, false, func(e *streamEntry) bool {
+				entries = append(entries, streamEntryReply(e))
+				return parsed.count <= 0 || int64(len(entries)) < parsed.count
+			})
+		}
+
+		if entries == nil {
+			continue
+		}
+		replies = append(replies, Array{Elements: &[]RESPData{bulkString(target.key), Array{Elements: &entries}}})
+	}
+	return replies, nil
+}
+
+// streamRead serves XREAD and XREADGROUP, blocking for new entries when BLOCK is given and nothing is available
+func streamRead(args []BulkString, xreadgroup bool) ([]byte, error) {
+	parsed, err := parseStreamReadArgs(args, xreadgroup)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	targets, err := resolveReadTargets(parsed, xreadgroup)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	var deadline time.Time
+	if parsed.block > 0 {
+		deadline = time.Now().Add(parsed.block)
+	}
+
+	for {
+		replies, err := serveStreamReads(parsed, targets, xreadgroup)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		if len(replies) > 0 {
+			return SerializeArray(Array{Elements: &replies})
+		}
+		if !parsed.blocking || denyBlocking {
+			return SerializeArray(Array{})
+		}
+
+		timeout := time.Duration(0)
+		if !deadline.IsZero() {
+			if timeout = time.Until(deadline); timeout <= 0 {
+				return SerializeArray(Array{})
+			}
+		}
+		if !blockOnKeys(parsed.keys).wait(timeout) {
+			return SerializeArray(Array{})
+		}
+	}
+}
+
+// handleXRead returns entries newer than the given IDs from one or more streams
+func handleXRead(args ...BulkString) ([]byte, error) {
+	if len(args) < 4 {
+		return wrongArgsReply("xread")
+	}
+	return streamRead(args, false)
+}
+
+// handleXReadGroup reads on behalf of a consumer of a group, either new entries (">") or its pending history
+func handleXReadGroup(args ...BulkString) ([]byte, error) {
+	if len(args) < 7 {
+		return wrongArgsReply("xreadgroup")
+	}
+	// what was delivered is logged as XCLAIM and XGROUP SETID as it happens
+	preventPropagation()
+	return streamRead(args, true)
+}
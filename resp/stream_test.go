@@ -0,0 +1,135 @@
+package resp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRaxOrdering(t *testing.T) {
+	r := newRax[int]()
+	keys := []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus", "rom"}
+	for i, k := range keys {
+		if !r.Insert([]byte(k), i) {
+			t.Fatalf("expected %s to be newly inserted", k)
+		}
+	}
+	if r.Insert([]byte("rom"), 42) {
+		t.Errorf("expected overwrite of rom to not count as a new key")
+	}
+	if r.Len() != len(keys) {
+		t.Errorf("expected %d keys, but got %d", len(keys), r.Len())
+	}
+
+	var ascending []string
+	r.Ascend([]byte("romb"), func(k []byte, _ int) bool {
+		ascending = append(ascending, string(k))
+		return true
+	})
+	expected := "[romulus rubens ruber rubicon rubicundus]"
+	if fmt.Sprint(ascending) != expected {
+		t.Errorf("expected %s, but got %v", expected, ascending)
+	}
+
+	key, _, ok := r.Floor([]byte("rubeo"))
+	if !ok || string(key) != "rubens" {
+		t.Errorf("expected floor rubens, but got %q", key)
+	}
+
+	for _, k := range []string{"rubens", "rom", "romulus"} {
+		if !r.Remove([]byte(k)) {
+			t.Errorf("expected %s to be removed", k)
+		}
+	}
+	if r.Remove([]byte("rub")) {
+		t.Errorf("expected inner node rub to not be removable")
+	}
+
+	var descending []string
+	r.Descend(nil, func(k []byte, _ int) bool {
+		descending = append(descending, string(k))
+		return true
+	})
+	expected = "[rubicundus rubicon ruber romanus romane]"
+	if fmt.Sprint(descending) != expected {
+		t.Errorf("expected %s, but got %v", expected, descending)
+	}
+	if v, ok := r.Find([]byte("ruber")); !ok || v != 4 {
+		t.Errorf("expected to find ruber with value 4, but got %d %v", v, ok)
+	}
+}
+
+func TestStreamSpansNodes(t *testing.T) {
+	s := newStream()
+	for i := uint64(1); i <= 350; i++ {
+		s.add(streamID{ms: i, seq: 0}, []string{"n", fmt.Sprint(i)})
+	}
+	if s.nodes.Len() != 4 {
+		t.Errorf("expected 4 nodes, but got %d", s.nodes.Len())
+	}
+
+	var got []streamID
+	s.forRange(streamID{99, 0}, streamID{102, 0}, false, func(e *streamEntry) bool {
+		got = append(got, e.id)
+		return true
+	})
+	if fmt.Sprint(got) != "[99-0 100-0 101-0 102-0]" {
+		t.Errorf("unexpected forward range %v", got)
+	}
+
+	got = nil
+	s.forRange(streamID{200, 0}, streamID{201, 5}, true, func(e *streamEntry) bool {
+		got = append(got, e.id)
+		return true
+	})
+	if fmt.Sprint(got) != "[201-0 200-0]" {
+		t.Errorf("unexpected reverse range %v", got)
+	}
+
+	if removed := s.trim(trimStrategy{specified: true, maxLen: 160, approx: true}); removed != 100 {
+		t.Errorf("expected approximate trim to drop one node of 100, but got %d", removed)
+	}
+	if removed := s.trim(trimStrategy{specified: true, maxLen: 160}); removed != 90 {
+		t.Errorf("expected exact trim to drop 90 entries, but got %d", removed)
+	}
+	if s.length != 160 || s.firstID != (streamID{191, 0}) {
+		t.Errorf("expected 160 entries starting at 191-0, but got %d starting at %s", s.length, s.firstID)
+	}
+}
+
+func TestStreamCommands(t *testing.T) {
+	runCommandCases(t, []commandCase{
+		{"explicit id", []string{"XADD", "st:basic", "1-1", "a", "1"}, "$3\r\n1-1\r\n"},
+		{"partial id same ms", []string{"XADD", "st:basic", "1-*", "b", "2"}, "$3\r\n1-2\r\n"},
+		{"partial id new ms", []string{"XADD", "st:basic", "5-*", "c", "3"}, "$3\r\n5-0\r\n"},
+		{"smaller id", []string{"XADD", "st:basic", "5-0", "d", "4"}, "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"},
+		{"zero id", []string{"XADD", "st:basic", "0-0", "d", "4"}, "-ERR The ID specified in XADD must be greater than 0-0\r\n"},
+		{"zero partial id on new stream", []string{"XADD", "st:zero", "0-*", "a", "1"}, "$3\r\n0-1\r\n"},
+		{"odd field count", []string{"XADD", "st:basic", "*", "a"}, "-ERR wrong number of arguments for 'xadd' command\r\n"},
+		{"invalid id", []string{"XADD", "st:basic", "1-x", "a", "1"}, "-ERR Invalid stream ID specified as stream command argument\r\n"},
+		{"nomkstream", []string{"XADD", "st:missing", "NOMKSTREAM", "*", "a", "1"}, "$-1\r\n"},
+		{"len", []string{"XLEN", "st:basic"}, ":3\r\n"},
+		{"len missing", []string{"XLEN", "st:missing"}, ":0\r\n"},
+		{"range all", []string{"XRANGE", "st:basic", "-", "+"},
+			"*3\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n*2\r\n$3\r\n5-0\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{"range exclusive with count", []string{"XRANGE", "st:basic", "(1-1", "+", "COUNT", "1"},
+			"*1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{"range incomplete end", []string{"XRANGE", "st:basic", "-", "1"},
+			"*2\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{"revrange with count", []string{"XREVRANGE", "st:basic", "+", "-", "COUNT", "1"},
+			"*1\r\n*2\r\n$3\r\n5-0\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{"invalid exclusive start", []string{"XRANGE", "st:basic", "(18446744073709551615-18446744073709551615", "+"}, "-ERR invalid start ID for the interval\r\n"},
+		{"exclusive special id", []string{"XRANGE", "st:basic", "(-", "+"}, "-ERR Invalid stream ID specified as stream command argument\r\n"},
+		{"del", []string{"XDEL", "st:basic", "1-2", "9-9"}, ":1\r\n"},
+		{"setid below top", []string{"XSETID", "st:basic", "4-0"}, "-ERR The ID specified in XSETID is smaller than the target stream top item\r\n"},
+		{"setid", []string{"XSETID", "st:basic", "10-0", "ENTRIESADDED", "7", "MAXDELETEDID", "1-2"}, "+OK\r\n"},
+		{"add after setid", []string{"XADD", "st:basic", "10-*", "e", "5"}, "$4\r\n10-1\r\n"},
+		{"setid missing key", []string{"XSETID", "st:missing", "1-0"}, "-ERR no such key\r\n"},
+		{"trim maxlen", []string{"XTRIM", "st:basic", "MAXLEN", "=", "1"}, ":2\r\n"},
+		{"trim limit without tilde", []string{"XTRIM", "st:basic", "MAXLEN", "1", "LIMIT", "10"}, "-ERR syntax error, LIMIT cannot be used without the special ~ option\r\n"},
+		{"add with minid", []string{"XADD", "st:basic", "MINID", "11", "11-0", "f", "6"}, "$4\r\n11-0\r\n"},
+		{"len after trims", []string{"XLEN", "st:basic"}, ":1\r\n"},
+		{"wrong type", []string{"SET", "st:string", "v"}, "+OK\r\n"},
+		{"xadd on string", []string{"XADD", "st:string", "*", "a", "1"}, "-" + wrongTypeErr + "\r\n"},
+		{"get on stream", []string{"GET", "st:basic"}, "-" + wrongTypeErr + "\r\n"},
+	})
+}
@@ -0,0 +1,115 @@
+package resp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// tlsContext is the TLS configuration built from the tls-* parameters, nil while TLS is not used. It is
+// replaced as a whole when they change, the connections already established keeping the one they started with.
+var tlsContext atomic.Pointer[tls.Config]
+
+// tlsConfig makes a tls-* parameter rebuild the TLS configuration once a CONFIG SET changed it
+func tlsConfig(param configParam) configParam {
+	param.apply = applyTLSConfig
+	return param
+}
+
+func setTLSAuthClients(value string) error {
+	switch v := strings.ToLower(value); v {
+	case "yes", "no", "optional":
+		config.tlsAuthClients = v
+		return nil
+	}
+	return errors.New("argument(s) must be one of the following: no, yes, optional")
+}
+
+// applyTLSConfig loads the certificates of the tls-* parameters when the server listens for TLS or
+// replicates over it, keeping the configuration in use when they can't be loaded. The caller must hold mu.
+func applyTLSConfig() error {
+	if config.tlsPort == 0 && !config.tlsReplication {
+		tlsContext.Store(nil)
+		return nil
+	}
+	ctx, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+	tlsContext.Store(ctx)
+	return nil
+}
+
+// newTLSConfig builds the configuration used both to accept connections and to connect to a master
+func newTLSConfig() (*tls.Config, error) {
+	if config.tlsCertFile == "" || config.tlsKeyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file must be specified")
+	}
+	cert, err := tls.LoadX509KeyPair(config.tlsCertFile, config.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate %s with the key %s: %v", config.tlsCertFile, config.tlsKeyFile, err)
+	}
+	ctx := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if config.tlsCACertFile != "" {
+		pem, err := os.ReadFile(config.tlsCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the CA certificates: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", config.tlsCACertFile)
+		}
+		ctx.ClientCAs, ctx.RootCAs = pool, pool
+	} else if config.tlsAuthClients != "no" || config.tlsReplication {
+		return nil, errors.New("tls-ca-cert-file must be specified when tls-replication or tls-auth-clients are enabled")
+	}
+
+	switch config.tlsAuthClients {
+	case "yes":
+		ctx.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		ctx.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return ctx, nil
+}
+
+// TLSPort is the port of the TLS listener, 0 when there is none
+func TLSPort() int {
+	return config.tlsPort
+}
+
+// tlsListener accepts TLS connections on l. Every handshake uses the configuration in use at the time,
+// so certificates changed by CONFIG SET apply to the next connections.
+func tlsListener(l net.Listener) net.Listener {
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if ctx := tlsContext.Load(); ctx != nil {
+				return ctx, nil
+			}
+			return nil, errors.New("TLS is not configured")
+		},
+	})
+}
+
+// dialMaster connects to the master, over TLS when tls-replication is set
+func dialMaster(host string, port int) (net.Conn, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	mu.RLock()
+	useTLS := config.tlsReplication
+	mu.RUnlock()
+	ctx := tlsContext.Load()
+	if !useTLS || ctx == nil {
+		return net.DialTimeout("tcp", address, replTimeout)
+	}
+	ctx = ctx.Clone()
+	ctx.ServerName = host
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: replTimeout}, Config: ctx}
+	return dialer.Dial("tcp", address)
+}
@@ -0,0 +1,246 @@
+package resp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCertificates are PEM files signed by a test authority: two server certificates with serial
+// numbers 1 and 2, which also serve as client certificates when replicating, and a client one
+type testCertificates struct {
+	ca                  string
+	server, serverKey   string
+	server2, server2Key string
+	client, clientKey   string
+	caPool              *x509.CertPool
+	clientCertificate   tls.Certificate
+}
+
+func writeTestCertificates(t *testing.T) *testCertificates {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(100),
+		Subject:               pkix.Name{CommonName: "test authority"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	certs := &testCertificates{ca: write("ca.pem", "CERTIFICATE", caDER), caPool: x509.NewCertPool()}
+	certs.caPool.AddCert(caCert)
+	issue := func(name string, serial int64, usage ...x509.ExtKeyUsage) (string, string) {
+		key := newKey()
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  usage,
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return write(name+".pem", "CERTIFICATE", der), write(name+".key", "EC PRIVATE KEY", keyDER)
+	}
+	certs.server, certs.serverKey = issue("server", 1, x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+	certs.server2, certs.server2Key = issue("server2", 2, x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+	certs.client, certs.clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth)
+	certs.clientCertificate, err = tls.LoadX509KeyPair(certs.client, certs.clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+// useTLS configures TLS with the first server certificate, as a tls-port would
+func useTLS(t *testing.T, certs *testCertificates) {
+	t.Helper()
+	mu.Lock()
+	defer mu.Unlock()
+	config.tlsPort, config.tlsCertFile, config.tlsKeyFile, config.tlsCACertFile = 1, certs.server, certs.serverKey, certs.ca
+	if err := applyTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		config.tlsPort, config.tlsCertFile, config.tlsKeyFile, config.tlsCACertFile = 0, "", "", ""
+		applyTLSConfig()
+	})
+}
+
+// serveTLS runs the clients of a TLS listener like the server does
+func serveTLS(t *testing.T) string {
+	t.Helper()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := tlsListener(tcp)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				client := NewConnClient(conn)
+				defer client.Close()
+				r := bufio.NewReader(conn)
+				for {
+					data, err := ReadCommand(r)
+					if err != nil {
+						return
+					}
+					answer, _ := client.Execute(data)
+					if _, err := client.Write(answer); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// tlsPing connects with the certificate given, if any, and returns the PING reply and the serial
+// number of the certificate of the server
+func tlsPing(t *testing.T, address string, certs *testCertificates, certificates ...tls.Certificate) (string, int64) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: certs.caPool, Certificates: certificates})
+	if err != nil {
+		return err.Error(), 0
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(respCommand("PING"))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err.Error(), 0
+	}
+	return reply, conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestTLSListener(t *testing.T) {
+	certs := writeTestCertificates(t)
+	useTLS(t, certs)
+	address := serveTLS(t)
+
+	if reply, serial := tlsPing(t, address, certs, certs.clientCertificate); reply != "+PONG\r\n" || serial != 1 {
+		t.Errorf("expected +PONG from the first certificate, got %q from %d", reply, serial)
+	}
+	if reply, _ := tlsPing(t, address, certs); reply == "+PONG\r\n" {
+		t.Error("expected a client without a certificate to be refused")
+	}
+	setConfig(t, "tls-auth-clients", "optional")
+	if reply, _ := tlsPing(t, address, certs); reply != "+PONG\r\n" {
+		t.Errorf("expected a client without a certificate to be accepted, got %q", reply)
+	}
+
+	// a certificate and its key change together, the next connections using them
+	runCommandCases(t, []commandCase{
+		{"reload", []string{"CONFIG", "SET", "tls-cert-file", certs.server2, "tls-key-file", certs.server2Key}, "+OK\r\n"},
+	})
+	if reply, serial := tlsPing(t, address, certs, certs.clientCertificate); reply != "+PONG\r\n" || serial != 2 {
+		t.Errorf("expected +PONG from the second certificate, got %q from %d", reply, serial)
+	}
+
+	// a certificate that can't be loaded leaves the one in use
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	runCommandCases(t, []commandCase{
+		{"missing file", []string{"CONFIG", "SET", "tls-cert-file", missing}, "-ERR CONFIG SET failed (possibly related to argument 'tls-cert-file') - failed to load the certificate " +
+			missing + " with the key " + certs.server2Key + ": open " + missing + ": no such file or directory\r\n"},
+		{"mismatched key", []string{"CONFIG", "SET", "tls-key-file", certs.serverKey}, "-ERR CONFIG SET failed (possibly related to argument 'tls-key-file') - failed to load the certificate " +
+			certs.server2 + " with the key " + certs.serverKey + ": tls: private key does not match public key\r\n"},
+		{"unchanged", []string{"CONFIG", "GET", "tls-*-file"}, string(respCommand("tls-ca-cert-file", certs.ca, "tls-cert-file", certs.server2, "tls-key-file", certs.server2Key))},
+		{"auth clients", []string{"CONFIG", "SET", "tls-auth-clients", "maybe"}, "-ERR CONFIG SET failed (possibly related to argument 'tls-auth-clients') - argument(s) must be one of the following: no, yes, optional\r\n"},
+		{"port", []string{"CONFIG", "SET", "tls-port", "6380"}, "-ERR CONFIG SET failed (possibly related to argument 'tls-port') - can't set immutable config\r\n"},
+	})
+	if reply, serial := tlsPing(t, address, certs, certs.clientCertificate); reply != "+PONG\r\n" || serial != 2 {
+		t.Errorf("expected +PONG from the second certificate, got %q from %d", reply, serial)
+	}
+}
+
+func TestTLSReplication(t *testing.T) {
+	useTempDir(t)
+	certs := writeTestCertificates(t)
+	useTLS(t, certs)
+	setConfig(t, "tls-replication", "yes")
+
+	serverCertificate, err := tls.LoadX509KeyPair(certs.server, certs.serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    certs.caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	runCommandCases(t, []commandCase{
+		{"replicaof", []string{"REPLICAOF", "127.0.0.1", strconv.Itoa(l.Addr().(*net.TCPAddr).Port)}, "+OK\r\n"},
+	})
+	defer ExecuteRespData(respCommand("REPLICAOF", "NO", "ONE"))
+
+	// the replica presents its certificate and starts the handshake
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	expectCommand(t, bufio.NewReader(conn), "PING")
+	if peer := conn.(*tls.Conn).ConnectionState().PeerCertificates; len(peer) == 0 || peer[0].SerialNumber.Int64() != 1 {
+		t.Errorf("expected the replica to present the first certificate, got %v", peer)
+	}
+}
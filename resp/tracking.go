@@ -0,0 +1,341 @@
+package resp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// trackingState is the client side caching mode of a client, set with CLIENT TRACKING
+type trackingState struct {
+	// redirect is the ID of the client invalidations are sent to, 0 for the client itself.
+	// brokenRedirect is set once that client is gone.
+	redirect       int64
+	brokenRedirect bool
+	bcast          bool
+	optin          bool
+	optout         bool
+	noloop         bool
+	// caching is set by CLIENT CACHING for the next command only
+	caching  bool
+	prefixes []string
+}
+
+// trackingTable maps the keys read by clients in the default tracking mode to their IDs, a key being
+// dropped once its invalidation is sent. trackingPrefixes maps the prefixes of BCAST clients to them.
+// Both are guarded by mu.
+var (
+	trackingTable    = make(map[string]map[int64]struct{})
+	trackingPrefixes = make(map[string]map[*Client]struct{})
+)
+
+// clientsByID holds the clients with a connection, guarded by mu
+var clientsByID = make(map[int64]*Client)
+
+// trackingChannel is the channel RESP2 clients get the invalidations of the clients redirecting to them on
+const trackingChannel = "__redis__:invalidate"
+
+// trackKeyRead remembers that the running client read key, so it is told once the key changes.
+// The caller must hold mu.
+func trackKeyRead(key string) {
+	c := currentClient
+	if c == nil || c.tracking == nil || c.tracking.bcast || currentCommandFlags&cmdWrite != 0 {
+		return
+	}
+	t := c.tracking
+	if (t.optin && !t.caching) || (t.optout && t.caching) {
+		return
+	}
+	if trackingTable[key] == nil {
+		trackingTable[key] = make(map[int64]struct{})
+	}
+	trackingTable[key][c.id] = struct{}{}
+}
+
+// trackingInvalidateKey tells the clients that read key, or follow a prefix of it, that it changed.
+// The caller must hold mu.
+func trackingInvalidateKey(key string) {
+	keys := Array{Elements: &[]RESPData{bulkString(key)}}
+	for prefix, clients := range trackingPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for c := range clients {
+			if c.tracking.noloop && c == currentClient {
+				continue
+			}
+			c.sendInvalidation(keys)
+		}
+	}
+
+	ids := trackingTable[key]
+	delete(trackingTable, key)
+	for id := range ids {
+		c := clientsByID[id]
+		// the client may have turned tracking off or switched to BCAST since it read the key
+		if c == nil || c.tracking == nil || c.tracking.bcast {
+			continue
+		}
+		if c.tracking.noloop && c == currentClient {
+			continue
+		}
+		c.sendInvalidation(keys)
+	}
+}
+
+// trackingInvalidateKeysOnFlush tells every tracking client that all keys changed, with a null in place
+// of the keys. The caller must hold mu.
+func trackingInvalidateKeysOnFlush() {
+	for _, c := range clientsByID {
+		if c.tracking != nil {
+			c.sendInvalidation(BulkString{})
+		}
+	}
+	clear(trackingTable)
+}
+
+// sendInvalidation sends an invalidate message for keys to the client, or the one it redirects to: a push
+// in RESP3, a message on the invalidation channel for a subscribed RESP2 client. A RESP2 client without
+// redirection can't be told. The running client gets the message after its reply. The caller must hold mu.
+func (c *Client) sendInvalidation(keys RESPData) {
+	target := c
+	if c.tracking.redirect != 0 {
+		target = clientsByID[c.tracking.redirect]
+		if target == nil {
+			c.tracking.brokenRedirect = true
+			if c.resp == 3 {
+				c.deferMessage(c.pubsubFrame(bulkString("tracking-redir-broken"), Integer{Value: int(c.tracking.redirect)}))
+			}
+			return
+		}
+	}
+
+	switch {
+	case target.resp == 3:
+		target.deferMessage(target.pubsubFrame(bulkString("invalidate"), keys))
+	case c.tracking.redirect != 0 && target.subscribed():
+		target.deferMessage(target.pubsubFrame(bulkString("message"), bulkString(trackingChannel), keys))
+	}
+}
+
+// deferMessage sends a message, after the reply when the client is the one running a command.
+// The caller must hold mu.
+func (c *Client) deferMessage(p []byte) {
+	if c == currentClient {
+		c.deferred = append(c.deferred, p)
+		return
+	}
+	c.sendMessage(p)
+}
+
+// sendDeferredMessages sends the messages held back until the reply of the command. The caller must hold mu.
+func (c *Client) sendDeferredMessages() {
+	for _, p := range c.deferred {
+		c.sendMessage(p)
+	}
+	c.deferred = nil
+}
+
+// endTrackingCaching drops what CLIENT CACHING set once the command that follows it, or the transaction
+// it starts, is done
+func (c *Client) endTrackingCaching(name string) {
+	if c.tracking != nil && c.multi == nil && name != "CLIENT" {
+		c.tracking.caching = false
+	}
+}
+
+// enableTracking turns tracking on with the given mode, or adds the prefixes of a BCAST client.
+// The caller must hold mu.
+func (c *Client) enableTracking(mode trackingState, prefixes []string) {
+	if c.tracking == nil {
+		c.tracking = &trackingState{}
+	}
+	t := c.tracking
+	t.redirect, t.brokenRedirect = mode.redirect, false
+	t.bcast, t.optin, t.optout, t.noloop = mode.bcast, mode.optin, mode.optout, mode.noloop
+	if !t.bcast {
+		return
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	for _, prefix := range prefixes {
+		if trackingPrefixes[prefix] == nil {
+			trackingPrefixes[prefix] = make(map[*Client]struct{})
+		}
+		if _, ok := trackingPrefixes[prefix][c]; !ok {
+			trackingPrefixes[prefix][c] = struct{}{}
+			t.prefixes = append(t.prefixes, prefix)
+		}
+	}
+}
+
+// disableTracking turns tracking off. The keys the client read stay in the table until they change,
+// the client being skipped then. The caller must hold mu.
+func (c *Client) disableTracking() {
+	if c.tracking == nil {
+		return
+	}
+	for _, prefix := range c.tracking.prefixes {
+		delete(trackingPrefixes[prefix], c)
+		if len(trackingPrefixes[prefix]) == 0 {
+			delete(trackingPrefixes, prefix)
+		}
+	}
+	c.tracking = nil
+}
+
+// prefixCollision returns an error when a prefix of a BCAST client would overlap with another of its own
+func (c *Client) prefixCollision(prefixes []string) error {
+	for i, prefix := range prefixes {
+		if c.tracking != nil {
+			for _, existing := range c.tracking.prefixes {
+				if strings.HasPrefix(prefix, existing) || strings.HasPrefix(existing, prefix) {
+					return fmt.Errorf("ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, existing)
+				}
+			}
+		}
+		for _, other := range prefixes[i+1:] {
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				return fmt.Errorf("ERR Prefix '%s' overlaps with another provided prefix '%s'. Prefixes for a single client must not overlap.", prefix, other)
+			}
+		}
+	}
+	return nil
+}
+
+// clientTracking implements CLIENT TRACKING ON|OFF [REDIRECT id] [BCAST] [PREFIX prefix ...] [OPTIN]
+// [OPTOUT] [NOLOOP]
+func clientTracking(c *Client, args []BulkString) ([]byte, error) {
+	var mode trackingState
+	var prefixes []string
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(*args[i].Value)
+		switch {
+		case opt == "REDIRECT" && i+1 < len(args):
+			id, err := strconv.ParseInt(*args[i+1].Value, 10, 64)
+			if err != nil {
+				return errorReply(errNotInteger.Error())
+			}
+			if clientsByID[id] == nil {
+				return errorReply("ERR The client ID you want redirect to does not exist")
+			}
+			mode.redirect = id
+			i++
+		case opt == "BCAST":
+			mode.bcast = true
+		case opt == "OPTIN":
+			mode.optin = true
+		case opt == "OPTOUT":
+			mode.optout = true
+		case opt == "NOLOOP":
+			mode.noloop = true
+		case opt == "PREFIX" && i+1 < len(args):
+			prefixes = append(prefixes, *args[i+1].Value)
+			i++
+		default:
+			return errorReply(errSyntax.Error())
+		}
+	}
+
+	switch strings.ToUpper(*args[2].Value) {
+	case "ON":
+		if !mode.bcast && len(prefixes) > 0 {
+			return errorReply("ERR PREFIX option requires BCAST mode to be enabled")
+		}
+		if t := c.tracking; t != nil {
+			if t.bcast != mode.bcast {
+				return errorReply("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+			}
+		}
+		if mode.bcast && (mode.optin || mode.optout) {
+			return errorReply("ERR OPTIN and OPTOUT are not compatible with BCAST")
+		}
+		if mode.optin && mode.optout {
+			return errorReply("ERR You can't use both OPTIN and OPTOUT")
+		}
+		if t := c.tracking; t != nil && ((mode.optin && t.optout) || (mode.optout && t.optin)) {
+			return errorReply("ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+		}
+		if mode.bcast {
+			if err := c.prefixCollision(prefixes); err != nil {
+				return errorReply(err.Error())
+			}
+		}
+		c.startOutput()
+		c.enableTracking(mode, prefixes)
+	case "OFF":
+		c.disableTracking()
+	default:
+		return errorReply(errSyntax.Error())
+	}
+	return []byte("+OK\r\n"), nil
+}
+
+// clientCaching implements CLIENT CACHING YES|NO, which picks whether the keys of the next command are
+// tracked in the OPTIN and OPTOUT modes
+func clientCaching(c *Client, args []BulkString) ([]byte, error) {
+	if c.tracking == nil {
+		return errorReply("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	}
+	switch strings.ToUpper(*args[2].Value) {
+	case "YES":
+		if !c.tracking.optin {
+			return errorReply("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+		}
+	case "NO":
+		if !c.tracking.optout {
+			return errorReply("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+		}
+	default:
+		return errorReply(errSyntax.Error())
+	}
+	c.tracking.caching = true
+	return []byte("+OK\r\n"), nil
+}
+
+// clientGetRedir implements CLIENT GETREDIR: the client invalidations are redirected to, 0 when they are
+// not and -1 when tracking is off
+func clientGetRedir(c *Client) ([]byte, error) {
+	if c.tracking == nil {
+		return SerializeInteger(Integer{Value: -1})
+	}
+	return SerializeInteger(Integer{Value: int(c.tracking.redirect)})
+}
+
+// clientTrackingInfo implements CLIENT TRACKINGINFO, describing the tracking mode of the client
+func clientTrackingInfo(c *Client) ([]byte, error) {
+	flags := []RESPData{}
+	redirect := -1
+	prefixes := []RESPData{}
+	if t := c.tracking; t == nil {
+		flags = append(flags, bulkString("off"))
+	} else {
+		flags = append(flags, bulkString("on"))
+		for _, flag := range []struct {
+			set  bool
+			name string
+		}{
+			{t.bcast, "bcast"},
+			{t.optin, "optin"},
+			{t.optout, "optout"},
+			{t.optin && t.caching, "caching-yes"},
+			{t.optout && t.caching, "caching-no"},
+			{t.noloop, "noloop"},
+			{t.brokenRedirect, "broken_redirect"},
+		} {
+			if flag.set {
+				flags = append(flags, bulkString(flag.name))
+			}
+		}
+		redirect = int(t.redirect)
+		for _, prefix := range t.prefixes {
+			prefixes = append(prefixes, bulkString(prefix))
+		}
+	}
+	return c.mapReply([]RESPData{
+		bulkString("flags"), Array{Elements: &flags},
+		bulkString("redirect"), Integer{Value: redirect},
+		bulkString("prefixes"), Array{Elements: &prefixes},
+	})
+}
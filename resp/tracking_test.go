@@ -0,0 +1,142 @@
+package resp
+
+import (
+	"strconv"
+	"testing"
+)
+
+// invalidatePush is the RESP3 invalidation of keys
+func invalidatePush(keys ...string) string {
+	frame := "*" + strconv.Itoa(len(keys)) + "\r\n"
+	for _, key := range keys {
+		frame += "$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n"
+	}
+	return ">2\r\n$10\r\ninvalidate\r\n" + frame
+}
+
+func TestClientTracking(t *testing.T) {
+	c, r := subscriber(t)
+	helloResp3(t, c, r)
+	runClientCommandCases(t, c, []commandCase{
+		{"getredir off", []string{"CLIENT", "GETREDIR"}, ""},
+		{"tracking", []string{"CLIENT", "TRACKING", "ON"}, ""},
+		{"read", []string{"GET", "tracking:key"}, ""},
+	})
+	expectOutput(t, r, ":-1\r\n+OK\r\n$-1\r\n")
+
+	// the key is forgotten once invalidated
+	runCommandCases(t, []commandCase{
+		{"write", []string{"SET", "tracking:key", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+		{"write again", []string{"SET", "tracking:key", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+	})
+	runClientCommandCases(t, c, []commandCase{
+		{"ping", []string{"PING"}, ""},
+		// the invalidation of its own write follows the reply
+		{"read", []string{"GET", "tracking:key"}, ""},
+		{"own write", []string{"DEL", "tracking:key"}, ""},
+	})
+	expectOutput(t, r, invalidatePush("tracking:key")+"+PONG\r\n$1\r\nv\r\n:1\r\n"+invalidatePush("tracking:key"))
+
+	runClientCommandCases(t, c, []commandCase{
+		{"noloop", []string{"CLIENT", "TRACKING", "ON", "NOLOOP"}, ""},
+		{"read", []string{"GET", "tracking:key"}, ""},
+		{"own write", []string{"SET", "tracking:key", "v", "PXAT", "99999999999999"}, ""},
+		{"info", []string{"CLIENT", "TRACKINGINFO"}, ""},
+		{"getredir", []string{"CLIENT", "GETREDIR"}, ""},
+		{"off", []string{"CLIENT", "TRACKING", "OFF"}, ""},
+		{"info off", []string{"CLIENT", "TRACKINGINFO"}, ""},
+	})
+	expectOutput(t, r, "+OK\r\n$-1\r\n+OK\r\n")
+	expectOutput(t, r, "%3\r\n$5\r\nflags\r\n*2\r\n$2\r\non\r\n$6\r\nnoloop\r\n$8\r\nredirect\r\n:0\r\n$8\r\nprefixes\r\n*0\r\n:0\r\n+OK\r\n")
+	expectOutput(t, r, "%3\r\n$5\r\nflags\r\n*1\r\n$3\r\noff\r\n$8\r\nredirect\r\n:-1\r\n$8\r\nprefixes\r\n*0\r\n")
+
+	// a flush invalidates everything
+	runClientCommandCases(t, c, []commandCase{
+		{"tracking", []string{"CLIENT", "TRACKING", "ON"}, ""},
+	})
+	flusher := NewClient()
+	runClientCommandCases(t, flusher, []commandCase{
+		{"select", []string{"SELECT", "9"}, "+OK\r\n"},
+		{"flush", []string{"FLUSHDB"}, "+OK\r\n"},
+	})
+	expectOutput(t, r, "+OK\r\n>2\r\n$10\r\ninvalidate\r\n$-1\r\n")
+}
+
+func TestClientTrackingModes(t *testing.T) {
+	c, r := subscriber(t)
+	helloResp3(t, c, r)
+	runClientCommandCases(t, c, []commandCase{
+		{"prefix without bcast", []string{"CLIENT", "TRACKING", "ON", "PREFIX", "user:"}, ""},
+		{"bcast optin", []string{"CLIENT", "TRACKING", "ON", "BCAST", "OPTIN"}, ""},
+		{"overlap", []string{"CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:", "PREFIX", "user:1"}, ""},
+		{"no redirect target", []string{"CLIENT", "TRACKING", "ON", "REDIRECT", "999999"}, ""},
+		{"caching off", []string{"CLIENT", "CACHING", "YES"}, ""},
+	})
+	expectOutput(t, r, "-ERR PREFIX option requires BCAST mode to be enabled\r\n")
+	expectOutput(t, r, "-ERR OPTIN and OPTOUT are not compatible with BCAST\r\n")
+	expectOutput(t, r, "-ERR Prefix 'user:' overlaps with another provided prefix 'user:1'. Prefixes for a single client must not overlap.\r\n")
+	expectOutput(t, r, "-ERR The client ID you want redirect to does not exist\r\n")
+	expectOutput(t, r, "-ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled\r\n")
+
+	// BCAST is told about every key under its prefixes, read or not
+	runClientCommandCases(t, c, []commandCase{
+		{"bcast", []string{"CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:", "PREFIX", "order:"}, ""},
+		{"switch mode", []string{"CLIENT", "TRACKING", "ON"}, ""},
+	})
+	expectOutput(t, r, "+OK\r\n-ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.\r\n")
+	runCommandCases(t, []commandCase{
+		{"matching", []string{"SET", "user:1", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+		{"not matching", []string{"SET", "item:1", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+		{"matching again", []string{"DEL", "user:1"}, ":1\r\n"},
+	})
+	expectOutput(t, r, invalidatePush("user:1")+invalidatePush("user:1"))
+
+	// OPTIN only tracks the command after CLIENT CACHING YES
+	runClientCommandCases(t, c, []commandCase{
+		{"off", []string{"CLIENT", "TRACKING", "OFF"}, ""},
+		{"optin", []string{"CLIENT", "TRACKING", "ON", "OPTIN"}, ""},
+		{"caching no", []string{"CLIENT", "CACHING", "NO"}, ""},
+		{"untracked read", []string{"GET", "optin:1"}, ""},
+		{"caching yes", []string{"CLIENT", "CACHING", "YES"}, ""},
+		{"tracked read", []string{"GET", "optin:2"}, ""},
+		{"untracked again", []string{"GET", "optin:3"}, ""},
+	})
+	expectOutput(t, r, "+OK\r\n+OK\r\n-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.\r\n$-1\r\n+OK\r\n$-1\r\n$-1\r\n")
+	runCommandCases(t, []commandCase{
+		{"write 1", []string{"SET", "optin:1", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+		{"write 2", []string{"SET", "optin:2", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+		{"write 3", []string{"SET", "optin:3", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+	})
+	expectOutput(t, r, invalidatePush("optin:2"))
+	runCommandCases(t, []commandCase{{"cleanup", []string{"DEL", "optin:1", "optin:2", "optin:3", "item:1"}, ":4\r\n"}})
+}
+
+func TestClientTrackingRedirect(t *testing.T) {
+	listener, lr := subscriber(t)
+	runClientCommandCases(t, listener, []commandCase{
+		{"subscribe", []string{"SUBSCRIBE", trackingChannel}, ""},
+	})
+	expectOutput(t, lr, "*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n:1\r\n")
+
+	c, r := subscriber(t)
+	runClientCommandCases(t, c, []commandCase{
+		{"tracking", []string{"CLIENT", "TRACKING", "ON", "REDIRECT", strconv.FormatInt(listener.id, 10)}, ""},
+		{"getredir", []string{"CLIENT", "GETREDIR"}, ""},
+		{"read", []string{"GET", "redirect:key"}, ""},
+	})
+	expectOutput(t, r, "+OK\r\n:"+strconv.FormatInt(listener.id, 10)+"\r\n$-1\r\n")
+
+	runCommandCases(t, []commandCase{
+		{"write", []string{"SET", "redirect:key", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+	})
+	expectOutput(t, lr, "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$12\r\nredirect:key\r\n")
+
+	// once the listener is gone the redirection is broken
+	listener.Close()
+	runClientCommandCases(t, c, []commandCase{
+		{"read", []string{"GET", "redirect:key"}, ""},
+		{"own write", []string{"DEL", "redirect:key"}, ""},
+		{"info", []string{"CLIENT", "TRACKINGINFO"}, ""},
+	})
+	expectOutput(t, r, "$1\r\nv\r\n:1\r\n*6\r\n$5\r\nflags\r\n*2\r\n$2\r\non\r\n$15\r\nbroken_redirect\r\n$8\r\nredirect\r\n:"+strconv.FormatInt(listener.id, 10)+"\r\n$8\r\nprefixes\r\n*0\r\n")
+}
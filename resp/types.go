@@ -51,5 +51,23 @@ func (a Array) serialize() ([]byte, error) {
 	return SerializeArray(a)
 }
 
+// Push is a RESP3 out of band message, such as a Pub/Sub message, framed like an Array
+type Push struct {
+	Elements *[]RESPData
+}
+
+func (p Push) serialize() ([]byte, error) {
+	return SerializePush(p)
+}
+
+// Map is a RESP3 map, its Elements holding the keys and values one after the other
+type Map struct {
+	Elements *[]RESPData
+}
+
+func (m Map) serialize() ([]byte, error) {
+	return SerializeMap(m)
+}
+
 
 
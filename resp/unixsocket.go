@@ -0,0 +1,64 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// unixSocketPath is the socket file the server listens on, removed when it shuts down, guarded by mu
+var unixSocketPath string
+
+// UnixSocket is the path of the Unix socket the server listens on, none when empty
+func UnixSocket() string {
+	return config.unixSocket
+}
+
+// ListenUnix listens on the unixsocket path, replacing the file a previous run may have left and giving
+// it the unixsocketperm permissions when set
+func ListenUnix() (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	path := config.unixSocket
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if config.unixSocketPerm != 0 {
+		if err := os.Chmod(path, config.unixSocketPerm); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	unixSocketPath = path
+	return l, nil
+}
+
+// removeUnixSocket deletes the socket file before the process exits. The caller must hold mu.
+func removeUnixSocket() {
+	if unixSocketPath == "" {
+		return
+	}
+	fmt.Println("Removing the unix socket file.")
+	if err := os.Remove(unixSocketPath); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error removing the unix socket file: %v\n", err)
+	}
+	unixSocketPath = ""
+}
+
+func formatUnixSocketPerm() string {
+	return strconv.FormatUint(uint64(config.unixSocketPerm), 8)
+}
+
+// setUnixSocketPerm takes the permissions of the socket file in octal, like chmod
+func setUnixSocketPerm(value string) error {
+	perm, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || perm > 0o777 {
+		return errors.New("argument must be an octal number between 0 and 777")
+	}
+	config.unixSocketPerm = os.FileMode(perm)
+	return nil
+}
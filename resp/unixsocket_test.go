@@ -0,0 +1,115 @@
+package resp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// listenUnix listens on a socket at path with the permissions given
+func listenUnix(t *testing.T, path, perm string) net.Listener {
+	t.Helper()
+	mu.Lock()
+	config.unixSocket = path
+	err := setUnixSocketPerm(perm)
+	mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		config.unixSocket, config.unixSocketPerm, unixSocketPath = "", 0, ""
+	})
+	l, err := ListenUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestUnixSocket(t *testing.T) {
+	// a file left by a previous run is replaced
+	path := filepath.Join(t.TempDir(), "redis.sock")
+	os.WriteFile(path, nil, 0o644)
+	l := listenUnix(t, path, "700")
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o700 {
+		t.Fatalf("expected a socket with permissions 700, got %v, %v", info.Mode(), err)
+	}
+	runCommandCases(t, []commandCase{
+		{"config", []string{"CONFIG", "GET", "unixsocket*"}, string(respCommand("unixsocket", path, "unixsocketperm", "700"))},
+		{"immutable", []string{"CONFIG", "SET", "unixsocketperm", "777"}, "-ERR CONFIG SET failed (possibly related to argument 'unixsocketperm') - can't set immutable config\r\n"},
+	})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverConn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConnClient(serverConn)
+	defer c.Close()
+	reply, _ := c.Execute(respCommand("CLIENT", "INFO"))
+	expected := regexp.MustCompile(`^\$\d+\r\nid=` + strconv.FormatInt(c.id, 10) + ` addr=` + regexp.QuoteMeta(path) + `:0 laddr=` + regexp.QuoteMeta(path) +
+		`:0 name= age=0 idle=0 flags=U db=0 sub=0 psub=0 ssub=0 multi=-1 watch=0 user=default redir=-1 resp=2\n\r\n$`)
+	if !expected.Match(reply) {
+		t.Errorf("unexpected CLIENT INFO %q", reply)
+	}
+}
+
+func TestClientList(t *testing.T) {
+	c, r := subscriber(t)
+	other, _ := subscriber(t)
+	runClientCommandCases(t, c, []commandCase{
+		{"subscribe", []string{"SUBSCRIBE", "list:news"}, ""},
+	})
+	expectOutput(t, r, "*3\r\n$9\r\nsubscribe\r\n$9\r\nlist:news\r\n:1\r\n")
+	runClientCommandCases(t, other, []commandCase{
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"queued", []string{"GET", "list:key"}, "+QUEUED\r\n"},
+	})
+
+	id, otherID := strconv.FormatInt(c.id, 10), strconv.FormatInt(other.id, 10)
+	reply, _ := ExecuteRespData(respCommand("CLIENT", "LIST", "ID", otherID, id))
+	expected := regexp.MustCompile(`^\$\d+\r\n` +
+		`id=` + id + ` addr=127\.0\.0\.1:\d+ laddr=127\.0\.0\.1:\d+ name= age=0 idle=0 flags=P db=0 sub=1 psub=0 ssub=0 multi=-1 watch=0 user=default redir=-1 resp=2\n` +
+		`id=` + otherID + ` addr=127\.0\.0\.1:\d+ laddr=127\.0\.0\.1:\d+ name= age=0 idle=0 flags=x db=0 sub=0 psub=0 ssub=0 multi=1 watch=0 user=default redir=-1 resp=2\n\r\n$`)
+	if !expected.Match(reply) {
+		t.Errorf("unexpected CLIENT LIST %q", reply)
+	}
+	reply, _ = ExecuteRespData(respCommand("CLIENT", "LIST", "TYPE", "pubsub", "ID", otherID, id))
+	if !regexp.MustCompile(`^\$\d+\r\nid=` + id + ` [^\n]*\n\r\n$`).Match(reply) {
+		t.Errorf("expected only the subscriber, got %q", reply)
+	}
+	runCommandCases(t, []commandCase{
+		{"no match", []string{"CLIENT", "LIST", "TYPE", "master", "ID", id}, "$0\r\n\r\n"},
+		{"bad type", []string{"CLIENT", "LIST", "TYPE", "nope"}, "-ERR Unknown client type 'nope'\r\n"},
+		{"bad id", []string{"CLIENT", "LIST", "ID", "x"}, "-ERR Invalid client ID\r\n"},
+		{"syntax", []string{"CLIENT", "LIST", "TYPE"}, "-ERR syntax error\r\n"},
+	})
+}
+
+func TestShutdownRemovesUnixSocket(t *testing.T) {
+	codes := stubExit(t)
+	useTempDir(t)
+	path := filepath.Join(t.TempDir(), "redis.sock")
+	listenUnix(t, path, "0")
+	client := NewClient()
+	if _, err := client.Execute(respCommand("SHUTDOWN", "NOSAVE")); err == nil {
+		t.Error("expected SHUTDOWN to close the connection")
+	}
+	if len(*codes) != 1 {
+		t.Fatalf("expected the server to exit, got %v", *codes)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket file to be removed, got %v", err)
+	}
+}
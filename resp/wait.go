@@ -0,0 +1,163 @@
+package resp
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// replWaiter is a client blocked in WAIT or WAITAOF until enough replicas, and the local AOF for
+// WAITAOF, acknowledged the offset of its last write
+type replWaiter struct {
+	offset      int64
+	numLocal    int
+	numReplicas int
+	aof         bool
+	ready       chan struct{}
+	fired       bool
+}
+
+// replWaiters are the clients blocked in WAIT and WAITAOF, guarded by mu
+var replWaiters []*replWaiter
+
+var (
+	errTimeoutNotInteger = errors.New("ERR timeout is not an integer or out of range")
+	errTimeoutNegative   = errors.New("ERR timeout is negative")
+)
+
+// parseTimeoutMillis reads the timeout of WAIT and WAITAOF, 0 meaning forever
+func parseTimeoutMillis(value string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms > int64(time.Duration(1<<63-1)/time.Millisecond) {
+		return 0, errTimeoutNotInteger
+	}
+	if ms < 0 {
+		return 0, errTimeoutNegative
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// replicasAcked counts the replicas that acknowledged offset, in their AOF with aof. The caller must hold mu.
+func replicasAcked(offset int64, aof bool) int {
+	n := 0
+	for _, r := range replicationState.replicas {
+		if r.state != replicaOnline {
+			continue
+		}
+		if (aof && r.aofAckOffset >= offset) || (!aof && r.ackOffset >= offset) {
+			n++
+		}
+	}
+	return n
+}
+
+// localAcked is 1 when the AOF is synced up to offset. The caller must hold mu.
+func localAcked(offset int64) int {
+	if aofState.status == aofOn && aofState.fsyncedOffset >= offset {
+		return 1
+	}
+	return 0
+}
+
+func (w *replWaiter) satisfied() bool {
+	if w.aof && localAcked(w.offset) < w.numLocal {
+		return false
+	}
+	return replicasAcked(w.offset, w.aof) >= w.numReplicas
+}
+
+// signalReplicationWaiters wakes the clients of WAIT and WAITAOF whose offset was acknowledged.
+// The caller must hold mu.
+func signalReplicationWaiters() {
+	for _, w := range replWaiters {
+		if !w.fired && w.satisfied() {
+			w.fired = true
+			close(w.ready)
+		}
+	}
+}
+
+// waitForAcks blocks the client until w is satisfied, timeout passes or the client disconnects, a zero
+// timeout waiting forever. The replicas are asked to acknowledge their offset right away. The caller must
+// hold mu.
+func waitForAcks(c *Client, w *replWaiter, timeout time.Duration) {
+	if denyBlocking || w.satisfied() {
+		return
+	}
+	w.ready = make(chan struct{})
+	replWaiters = append(replWaiters, w)
+	feedReplicationStream(nil, []string{"REPLCONF", "GETACK", "*"})
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	withoutLock(func() {
+		select {
+		case <-w.ready:
+		case <-expired:
+		case <-c.disconnected:
+		}
+	})
+
+	for i, other := range replWaiters {
+		if other == w {
+			replWaiters = append(replWaiters[:i], replWaiters[i+1:]...)
+			break
+		}
+	}
+}
+
+// handleWait blocks until numreplicas replicas acknowledged the last write of the client or the
+// timeout in milliseconds passes, returning how many did
+func handleWait(c *Client, args ...BulkString) ([]byte, error) {
+	if replicationState.masterHost != "" {
+		return errorReply("ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.")
+	}
+	numReplicas, err := strconv.Atoi(*args[1].Value)
+	if err != nil {
+		return errorReply(errNotInteger.Error())
+	}
+	timeout, err := parseTimeoutMillis(*args[2].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+
+	w := &replWaiter{offset: c.woff, numReplicas: numReplicas}
+	waitForAcks(c, w, timeout)
+	return SerializeInteger(Integer{Value: replicasAcked(w.offset, false)})
+}
+
+// handleWaitAOF blocks until the last write of the client was synced to the local AOF, when numlocal
+// is 1, and to the AOF of numreplicas replicas, or the timeout in milliseconds passes. It returns how
+// many AOF files got it, locally and on the replicas.
+func handleWaitAOF(c *Client, args ...BulkString) ([]byte, error) {
+	if replicationState.masterHost != "" {
+		return errorReply("ERR WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+	}
+	numLocal, err := strconv.Atoi(*args[1].Value)
+	if err != nil {
+		return errorReply(errNotInteger.Error())
+	}
+	numReplicas, err := strconv.Atoi(*args[2].Value)
+	if err != nil {
+		return errorReply(errNotInteger.Error())
+	}
+	timeout, err := parseTimeoutMillis(*args[3].Value)
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if numLocal > 0 && !config.appendOnly {
+		return errorReply("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+
+	w := &replWaiter{offset: c.woff, numLocal: numLocal, numReplicas: numReplicas, aof: true}
+	waitForAcks(c, w, timeout)
+	elements := []RESPData{
+		Integer{Value: localAcked(w.offset)},
+		Integer{Value: replicasAcked(w.offset, true)},
+	}
+	return SerializeArray(Array{Elements: &elements})
+}
@@ -0,0 +1,151 @@
+package resp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// runAsync executes a command from another goroutine, the reply arriving on the returned channel
+func runAsync(client *Client, args ...string) <-chan string {
+	done := make(chan string, 1)
+	go func() {
+		result, _ := client.Execute(respCommand(args...))
+		done <- string(result)
+	}()
+	return done
+}
+
+func TestWait(t *testing.T) {
+	useTempDir(t)
+	client := NewClient()
+	runClientCommandCases(t, client, []commandCase{
+		{"no replica needed", []string{"WAIT", "0", "0"}, ":0\r\n"},
+		{"bad count", []string{"WAIT", "one", "0"}, "-ERR value is not an integer or out of range\r\n"},
+		{"bad timeout", []string{"WAIT", "1", "soon"}, "-ERR timeout is not an integer or out of range\r\n"},
+		{"negative timeout", []string{"WAIT", "1", "-1"}, "-ERR timeout is negative\r\n"},
+		{"timed out", []string{"WAIT", "1", "50"}, ":0\r\n"},
+	})
+
+	replicaClient, r, _, _ := connectReplica(t)
+	defer replicaClient.Close()
+	runClientCommandCases(t, client, []commandCase{
+		{"write", []string{"SET", "wait:key", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+	})
+	expectCommand(t, r, "SELECT", "0")
+	expectCommand(t, r, "SET", "wait:key", "v", "PXAT", "99999999999999")
+	mu.RLock()
+	offset := replicationState.offset
+	mu.RUnlock()
+
+	// the client blocks until the replica acknowledges, which it is asked to do
+	done := runAsync(client, "WAIT", "1", "0")
+	expectCommand(t, r, "REPLCONF", "GETACK", "*")
+	select {
+	case reply := <-done:
+		t.Fatalf("expected WAIT to block, but got %q", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+	runClientCommandCases(t, replicaClient, []commandCase{
+		{"ack", []string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10), "FACK", "-1"}, ""},
+	})
+	select {
+	case reply := <-done:
+		if reply != ":1\r\n" {
+			t.Errorf("expected :1, but got %q", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for WAIT")
+	}
+
+	runClientCommandCases(t, client, []commandCase{
+		{"more than connected", []string{"WAIT", "2", "50"}, ":1\r\n"},
+		// inside a transaction it doesn't block
+		{"multi", []string{"MULTI"}, "+OK\r\n"},
+		{"queue", []string{"WAIT", "2", "0"}, "+QUEUED\r\n"},
+		{"exec", []string{"EXEC"}, "*1\r\n:1\r\n"},
+		// the replica's AOF did not acknowledge anything
+		{"waitaof timed out", []string{"WAITAOF", "0", "1", "50"}, "*2\r\n:0\r\n:0\r\n"},
+		{"local without aof", []string{"WAITAOF", "1", "0", "0"}, "-ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.\r\n"},
+	})
+}
+
+func TestWaitAOF(t *testing.T) {
+	withAOF(t)
+	mu.Lock()
+	config.appendFsync = "always"
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		config.appendFsync = "everysec"
+		mu.Unlock()
+	}()
+
+	client := NewClient()
+	runClientCommandCases(t, client, []commandCase{
+		{"write", []string{"SET", "waitaof:key", "v"}, "+OK\r\n"},
+		{"synced locally", []string{"WAITAOF", "1", "0", "0"}, "*2\r\n:1\r\n:0\r\n"},
+	})
+
+	replicaClient, r, _, _ := connectReplica(t)
+	defer replicaClient.Close()
+	runClientCommandCases(t, client, []commandCase{
+		{"write", []string{"SET", "waitaof:key", "v", "PXAT", "99999999999999"}, "+OK\r\n"},
+	})
+	expectCommand(t, r, "SELECT", "0")
+	expectCommand(t, r, "SET", "waitaof:key", "v", "PXAT", "99999999999999")
+	mu.RLock()
+	offset := strconv.FormatInt(replicationState.offset, 10)
+	mu.RUnlock()
+
+	done := runAsync(client, "WAITAOF", "1", "1", "0")
+	expectCommand(t, r, "REPLCONF", "GETACK", "*")
+	// an acknowledgement of the stream alone is not enough
+	runClientCommandCases(t, replicaClient, []commandCase{
+		{"ack", []string{"REPLCONF", "ACK", offset, "FACK", "-1"}, ""},
+	})
+	select {
+	case reply := <-done:
+		t.Fatalf("expected WAITAOF to block, but got %q", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+	runClientCommandCases(t, replicaClient, []commandCase{
+		{"fack", []string{"REPLCONF", "ACK", offset, "FACK", offset}, ""},
+	})
+	select {
+	case reply := <-done:
+		if reply != "*2\r\n:1\r\n:1\r\n" {
+			t.Errorf("expected both AOF files to have the write, but got %q", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for WAITAOF")
+	}
+}
+
+func TestBlockedClientDisconnects(t *testing.T) {
+	blocked := func() int {
+		mu.RLock()
+		defer mu.RUnlock()
+		return len(databases[0].blockingKeys["gone:stream"]) + len(replWaiters)
+	}
+	for _, args := range [][]string{
+		{"XREAD", "BLOCK", "0", "STREAMS", "gone:stream", "$"},
+		{"WAIT", "1", "0"},
+	} {
+		client := NewClient()
+		done := runAsync(client, args...)
+		waitFor(t, args[0]+" to block", func() bool { return blocked() == 1 })
+
+		// the connection going away ends the command and drops its waiter
+		client.Disconnect()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not woken by the disconnection", args[0])
+		}
+		if n := blocked(); n != 0 {
+			t.Errorf("%s: expected the waiter to be dropped, %d left", args[0], n)
+		}
+		client.Close()
+	}
+}